@@ -17,6 +17,8 @@ var (
 
 		KeyO11yHost,
 		KeyO11yPort,
+		KeyO11yEnableTLS,
+		KeyO11yAdminToken,
 
 		KeyGinMode,
 
@@ -30,12 +32,76 @@ var (
 		KeyHTTPReadTimeout,
 		KeyHTTPWriteTimeout,
 		KeyHTTPIdleTimeout,
+		KeyHTTPTransferReadTimeout,
+		KeyHTTPTransferWriteTimeout,
 		KeyHTTPShutdownTimeout,
+		KeyHTTPSigningKeys,
+		KeyHTTPTokenStorePath,
+		KeyHTTPTLSCertFile,
+		KeyHTTPTLSKeyFile,
+		KeyHTTPTLSMinVersion,
+		KeyHTTPTLSClientCAFile,
+		KeyHTTPTLSReadOnlySubjects,
+		KeyHTTPTLSReadWriteSubjects,
+		KeyHTTPRedirectPort,
+		KeyHTTPTrustedProxies,
 
+		KeyFileBackend,
 		KeyFileRoot,
 		KeyFileGarbageCollectionPattern,
 		KeyFileWebRoot,
 		KeyFileWebUploadPath,
+		KeyFileMetadataPath,
+		KeyFileDedup,
+		KeyFileEncryptionKeyFile,
+		KeyFileEncryptionOldKeyFiles,
+		KeyFileVersioning,
+		KeyFileVersioningKeepLast,
+		KeyFileVersioningKeepFor,
+		KeyFileTrash,
+		KeyFileTrashMaxAge,
+		KeyFileScrub,
+		KeyFileScrubInterval,
+		KeyFileScrubBatchSize,
+		KeyFileScrubBatchDelay,
+		KeyFileScrubQuarantine,
+
+		KeyS3Endpoint,
+		KeyS3Bucket,
+		KeyS3Prefix,
+		KeyS3Region,
+		KeyS3AccessKeyID,
+		KeyS3SecretAccessKey,
+		KeyS3UseSSL,
+
+		KeyQuotaTokenMaxBytes,
+		KeyQuotaTokenMaxFiles,
+		KeyQuotaDirectoryMaxBytes,
+		KeyQuotaDirectoryMaxFiles,
+
+		KeyTusExpiration,
+
+		KeyEventsBufferSize,
+		KeyEventsWatch,
+
+		KeyReplicationBackend,
+		KeyReplicationRoot,
+		KeyReplicationS3Endpoint,
+		KeyReplicationS3Bucket,
+		KeyReplicationS3Prefix,
+		KeyReplicationS3Region,
+		KeyReplicationS3AccessKeyID,
+		KeyReplicationS3SecretAccessKey,
+		KeyReplicationS3UseSSL,
+		KeyReplicationReconcileInterval,
+		KeyReplicationReconcileBatchSize,
+
+		KeyWebhookURLs,
+		KeyWebhookSecret,
+		KeyWebhookTimeout,
+
+		KeySchedulerBackend,
+		KeySchedulerEmbeddedPath,
 
 		KeyTemporalAddress,
 		KeyTemporalNamespace,
@@ -8,27 +8,94 @@ const (
 	KeyLogFormat = "log.format"
 	KeyLogColor  = "log.color"
 
-	KeyO11yHost = "o11y.host"
-	KeyO11yPort = "o11y.port"
+	KeyO11yHost       = "o11y.host"
+	KeyO11yPort       = "o11y.port"
+	KeyO11yEnableTLS  = "o11y.enable_tls"
+	KeyO11yAdminToken = "o11y.admin_token"
 
 	KeyGinMode = "gin.mode"
 
-	KeyHTTPPort            = "http.port"
-	KeyHTTPHost            = "http.host"
-	KeyHTTPEnableCORS      = "http.enable_cors"
-	KeyHTTPEnableAuth      = "http.enable_auth"
-	KeyHTTPReadOnlyTokens  = "http.read_only_tokens"
-	KeyHTTPReadWriteTokens = "http.read_write_tokens"
-	KeyHTTPMaxUploadSize   = "http.max_upload_size"
-	KeyHTTPReadTimeout     = "http.read_timeout"
-	KeyHTTPWriteTimeout    = "http.write_timeout"
-	KeyHTTPIdleTimeout     = "http.idle_timeout"
-	KeyHTTPShutdownTimeout = "http.shutdown_timeout"
+	KeyHTTPPort                 = "http.port"
+	KeyHTTPHost                 = "http.host"
+	KeyHTTPEnableCORS           = "http.enable_cors"
+	KeyHTTPEnableAuth           = "http.enable_auth"
+	KeyHTTPReadOnlyTokens       = "http.read_only_tokens"
+	KeyHTTPReadWriteTokens      = "http.read_write_tokens"
+	KeyHTTPMaxUploadSize        = "http.max_upload_size"
+	KeyHTTPReadTimeout          = "http.read_timeout"
+	KeyHTTPWriteTimeout         = "http.write_timeout"
+	KeyHTTPIdleTimeout          = "http.idle_timeout"
+	KeyHTTPTransferReadTimeout  = "http.transfer_read_timeout"
+	KeyHTTPTransferWriteTimeout = "http.transfer_write_timeout"
+	KeyHTTPShutdownTimeout      = "http.shutdown_timeout"
+	KeyHTTPSigningKeys          = "http.signing_keys"
+	KeyHTTPPolicies             = "http.policies"
+	KeyHTTPTokenStorePath       = "http.token_store_path"
+	KeyHTTPTLSCertFile          = "http.tls_cert_file"
+	KeyHTTPTLSKeyFile           = "http.tls_key_file"
+	KeyHTTPTLSMinVersion        = "http.tls_min_version"
+	KeyHTTPTLSClientCAFile      = "http.tls_client_ca_file"
+	KeyHTTPTLSReadOnlySubjects  = "http.tls_read_only_subjects"
+	KeyHTTPTLSReadWriteSubjects = "http.tls_read_write_subjects"
+	KeyHTTPRedirectPort         = "http.redirect_port"
+	KeyHTTPTrustedProxies       = "http.trusted_proxies"
 
+	KeyFileBackend                  = "file.backend"
 	KeyFileRoot                     = "file.root"
 	KeyFileGarbageCollectionPattern = "file.garbage_collection_pattern"
 	KeyFileWebRoot                  = "file.web_root"
 	KeyFileWebUploadPath            = "file.web_upload_path"
+	KeyFileMetadataPath             = "file.metadata_path"
+	KeyFileDedup                    = "file.dedup"
+	KeyFileEncryptionKeyFile        = "file.encryption_key_file"
+	KeyFileEncryptionOldKeyFiles    = "file.encryption_old_key_files"
+	KeyFileVersioning               = "file.versioning"
+	KeyFileVersioningKeepLast       = "file.versioning_keep_last"
+	KeyFileVersioningKeepFor        = "file.versioning_keep_for"
+	KeyFileTrash                    = "file.trash"
+	KeyFileTrashMaxAge              = "file.trash_max_age"
+	KeyFileScrub                    = "file.scrub"
+	KeyFileScrubInterval            = "file.scrub_interval"
+	KeyFileScrubBatchSize           = "file.scrub_batch_size"
+	KeyFileScrubBatchDelay          = "file.scrub_batch_delay"
+	KeyFileScrubQuarantine          = "file.scrub_quarantine"
+
+	KeyS3Endpoint        = "s3.endpoint"
+	KeyS3Bucket          = "s3.bucket"
+	KeyS3Prefix          = "s3.prefix"
+	KeyS3Region          = "s3.region"
+	KeyS3AccessKeyID     = "s3.access_key_id"
+	KeyS3SecretAccessKey = "s3.secret_access_key"
+	KeyS3UseSSL          = "s3.use_ssl"
+
+	KeyQuotaTokenMaxBytes     = "quota.token_max_bytes"
+	KeyQuotaTokenMaxFiles     = "quota.token_max_files"
+	KeyQuotaDirectoryMaxBytes = "quota.directory_max_bytes"
+	KeyQuotaDirectoryMaxFiles = "quota.directory_max_files"
+
+	KeyTusExpiration = "tus.expiration"
+
+	KeyEventsBufferSize = "events.buffer_size"
+	KeyEventsWatch      = "events.watch"
+
+	KeyReplicationBackend            = "replication.backend"
+	KeyReplicationRoot               = "replication.root"
+	KeyReplicationS3Endpoint         = "replication.s3_endpoint"
+	KeyReplicationS3Bucket           = "replication.s3_bucket"
+	KeyReplicationS3Prefix           = "replication.s3_prefix"
+	KeyReplicationS3Region           = "replication.s3_region"
+	KeyReplicationS3AccessKeyID      = "replication.s3_access_key_id"
+	KeyReplicationS3SecretAccessKey  = "replication.s3_secret_access_key"
+	KeyReplicationS3UseSSL           = "replication.s3_use_ssl"
+	KeyReplicationReconcileInterval  = "replication.reconcile_interval"
+	KeyReplicationReconcileBatchSize = "replication.reconcile_batch_size"
+
+	KeyWebhookURLs    = "webhook.urls"
+	KeyWebhookSecret  = "webhook.secret"
+	KeyWebhookTimeout = "webhook.timeout"
+
+	KeySchedulerBackend      = "scheduler.backend"
+	KeySchedulerEmbeddedPath = "scheduler.embedded_path"
 
 	KeyTemporalAddress   = "temporal.address"
 	KeyTemporalNamespace = "temporal.namespace"
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"maps"
+	"reflect"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -22,3 +24,77 @@ func InitViper() error {
 
 	return nil
 }
+
+// SecretKeys are the keys of the settings holding secrets, which are redacted from the logs.
+var SecretKeys = []string{
+	KeyO11yAdminToken,
+	KeyHTTPReadOnlyTokens,
+	KeyHTTPReadWriteTokens,
+	KeyHTTPSigningKeys,
+	KeyS3SecretAccessKey,
+	KeyReplicationS3SecretAccessKey,
+	KeyWebhookSecret,
+}
+
+const redacted = "[REDACTED]"
+
+// RedactedSettings returns all settings like viper.AllSettings, with the secrets and the tokens of the policies
+// redacted, so they can be logged. The empty secrets are kept, telling that they are not set.
+func RedactedSettings() map[string]any {
+	settings := viper.AllSettings()
+	for _, key := range SecretKeys {
+		redactSetting(settings, key, func(any) any { return redacted })
+	}
+	redactSetting(settings, KeyHTTPPolicies, func(v any) any {
+		var policies []any
+		switch v := v.(type) {
+		case []any:
+			policies = v
+		case []map[string]any:
+			for _, m := range v {
+				policies = append(policies, m)
+			}
+		default:
+			// The policies set as a string, e.g. by an environment variable, are redacted as a whole.
+			return redacted
+		}
+		redactedPolicies := make([]any, 0, len(policies))
+		for _, p := range policies {
+			m, ok := p.(map[string]any)
+			if !ok {
+				redactedPolicies = append(redactedPolicies, redacted)
+				continue
+			}
+			policy := maps.Clone(m)
+			if _, ok := policy["token"]; ok {
+				policy["token"] = redacted
+			}
+			redactedPolicies = append(redactedPolicies, policy)
+		}
+		return redactedPolicies
+	})
+	return settings
+}
+
+// redactSetting replaces the value of the nested key in the settings by the result of redact, unless it is empty.
+func redactSetting(settings map[string]any, key string, redact func(any) any) {
+	parts := strings.Split(key, ".")
+	m := settings
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := m[part].(map[string]any)
+		if !ok {
+			return
+		}
+		m = next
+	}
+
+	last := parts[len(parts)-1]
+	v, ok := m[last]
+	if !ok || v == nil {
+		return
+	}
+	if rv := reflect.ValueOf(v); (rv.Kind() == reflect.String || rv.Kind() == reflect.Slice || rv.Kind() == reflect.Map) && rv.Len() == 0 {
+		return
+	}
+	m[last] = redact(v)
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+)
+
+func TestRedactedSettings(t *testing.T) {
+	defer viper.Reset()
+
+	Convey("Given the settings with secrets", t, func() {
+		viper.Reset()
+		viper.Set(KeyHTTPPort, 8080)
+		viper.Set(KeyHTTPReadWriteTokens, []string{"rw-token"})
+		viper.Set(KeyHTTPReadOnlyTokens, []string{})
+		viper.Set(KeyS3SecretAccessKey, "s3-secret")
+		viper.Set(KeyWebhookSecret, "")
+		viper.Set(KeyHTTPPolicies, []map[string]any{
+			{"name": "team-a", "token": "a-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"read"}}}},
+		})
+
+		settings := RedactedSettings()
+		http := settings["http"].(map[string]any)
+
+		Convey("The secrets should be redacted", func() {
+			So(http["read_write_tokens"], ShouldEqual, redacted)
+			So(settings["s3"].(map[string]any)["secret_access_key"], ShouldEqual, redacted)
+		})
+
+		Convey("The tokens of the policies should be redacted", func() {
+			policy := http["policies"].([]any)[0].(map[string]any)
+			So(policy["name"], ShouldEqual, "team-a")
+			So(policy["token"], ShouldEqual, redacted)
+		})
+
+		Convey("The empty secrets and the other settings should be kept", func() {
+			So(http["read_only_tokens"], ShouldBeEmpty)
+			So(settings["webhook"].(map[string]any)["secret"], ShouldEqual, "")
+			So(http["port"], ShouldEqual, 8080)
+		})
+
+		Convey("The settings of viper should not be changed", func() {
+			So(viper.GetStringSlice(KeyHTTPReadWriteTokens), ShouldResemble, []string{"rw-token"})
+			So(viper.Get(KeyHTTPPolicies).([]map[string]any)[0]["token"], ShouldEqual, "a-token")
+		})
+	})
+}
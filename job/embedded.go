@@ -0,0 +1,301 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"go.temporal.io/sdk/temporal"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+const (
+	embeddedPollInterval = 10 * time.Second
+	// embeddedConcurrency bounds the due tasks run at once, so a slow task does not hold up the others.
+	embeddedConcurrency = 8
+
+	// The retry policy of the embedded tasks mirrors the activity retry policy of the Temporal workflows.
+	embeddedTaskInitialInterval = time.Second
+	embeddedTaskMaximumInterval = 15 * time.Second
+	embeddedTaskMaximumAttempts = 3
+
+	taskFileExpire = "file_expire"
+)
+
+var bucketTasks = []byte("tasks")
+
+type embeddedTask struct {
+	Kind     string    `json:"kind"`
+	Arg      string    `json:"arg"`
+	RunAt    time.Time `json:"runAt"`
+	Attempts int       `json:"attempts"`
+}
+
+func (t embeddedTask) key() []byte {
+	return []byte(t.Kind + "\x00" + t.Arg)
+}
+
+// RetryPolicy is the backoff of the failed embedded tasks of a kind.
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaximumInterval time.Duration
+	MaximumAttempts int
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	InitialInterval: embeddedTaskInitialInterval,
+	MaximumInterval: embeddedTaskMaximumInterval,
+	MaximumAttempts: embeddedTaskMaximumAttempts,
+}
+
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := p.InitialInterval
+	for i := 1; i < attempts && backoff < p.MaximumInterval; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.MaximumInterval)
+}
+
+type taskHandler struct {
+	fn    func(context.Context, string) error
+	retry RetryPolicy
+}
+
+type periodicJob struct {
+	name     string
+	interval time.Duration
+	fn       func(context.Context) error
+}
+
+// EmbeddedScheduler runs the background jobs in-process.
+// Pending tasks are kept in a local bbolt database, so they survive restarts.
+type EmbeddedScheduler struct {
+	logger zerolog.Logger
+	db     *bolt.DB
+
+	mu        sync.RWMutex
+	handlers  map[string]taskHandler
+	periodics []periodicJob
+
+	// now returns the current time, which the tests replace to run the retries without waiting. nil is time.Now.
+	now func() time.Time
+}
+
+func (s *EmbeddedScheduler) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Handle registers the function to run the tasks of the kind, retried with the default policy.
+func (s *EmbeddedScheduler) Handle(kind string, fn func(ctx context.Context, arg string) error) {
+	s.HandleWithRetry(kind, defaultRetryPolicy, fn)
+}
+
+// HandleWithRetry registers the function to run the tasks of the kind, retried with the policy.
+// A task failing with a non-retryable temporal.ApplicationError is not retried.
+func (s *EmbeddedScheduler) HandleWithRetry(kind string, retry RetryPolicy, fn func(ctx context.Context, arg string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[kind] = taskHandler{fn: fn, retry: retry}
+}
+
+// Every registers the function to run periodically while the scheduler is running.
+func (s *EmbeddedScheduler) Every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.periodics = append(s.periodics, periodicJob{name: name, interval: interval, fn: fn})
+}
+
+// Schedule persists a task to run at the given time. A pending task of the same kind and arg is replaced.
+func (s *EmbeddedScheduler) Schedule(kind, arg string, runAt time.Time) error {
+	t := embeddedTask{Kind: kind, Arg: arg, RunAt: runAt}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putTask(tx, t)
+	})
+}
+
+func (s *EmbeddedScheduler) ScheduleFileExpire(_ context.Context, path string, delay time.Duration) error {
+	return s.Schedule(taskFileExpire, path, s.clock().Add(delay))
+}
+
+// Cancel removes the pending task of the kind and arg, if any.
+func (s *EmbeddedScheduler) Cancel(kind, arg string) error {
+	t := embeddedTask{Kind: kind, Arg: arg}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTasks).Delete(t.key())
+	})
+}
+
+func (s *EmbeddedScheduler) CancelFileExpire(_ context.Context, path string) error {
+	return s.Cancel(taskFileExpire, path)
+}
+
+func putTask(tx *bolt.Tx, t embeddedTask) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTasks).Put(t.key(), b)
+}
+
+// runDueTasks runs every task whose time has come, at most embeddedConcurrency at once, and waits for them.
+func (s *EmbeddedScheduler) runDueTasks(ctx context.Context) {
+	now := s.clock()
+
+	var due []embeddedTask
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTasks).ForEach(func(_, v []byte) error {
+			var t embeddedTask
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if !t.RunAt.After(now) {
+				due = append(due, t)
+			}
+			return nil
+		})
+	}); err != nil {
+		s.logger.Error().Ctx(ctx).Err(err).Msg("failed to load due tasks")
+		return
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, embeddedConcurrency)
+	for _, t := range due {
+		s.mu.RLock()
+		h, ok := s.handlers[t.Kind]
+		s.mu.RUnlock()
+		if !ok {
+			s.logger.Warn().Ctx(ctx).Str("kind", t.Kind).Str("arg", t.Arg).Msg("no handler registered for task")
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			s.runTask(ctx, h, t)
+		}()
+	}
+	wg.Wait()
+}
+
+// runTask runs the task and removes it, or reschedules it with backoff if it failed.
+func (s *EmbeddedScheduler) runTask(ctx context.Context, h taskHandler, t embeddedTask) {
+	err := h.fn(ctx, t.Arg)
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		// The task may have been replaced while running.
+		if v := tx.Bucket(bucketTasks).Get(t.key()); v != nil {
+			var current embeddedTask
+			if err := json.Unmarshal(v, &current); err != nil {
+				return err
+			}
+			if !current.RunAt.Equal(t.RunAt) {
+				return nil
+			}
+		}
+
+		if err == nil {
+			return tx.Bucket(bucketTasks).Delete(t.key())
+		}
+
+		t.Attempts++
+		var appErr *temporal.ApplicationError
+		if t.Attempts >= h.retry.MaximumAttempts || (errors.As(err, &appErr) && appErr.NonRetryable()) {
+			s.logger.Error().Ctx(ctx).Err(err).Str("kind", t.Kind).Str("arg", t.Arg).Int("attempts", t.Attempts).Msg("task failed")
+			return tx.Bucket(bucketTasks).Delete(t.key())
+		}
+
+		t.RunAt = s.clock().Add(h.retry.backoff(t.Attempts))
+		return putTask(tx, t)
+	}); err != nil {
+		s.logger.Error().Ctx(ctx).Err(err).Str("kind", t.Kind).Str("arg", t.Arg).Msg("failed to update task")
+	}
+}
+
+func (s *EmbeddedScheduler) run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	s.mu.RLock()
+	for _, p := range s.periodics {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := p.fn(ctx); err != nil {
+						s.logger.Error().Ctx(ctx).Err(err).Str("job", p.name).Msg("periodic job failed")
+					}
+				}
+			}
+		}()
+	}
+	s.mu.RUnlock()
+
+	ticker := time.NewTicker(embeddedPollInterval)
+	defer ticker.Stop()
+	for {
+		s.runDueTasks(ctx)
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func NewEmbeddedScheduler(lc fx.Lifecycle) (*EmbeddedScheduler, error) {
+	db, err := store.OpenDB(viper.GetString(config.KeySchedulerEmbeddedPath), bucketTasks)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EmbeddedScheduler{
+		logger:   log.With().Str("logger", "embeddedScheduler").Logger(),
+		db:       db,
+		handlers: make(map[string]taskHandler),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				s.run(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+			return db.Close()
+		},
+	})
+
+	return s, nil
+}
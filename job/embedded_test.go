@@ -0,0 +1,155 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.temporal.io/sdk/temporal"
+
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func newTestEmbeddedScheduler(t *testing.T) *EmbeddedScheduler {
+	db, err := store.OpenDB(filepath.Join(t.TempDir(), "scheduler.db"), bucketTasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &EmbeddedScheduler{
+		logger:   zerolog.Nop(),
+		db:       db,
+		handlers: make(map[string]taskHandler),
+	}
+}
+
+func TestEmbeddedScheduler_FileExpire(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	s := newTestEmbeddedScheduler(t)
+	RegisterEmbeddedFileJobs(s, noop.NewMeterProvider(), NewFileActivities(FileActivitiesParams{Fs: memFs}))
+
+	_ = afero.WriteFile(memFs, "expired.txt", []byte("hello"), 0644)
+	_ = afero.WriteFile(memFs, "pending.txt", []byte("world"), 0644)
+
+	Convey("When due tasks are run", t, func() {
+		So(s.ScheduleFileExpire(context.Background(), "expired.txt", -time.Second), ShouldBeNil)
+		So(s.ScheduleFileExpire(context.Background(), "pending.txt", time.Hour), ShouldBeNil)
+
+		s.runDueTasks(context.Background())
+
+		exists, err := afero.Exists(memFs, "expired.txt")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeFalse)
+
+		exists, err = afero.Exists(memFs, "pending.txt")
+		So(err, ShouldBeNil)
+		So(exists, ShouldBeTrue)
+	})
+}
+
+func TestEmbeddedScheduler_Retry(t *testing.T) {
+	s := newTestEmbeddedScheduler(t)
+
+	var attempts int
+	s.Handle("failing", func(context.Context, string) error {
+		attempts++
+		return errors.New("failed")
+	})
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	Convey("When a task keeps failing", t, func() {
+		So(s.Schedule("failing", "arg", now), ShouldBeNil)
+
+		for i := 0; i < embeddedTaskMaximumAttempts; i++ {
+			s.runDueTasks(context.Background())
+			So(attempts, ShouldEqual, i+1)
+
+			// The task is not retried until its backoff elapses.
+			now = now.Add(embeddedTaskInitialInterval<<i - time.Millisecond)
+			s.runDueTasks(context.Background())
+			So(attempts, ShouldEqual, i+1)
+			now = now.Add(time.Millisecond)
+		}
+		// The task is dropped after the maximum attempts.
+		s.runDueTasks(context.Background())
+
+		So(attempts, ShouldEqual, embeddedTaskMaximumAttempts)
+	})
+}
+
+func TestEmbeddedScheduler_NonRetryable(t *testing.T) {
+	s := newTestEmbeddedScheduler(t)
+
+	var attempts int
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.HandleWithRetry("rejected", RetryPolicy{InitialInterval: time.Millisecond, MaximumInterval: time.Millisecond, MaximumAttempts: 10}, func(context.Context, string) error {
+		attempts++
+		return temporal.NewNonRetryableApplicationError("rejected", "Rejected", nil)
+	})
+
+	Convey("When a task fails with a non-retryable error", t, func() {
+		So(s.Schedule("rejected", "arg", now), ShouldBeNil)
+
+		s.runDueTasks(context.Background())
+		now = now.Add(time.Second)
+		s.runDueTasks(context.Background())
+
+		So(attempts, ShouldEqual, 1)
+	})
+}
+
+func TestEmbeddedScheduler_Concurrency(t *testing.T) {
+	s := newTestEmbeddedScheduler(t)
+
+	var (
+		mu            sync.Mutex
+		running, peak int
+		done          int
+	)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	s.Handle("slow", func(context.Context, string) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		if running == embeddedConcurrency {
+			releaseOnce.Do(func() { close(release) })
+		}
+		mu.Unlock()
+
+		// A serial scheduler would never reach the concurrency, so give up waiting after a while.
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+
+		mu.Lock()
+		running--
+		done++
+		mu.Unlock()
+		return nil
+	})
+
+	Convey("When more due tasks than the concurrency are run", t, func() {
+		for i := 0; i < 2*embeddedConcurrency; i++ {
+			So(s.Schedule("slow", strconv.Itoa(i), time.Now()), ShouldBeNil)
+		}
+
+		s.runDueTasks(context.Background())
+
+		So(done, ShouldEqual, 2*embeddedConcurrency)
+		So(peak, ShouldEqual, embeddedConcurrency)
+	})
+}
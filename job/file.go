@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/worker"
@@ -21,11 +23,24 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/events"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+	"github.com/wei840222/simple-file-server/server/trash"
+	"github.com/wei840222/simple-file-server/server/versioning"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 type FileActivities struct {
-	logger zerolog.Logger
-	fs     afero.Fs
+	logger     zerolog.Logger
+	fs         afero.Fs
+	metadata   *store.MetadataStore
+	versioning *versioning.Fs
+	trash      *trash.Fs
+	webhooks   *webhook.Notifier
+	events     *events.Broker
+	scrub      *store.ScrubStore
 }
 
 func (a *FileActivities) ListByPattern(ctx context.Context, pattern []string) ([]string, error) {
@@ -35,6 +50,14 @@ func (a *FileActivities) ListByPattern(ctx context.Context, pattern []string) ([
 			return err
 		}
 
+		// Only the files of the users are collected. The deleted files are purged from the trash, and the temporary
+		// files are cleaned, by their age instead, and the quarantined files are kept for inspection.
+		if internalpath.Is(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if info.IsDir() {
 			return nil
 		}
@@ -65,15 +88,127 @@ func (a *FileActivities) Delete(ctx context.Context, path string) error {
 		return err
 	}
 
+	if a.metadata != nil {
+		if err := a.metadata.Delete(path); err != nil {
+			a.logger.Warn().Ctx(ctx).Err(err).Str("path", path).Msg("failed to delete file metadata")
+			return err
+		}
+	}
+
 	a.logger.Info().Ctx(ctx).Str("path", path).Msg("file deleted successfully")
 
 	return nil
 }
 
-func NewFileActivities(fs afero.Fs) *FileActivities {
+// Expire deletes the expired file, and notifies the webhook receivers of the expiration on behalf of its uploader.
+// The internal files, such as the incomplete tus uploads and their info files, expire without a notification.
+func (a *FileActivities) Expire(ctx context.Context, path string) error {
+	notify := a.webhooks.Enabled() && !internalpath.Is(path)
+	e := webhook.Event{Type: webhook.EventFileExpired, Path: path}
+	if notify {
+		if info, err := a.fs.Stat(path); err == nil {
+			e.Size = info.Size()
+		}
+		if a.metadata != nil {
+			if m, err := a.metadata.Get(path); err == nil {
+				e.Token = m.Uploader
+			}
+		}
+	}
+
+	if err := a.events.Expiring(path, func() error { return a.Delete(ctx, path) }); err != nil {
+		return err
+	}
+
+	if notify {
+		a.webhooks.Notify(ctx, e)
+	}
+
+	return nil
+}
+
+// CleanTempFiles removes the temporary files of the writes interrupted longer than the transfer read timeout ago,
+// which can no longer be completed, and returns the number of the removed files.
+func (a *FileActivities) CleanTempFiles(ctx context.Context) (int, error) {
+	n, err := tempfile.Clean(a.fs, viper.GetDuration(config.KeyHTTPTransferReadTimeout))
+	if err != nil {
+		a.logger.Warn().Ctx(ctx).Err(err).Int("files", n).Msg("failed to clean temporary files")
+		return n, err
+	}
+
+	if n > 0 {
+		a.logger.Info().Ctx(ctx).Int("files", n).Msg("temporary files cleaned successfully")
+	}
+
+	return n, nil
+}
+
+// PruneVersions removes the file versions beyond the retention of the config, and returns the number of the removed versions.
+func (a *FileActivities) PruneVersions(ctx context.Context) (int, error) {
+	if a.versioning == nil {
+		return 0, nil
+	}
+
+	n, err := a.versioning.Prune(versioning.Retention{
+		KeepLast: viper.GetInt(config.KeyFileVersioningKeepLast),
+		KeepFor:  viper.GetDuration(config.KeyFileVersioningKeepFor),
+	})
+	if err != nil {
+		a.logger.Warn().Ctx(ctx).Err(err).Int("versions", n).Msg("failed to prune file versions")
+		return n, err
+	}
+
+	if n > 0 {
+		a.logger.Info().Ctx(ctx).Int("versions", n).Msg("file versions pruned successfully")
+	}
+
+	return n, nil
+}
+
+// PurgeTrash removes the files deleted longer than the max age of the config from the trash, and returns the number of the removed files.
+func (a *FileActivities) PurgeTrash(ctx context.Context) (int, error) {
+	maxAge := viper.GetDuration(config.KeyFileTrashMaxAge)
+	if a.trash == nil || maxAge <= 0 {
+		return 0, nil
+	}
+
+	n, err := a.trash.PurgeOlderThan(maxAge)
+	if err != nil {
+		a.logger.Warn().Ctx(ctx).Err(err).Int("files", n).Msg("failed to purge trash")
+		return n, err
+	}
+
+	if n > 0 {
+		a.logger.Info().Ctx(ctx).Int("files", n).Msg("trash purged successfully")
+	}
+
+	return n, nil
+}
+
+// FileActivitiesParams are the dependencies of FileActivities. The versioning and the trash are nil unless enabled.
+type FileActivitiesParams struct {
+	fx.In
+
+	Fs         afero.Fs
+	Metadata   *store.MetadataStore
+	Versioning *versioning.Fs
+	Trash      *trash.Fs
+	Webhooks   *webhook.Notifier
+	Events     *events.Broker
+	Scrub      *store.ScrubStore
+}
+
+// NewFileActivities returns the FileActivities shared by the file jobs of both schedulers.
+func NewFileActivities(p FileActivitiesParams) *FileActivities {
 	return &FileActivities{
-		logger: log.With().Str("logger", "fileActivity").Logger(),
-		fs:     fs,
+		logger:     log.With().Str("logger", "fileActivities").Logger(),
+		fs:         p.Fs,
+		metadata:   p.Metadata,
+		versioning: p.Versioning,
+		trash:      p.Trash,
+		webhooks:   p.Webhooks,
+		events:     p.Events,
+		scrub:      p.Scrub,
 	}
 }
 
@@ -89,7 +224,7 @@ func FileExpireWorkflow(ctx workflow.Context, path string) error {
 	})
 
 	var fileActivities *FileActivities
-	if err := workflow.ExecuteActivity(ctx, fileActivities.Delete, path).Get(ctx, nil); err != nil {
+	if err := workflow.ExecuteActivity(ctx, fileActivities.Expire, path).Get(ctx, nil); err != nil {
 		return fmt.Errorf("failed to delete file: %s", err)
 	}
 
@@ -120,37 +255,143 @@ func FileGarbageCollectionWorkflow(ctx workflow.Context) error {
 		}
 	}
 
+	if err := workflow.ExecuteActivity(ctx, fileActivities.CleanTempFiles).Get(ctx, nil); err != nil {
+		return fmt.Errorf("failed to clean temporary files: %s", err)
+	}
+
 	return nil
 }
 
-func RegisterFileWorkflows(lc fx.Lifecycle, c client.Client, w worker.Worker, fs afero.Fs) error {
-	w.RegisterActivity(&FileActivities{
-		logger: log.With().Str("logger", "fileActivities").Logger(),
-		fs:     fs,
+func FileVersionRetentionWorkflow(ctx workflow.Context) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 10 * time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			MaximumInterval:    15 * time.Second,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    3,
+		},
+	})
+
+	var fileActivities *FileActivities
+	if err := workflow.ExecuteActivity(ctx, fileActivities.PruneVersions).Get(ctx, nil); err != nil {
+		return fmt.Errorf("failed to prune file versions: %s", err)
+	}
+
+	return nil
+}
+
+func FileTrashPurgeWorkflow(ctx workflow.Context) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 10 * time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			MaximumInterval:    15 * time.Second,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    3,
+		},
+	})
+
+	var fileActivities *FileActivities
+	if err := workflow.ExecuteActivity(ctx, fileActivities.PurgeTrash).Get(ctx, nil); err != nil {
+		return fmt.Errorf("failed to purge trash: %s", err)
+	}
+
+	return nil
+}
+
+// RegisterEmbeddedFileJobs registers the same file jobs as RegisterFileWorkflows on the embedded scheduler.
+func RegisterEmbeddedFileJobs(s *EmbeddedScheduler, mp metric.MeterProvider, fileActivities *FileActivities) error {
+	s.Handle(taskFileExpire, fileActivities.Expire)
+	s.Every("file_garbage_collection", 5*time.Minute, func(ctx context.Context) error {
+		garbageFiles, err := fileActivities.ListByPattern(ctx, viper.GetStringSlice(config.KeyFileGarbageCollectionPattern))
+		if err != nil {
+			return fmt.Errorf("failed to get garbage files: %s", err)
+		}
+
+		for _, file := range garbageFiles {
+			if err := fileActivities.Delete(ctx, file); err != nil {
+				return fmt.Errorf("failed to delete file: %s", err)
+			}
+		}
+
+		if _, err := fileActivities.CleanTempFiles(ctx); err != nil {
+			return fmt.Errorf("failed to clean temporary files: %s", err)
+		}
+
+		return nil
 	})
+
+	if fileActivities.versioning != nil {
+		s.Every("file_version_retention", time.Hour, func(ctx context.Context) error {
+			_, err := fileActivities.PruneVersions(ctx)
+			return err
+		})
+	}
+	if fileActivities.trash != nil {
+		s.Every("file_trash_purge", time.Hour, func(ctx context.Context) error {
+			_, err := fileActivities.PurgeTrash(ctx)
+			return err
+		})
+	}
+	if viper.GetBool(config.KeyFileScrub) {
+		if err := registerScrubMetrics(mp.Meter("github.com/wei840222/simple-file-server/job"), fileActivities.scrub); err != nil {
+			return err
+		}
+		s.Every("file_scrub", viper.GetDuration(config.KeyFileScrubInterval), fileActivities.Scrub)
+	}
+
+	return nil
+}
+
+func RegisterFileWorkflows(lc fx.Lifecycle, c client.Client, w worker.Worker, mp metric.MeterProvider, fileActivities *FileActivities) error {
+	w.RegisterActivity(fileActivities)
 	w.RegisterWorkflow(FileExpireWorkflow)
 	w.RegisterWorkflow(FileGarbageCollectionWorkflow)
+	w.RegisterWorkflow(FileVersionRetentionWorkflow)
+	w.RegisterWorkflow(FileTrashPurgeWorkflow)
+	w.RegisterWorkflow(FileScrubWorkflow)
 
 	hostname, err := os.Hostname()
 	if err != nil {
 		return fmt.Errorf("failed to get hostname: %w", err)
 	}
 
+	appendSchedule(lc, c, hostname, 5*time.Minute, FileGarbageCollectionWorkflow)
+	if fileActivities.versioning != nil {
+		appendSchedule(lc, c, hostname+"-version-retention", time.Hour, FileVersionRetentionWorkflow)
+	}
+	if fileActivities.trash != nil {
+		appendSchedule(lc, c, hostname+"-trash-purge", time.Hour, FileTrashPurgeWorkflow)
+	}
+	if viper.GetBool(config.KeyFileScrub) {
+		if err := registerScrubMetrics(mp.Meter("github.com/wei840222/simple-file-server/job"), fileActivities.scrub); err != nil {
+			return err
+		}
+		appendSchedule(lc, c, hostname+"-scrub", viper.GetDuration(config.KeyFileScrubInterval), FileScrubWorkflow, ScrubState{})
+	}
+
+	return nil
+}
+
+// appendSchedule creates the schedule running the workflow with the args at the interval while the app runs.
+func appendSchedule(lc fx.Lifecycle, c client.Client, id string, every time.Duration, workflow any, args ...any) {
 	var s client.ScheduleHandle
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
 			scheduleHandle, err := c.ScheduleClient().Create(ctx, client.ScheduleOptions{
-				ID: hostname,
+				ID: id,
 				Spec: client.ScheduleSpec{
 					Intervals: []client.ScheduleIntervalSpec{
 						{
-							Every: 5 * time.Minute,
+							Every: every,
 						},
 					},
 				},
 				Action: &client.ScheduleWorkflowAction{
 					ID:        uuid.New().String(),
-					Workflow:  FileGarbageCollectionWorkflow,
+					Workflow:  workflow,
+					Args:      args,
 					TaskQueue: viper.GetString(config.KeyTemporalTaskQueue),
 				},
 			})
@@ -164,6 +405,4 @@ func RegisterFileWorkflows(lc fx.Lifecycle, c client.Client, w worker.Worker, fs
 			return s.Delete(ctx)
 		},
 	})
-
-	return nil
 }
@@ -6,6 +6,10 @@ import (
 
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/webhook"
 )
 
 func TestFileActivity_ListByPattern(t *testing.T) {
@@ -18,6 +22,8 @@ func TestFileActivity_ListByPattern(t *testing.T) {
 	_ = afero.WriteFile(memFs, "dir1/file1.txt", []byte("hello"), 0644)
 	_ = afero.WriteFile(memFs, "dir1/._file1.txt", []byte("world"), 0644)
 	_ = afero.WriteFile(memFs, "dir1/.DS_Store", []byte("log"), 0644)
+	_ = memFs.MkdirAll(".trash", 0755)
+	_ = afero.WriteFile(memFs, ".trash/._file2.txt", []byte("trash"), 0644)
 
 	Convey("When ListByPattern is called", t, func() {
 		files, err := act.ListByPattern(context.Background(), []string{`^\._.+`, `^\.DS_Store$`})
@@ -46,3 +52,44 @@ func TestFileActivity_Delete(t *testing.T) {
 		So(files, ShouldBeEmpty)
 	})
 }
+
+type fakeWebhookScheduler struct {
+	events []*webhook.Event
+}
+
+func (s *fakeWebhookScheduler) ScheduleWebhook(_ context.Context, _ string, e *webhook.Event) error {
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestFileActivity_Expire(t *testing.T) {
+	viper.Set(config.KeyWebhookURLs, []string{"http://localhost/hook"})
+	defer viper.Reset()
+
+	Convey("When Expire is called", t, func() {
+		memFs := afero.NewMemMapFs()
+		scheduler := &fakeWebhookScheduler{}
+		act := &FileActivities{fs: memFs, webhooks: webhook.NewNotifier(scheduler)}
+
+		So(afero.WriteFile(memFs, "dir1/file1.txt", []byte("hello"), 0644), ShouldBeNil)
+		So(afero.WriteFile(memFs, ".tus/upload.info", []byte("{}"), 0644), ShouldBeNil)
+
+		Convey("The expiration of a file should be notified", func() {
+			So(act.Expire(context.Background(), "dir1/file1.txt"), ShouldBeNil)
+
+			So(scheduler.events, ShouldHaveLength, 1)
+			So(scheduler.events[0].Type, ShouldEqual, webhook.EventFileExpired)
+			So(scheduler.events[0].Path, ShouldEqual, "dir1/file1.txt")
+			So(scheduler.events[0].Size, ShouldEqual, 5)
+		})
+
+		Convey("The expiration of an internal file should not be notified", func() {
+			So(act.Expire(context.Background(), ".tus/upload.info"), ShouldBeNil)
+
+			exists, err := afero.Exists(memFs, ".tus/upload.info")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+			So(scheduler.events, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,287 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/worker"
+	"go.temporal.io/sdk/workflow"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/events"
+	"github.com/wei840222/simple-file-server/server/replication"
+)
+
+const (
+	// The replications are retried for about a day, so an outage of the secondary storage does not lose the changes.
+	replicationInitialInterval = time.Second
+	replicationMaximumInterval = 10 * time.Minute
+	replicationMaximumAttempts = 150
+
+	// signalFileChanged signals the replication workflow of a path that the path is changed again.
+	signalFileChanged = "file-changed"
+
+	// reconcileBatchesPerRun bounds the batches of a reconciliation workflow run, like scrubBatchesPerRun.
+	reconcileBatchesPerRun = 200
+
+	reconcilePhasePrimary   = ""
+	reconcilePhaseSecondary = "secondary"
+
+	taskFileReplicate = "file_replicate"
+)
+
+func fileReplicationWorkflowID(path string) string {
+	return "file-replication:" + path
+}
+
+// ReconcileState is the state of a reconciliation with the secondary storage carried between its batches. The files
+// of the primary are walked first, finding the ones missing or stale on the secondary, and the files of the secondary
+// are walked afterward, finding the ones no longer on the primary.
+type ReconcileState struct {
+	Phase   string `json:"phase"`
+	Cursor  string `json:"cursor"`
+	Scanned int64  `json:"scanned"`
+	Drifted int64  `json:"drifted"`
+	Done    bool   `json:"done"`
+}
+
+type ReplicationActivities struct {
+	logger     zerolog.Logger
+	replicator *replication.Replicator
+	scheduler  Scheduler
+}
+
+// Replicate replicates the path to the secondary storage.
+func (a *ReplicationActivities) Replicate(ctx context.Context, path string) error {
+	if err := a.replicator.Replicate(ctx, path); err != nil {
+		a.logger.Warn().Ctx(ctx).Err(err).Str("path", path).Msg("failed to replicate file")
+		return err
+	}
+	return nil
+}
+
+// reconcile queues the replication of the path if it is out of sync with the secondary storage. A path pending
+// replication is not drifted, but lagging.
+func (a *ReplicationActivities) reconcile(ctx context.Context, state *ReconcileState, p string) error {
+	state.Scanned++
+	if a.replicator.Pending(p) {
+		return nil
+	}
+	ok, err := a.replicator.InSync(p)
+	if err != nil || ok {
+		return err
+	}
+
+	state.Drifted++
+	a.logger.Info().Ctx(ctx).Str("path", p).Msg("replica drifted")
+	return a.replicator.Queue(ctx, a.scheduler, p)
+}
+
+// ReconcileBatch compares the next batch of the files with the secondary storage, queues the replication of the
+// drifted ones, and returns the state of the next batch.
+func (a *ReplicationActivities) ReconcileBatch(ctx context.Context, state ReconcileState) (ReconcileState, error) {
+	limit := max(viper.GetInt(config.KeyReplicationReconcileBatchSize), 1)
+
+	var fsys afero.Fs
+	switch state.Phase {
+	case reconcilePhasePrimary:
+		fsys = a.replicator.Primary()
+	case reconcilePhaseSecondary:
+		fsys = a.replicator.Secondary()
+	default:
+		return state, temporal.NewNonRetryableApplicationError(fmt.Sprintf("unknown reconcile phase: %s", state.Phase), "", nil)
+	}
+
+	files, err := listFiles(fsys, state.Cursor, limit)
+	if err != nil {
+		return state, err
+	}
+	for _, p := range files {
+		// The files on both are compared in the first phase.
+		if state.Phase == reconcilePhaseSecondary {
+			if _, err := a.replicator.Primary().Stat(p); err == nil {
+				state.Cursor = p
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return state, err
+			}
+		}
+		if err := a.reconcile(ctx, &state, p); err != nil {
+			return state, fmt.Errorf("failed to reconcile file '%s': %w", p, err)
+		}
+		state.Cursor = p
+	}
+	if len(files) < limit {
+		if state.Phase == reconcilePhasePrimary {
+			state.Phase, state.Cursor = reconcilePhaseSecondary, ""
+		} else {
+			state.Done = true
+		}
+	}
+
+	if state.Done {
+		a.replicator.Reconciled(state.Drifted)
+		a.logger.Info().Ctx(ctx).Int64("scanned", state.Scanned).Int64("drifted", state.Drifted).Msg("replication reconciliation finished")
+	}
+
+	return state, nil
+}
+
+// Reconcile runs the reconciliation through all its batches. It is the embedded counterpart of
+// FileReplicationReconcileWorkflow.
+func (a *ReplicationActivities) Reconcile(ctx context.Context) error {
+	var state ReconcileState
+	for !state.Done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		if state, err = a.ReconcileBatch(ctx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileReplicationWorkflow replicates the path to the secondary storage until no change of the path is signaled
+// meanwhile. There is one workflow of a path at a time, so the replications of a path never overlap.
+func FileReplicationWorkflow(ctx workflow.Context, path string) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: time.Hour,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    replicationInitialInterval,
+			MaximumInterval:    replicationMaximumInterval,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    replicationMaximumAttempts,
+		},
+	})
+	changed := workflow.GetSignalChannel(ctx, signalFileChanged)
+
+	var replicationActivities *ReplicationActivities
+	for {
+		// The changes signaled so far are covered by the replication of the current state of the path.
+		for changed.ReceiveAsync(nil) {
+		}
+		if err := workflow.ExecuteActivity(ctx, replicationActivities.Replicate, path).Get(ctx, nil); err != nil {
+			return fmt.Errorf("failed to replicate file: %s", err)
+		}
+		if changed.Len() == 0 {
+			return nil
+		}
+	}
+}
+
+// FileReplicationReconcileWorkflow compares all files with the secondary storage in batches, queueing the
+// replication of the drifted ones. It continues as new like FileScrubWorkflow.
+func FileReplicationReconcileWorkflow(ctx workflow.Context, state ReconcileState) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 10 * time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			MaximumInterval:    15 * time.Second,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    3,
+		},
+	})
+
+	var replicationActivities *ReplicationActivities
+	for batches := 0; ; batches++ {
+		if err := workflow.ExecuteActivity(ctx, replicationActivities.ReconcileBatch, state).Get(ctx, &state); err != nil {
+			return fmt.Errorf("failed to reconcile replicas: %s", err)
+		}
+		if state.Done {
+			return nil
+		}
+
+		if batches+1 >= reconcileBatchesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+			return workflow.NewContinueAsNewError(ctx, FileReplicationReconcileWorkflow, state)
+		}
+	}
+}
+
+func (s *temporalScheduler) ScheduleReplication(ctx context.Context, path string) error {
+	workflowOptions := client.StartWorkflowOptions{
+		ID:        fileReplicationWorkflowID(path),
+		TaskQueue: viper.GetString(config.KeyTemporalTaskQueue),
+	}
+	if _, err := s.client.SignalWithStartWorkflow(ctx, fileReplicationWorkflowID(path), signalFileChanged, nil, workflowOptions, FileReplicationWorkflow, path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *EmbeddedScheduler) ScheduleReplication(_ context.Context, path string) error {
+	return s.Schedule(taskFileReplicate, path, s.clock())
+}
+
+// runReplicator queues the replication of the changes of the files while the app runs.
+func runReplicator(lc fx.Lifecycle, r *replication.Replicator, b *events.Broker, s Scheduler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go r.Run(ctx, b, s)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+}
+
+// RegisterEmbeddedReplicationJobs registers the same replication as RegisterReplicationWorkflows on the embedded
+// scheduler. It does nothing unless the replication is enabled.
+func RegisterEmbeddedReplicationJobs(lc fx.Lifecycle, s *EmbeddedScheduler, r *replication.Replicator, b *events.Broker) {
+	if r == nil {
+		return
+	}
+	replicationActivities := &ReplicationActivities{
+		logger:     log.With().Str("logger", "replicationActivities").Logger(),
+		replicator: r,
+		scheduler:  s,
+	}
+
+	s.HandleWithRetry(taskFileReplicate, RetryPolicy{
+		InitialInterval: replicationInitialInterval,
+		MaximumInterval: replicationMaximumInterval,
+		MaximumAttempts: replicationMaximumAttempts,
+	}, replicationActivities.Replicate)
+	s.Every("file_replication_reconcile", viper.GetDuration(config.KeyReplicationReconcileInterval), replicationActivities.Reconcile)
+
+	runReplicator(lc, r, b, s)
+}
+
+// RegisterReplicationWorkflows registers the replication of the changes of the files to the secondary storage, and
+// schedules its reconciliation. It does nothing unless the replication is enabled.
+func RegisterReplicationWorkflows(lc fx.Lifecycle, c client.Client, w worker.Worker, s Scheduler, r *replication.Replicator, b *events.Broker) error {
+	if r == nil {
+		return nil
+	}
+	w.RegisterActivity(&ReplicationActivities{
+		logger:     log.With().Str("logger", "replicationActivities").Logger(),
+		replicator: r,
+		scheduler:  s,
+	})
+	w.RegisterWorkflow(FileReplicationWorkflow)
+	w.RegisterWorkflow(FileReplicationReconcileWorkflow)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	appendSchedule(lc, c, hostname+"-replication-reconcile", viper.GetDuration(config.KeyReplicationReconcileInterval), FileReplicationReconcileWorkflow, ReconcileState{})
+
+	runReplicator(lc, r, b, s)
+	return nil
+}
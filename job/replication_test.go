@@ -0,0 +1,81 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/replication"
+)
+
+func TestReplicationActivity_Reconcile(t *testing.T) {
+	viper.Set(config.KeyReplicationReconcileBatchSize, 2)
+	defer viper.Reset()
+
+	Convey("Given the secondary storage drifted from the files", t, func() {
+		primary, secondary := afero.NewMemMapFs(), afero.NewMemMapFs()
+		r := replication.New(primary, secondary)
+		s := newTestEmbeddedScheduler(t)
+		act := &ReplicationActivities{logger: zerolog.Nop(), replicator: r, scheduler: s}
+		s.Handle(taskFileReplicate, act.Replicate)
+
+		for _, p := range []string{"a.txt", "dir/b.txt", "dir/c.txt", "stale.txt"} {
+			So(afero.WriteFile(primary, p, []byte(p), 0644), ShouldBeNil)
+			So(r.Replicate(context.Background(), p), ShouldBeNil)
+		}
+		So(afero.WriteFile(primary, "missing.txt", []byte("m"), 0644), ShouldBeNil)
+		So(afero.WriteFile(secondary, "stale.txt", []byte("x"), 0644), ShouldBeNil)
+		old := time.Now().Add(-time.Hour)
+		So(secondary.Chtimes("stale.txt", old, old), ShouldBeNil)
+		So(afero.WriteFile(secondary, "deleted.txt", []byte("d"), 0644), ShouldBeNil)
+
+		Convey("The reconciliation should walk both in batches and queue the drifted files", func() {
+			var state ReconcileState
+			batches := 0
+			for !state.Done {
+				var err error
+				state, err = act.ReconcileBatch(context.Background(), state)
+				So(err, ShouldBeNil)
+				batches++
+			}
+			So(batches, ShouldBeGreaterThan, 3)
+			So(state.Scanned, ShouldEqual, 6)
+			So(state.Drifted, ShouldEqual, 3)
+			_, pending := r.Lag()
+			So(pending, ShouldEqual, 3)
+
+			Convey("The pending files should not be queued again", func() {
+				var state ReconcileState
+				for !state.Done {
+					var err error
+					state, err = act.ReconcileBatch(context.Background(), state)
+					So(err, ShouldBeNil)
+				}
+				So(state.Drifted, ShouldEqual, 0)
+			})
+
+			Convey("The queued replications should bring the secondary in sync", func() {
+				s.runDueTasks(context.Background())
+
+				b, err := afero.ReadFile(secondary, "missing.txt")
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "m")
+				b, err = afero.ReadFile(secondary, "stale.txt")
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "stale.txt")
+				exists, err := afero.Exists(secondary, "deleted.txt")
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeFalse)
+
+				_, pending := r.Lag()
+				So(pending, ShouldEqual, 0)
+			})
+		})
+	})
+}
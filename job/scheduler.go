@@ -0,0 +1,111 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
+	"go.temporal.io/sdk/client"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/webhook"
+)
+
+const (
+	SchedulerBackendTemporal = "temporal"
+	SchedulerBackendEmbedded = "embedded"
+)
+
+// Scheduler schedules the background jobs of the server.
+type Scheduler interface {
+	// ScheduleFileExpire deletes the file at path after the delay.
+	ScheduleFileExpire(ctx context.Context, path string, delay time.Duration) error
+	// CancelFileExpire cancels the pending expiration of the file at path, if any.
+	CancelFileExpire(ctx context.Context, path string) error
+	// ScheduleWebhook delivers the event to the webhook receiver at url, retrying with backoff until it succeeds.
+	ScheduleWebhook(ctx context.Context, url string, e *webhook.Event) error
+	// ScheduleReplication replicates the path to the secondary storage, retrying with backoff until it succeeds.
+	ScheduleReplication(ctx context.Context, path string) error
+}
+
+func fileExpireWorkflowID(path string) string {
+	return "file-expire:" + path
+}
+
+// NewSchedulerModule provides the Scheduler of the backend chosen by config and registers the file jobs on it.
+func NewSchedulerModule() fx.Option {
+	switch backend := viper.GetString(config.KeySchedulerBackend); backend {
+	case SchedulerBackendTemporal:
+		return fx.Options(
+			fx.Provide(
+				NewTemporalClient,
+				NewTemporalWorker,
+				NewTemporalScheduler,
+				NewWebhookNotifier,
+				NewFileActivities,
+			),
+			fx.Invoke(RegisterFileWorkflows, RegisterWebhookWorkflows, RegisterReplicationWorkflows),
+		)
+	case SchedulerBackendEmbedded:
+		return fx.Options(
+			fx.Provide(
+				fx.Annotate(NewEmbeddedScheduler, fx.As(fx.Self()), fx.As(new(Scheduler))),
+				NewWebhookNotifier,
+				NewFileActivities,
+			),
+			fx.Invoke(RegisterEmbeddedFileJobs, RegisterEmbeddedWebhookJobs, RegisterEmbeddedReplicationJobs),
+		)
+	default:
+		return fx.Error(fmt.Errorf("unknown scheduler backend: %s", backend))
+	}
+}
+
+type temporalScheduler struct {
+	client client.Client
+}
+
+func (s *temporalScheduler) ScheduleFileExpire(ctx context.Context, path string, delay time.Duration) error {
+	// Rescheduling must replace the pending expiration, otherwise the running workflow keeps its old deadline.
+	workflowOptions := client.StartWorkflowOptions{
+		ID:                       fileExpireWorkflowID(path),
+		TaskQueue:                viper.GetString(config.KeyTemporalTaskQueue),
+		StartDelay:               delay,
+		WorkflowIDConflictPolicy: enumspb.WORKFLOW_ID_CONFLICT_POLICY_TERMINATE_EXISTING,
+	}
+	if _, err := s.client.ExecuteWorkflow(ctx, workflowOptions, FileExpireWorkflow, path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *temporalScheduler) CancelFileExpire(ctx context.Context, path string) error {
+	// Terminate rather than cancel, since the workflow may not have started yet because of its start delay.
+	if err := s.client.TerminateWorkflow(ctx, fileExpireWorkflowID(path), "", "file deleted"); err != nil {
+		var notFound *serviceerror.NotFound
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *temporalScheduler) ScheduleWebhook(ctx context.Context, url string, e *webhook.Event) error {
+	workflowOptions := client.StartWorkflowOptions{
+		ID:        webhookWorkflowID(url, e),
+		TaskQueue: viper.GetString(config.KeyTemporalTaskQueue),
+	}
+	if _, err := s.client.ExecuteWorkflow(ctx, workflowOptions, WebhookDeliveryWorkflow, url, e); err != nil {
+		return err
+	}
+	return nil
+}
+
+func NewTemporalScheduler(c client.Client) Scheduler {
+	return &temporalScheduler{client: c}
+}
@@ -0,0 +1,40 @@
+package job
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	enumspb "go.temporal.io/api/enums/v1"
+	"go.temporal.io/sdk/client"
+)
+
+type fakeTemporalClient struct {
+	client.Client
+	started []client.StartWorkflowOptions
+}
+
+func (c *fakeTemporalClient) ExecuteWorkflow(_ context.Context, options client.StartWorkflowOptions, _ interface{}, _ ...interface{}) (client.WorkflowRun, error) {
+	c.started = append(c.started, options)
+	return nil, nil
+}
+
+func TestTemporalScheduler_ScheduleFileExpire(t *testing.T) {
+	Convey("Given a temporal scheduler", t, func() {
+		c := &fakeTemporalClient{}
+		s := NewTemporalScheduler(c)
+
+		Convey("When the expiration of a file is rescheduled", func() {
+			So(s.ScheduleFileExpire(context.Background(), "file.txt", time.Hour), ShouldBeNil)
+			So(s.ScheduleFileExpire(context.Background(), "file.txt", time.Minute), ShouldBeNil)
+
+			Convey("Then the new workflow replaces the pending one with the new delay", func() {
+				So(c.started, ShouldHaveLength, 2)
+				So(c.started[1].ID, ShouldEqual, c.started[0].ID)
+				So(c.started[1].StartDelay, ShouldEqual, time.Minute)
+				So(c.started[1].WorkflowIDConflictPolicy, ShouldEqual, enumspb.WORKFLOW_ID_CONFLICT_POLICY_TERMINATE_EXISTING)
+			})
+		})
+	})
+}
@@ -0,0 +1,366 @@
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+const (
+	// QuarantineDir is the hidden directory at the root keeping the corrupted files found by the integrity scrub.
+	QuarantineDir = internalpath.Quarantine
+
+	// scrubChecksumAlgorithm is the algorithm of the checksum recorded on upload which the scrub compares with.
+	scrubChecksumAlgorithm = "sha-256"
+
+	// scrubBatchesPerRun bounds the batches of a workflow run, which continues as new with the state afterward, so
+	// the history of a long scrub stays bounded.
+	scrubBatchesPerRun = 200
+
+	scrubPhaseFiles    = ""
+	scrubPhaseMetadata = "metadata"
+)
+
+// errBatchFull stops the walk once the batch is full.
+var errBatchFull = errors.New("batch full")
+
+// ScrubState is the state of an integrity scrub carried between its batches. The files are walked first, comparing
+// them with their checksums, and the metadata is walked afterward, finding the missing files.
+type ScrubState struct {
+	Run    store.ScrubRun `json:"run"`
+	Phase  string         `json:"phase"`
+	Cursor string         `json:"cursor"`
+	Done   bool           `json:"done"`
+}
+
+// walkBefore reports whether the walk visits the path a before the path b, which is in the order of their elements.
+func walkBefore(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// listFiles returns at most limit files of fsys walked after the cursor, skipping the internal directories.
+func listFiles(fsys afero.Fs, cursor string, limit int) ([]string, error) {
+	var files []string
+	if err := afero.Walk(fsys, ".", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			// A file removed while walking is not an issue of the walk.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		p = filepath.ToSlash(p)
+
+		if info.IsDir() {
+			if p == "." {
+				return nil
+			}
+			if internalpath.Is(p) {
+				return filepath.SkipDir
+			}
+			// The directories walked entirely before the cursor are skipped.
+			if cursor != "" && walkBefore(p, cursor) && !strings.HasPrefix(cursor, p+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if cursor != "" && !walkBefore(cursor, p) {
+			return nil
+		}
+		if len(files) == limit {
+			return errBatchFull
+		}
+		files = append(files, p)
+		return nil
+	}); err != nil && !errors.Is(err, errBatchFull) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// hashFile returns the hex SHA-256 digest of the content of the file.
+func (a *FileActivities) hashFile(p string) (string, error) {
+	f, err := a.fs.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scrubFile compares the content of the file with its recorded checksum, and records the mismatch as an issue,
+// quarantining the file if configured.
+func (a *FileActivities) scrubFile(ctx context.Context, run *store.ScrubRun, p string) error {
+	run.Scanned++
+
+	info, err := a.fs.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			run.Skipped++
+			return nil
+		}
+		return err
+	}
+
+	m, err := a.metadata.Get(p)
+	if err != nil && !errors.Is(err, store.ErrMetadataNotFound) {
+		return err
+	}
+	// A file changed since its checksum is recorded keeps its new modification time, while the silent corruption of
+	// its content does not change it.
+	if m == nil || m.Checksums[scrubChecksumAlgorithm] == "" || !info.ModTime().Equal(m.ModTime) {
+		run.Skipped++
+		return nil
+	}
+
+	actual, err := a.hashFile(p)
+	if err != nil {
+		return err
+	}
+	if actual == m.Checksums[scrubChecksumAlgorithm] {
+		run.Verified++
+		return a.scrub.DeleteIssues(p)
+	}
+
+	run.Mismatched++
+	issue := &store.ScrubIssue{
+		Path:       p,
+		Kind:       store.ScrubIssueMismatch,
+		Expected:   m.Checksums[scrubChecksumAlgorithm],
+		Actual:     actual,
+		DetectedAt: time.Now(),
+	}
+	a.logger.Warn().Ctx(ctx).Str("path", p).Str("expected", issue.Expected).Str("actual", actual).Msg("file checksum mismatched")
+
+	if viper.GetBool(config.KeyFileScrubQuarantine) {
+		quarantine := path.Join(QuarantineDir, p)
+		if err := a.fs.MkdirAll(path.Dir(quarantine), 0755); err != nil {
+			return err
+		}
+		if err := a.fs.Rename(p, quarantine); err != nil {
+			return err
+		}
+		// The quarantined file is no longer missing from its path.
+		if err := a.metadata.Delete(p); err != nil {
+			return err
+		}
+		issue.Quarantine = quarantine
+		a.logger.Warn().Ctx(ctx).Str("path", p).Str("quarantine", quarantine).Msg("file quarantined")
+	}
+
+	return a.scrub.PutIssue(issue)
+}
+
+// scrubMetadata records the file of the metadata as missing if it has a checksum but no longer exists.
+func (a *FileActivities) scrubMetadata(ctx context.Context, run *store.ScrubRun, m *store.Metadata) error {
+	if m.Checksums[scrubChecksumAlgorithm] == "" {
+		return nil
+	}
+	if _, err := a.fs.Stat(m.Path); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	run.Missing++
+	a.logger.Warn().Ctx(ctx).Str("path", m.Path).Msg("file missing")
+	return a.scrub.PutIssue(&store.ScrubIssue{
+		Path:       m.Path,
+		Kind:       store.ScrubIssueMissing,
+		Expected:   m.Checksums[scrubChecksumAlgorithm],
+		DetectedAt: time.Now(),
+	})
+}
+
+// ScrubBatch scrubs the next batch of the integrity scrub, records its progress, and returns the state of the next
+// batch. The issues not found again are removed once the scrub is done.
+func (a *FileActivities) ScrubBatch(ctx context.Context, state ScrubState) (ScrubState, error) {
+	if state.Run.StartedAt.IsZero() {
+		state.Run.StartedAt = time.Now()
+	}
+	limit := max(viper.GetInt(config.KeyFileScrubBatchSize), 1)
+
+	switch state.Phase {
+	case scrubPhaseFiles:
+		files, err := listFiles(a.fs, state.Cursor, limit)
+		if err != nil {
+			return state, err
+		}
+		for _, p := range files {
+			if err := a.scrubFile(ctx, &state.Run, p); err != nil {
+				return state, fmt.Errorf("failed to scrub file '%s': %w", p, err)
+			}
+			state.Cursor = p
+		}
+		if len(files) < limit {
+			state.Phase, state.Cursor = scrubPhaseMetadata, ""
+		}
+
+	case scrubPhaseMetadata:
+		records, err := a.metadata.List(state.Cursor, limit)
+		if err != nil {
+			return state, err
+		}
+		for _, m := range records {
+			if err := a.scrubMetadata(ctx, &state.Run, m); err != nil {
+				return state, fmt.Errorf("failed to scrub file '%s': %w", m.Path, err)
+			}
+			state.Cursor = m.Path
+		}
+		if len(records) < limit {
+			state.Run.FinishedAt = time.Now()
+			state.Done = true
+		}
+
+	default:
+		return state, temporal.NewNonRetryableApplicationError(fmt.Sprintf("unknown scrub phase: %s", state.Phase), "", nil)
+	}
+
+	if err := a.scrub.PutRun(&state.Run); err != nil {
+		return state, err
+	}
+
+	if state.Done {
+		n, err := a.scrub.PruneIssues(state.Run.StartedAt)
+		if err != nil {
+			return state, err
+		}
+		a.logger.Info().Ctx(ctx).
+			Int64("scanned", state.Run.Scanned).
+			Int64("verified", state.Run.Verified).
+			Int64("skipped", state.Run.Skipped).
+			Int64("mismatched", state.Run.Mismatched).
+			Int64("missing", state.Run.Missing).
+			Int("resolved", n).
+			Msg("integrity scrub finished")
+	}
+
+	return state, nil
+}
+
+// Scrub runs the integrity scrub through all its batches, pausing between them. It is the embedded counterpart of
+// FileScrubWorkflow.
+func (a *FileActivities) Scrub(ctx context.Context) error {
+	var state ScrubState
+	for !state.Done {
+		var err error
+		if state, err = a.ScrubBatch(ctx, state); err != nil {
+			return err
+		}
+		if state.Done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(viper.GetDuration(config.KeyFileScrubBatchDelay)):
+		}
+	}
+	return nil
+}
+
+// FileScrubWorkflow runs the integrity scrub in throttled batches. It continues as new with its state after
+// scrubBatchesPerRun batches or when suggested by the server, so the history of a long scrub stays bounded.
+func FileScrubWorkflow(ctx workflow.Context, state ScrubState) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: 10 * time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    time.Second,
+			MaximumInterval:    15 * time.Second,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    3,
+		},
+	})
+
+	var fileActivities *FileActivities
+	for batches := 0; ; batches++ {
+		if err := workflow.ExecuteActivity(ctx, fileActivities.ScrubBatch, state).Get(ctx, &state); err != nil {
+			return fmt.Errorf("failed to scrub files: %s", err)
+		}
+		if state.Done {
+			return nil
+		}
+
+		if batches+1 >= scrubBatchesPerRun || workflow.GetInfo(ctx).GetContinueAsNewSuggested() {
+			return workflow.NewContinueAsNewError(ctx, FileScrubWorkflow, state)
+		}
+
+		if err := workflow.Sleep(ctx, viper.GetDuration(config.KeyFileScrubBatchDelay)); err != nil {
+			return err
+		}
+	}
+}
+
+// registerScrubMetrics observes the issues of the integrity scrub, and the files of its latest run by their results.
+func registerScrubMetrics(meter metric.Meter, s *store.ScrubStore) error {
+	issues, err := meter.Int64ObservableGauge("scrub.issues", metric.WithDescription("Number of the files failing the integrity scrub, by the kind of the issue."))
+	if err != nil {
+		return err
+	}
+	files, err := meter.Int64ObservableGauge("scrub.files", metric.WithDescription("Number of the files of the latest integrity scrub, by their results."))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		list, err := s.ListIssues()
+		if err != nil {
+			return err
+		}
+		counts := map[string]int64{store.ScrubIssueMismatch: 0, store.ScrubIssueMissing: 0}
+		for _, i := range list {
+			counts[i.Kind]++
+		}
+		for kind, n := range counts {
+			o.ObserveInt64(issues, n, metric.WithAttributes(attribute.String("kind", kind)))
+		}
+
+		run, err := s.LastRun()
+		if errors.Is(err, store.ErrScrubRunNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for result, n := range map[string]int64{
+			"verified":   run.Verified,
+			"skipped":    run.Skipped,
+			"mismatched": run.Mismatched,
+			"missing":    run.Missing,
+		} {
+			o.ObserveInt64(files, n, metric.WithAttributes(attribute.String("result", result)))
+		}
+		return nil
+	}, issues, files)
+	return err
+}
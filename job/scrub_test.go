@@ -0,0 +1,181 @@
+package job
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestWalkBefore(t *testing.T) {
+	Convey("Paths should be ordered as they are walked", t, func() {
+		So(walkBefore("a/b", "a.txt"), ShouldBeTrue)
+		So(walkBefore("a", "a/b"), ShouldBeTrue)
+		So(walkBefore("a/b", "a/c"), ShouldBeTrue)
+		So(walkBefore("b", "a/c"), ShouldBeFalse)
+		So(walkBefore("a", "a"), ShouldBeFalse)
+	})
+}
+
+func TestFileActivity_Scrub(t *testing.T) {
+	viper.Set(config.KeyFileScrubBatchSize, 2)
+	viper.Set(config.KeyFileScrubBatchDelay, 0)
+	defer viper.Reset()
+
+	db, err := store.OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := store.NewMetadataStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrub, err := store.NewScrubStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given the files with the checksums recorded on upload", t, func() {
+		memFs := afero.NewMemMapFs()
+		act := &FileActivities{logger: zerolog.Nop(), fs: memFs, metadata: metadata, scrub: scrub}
+
+		upload := func(p, content string) {
+			So(afero.WriteFile(memFs, p, []byte(content), 0644), ShouldBeNil)
+			info, err := memFs.Stat(p)
+			So(err, ShouldBeNil)
+			sum := sha256.Sum256([]byte(content))
+			So(metadata.Put(&store.Metadata{
+				Path:      p,
+				Size:      info.Size(),
+				Checksums: map[string]string{"sha-256": hex.EncodeToString(sum[:])},
+				ModTime:   info.ModTime(),
+			}), ShouldBeNil)
+		}
+		upload("a.txt", "a")
+		upload("dir/b.txt", "b")
+		upload("dir/sub/c.txt", "c")
+		upload("corrupted.txt", "d")
+		upload("missing.txt", "e")
+		So(afero.WriteFile(memFs, "unrecorded.txt", []byte("f"), 0644), ShouldBeNil)
+		So(afero.WriteFile(memFs, ".tmp/partial", []byte("g"), 0644), ShouldBeNil)
+
+		// The silent corruption keeps the modification time of the file.
+		info, _ := memFs.Stat("corrupted.txt")
+		modTime := info.ModTime()
+		So(afero.WriteFile(memFs, "corrupted.txt", []byte("x"), 0644), ShouldBeNil)
+		So(memFs.Chtimes("corrupted.txt", modTime, modTime), ShouldBeNil)
+		So(memFs.Remove("missing.txt"), ShouldBeNil)
+
+		Reset(func() {
+			issues, _ := scrub.ListIssues()
+			for _, i := range issues {
+				scrub.DeleteIssues(i.Path)
+			}
+			records, _ := metadata.List("", 100)
+			for _, m := range records {
+				metadata.Delete(m.Path)
+			}
+		})
+
+		Convey("The scrub should walk every file once in batches and report the issues", func() {
+			var state ScrubState
+			batches := 0
+			for !state.Done {
+				state, err = act.ScrubBatch(context.Background(), state)
+				So(err, ShouldBeNil)
+				batches++
+			}
+			So(batches, ShouldBeGreaterThan, 3)
+
+			So(state.Run.Scanned, ShouldEqual, 5)
+			So(state.Run.Verified, ShouldEqual, 3)
+			So(state.Run.Skipped, ShouldEqual, 1)
+			So(state.Run.Mismatched, ShouldEqual, 1)
+			So(state.Run.Missing, ShouldEqual, 1)
+			So(state.Run.FinishedAt.IsZero(), ShouldBeFalse)
+
+			issues, err := scrub.ListIssues()
+			So(err, ShouldBeNil)
+			So(issues, ShouldHaveLength, 2)
+			So(issues[0].Path, ShouldEqual, "corrupted.txt")
+			So(issues[0].Kind, ShouldEqual, store.ScrubIssueMismatch)
+			So(issues[1].Path, ShouldEqual, "missing.txt")
+			So(issues[1].Kind, ShouldEqual, store.ScrubIssueMissing)
+
+			run, err := scrub.LastRun()
+			So(err, ShouldBeNil)
+			So(run.Scanned, ShouldEqual, 5)
+
+			Convey("The issues should be removed once they are not found again", func() {
+				upload("corrupted.txt", "x")
+				So(metadata.Delete("missing.txt"), ShouldBeNil)
+
+				So(act.Scrub(context.Background()), ShouldBeNil)
+
+				issues, err := scrub.ListIssues()
+				So(err, ShouldBeNil)
+				So(issues, ShouldBeEmpty)
+			})
+		})
+
+		Convey("The corrupted file should be moved to the quarantine if configured", func() {
+			viper.Set(config.KeyFileScrubQuarantine, true)
+			defer viper.Set(config.KeyFileScrubQuarantine, false)
+
+			So(act.Scrub(context.Background()), ShouldBeNil)
+
+			exists, _ := afero.Exists(memFs, "corrupted.txt")
+			So(exists, ShouldBeFalse)
+			b, err := afero.ReadFile(memFs, QuarantineDir+"/corrupted.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "x")
+
+			issues, err := scrub.ListIssues()
+			So(err, ShouldBeNil)
+			So(issues, ShouldHaveLength, 2)
+			So(issues[0].Quarantine, ShouldEqual, QuarantineDir+"/corrupted.txt")
+
+			Convey("The quarantined issue should be kept by the later scrubs", func() {
+				So(metadata.Delete("missing.txt"), ShouldBeNil)
+				So(act.Scrub(context.Background()), ShouldBeNil)
+
+				issues, err := scrub.ListIssues()
+				So(err, ShouldBeNil)
+				So(issues, ShouldHaveLength, 1)
+				So(issues[0].Path, ShouldEqual, "corrupted.txt")
+			})
+		})
+	})
+}
+
+func TestListFiles(t *testing.T) {
+	Convey("Listing the files after the cursor should continue the walk", t, func() {
+		memFs := afero.NewMemMapFs()
+		for _, p := range []string{"a.txt", "a/1", "a/2", "b/c/3", "z"} {
+			So(afero.WriteFile(memFs, p, nil, 0644), ShouldBeNil)
+		}
+
+		var all []string
+		cursor := ""
+		for {
+			files, err := listFiles(memFs, cursor, 2)
+			So(err, ShouldBeNil)
+			all = append(all, files...)
+			if len(files) < 2 {
+				break
+			}
+			cursor = files[len(files)-1]
+		}
+		So(all, ShouldResemble, []string{"a/1", "a/2", "a.txt", "b/c/3", "z"})
+	})
+}
@@ -0,0 +1,120 @@
+package job
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/worker"
+	"go.temporal.io/sdk/workflow"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/webhook"
+)
+
+const (
+	// The deliveries are retried for about a day, so an outage of the receiver does not lose the events.
+	webhookInitialInterval = time.Second
+	webhookMaximumInterval = 10 * time.Minute
+	webhookMaximumAttempts = 150
+
+	taskWebhook = "webhook"
+)
+
+func webhookWorkflowID(url string, e *webhook.Event) string {
+	return "webhook:" + e.ID + ":" + url
+}
+
+type webhookTask struct {
+	URL   string         `json:"url"`
+	Event *webhook.Event `json:"event"`
+}
+
+type WebhookActivities struct {
+	logger zerolog.Logger
+	client *http.Client
+}
+
+// Deliver sends the event to the receiver at url. A rejection by the receiver is not retried.
+func (a *WebhookActivities) Deliver(ctx context.Context, url string, e *webhook.Event) error {
+	if err := webhook.Deliver(ctx, a.client, url, e); err != nil {
+		a.logger.Warn().Ctx(ctx).Err(err).Str("url", url).Str("id", e.ID).Str("type", e.Type).Str("path", e.Path).Msg("failed to deliver webhook")
+
+		var statusErr *webhook.StatusError
+		if errors.As(err, &statusErr) && !statusErr.Retryable() {
+			return temporal.NewNonRetryableApplicationError(err.Error(), "WebhookRejected", err)
+		}
+		return err
+	}
+
+	a.logger.Info().Ctx(ctx).Str("url", url).Str("id", e.ID).Str("type", e.Type).Str("path", e.Path).Msg("webhook delivered successfully")
+
+	return nil
+}
+
+func NewWebhookActivities() *WebhookActivities {
+	return &WebhookActivities{
+		logger: log.With().Str("logger", "webhookActivities").Logger(),
+		client: &http.Client{Timeout: viper.GetDuration(config.KeyWebhookTimeout)},
+	}
+}
+
+func WebhookDeliveryWorkflow(ctx workflow.Context, url string, e *webhook.Event) error {
+	ctx = workflow.WithActivityOptions(ctx, workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute,
+		RetryPolicy: &temporal.RetryPolicy{
+			InitialInterval:    webhookInitialInterval,
+			MaximumInterval:    webhookMaximumInterval,
+			BackoffCoefficient: 2,
+			MaximumAttempts:    webhookMaximumAttempts,
+		},
+	})
+
+	var webhookActivities *WebhookActivities
+	if err := workflow.ExecuteActivity(ctx, webhookActivities.Deliver, url, e).Get(ctx, nil); err != nil {
+		return fmt.Errorf("failed to deliver webhook: %s", err)
+	}
+
+	return nil
+}
+
+func (s *EmbeddedScheduler) ScheduleWebhook(_ context.Context, url string, e *webhook.Event) error {
+	b, err := json.Marshal(webhookTask{URL: url, Event: e})
+	if err != nil {
+		return err
+	}
+	return s.Schedule(taskWebhook, string(b), s.clock())
+}
+
+// RegisterEmbeddedWebhookJobs registers the same webhook delivery as RegisterWebhookWorkflows on the embedded scheduler.
+func RegisterEmbeddedWebhookJobs(s *EmbeddedScheduler) {
+	webhookActivities := NewWebhookActivities()
+
+	s.HandleWithRetry(taskWebhook, RetryPolicy{
+		InitialInterval: webhookInitialInterval,
+		MaximumInterval: webhookMaximumInterval,
+		MaximumAttempts: webhookMaximumAttempts,
+	}, func(ctx context.Context, arg string) error {
+		var t webhookTask
+		if err := json.Unmarshal([]byte(arg), &t); err != nil {
+			return temporal.NewNonRetryableApplicationError(err.Error(), "InvalidWebhookTask", err)
+		}
+		return webhookActivities.Deliver(ctx, t.URL, t.Event)
+	})
+}
+
+func RegisterWebhookWorkflows(w worker.Worker) {
+	w.RegisterActivity(NewWebhookActivities())
+	w.RegisterWorkflow(WebhookDeliveryWorkflow)
+}
+
+func NewWebhookNotifier(s Scheduler) *webhook.Notifier {
+	return webhook.NewNotifier(s)
+}
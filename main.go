@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 
@@ -16,6 +17,8 @@ import (
 	"github.com/wei840222/simple-file-server/job"
 	"github.com/wei840222/simple-file-server/server"
 	"github.com/wei840222/simple-file-server/server/handler"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 var rootCmd = &cobra.Command{
@@ -32,23 +35,11 @@ var rootCmd = &cobra.Command{
 		config.InitCobraPFlag(cmd)
 		config.InitZerolog()
 
-		if viper.GetBool(config.KeyHTTPEnableAuth) && len(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens)) == 0 && len(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)) == 0 {
-			logger.Info().Ctx(cmd.Context()).Msg("authentication is enabled but no tokens provided. generating random tokens")
-			readOnlyToken, err := generateToken()
-			if err != nil {
-				return err
-			}
-			readWriteToken, err := generateToken()
-			if err != nil {
-				return err
-			}
-			viper.Set(config.KeyHTTPReadOnlyTokens, readOnlyToken)
-			viper.Set(config.KeyHTTPReadWriteTokens, readWriteToken)
-			logger.Info().Ctx(cmd.Context()).Msgf("generated read only token: %s", readOnlyToken)
-			logger.Info().Ctx(cmd.Context()).Msgf("generated read write token: %s", readWriteToken)
+		if _, err := middleware.LoadPolicies(); err != nil {
+			return fmt.Errorf("invalid %s: %w", config.KeyHTTPPolicies, err)
 		}
 
-		logger.Info().Ctx(cmd.Context()).Any("config", viper.AllSettings()).Msg("config loaded")
+		logger.Info().Ctx(cmd.Context()).Any("config", config.RedactedSettings()).Msg("config loaded")
 
 		return nil
 	},
@@ -57,17 +48,31 @@ var rootCmd = &cobra.Command{
 			fx.Provide(
 				server.NewMeterProvider,
 				server.NewTracerProvider,
+				server.NewTLSConfig,
 				server.NewGinEngine,
+				server.NewEventBroker,
 				server.NewAferoFS,
-				job.NewTemporalClient,
-				job.NewTemporalWorker,
+				server.NewReplicator,
+				store.NewMetadataStore,
+				store.NewTokenStore,
+				store.NewOwnerStore,
+				store.NewVersionStore,
+				store.NewTrashStore,
+				store.NewScrubStore,
 			),
+			job.NewSchedulerModule(),
 			fx.Invoke(
+				bootstrapTokens,
 				server.RunO11yHTTPServer,
 				handler.RegisterFileHandler,
 				handler.RegisterUploadHandler,
 				handler.RegisterWebdavHandler,
-				job.RegisterFileWorkflows,
+				handler.RegisterTusHandler,
+				handler.RegisterPresignHandler,
+				handler.RegisterQuotaHandler,
+				handler.RegisterVersionHandler,
+				handler.RegisterTrashHandler,
+				handler.RegisterEventsHandler,
 			),
 			fx.WithLogger(fxlogger.WithZerolog(log.With().Str("logger", "fx").Logger())),
 			fx.StopTimeout(3*viper.GetDuration(config.KeyHTTPShutdownTimeout)),
@@ -77,6 +82,37 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var presignCmd = &cobra.Command{
+	Use:   "presign",
+	Short: "Create a signed, time-limited URL.",
+	Long:  "Create a signed, time-limited URL with the first key of --http-signing-keys. The URL authorizes one method on one path without a token.",
+	PreRunE: func(cmd *cobra.Command, _ []string) error {
+		if err := config.InitViper(); err != nil {
+			return err
+		}
+
+		config.InitCobraPFlag(cmd)
+		config.InitZerolog()
+
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		method, _ := cmd.Flags().GetString("method")
+		path, _ := cmd.Flags().GetString("path")
+		expire, _ := cmd.Flags().GetDuration("expire")
+		maxContentLength, _ := cmd.Flags().GetInt64("max-content-length")
+		baseURL, _ := cmd.Flags().GetString("base-url")
+
+		u, _, err := middleware.PresignURL(baseURL, method, path, expire, maxContentLength, "")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(u)
+		return nil
+	},
+}
+
 func main() {
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyLogLevel), "debug", "Log level")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyLogFormat), "console", "Log format")
@@ -84,6 +120,8 @@ func main() {
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyO11yHost), "0.0.0.0", "Observability server host")
 	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyO11yPort), 9090, "Observability server port")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyO11yEnableTLS), false, "Serve the observability server with the TLS settings of the HTTP server")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyO11yAdminToken), "", "Token of the admin API on the observability server. empty means the admin API is disabled.")
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyGinMode), "debug", "Gin mode")
 
@@ -97,17 +135,96 @@ func main() {
 	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPReadTimeout), 15*time.Second, "Read timeout. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
 	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPWriteTimeout), 300*time.Second, "Write timeout. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
 	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPIdleTimeout), 60*time.Second, "Idle timeout. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPTransferReadTimeout), time.Hour, "Read timeout in total of the routes uploading files, while the read timeout applies when the upload stalls. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPTransferWriteTimeout), time.Hour, "Write timeout in total of the routes downloading files, while the write timeout applies when the download stalls. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPSigningKeys), []string{}, "Comma separated list of keys to sign URLs in the format '<id>:<secret>'. The first key signs new URLs and all keys verify them.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTokenStorePath), "./data/tokens.db", "Path to the database of the managed tokens.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSCertFile), "", "Path to the TLS certificate file. It is reloaded when modified. HTTPS is enabled with the key file.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSKeyFile), "", "Path to the TLS private key file. It is reloaded when modified.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSMinVersion), "1.2", "Minimum TLS version. One of '1.0', '1.1', '1.2' or '1.3'.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyHTTPTLSClientCAFile), "", "Path to the CA bundle to verify client certificates. Client certificates are optional.")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPTLSReadOnlySubjects), []string{}, "Comma separated list of client certificate subjects with read only permission. A subject matches the common name, the distinguished name or any SAN of the certificate.")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPTLSReadWriteSubjects), []string{}, "Comma separated list of client certificate subjects with read write permission. A subject matches the common name, the distinguished name or any SAN of the certificate.")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyHTTPRedirectPort), 0, "Port of the HTTP server redirecting to HTTPS. zero means disabled.")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyHTTPTrustedProxies), []string{}, "Comma separated list of the addresses or CIDR ranges of the trusted reverse proxies, whose X-Forwarded-For and X-Forwarded-Proto headers are honoured. None by default.")
 	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyHTTPShutdownTimeout), 15*time.Second, "Graceful shutdown timeout. zero or negative value means no timeout. can be suffixed by the time units (e.g. '1s', '500ms').")
 
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileBackend), server.FileBackendLocal, "Storage backend of the files. One of 'local' or 's3'.")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileRoot), "./data/files", "Path to save uploaded files.")
 	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyFileGarbageCollectionPattern), []string{`^\._.+`, `^\.DS_Store$`}, "Regular expressions to match files for garbage collection. Files matching these patterns will be deleted.")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileWebRoot), "./web/dist", "Path to the web root directory. This is used to serve the static files for the web interface.")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileWebUploadPath), "./files", "Path of the upload api response.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileMetadataPath), "./data/metadata.db", "Path to the database of the uploaded file metadata.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyFileEncryptionKeyFile), "", "Path to the master key encrypting the files at rest. empty means the files are not encrypted.")
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyFileEncryptionOldKeyFiles), []string{}, "Paths to the previous master keys. The data keys of the files wrapped by them are wrapped again by the current master key on start.")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyFileDedup), false, "Store the identical file content once under its SHA-256 digest, in the hidden '.blobs' directory of the file storage.")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyFileVersioning), false, "Keep the previous content of a file as a numbered version when it is overwritten or deleted, in the hidden '.versions' directory of the file storage.")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyFileVersioningKeepLast), 10, "Number of the latest versions to keep for each file. zero means unlimited.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyFileVersioningKeepFor), 30*24*time.Hour, "Duration to keep a version after it is archived. zero means forever. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyFileTrash), false, "Move the deleted files to the hidden '.trash' directory of the file storage, where they can be restored until they are purged.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyFileTrashMaxAge), 30*24*time.Hour, "Duration to keep a deleted file in the trash. zero means forever. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyFileScrub), false, "Re-hash the files periodically and compare them with the checksums recorded on upload, reporting the corrupted and missing files.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyFileScrubInterval), 24*time.Hour, "Interval between the integrity scrubs. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyFileScrubBatchSize), 100, "Number of the files re-hashed in a batch of the integrity scrub.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyFileScrubBatchDelay), time.Second, "Pause between the batches of the integrity scrub, throttling its load on the storage. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyFileScrubQuarantine), false, "Move the corrupted files found by the integrity scrub to the hidden '.quarantine' directory of the file storage.")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3Endpoint), "s3.amazonaws.com", "Endpoint of the S3 compatible object storage.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3Bucket), "", "Bucket to save uploaded files in the s3 backend.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3Prefix), "", "Key prefix of the uploaded files in the bucket.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3Region), "", "Region of the bucket. empty means auto detection.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3AccessKeyID), "", "Access key ID of the object storage. empty means loading the credentials from the environment variables or the IAM role.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyS3SecretAccessKey), "", "Secret access key of the object storage.")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyS3UseSSL), true, "Use HTTPS to connect to the object storage.")
+
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyQuotaTokenMaxBytes), 0, "Maximum bytes of the files written by each token. zero means unlimited.")
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyQuotaTokenMaxFiles), 0, "Maximum number of the files written by each token. zero means unlimited.")
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyQuotaDirectoryMaxBytes), 0, "Maximum bytes of the files in each top-level directory. The files at the root count as a directory. zero means unlimited.")
+	rootCmd.PersistentFlags().Int64(config.FlagReplacer.Replace(config.KeyQuotaDirectoryMaxFiles), 0, "Maximum number of the files in each top-level directory. The files at the root count as a directory. zero means unlimited.")
+
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyTusExpiration), 24*time.Hour, "Duration to keep an incomplete tus upload. can be suffixed by the time units (e.g. '1s', '500ms').")
+
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyEventsBufferSize), 1024, "Number of the latest file events kept for the clients of /events resuming with Last-Event-ID.")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyEventsWatch), true, "Watch the file root of the local backend for the changes made directly on disk, to send them to /events.")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationBackend), "", "Backend of the secondary storage mirroring the files for disaster recovery. One of 'local' or 's3'. empty means disabled.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationRoot), "", "Path to mirror the files in the local replication backend, e.g. on an NFS mount.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3Endpoint), "s3.amazonaws.com", "Endpoint of the S3 compatible object storage of the s3 replication backend.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3Bucket), "", "Bucket to mirror the files in the s3 replication backend.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3Prefix), "", "Key prefix of the mirrored files in the bucket.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3Region), "", "Region of the bucket of the s3 replication backend. empty means auto detection.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3AccessKeyID), "", "Access key ID of the object storage of the s3 replication backend. empty means loading the credentials from the environment variables or the IAM role.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyReplicationS3SecretAccessKey), "", "Secret access key of the object storage of the s3 replication backend.")
+	rootCmd.PersistentFlags().Bool(config.FlagReplacer.Replace(config.KeyReplicationS3UseSSL), true, "Use HTTPS to connect to the object storage of the s3 replication backend.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyReplicationReconcileInterval), time.Hour, "Interval between the full comparisons of the files with the secondary storage, replicating the drifted ones. can be suffixed by the time units (e.g. '1s', '500ms').")
+	rootCmd.PersistentFlags().Int(config.FlagReplacer.Replace(config.KeyReplicationReconcileBatchSize), 1000, "Number of the files compared in a batch of the reconciliation with the secondary storage.")
+
+	rootCmd.PersistentFlags().StringSlice(config.FlagReplacer.Replace(config.KeyWebhookURLs), []string{}, "Comma separated list of URLs to notify of the file lifecycle events. empty means disabled.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyWebhookSecret), "", "Key to sign the webhook requests with HMAC-SHA256. empty means unsigned.")
+	rootCmd.PersistentFlags().Duration(config.FlagReplacer.Replace(config.KeyWebhookTimeout), 10*time.Second, "Timeout of a webhook request. can be suffixed by the time units (e.g. '1s', '500ms').")
+
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeySchedulerBackend), job.SchedulerBackendTemporal, "Scheduler backend for background jobs such as file expiration. One of 'temporal' or 'embedded'.")
+	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeySchedulerEmbeddedPath), "./data/scheduler.db", "Path to the database of the embedded scheduler backend.")
 
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyTemporalAddress), "localhost:7233", "Temporal server address.")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyTemporalNamespace), "default", "Temporal namespace.")
 	rootCmd.PersistentFlags().String(config.FlagReplacer.Replace(config.KeyTemporalTaskQueue), "SIMPLE_FILE_SERVER:FILES", "Temporal task queue.")
 
+	presignCmd.Flags().String("method", http.MethodGet, "HTTP method to authorize.")
+	presignCmd.Flags().String("path", "", "URL path to authorize, e.g. '/files/foo.txt'.")
+	presignCmd.Flags().Duration("expire", time.Hour, "Duration until the URL expires. can be suffixed by the time units (e.g. '1s', '500ms').")
+	presignCmd.Flags().Int64("max-content-length", 0, "Maximum request body size in bytes. zero means no limit.")
+	presignCmd.Flags().String("base-url", "http://localhost:8080", "Base URL of the server.")
+	presignCmd.MarkFlagRequired("path")
+	rootCmd.AddCommand(presignCmd)
+
+	tokenCmd.PersistentFlags().String("admin-url", "http://localhost:9090", "Base URL of the observability server serving the admin API.")
+	tokenCreateCmd.Flags().String("label", "", "Label to identify the token.")
+	tokenCreateCmd.Flags().StringSlice("scopes", []string{store.ScopeRead}, "Comma separated list of scopes. 'read' allows the read only routes and 'write' allows all routes.")
+	tokenCreateCmd.Flags().Duration("expire", 0, "Duration until the token expires. zero means never. can be suffixed by the time units (e.g. '1s', '500ms').")
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd, tokenRotateCmd)
+	rootCmd.AddCommand(tokenCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
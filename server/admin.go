@@ -0,0 +1,177 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type CreateTokenReq struct {
+	Label  string   `json:"label"`
+	Scopes []string `json:"scopes"`
+	Expire string   `json:"expire"`
+}
+
+// TokenRes is the record of a token, with the token itself only after it is created or rotated.
+type TokenRes struct {
+	*store.Token
+	Value string `json:"token,omitempty"`
+}
+
+// ScrubReportRes is the report of the integrity scrub, with its latest run if it has run.
+type ScrubReportRes struct {
+	Run    *store.ScrubRun     `json:"run"`
+	Issues []*store.ScrubIssue `json:"issues"`
+}
+
+type adminHandler struct {
+	logger zerolog.Logger
+	tokens *store.TokenStore
+	scrub  *store.ScrubStore
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *adminHandler) writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, store.ErrTokenNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, store.ErrTokenScopeInvalid), errors.Is(err, ErrInvalidExpireTime):
+		status = http.StatusBadRequest
+	default:
+		h.logger.Error().Err(err).Msg("admin request failed")
+	}
+	writeJSON(w, status, ErrorRes{Error: err.Error()})
+}
+
+// auth requires the admin token as a bearer token.
+func (h *adminHandler) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			writeJSON(w, http.StatusUnauthorized, ErrorRes{Error: ErrAuthTokenRequired.Error()})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(viper.GetString(config.KeyO11yAdminToken))) != 1 {
+			writeJSON(w, http.StatusForbidden, ErrorRes{Error: ErrAuthTokenInvalid.Error()})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *adminHandler) ListTokens(w http.ResponseWriter, _ *http.Request) {
+	tokens, err := h.tokens.List()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (h *adminHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var req CreateTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorRes{Error: err.Error()})
+		return
+	}
+
+	var expire time.Duration
+	if req.Expire != "" {
+		var err error
+		if expire, err = time.ParseDuration(req.Expire); err != nil || expire < 0 {
+			h.writeError(w, ErrInvalidExpireTime)
+			return
+		}
+	}
+
+	t, token, err := h.tokens.Create(req.Label, req.Scopes, expire)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.logger.Info().Str("id", t.ID).Str("label", t.Label).Strs("scopes", t.Scopes).Msg("created token")
+
+	writeJSON(w, http.StatusCreated, TokenRes{Token: t, Value: token})
+}
+
+func (h *adminHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := h.tokens.Revoke(r.PathValue("id")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.logger.Info().Str("id", r.PathValue("id")).Msg("revoked token")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *adminHandler) RotateToken(w http.ResponseWriter, r *http.Request) {
+	t, token, err := h.tokens.Rotate(r.PathValue("id"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.logger.Info().Str("id", t.ID).Msg("rotated token")
+
+	writeJSON(w, http.StatusOK, TokenRes{Token: t, Value: token})
+}
+
+func (h *adminHandler) GetScrubReport(w http.ResponseWriter, _ *http.Request) {
+	run, err := h.scrub.LastRun()
+	if err != nil && !errors.Is(err, store.ErrScrubRunNotFound) {
+		h.writeError(w, err)
+		return
+	}
+	issues, err := h.scrub.ListIssues()
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ScrubReportRes{Run: run, Issues: issues})
+}
+
+// DeleteScrubIssue dismisses the issue of the file, such as a quarantined file which is dealt with.
+func (h *adminHandler) DeleteScrubIssue(w http.ResponseWriter, r *http.Request) {
+	if err := h.scrub.DeleteIssues(r.PathValue("path")); err != nil {
+		h.writeError(w, err)
+		return
+	}
+	h.logger.Info().Str("path", r.PathValue("path")).Msg("dismissed scrub issue")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerAdminHandler serves the admin API on the observability server if the admin token is configured.
+func registerAdminHandler(mux *http.ServeMux, tokens *store.TokenStore, scrub *store.ScrubStore) {
+	if viper.GetString(config.KeyO11yAdminToken) == "" {
+		return
+	}
+
+	h := &adminHandler{
+		logger: log.With().Str("logger", "adminHandler").Logger(),
+		tokens: tokens,
+		scrub:  scrub,
+	}
+
+	mux.HandleFunc("GET /admin/tokens", h.auth(h.ListTokens))
+	mux.HandleFunc("POST /admin/tokens", h.auth(h.CreateToken))
+	mux.HandleFunc("DELETE /admin/tokens/{id}", h.auth(h.RevokeToken))
+	mux.HandleFunc("POST /admin/tokens/{id}/rotate", h.auth(h.RotateToken))
+	mux.HandleFunc("GET /admin/scrub", h.auth(h.GetScrubReport))
+	mux.HandleFunc("DELETE /admin/scrub/issues/{path...}", h.auth(h.DeleteScrubIssue))
+}
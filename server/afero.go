@@ -2,54 +2,588 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/afero"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/metric"
+	"go.uber.org/fx"
 	"golang.org/x/net/webdav"
 
 	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/crypt"
+	"github.com/wei840222/simple-file-server/server/dedup"
+	"github.com/wei840222/simple-file-server/server/events"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/replication"
+	"github.com/wei840222/simple-file-server/server/s3fs"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+	"github.com/wei840222/simple-file-server/server/trash"
+	"github.com/wei840222/simple-file-server/server/versioning"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
 )
 
-func NewAferoFS() (afero.Fs, error) {
+const (
+	FileBackendLocal = "local"
+	FileBackendS3    = "s3"
+)
+
+// AferoFS is the file system of the files, and the layers of it serving their own APIs.
+type AferoFS struct {
+	fx.Out
+
+	Fs afero.Fs
+	// Versioning is nil unless the versioning is enabled.
+	Versioning *versioning.Fs
+	// Trash is nil unless the trash is enabled.
+	Trash *trash.Fs
+}
+
+// NewEventBroker returns the Broker of the changes of the files, keeping the latest events of the config.
+func NewEventBroker() *events.Broker {
+	return events.NewBroker(viper.GetInt(config.KeyEventsBufferSize))
+}
+
+func NewAferoFS(lc fx.Lifecycle, mp metric.MeterProvider, owners *store.OwnerStore, versions *store.VersionStore, entries *store.TrashStore, b *events.Broker) (AferoFS, error) {
+	var out AferoFS
+	var fs afero.Fs
+	var err error
+	switch backend := viper.GetString(config.KeyFileBackend); backend {
+	case FileBackendLocal:
+		fs, err = newLocalFS(viper.GetString(config.KeyFileRoot))
+	case FileBackendS3:
+		fs, err = newS3FS(s3fs.MinioOptions{
+			Endpoint:        viper.GetString(config.KeyS3Endpoint),
+			Bucket:          viper.GetString(config.KeyS3Bucket),
+			Region:          viper.GetString(config.KeyS3Region),
+			AccessKeyID:     viper.GetString(config.KeyS3AccessKeyID),
+			SecretAccessKey: viper.GetString(config.KeyS3SecretAccessKey),
+			UseSSL:          viper.GetBool(config.KeyS3UseSSL),
+		}, viper.GetString(config.KeyS3Prefix))
+	default:
+		return out, fmt.Errorf("unknown file backend: %s", backend)
+	}
+	if err != nil {
+		return out, err
+	}
+
+	if fs, err = encryptFS(fs); err != nil {
+		return out, err
+	}
+
+	if viper.GetBool(config.KeyFileDedup) {
+		dfs, err := dedup.New(fs)
+		if err != nil {
+			return out, err
+		}
+		if err := dfs.RegisterMetrics(mp.Meter("github.com/wei840222/simple-file-server/server/dedup")); err != nil {
+			return out, err
+		}
+		fs = dfs
+	}
+
+	// The versions and the trash are under the quotas, so they do not count against them.
+	if viper.GetBool(config.KeyFileVersioning) {
+		out.Versioning = versioning.New(fs, versions)
+		fs = out.Versioning
+	}
+
+	// The deleted files are moved to the trash rather than kept as versions.
+	if viper.GetBool(config.KeyFileTrash) {
+		out.Trash = trash.New(fs, entries)
+		fs = out.Trash
+	}
+
+	// The changes are published above the versions and the trash, so they are of the visible files.
+	if viper.GetString(config.KeyFileBackend) == FileBackendLocal && viper.GetBool(config.KeyEventsWatch) {
+		w, err := events.NewWatcher(fs, viper.GetString(config.KeyFileRoot), b, log.With().Str("logger", "fileWatcher").Logger())
+		if err != nil {
+			return out, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		lc.Append(fx.Hook{
+			OnStart: func(context.Context) error {
+				go w.Run(ctx)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				return nil
+			},
+		})
+	}
+	fs = events.New(fs, b)
+
+	// The temporary files left by the writes interrupted on the last shutdown can no longer be completed.
+	if n, err := tempfile.Clean(fs, 0); err != nil {
+		return out, err
+	} else if n > 0 {
+		log.Info().Int("files", n).Msg("removed temporary files of interrupted writes")
+	}
+
+	opts := quota.Options{
+		Owner: quota.Limits{
+			MaxBytes: viper.GetInt64(config.KeyQuotaTokenMaxBytes),
+			MaxFiles: viper.GetInt64(config.KeyQuotaTokenMaxFiles),
+		},
+		Directory: quota.Limits{
+			MaxBytes: viper.GetInt64(config.KeyQuotaDirectoryMaxBytes),
+			MaxFiles: viper.GetInt64(config.KeyQuotaDirectoryMaxFiles),
+		},
+	}
+	// Tracking the usage requires listing all files on startup, which is skipped unless any quota is configured.
+	if opts == (quota.Options{}) {
+		out.Fs = fs
+		return out, nil
+	}
+	qfs, err := quota.New(fs, owners, opts)
+	if err != nil {
+		return out, err
+	}
+	out.Fs = qfs
+	return out, nil
+}
+
+// NewReplicator returns the Replicator of the files to the secondary storage of the config, or nil if the replication
+// is disabled. The replicas are encrypted like the files.
+func NewReplicator(mp metric.MeterProvider, fs afero.Fs) (*replication.Replicator, error) {
+	var secondary afero.Fs
+	var err error
+	switch backend := viper.GetString(config.KeyReplicationBackend); backend {
+	case "":
+		return nil, nil
+	case FileBackendLocal:
+		root := viper.GetString(config.KeyReplicationRoot)
+		if root == "" {
+			return nil, errors.New("replication root is required by the local replication backend")
+		}
+		secondary, err = newLocalFS(root)
+	case FileBackendS3:
+		secondary, err = newS3FS(s3fs.MinioOptions{
+			Endpoint:        viper.GetString(config.KeyReplicationS3Endpoint),
+			Bucket:          viper.GetString(config.KeyReplicationS3Bucket),
+			Region:          viper.GetString(config.KeyReplicationS3Region),
+			AccessKeyID:     viper.GetString(config.KeyReplicationS3AccessKeyID),
+			SecretAccessKey: viper.GetString(config.KeyReplicationS3SecretAccessKey),
+			UseSSL:          viper.GetBool(config.KeyReplicationS3UseSSL),
+		}, viper.GetString(config.KeyReplicationS3Prefix))
+	default:
+		return nil, fmt.Errorf("unknown replication backend: %s", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secondary, err = encryptFS(secondary); err != nil {
+		return nil, err
+	}
+
+	r := replication.New(fs, secondary)
+	if err := r.RegisterMetrics(mp.Meter("github.com/wei840222/simple-file-server/server/replication")); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// encryptFS returns the Fs encrypting the files of fs with the master key of the config, or fs if it is not set.
+func encryptFS(fs afero.Fs) (afero.Fs, error) {
+	keyFile := viper.GetString(config.KeyFileEncryptionKeyFile)
+	if keyFile == "" {
+		return fs, nil
+	}
+	keys, err := crypt.LoadKeyring(keyFile, viper.GetStringSlice(config.KeyFileEncryptionOldKeyFiles)...)
+	if err != nil {
+		return nil, err
+	}
+	cfs, err := crypt.New(fs, keys)
+	if err != nil {
+		return nil, err
+	}
+	return cfs, nil
+}
+
+func newLocalFS(root string) (afero.Fs, error) {
 	fs := afero.NewOsFs()
 
-	exist, err := afero.DirExists(fs, viper.GetString(config.KeyFileRoot))
+	exist, err := afero.DirExists(fs, root)
 	if err != nil {
 		return nil, err
 	}
 
 	if !exist {
-		fs.MkdirAll(viper.GetString(config.KeyFileRoot), os.ModePerm)
+		fs.MkdirAll(root, os.ModePerm)
+	}
+
+	return afero.NewBasePathFs(fs, root), nil
+}
+
+func newS3FS(opts s3fs.MinioOptions, prefix string) (afero.Fs, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	client, err := s3fs.NewMinioClient(ctx, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return afero.NewBasePathFs(fs, viper.GetString(config.KeyFileRoot)), nil
+	return s3fs.New(client, prefix), nil
 }
 
-func AferoFSWebdavAdapter(fs afero.Fs) webdav.FileSystem {
-	return &aferoFSWebdavAdapter{fs: fs}
+// AferoFSWebdavAdapter serves the afero.Fs over WebDAV, and notifies the webhooks of the files written or removed.
+// The internal directories are not served.
+func AferoFSWebdavAdapter(fs afero.Fs, n *webhook.Notifier) webdav.FileSystem {
+	return &aferoFSWebdavAdapter{fs: fs, webhooks: n}
 }
 
 type aferoFSWebdavAdapter struct {
-	fs afero.Fs
+	fs       afero.Fs
+	webhooks *webhook.Notifier
+}
+
+func webdavNotExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
 }
 
 func (a *aferoFSWebdavAdapter) Mkdir(_ context.Context, name string, perm os.FileMode) error {
+	if internalpath.Is(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
 	return a.fs.Mkdir(name, perm)
 }
 
-func (a *aferoFSWebdavAdapter) OpenFile(_ context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	return a.fs.OpenFile(name, flag, perm)
+// OpenFile writes the files as the owner of the quota request in the context, if any. A file opened for writing with
+// O_TRUNC, as by PUT and COPY, is written to a temporary file, which replaces the file once it is closed.
+func (a *aferoFSWebdavAdapter) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if internalpath.Is(name) {
+		return nil, webdavNotExist("open", name)
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	notify := write && a.webhooks.Enabled()
+	existed := false
+	if notify {
+		_, err := a.fs.Stat(name)
+		existed = err == nil
+	}
+
+	fs := quota.WithContext(ctx, a.fs)
+	var f webdav.File
+	if write && flag&os.O_TRUNC != 0 && a.isFilePath(name) {
+		tf, err := tempfile.Create(fs, name, perm)
+		if err != nil {
+			return nil, err
+		}
+		f = &tempFile{File: tf, body: requestBodyFromContext(ctx)}
+	} else {
+		af, err := fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := af.Stat()
+		if err == nil && fi.IsDir() {
+			var d webdav.File = &webdavDir{File: af, name: name}
+			if qfs, ok := fs.(*quota.Fs); ok {
+				return &quotaDir{File: d, fs: qfs, dir: quota.TopDir(name)}, nil
+			}
+			return d, nil
+		}
+		f = af
+	}
+	if notify {
+		return newNotifyingFile(ctx, a, f, name, flag, existed), nil
+	}
+	return f, nil
+}
+
+// isFilePath reports whether a file can be written at the path, which is not a directory and is in an existing
+// directory. Otherwise, opening the path fails like on the file system.
+func (a *aferoFSWebdavAdapter) isFilePath(name string) bool {
+	if fi, err := a.fs.Stat(name); err == nil && fi.IsDir() {
+		return false
+	}
+	fi, err := a.fs.Stat(path.Dir(cleanWebhookPath(name)))
+	return err == nil && fi.IsDir()
 }
 
-func (a *aferoFSWebdavAdapter) RemoveAll(_ context.Context, name string) error {
-	return a.fs.RemoveAll(name)
+// RemoveAll notifies the webhooks of each file removed.
+func (a *aferoFSWebdavAdapter) RemoveAll(ctx context.Context, name string) error {
+	if internalpath.Is(name) {
+		return webdavNotExist("remove", name)
+	}
+	if !a.webhooks.Enabled() {
+		return a.fs.RemoveAll(name)
+	}
+
+	var events []webhook.Event
+	if err := afero.Walk(a.fs, name, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			events = append(events, webhook.Event{Type: webhook.EventFileDeleted, Path: cleanWebhookPath(p), Size: info.Size()})
+		}
+		return nil
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err := a.fs.RemoveAll(name); err != nil {
+		return err
+	}
+	for _, e := range events {
+		a.webhooks.Notify(ctx, e)
+	}
+	return nil
 }
 
-func (a *aferoFSWebdavAdapter) Rename(_ context.Context, oldName, newName string) error {
-	return a.fs.Rename(oldName, newName)
+func (a *aferoFSWebdavAdapter) Rename(ctx context.Context, oldName, newName string) error {
+	if internalpath.Is(oldName) {
+		return webdavNotExist("rename", oldName)
+	}
+	if internalpath.Is(newName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+	return quota.WithContext(ctx, a.fs).Rename(oldName, newName)
 }
 
 func (a *aferoFSWebdavAdapter) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	if internalpath.Is(name) {
+		return nil, webdavNotExist("stat", name)
+	}
 	return a.fs.Stat(name)
 }
+
+// webdavDir hides the internal directories at the root, and the temporary files in any directory.
+type webdavDir struct {
+	webdav.File
+	name string
+}
+
+func (d *webdavDir) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		infos, err := d.File.Readdir(count)
+		visible := infos[:0]
+		for _, info := range infos {
+			if !internalpath.Is(path.Join(d.name, info.Name())) {
+				visible = append(visible, info)
+			}
+		}
+		// Read on if only the internal paths are read, since no entries means the end of the directory.
+		if len(visible) == 0 && len(infos) > 0 && count > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
+
+type requestBodyKey struct{}
+
+// requestBody records the error of reading the request body.
+type requestBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Err returns the error of reading the request body, if any.
+func (b *requestBody) Err() error {
+	if b == nil {
+		return nil
+	}
+	return b.err
+}
+
+// NewRequestBodyContext returns the context carrying the request body, and the body to read instead, so the files
+// written from an incomplete body over WebDAV do not replace the existing ones.
+func NewRequestBodyContext(ctx context.Context, body io.ReadCloser) (context.Context, io.ReadCloser) {
+	b := &requestBody{ReadCloser: body}
+	return context.WithValue(ctx, requestBodyKey{}, b), b
+}
+
+func requestBodyFromContext(ctx context.Context) *requestBody {
+	b, _ := ctx.Value(requestBodyKey{}).(*requestBody)
+	return b
+}
+
+// tempFile replaces the file with the content written once it is closed, unless a write or the read of the request
+// body failed, so a failed upload leaves the file untouched.
+type tempFile struct {
+	*tempfile.File
+	body   *requestBody
+	failed error
+}
+
+func (f *tempFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.failed = err
+	}
+	return n, err
+}
+
+func (f *tempFile) Close() error {
+	err := f.failed
+	if err == nil {
+		err = f.body.Err()
+	}
+	if err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Commit()
+}
+
+// quotaDir reports the quota of the directory with the WebDAV properties of RFC 4331.
+// The used bytes are the usage of its top-level directory, and the available bytes are the least of
+// the quotas of the directory and the owner, or omitted if unlimited.
+type quotaDir struct {
+	webdav.File
+	fs  *quota.Fs
+	dir string
+}
+
+func (d *quotaDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	add := func(local string, v int64) {
+		name := xml.Name{Space: "DAV:", Local: local}
+		props[name] = webdav.Property{XMLName: name, InnerXML: []byte(strconv.FormatInt(v, 10))}
+	}
+
+	add("quota-used-bytes", d.fs.DirUsage(d.dir).Bytes)
+	if available := d.fs.Available(d.dir); available >= 0 {
+		add("quota-available-bytes", available)
+	}
+	return props, nil
+}
+
+// Patch rejects the changes of the properties, like the files without dead properties.
+func (d *quotaDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// cleanWebhookPath returns the path of the file relative to the root in slash form, like the paths of the API.
+func cleanWebhookPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// notifyingFile notifies the webhooks of the file once it is written and closed. The content written sequentially
+// from the start of the file is hashed on the fly, otherwise the file is read again to hash it.
+type notifyingFile struct {
+	webdav.File
+	ctx     context.Context
+	adapter *aferoFSWebdavAdapter
+	name    string
+	existed bool
+
+	// dirty reports whether the file is created, truncated or written.
+	dirty bool
+	// failed reports whether a write failed, e.g. when a quota is exceeded, so the file is left incomplete.
+	failed bool
+	// hash is the digest of the content written sequentially from the start, or nil once the file is written elsewhere.
+	hash   hash.Hash
+	offset int64
+}
+
+func newNotifyingFile(ctx context.Context, a *aferoFSWebdavAdapter, f webdav.File, name string, flag int, existed bool) *notifyingFile {
+	nf := &notifyingFile{
+		File:    f,
+		ctx:     ctx,
+		adapter: a,
+		name:    name,
+		existed: existed,
+		dirty:   !existed || flag&os.O_TRUNC != 0,
+	}
+	// Only a file starting empty is hashed entirely by its writes.
+	if nf.dirty && flag&os.O_APPEND == 0 {
+		nf.hash = sha256.New()
+	}
+	return nf
+}
+
+func (f *notifyingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.dirty = true
+	if err != nil {
+		f.failed = true
+	}
+	if f.hash != nil {
+		f.hash.Write(p[:n])
+		f.offset += int64(n)
+	}
+	return n, err
+}
+
+func (f *notifyingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if n > 0 {
+		f.hash = nil
+	}
+	return n, err
+}
+
+func (f *notifyingFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil && pos != f.offset {
+		f.hash = nil
+	}
+	return pos, err
+}
+
+func (f *notifyingFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if !f.dirty || f.failed {
+		return nil
+	}
+
+	e := webhook.Event{Type: webhook.EventFileUploaded, Path: cleanWebhookPath(f.name)}
+	if f.existed {
+		e.Type = webhook.EventFileOverwritten
+	}
+	if f.hash != nil {
+		e.Size, e.SHA256 = f.offset, hex.EncodeToString(f.hash.Sum(nil))
+	} else {
+		af, err := f.adapter.fs.Open(f.name)
+		if err != nil {
+			return err
+		}
+		defer af.Close()
+		h := sha256.New()
+		if e.Size, err = io.Copy(h, af); err != nil {
+			return err
+		}
+		e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	f.adapter.webhooks.Notify(f.ctx, e)
+	return nil
+}
@@ -0,0 +1,377 @@
+// Package crypt encrypts the files at rest with AES-256-GCM in chunks, so they can be read and written at any offset.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+)
+
+// The layout of an encrypted file is the header followed by the chunks.
+// Each chunk is a random nonce, the ciphertext of up to chunkSize bytes and the tag.
+//
+//	magic[6] version[1] reserved[1] keyID[8] fileID[16] chunkSize[4] wrappedKey[60]
+const (
+	magic          = "SFSENC"
+	version        = 1
+	headerSize     = 96
+	dataKeySize    = 32
+	nonceSize      = 12
+	tagSize        = 16
+	chunkOverhead  = nonceSize + tagSize
+	wrappedKeySize = nonceSize + dataKeySize + tagSize
+
+	// DefaultChunkSize is the plaintext size of the chunks of new files.
+	DefaultChunkSize = 64 * 1024
+
+	// tmpSuffix is the suffix of the temporary files encrypting the existing plaintext files.
+	tmpSuffix = ".sfs-encrypt"
+)
+
+var (
+	ErrNotEncrypted = errors.New("file is not encrypted")
+	ErrCorrupted    = errors.New("encrypted file is corrupted")
+)
+
+var randRead = rand.Read
+
+// header is the decoded header of an encrypted file.
+type header struct {
+	keyID     keyID
+	fileID    [16]byte
+	chunkSize int64
+	wrapped   []byte
+	aead      cipher.AEAD
+}
+
+// aad returns the additional data authenticating the data key, which is the header except the wrapping key.
+func (h *header) aad() []byte {
+	b := make([]byte, 0, 28)
+	b = append(b, magic...)
+	b = append(b, version, 0)
+	b = append(b, h.fileID[:]...)
+	return binary.BigEndian.AppendUint32(b, uint32(h.chunkSize))
+}
+
+func (h *header) encode() []byte {
+	b := make([]byte, 0, headerSize)
+	b = append(b, magic...)
+	b = append(b, version, 0)
+	b = append(b, h.keyID[:]...)
+	b = append(b, h.fileID[:]...)
+	b = binary.BigEndian.AppendUint32(b, uint32(h.chunkSize))
+	return append(b, h.wrapped...)
+}
+
+// chunkAAD returns the additional data authenticating a chunk, which binds it to the file, its index, and whether it is the last one,
+// so the chunks cannot be reordered, moved between files, or truncated.
+func (h *header) chunkAAD(idx int64, final bool) []byte {
+	b := make([]byte, 0, 25)
+	b = append(b, h.fileID[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(idx))
+	if final {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func newDataCipher(dek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader generates the header of a new file with a new data key.
+func newHeader(r *Keyring, chunkSize int64) (*header, error) {
+	h := &header{chunkSize: chunkSize}
+	if _, err := randRead(h.fileID[:]); err != nil {
+		return nil, err
+	}
+	dek := make([]byte, dataKeySize)
+	if _, err := randRead(dek); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if h.keyID, h.wrapped, err = r.wrap(dek, h.aad()); err != nil {
+		return nil, err
+	}
+	if h.aead, err = newDataCipher(dek); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// isEncrypted reports whether the bytes start with the magic of an encrypted file.
+func isEncrypted(b []byte) bool {
+	return len(b) >= len(magic)+1 && string(b[:len(magic)]) == magic && b[len(magic)] == version
+}
+
+// parseHeader decodes the header, and unwraps the data key with the keyring.
+func parseHeader(b []byte, r *Keyring) (*header, error) {
+	if len(b) < headerSize || !isEncrypted(b) {
+		return nil, ErrNotEncrypted
+	}
+	h := &header{
+		chunkSize: int64(binary.BigEndian.Uint32(b[32:36])),
+		wrapped:   bytes.Clone(b[36:headerSize]),
+	}
+	copy(h.keyID[:], b[8:16])
+	copy(h.fileID[:], b[16:32])
+	if h.chunkSize <= 0 {
+		return nil, ErrCorrupted
+	}
+
+	dek, err := r.unwrap(h.keyID, h.wrapped, h.aad())
+	if err != nil {
+		return nil, err
+	}
+	if h.aead, err = newDataCipher(dek); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// plaintextSize returns the size of the content of an encrypted file of the size.
+func plaintextSize(size int64, chunkSize int64) int64 {
+	body := size - headerSize
+	if body <= 0 {
+		return 0
+	}
+	full, rem := body/(chunkSize+chunkOverhead), body%(chunkSize+chunkOverhead)
+	return full*chunkSize + max(rem-chunkOverhead, 0)
+}
+
+// Fs encrypts the files of the underlying afero.Fs. Every file is written through it,
+// so the sizes of the contents are known from the sizes of the encrypted files.
+type Fs struct {
+	afero.Fs
+	logger    zerolog.Logger
+	keys      *Keyring
+	chunkSize int64
+}
+
+// New returns the Fs on the files of base. The existing plaintext files are encrypted,
+// and the data keys wrapped by a previous master key are wrapped again by the current one.
+func New(base afero.Fs, keys *Keyring) (*Fs, error) {
+	f := &Fs{
+		Fs:        base,
+		logger:    log.With().Str("logger", "cryptFs").Logger(),
+		keys:      keys,
+		chunkSize: DefaultChunkSize,
+	}
+
+	var encrypted, rewrapped int
+	if err := afero.Walk(base, ".", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(p, tmpSuffix) {
+			return base.Remove(p)
+		}
+
+		done, err := f.migrate(p, info)
+		if err != nil {
+			return err
+		}
+		switch done {
+		case migrateEncrypted:
+			encrypted++
+		case migrateRewrapped:
+			rewrapped++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if encrypted > 0 || rewrapped > 0 {
+		f.logger.Info().Int("encrypted", encrypted).Int("rewrapped", rewrapped).Msg("files migrated to the current master key")
+	}
+
+	return f, nil
+}
+
+type migration int
+
+const (
+	migrateNone migration = iota
+	migrateEncrypted
+	migrateRewrapped
+)
+
+// migrate encrypts the plaintext file, or wraps the data key of the encrypted file by the current master key.
+func (f *Fs) migrate(name string, info fs.FileInfo) (migration, error) {
+	af, err := f.Fs.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return migrateNone, err
+	}
+	defer af.Close()
+
+	b := make([]byte, headerSize)
+	n, err := io.ReadFull(af, b)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return migrateNone, err
+	}
+	if n == 0 {
+		return migrateNone, nil
+	}
+
+	if !isEncrypted(b[:n]) {
+		if err := f.encrypt(name, af, info); err != nil {
+			return migrateNone, err
+		}
+		return migrateEncrypted, nil
+	}
+
+	h, err := parseHeader(b, f.keys)
+	if err != nil {
+		return migrateNone, err
+	}
+	if h.keyID == f.keys.current.id {
+		return migrateNone, nil
+	}
+
+	dek, err := f.keys.unwrap(h.keyID, h.wrapped, h.aad())
+	if err != nil {
+		return migrateNone, err
+	}
+	if h.keyID, h.wrapped, err = f.keys.wrap(dek, h.aad()); err != nil {
+		return migrateNone, err
+	}
+	if _, err := af.WriteAt(h.encode(), 0); err != nil {
+		return migrateNone, err
+	}
+	return migrateRewrapped, nil
+}
+
+// encrypt replaces the plaintext file with an encrypted copy.
+func (f *Fs) encrypt(name string, src afero.File, info fs.FileInfo) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+tmpSuffix)
+	dst, err := f.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		f.Fs.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		f.Fs.Remove(tmp)
+		return err
+	}
+
+	if err := f.Fs.Rename(tmp, name); err != nil {
+		return err
+	}
+	return f.Fs.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	// The chunks are read to be modified, and appended at the end by the file itself.
+	baseFlag := flag &^ (os.O_WRONLY | os.O_APPEND)
+	if writable {
+		baseFlag |= os.O_RDWR
+	}
+	af, err := f.Fs.OpenFile(name, baseFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := af.Stat()
+	if err != nil {
+		af.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &dir{File: af, fs: f}, nil
+	}
+
+	ef := &file{
+		File:     af,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}
+	if err := ef.init(f, info.Size()); err != nil {
+		af.Close()
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return ef, nil
+}
+
+// init reads the header of the file, or writes a new one to an empty file.
+func (ef *file) init(f *Fs, size int64) error {
+	if size == 0 {
+		if !ef.writable {
+			return nil
+		}
+		h, err := newHeader(f.keys, f.chunkSize)
+		if err != nil {
+			return err
+		}
+		if _, err := ef.File.WriteAt(h.encode(), 0); err != nil {
+			return err
+		}
+		ef.h = h
+		return nil
+	}
+
+	b := make([]byte, headerSize)
+	if _, err := ef.File.ReadAt(b, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return ErrNotEncrypted
+		}
+		return err
+	}
+	h, err := parseHeader(b, f.keys)
+	if err != nil {
+		return err
+	}
+	ef.h = h
+	ef.size = plaintextSize(size, h.chunkSize)
+	return nil
+}
+
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	info, err := f.Fs.Stat(name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	return &fileInfo{FileInfo: info, size: plaintextSize(info.Size(), f.chunkSize)}, nil
+}
+
+func (f *Fs) Name() string {
+	return "crypt(" + f.Fs.Name() + ")"
+}
@@ -0,0 +1,188 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+)
+
+func newKey() []byte {
+	k := make([]byte, 32)
+	rand.Read(k)
+	return k
+}
+
+func TestFs(t *testing.T) {
+	Convey("Given an encrypting file system with small chunks", t, func() {
+		base := afero.NewMemMapFs()
+		key := newKey()
+		keys, err := NewKeyring(key)
+		So(err, ShouldBeNil)
+		efs, err := New(base, keys)
+		So(err, ShouldBeNil)
+		efs.chunkSize = 16
+
+		content := make([]byte, 100)
+		rand.Read(content)
+		So(afero.WriteFile(efs, "a.bin", content, 0644), ShouldBeNil)
+
+		Convey("The content should be encrypted", func() {
+			raw, err := afero.ReadFile(base, "a.bin")
+			So(err, ShouldBeNil)
+			So(bytes.Contains(raw, content[:16]), ShouldBeFalse)
+			So(int64(len(raw)), ShouldEqual, headerSize+7*chunkOverhead+100)
+		})
+
+		Convey("The plaintext size should be reported", func() {
+			info, err := efs.Stat("a.bin")
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, 100)
+
+			infos, err := afero.ReadDir(efs, "/")
+			So(err, ShouldBeNil)
+			So(infos[0].Size(), ShouldEqual, 100)
+		})
+
+		Convey("It should be read at any offset", func() {
+			f, err := efs.Open("a.bin")
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			b := make([]byte, 30)
+			n, err := f.ReadAt(b, 10)
+			So(err, ShouldBeNil)
+			So(b[:n], ShouldResemble, content[10:40])
+
+			n, err = f.ReadAt(b, 90)
+			So(err, ShouldEqual, io.EOF)
+			So(b[:n], ShouldResemble, content[90:])
+		})
+
+		Convey("Range requests should be served", func() {
+			f, err := efs.Open("a.bin")
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			r := httptest.NewRequest(http.MethodGet, "/a.bin", nil)
+			r.Header.Set("Range", "bytes=20-49")
+			w := httptest.NewRecorder()
+			http.ServeContent(w, r, "a.bin", time.Time{}, f)
+			So(w.Code, ShouldEqual, http.StatusPartialContent)
+			So(w.Body.Bytes(), ShouldResemble, content[20:50])
+		})
+
+		Convey("Random writes should be read back", func() {
+			want := bytes.Clone(content)
+			f, err := efs.OpenFile("a.bin", os.O_RDWR, 0)
+			So(err, ShouldBeNil)
+
+			for range 50 {
+				off := mathrand.IntN(len(want) + 20)
+				p := make([]byte, mathrand.IntN(40))
+				rand.Read(p)
+				_, err := f.WriteAt(p, int64(off))
+				So(err, ShouldBeNil)
+				if end := off + len(p); end > len(want) {
+					want = append(want, make([]byte, end-len(want))...)
+				}
+				copy(want[off:], p)
+			}
+			So(f.Truncate(int64(len(want)-5)), ShouldBeNil)
+			want = want[:len(want)-5]
+			So(f.Close(), ShouldBeNil)
+
+			got, err := afero.ReadFile(efs, "a.bin")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, want)
+		})
+
+		Convey("Appending should write at the end", func() {
+			f, err := efs.OpenFile("a.bin", os.O_WRONLY|os.O_APPEND, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("tail"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			got, err := afero.ReadFile(efs, "a.bin")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, append(bytes.Clone(content), "tail"...))
+		})
+
+		Convey("Modified ciphertext should be rejected", func() {
+			raw, _ := afero.ReadFile(base, "a.bin")
+			raw[headerSize+chunkOverhead+20] ^= 1
+			So(afero.WriteFile(base, "a.bin", raw, 0644), ShouldBeNil)
+
+			_, err := afero.ReadFile(efs, "a.bin")
+			So(err, ShouldEqual, ErrCorrupted)
+		})
+
+		Convey("Ciphertext truncated at a chunk should be rejected", func() {
+			f, err := base.OpenFile("a.bin", os.O_RDWR, 0)
+			So(err, ShouldBeNil)
+			So(f.Truncate(headerSize+3*(16+chunkOverhead)), ShouldBeNil)
+			f.Close()
+
+			_, err = afero.ReadFile(efs, "a.bin")
+			So(err, ShouldEqual, ErrCorrupted)
+		})
+
+		Convey("Rotating the master key should wrap the data keys again", func() {
+			newKey := newKey()
+			rotated, err := NewKeyring(newKey, key)
+			So(err, ShouldBeNil)
+			_, err = New(base, rotated)
+			So(err, ShouldBeNil)
+
+			// The previous key is no longer required.
+			rotated, err = NewKeyring(newKey)
+			So(err, ShouldBeNil)
+			efs, err := New(base, rotated)
+			So(err, ShouldBeNil)
+			efs.chunkSize = 16
+			got, err := afero.ReadFile(efs, "a.bin")
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, content)
+		})
+
+		Convey("A file encrypted by an unknown key should not be opened", func() {
+			other, err := NewKeyring(newKey())
+			So(err, ShouldBeNil)
+			_, err = New(base, other)
+			So(err, ShouldWrap, ErrKeyNotFound)
+		})
+	})
+
+	Convey("Given plaintext files", t, func() {
+		base := afero.NewMemMapFs()
+		So(afero.WriteFile(base, "dir/plain.txt", []byte("hello"), 0644), ShouldBeNil)
+
+		Convey("They should be encrypted on start", func() {
+			keys, err := NewKeyring(newKey())
+			So(err, ShouldBeNil)
+			efs, err := New(base, keys)
+			So(err, ShouldBeNil)
+
+			raw, err := afero.ReadFile(base, "dir/plain.txt")
+			So(err, ShouldBeNil)
+			So(isEncrypted(raw), ShouldBeTrue)
+
+			got, err := afero.ReadFile(efs, "dir/plain.txt")
+			So(err, ShouldBeNil)
+			So(string(got), ShouldEqual, "hello")
+
+			infos, err := afero.ReadDir(base, "dir")
+			So(err, ShouldBeNil)
+			So(len(infos), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,273 @@
+package crypt
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// fileInfo is the info of an encrypted file with the size of its content.
+type fileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+// dir reports the sizes of the contents of the files in the directory.
+type dir struct {
+	afero.File
+	fs *Fs
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, info := range infos {
+		if !info.IsDir() {
+			infos[i] = &fileInfo{FileInfo: info, size: plaintextSize(info.Size(), d.fs.chunkSize)}
+		}
+	}
+	return infos, err
+}
+
+// file decrypts the chunks to read, and encrypts the chunks again after modifying them.
+// The last decrypted chunk is kept, so small sequential reads and writes decrypt each chunk once.
+type file struct {
+	afero.File
+	h        *header
+	writable bool
+	append   bool
+	size     int64
+	pos      int64
+
+	cacheIdx   int64
+	cacheChunk []byte
+	cached     bool
+}
+
+// lastIndex returns the index of the last chunk of the content of the size, or -1 if it is empty.
+func (f *file) lastIndex(size int64) int64 {
+	if size == 0 {
+		return -1
+	}
+	return (size - 1) / f.h.chunkSize
+}
+
+func (f *file) chunkOffset(idx int64) int64 {
+	return headerSize + idx*(f.h.chunkSize+chunkOverhead)
+}
+
+// chunkLen returns the plaintext size of the chunk in the content of the size.
+func (f *file) chunkLen(idx int64, size int64) int64 {
+	return min(f.h.chunkSize, size-idx*f.h.chunkSize)
+}
+
+// readChunk returns the plaintext of the chunk. The returned slice must not be modified.
+func (f *file) readChunk(idx int64) ([]byte, error) {
+	if f.cached && f.cacheIdx == idx {
+		return f.cacheChunk, nil
+	}
+
+	n := f.chunkLen(idx, f.size)
+	b := make([]byte, n+chunkOverhead)
+	if _, err := f.File.ReadAt(b, f.chunkOffset(idx)); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	plain, err := f.h.aead.Open(nil, b[:nonceSize], b[nonceSize:], f.h.chunkAAD(idx, idx == f.lastIndex(f.size)))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+
+	f.cacheIdx, f.cacheChunk, f.cached = idx, plain, true
+	return plain, nil
+}
+
+// writeChunk encrypts and writes the plaintext of the chunk, which is the last one if final.
+func (f *file) writeChunk(idx int64, plain []byte, final bool) error {
+	b := make([]byte, nonceSize, nonceSize+len(plain)+tagSize)
+	if _, err := randRead(b); err != nil {
+		return err
+	}
+	b = f.h.aead.Seal(b, b, plain, f.h.chunkAAD(idx, final))
+	if _, err := f.File.WriteAt(b, f.chunkOffset(idx)); err != nil {
+		f.cached = false
+		return err
+	}
+
+	f.cacheIdx, f.cacheChunk, f.cached = idx, plain, true
+	return nil
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.Name(), Err: fs.ErrInvalid}
+	}
+
+	n := 0
+	for n < len(p) {
+		if off >= f.size {
+			return n, io.EOF
+		}
+		idx := off / f.h.chunkSize
+		plain, err := f.readChunk(idx)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], plain[off-idx*f.h.chunkSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if n > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.Name(), Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// reseal writes the chunk again, since whether it is the last one changes.
+func (f *file) reseal(idx int64, final bool) error {
+	plain, err := f.readChunk(idx)
+	if err != nil {
+		return err
+	}
+	return f.writeChunk(idx, plain, final)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.Name(), Err: fs.ErrPermission}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.Name(), Err: fs.ErrInvalid}
+	}
+
+	// Fill the gap with zeros, as the file system does.
+	if off > f.size {
+		zeros := make([]byte, min(off-f.size, f.h.chunkSize))
+		for f.size < off {
+			if _, err := f.WriteAt(zeros[:min(off-f.size, int64(len(zeros)))], f.size); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(p))
+	newSize := max(f.size, end)
+	first, last := off/f.h.chunkSize, (end-1)/f.h.chunkSize
+	newLast := f.lastIndex(newSize)
+
+	// The previous last chunk is no longer the last one.
+	if oldLast := f.lastIndex(f.size); oldLast >= 0 && oldLast < first {
+		if err := f.reseal(oldLast, false); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	for idx := first; idx <= last; idx++ {
+		start := idx * f.h.chunkSize
+		chunk := make([]byte, f.chunkLen(idx, newSize))
+		if existing := f.chunkLen(idx, f.size); existing > 0 {
+			plain, err := f.readChunk(idx)
+			if err != nil {
+				return n, err
+			}
+			copy(chunk, plain)
+		}
+		c := copy(chunk[max(off-start, 0):], p[n:])
+		if err := f.writeChunk(idx, chunk, idx == newLast); err != nil {
+			return n, err
+		}
+		n += c
+		f.size = max(f.size, start+int64(len(chunk)))
+	}
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if f.append {
+		f.pos = f.size
+	}
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Truncate(size int64) error {
+	if !f.writable {
+		return &fs.PathError{Op: "truncate", Path: f.Name(), Err: fs.ErrPermission}
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.Name(), Err: fs.ErrInvalid}
+	}
+	if size >= f.size {
+		if size > f.size {
+			_, err := f.WriteAt(nil, size)
+			return err
+		}
+		return nil
+	}
+
+	idx := f.lastIndex(size)
+	if idx < 0 {
+		f.size, f.cached = 0, false
+		return f.File.Truncate(headerSize)
+	}
+
+	plain, err := f.readChunk(idx)
+	if err != nil {
+		return err
+	}
+	plain = plain[:f.chunkLen(idx, size)]
+	if err := f.File.Truncate(f.chunkOffset(idx)); err != nil {
+		f.cached = false
+		return err
+	}
+	f.size = size
+	return f.writeChunk(idx, plain, true)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{FileInfo: info, size: f.size}, nil
+}
@@ -0,0 +1,125 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrKeyInvalid  = errors.New("master key must be 32 bytes, optionally encoded in hex or base64")
+	ErrKeyNotFound = errors.New("master key of the file not found")
+)
+
+type keyID [8]byte
+
+func (id keyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+type masterKey struct {
+	id   keyID
+	aead cipher.AEAD
+}
+
+// Keyring is the master keys wrapping the data keys of the files.
+// The data keys of new files are wrapped by the current key, and the previous keys can still unwrap them.
+type Keyring struct {
+	current *masterKey
+	keys    map[keyID]*masterKey
+}
+
+// parseKey decodes a 32-byte AES-256 key from raw bytes, hex or base64.
+func parseKey(b []byte) ([]byte, error) {
+	if len(b) == 32 {
+		return b, nil
+	}
+	s := string(bytes.TrimSpace(b))
+	if k, err := hex.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, ErrKeyInvalid
+}
+
+func newMasterKey(key []byte) (*masterKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: keyID(sum[:8]), aead: aead}, nil
+}
+
+// NewKeyring returns the keyring of the current key and the previous keys.
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	r := &Keyring{keys: make(map[keyID]*masterKey)}
+	for i, b := range append([][]byte{current}, previous...) {
+		key, err := parseKey(b)
+		if err != nil {
+			return nil, err
+		}
+		k, err := newMasterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			r.current = k
+		}
+		r.keys[k.id] = k
+	}
+	return r, nil
+}
+
+// LoadKeyring reads the current key and the previous keys from the key files.
+func LoadKeyring(currentFile string, previousFiles ...string) (*Keyring, error) {
+	current, err := os.ReadFile(currentFile)
+	if err != nil {
+		return nil, err
+	}
+	previous := make([][]byte, 0, len(previousFiles))
+	for _, name := range previousFiles {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, b)
+	}
+
+	r, err := NewKeyring(current, previous...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file: %w", err)
+	}
+	return r, nil
+}
+
+// wrap encrypts the data key with the current key, and returns the ID of the key with the nonce and the ciphertext.
+func (r *Keyring) wrap(dek []byte, aad []byte) (keyID, []byte, error) {
+	nonce := make([]byte, r.current.aead.NonceSize(), wrappedKeySize)
+	if _, err := randRead(nonce); err != nil {
+		return keyID{}, nil, err
+	}
+	return r.current.id, r.current.aead.Seal(nonce, nonce, dek, aad), nil
+}
+
+// unwrap decrypts the data key wrapped by the key of the ID.
+func (r *Keyring) unwrap(id keyID, wrapped []byte, aad []byte) ([]byte, error) {
+	k, ok := r.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, id)
+	}
+	n := k.aead.NonceSize()
+	return k.aead.Open(nil, wrapped[:n], wrapped[n:], aad)
+}
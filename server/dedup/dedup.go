@@ -0,0 +1,716 @@
+// Package dedup stores the content of the files once under its SHA-256 digest.
+package dedup
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+)
+
+const (
+	// BlobDir is the hidden directory at the root keeping the blobs, which is not visible through the Fs.
+	BlobDir = internalpath.Blobs
+	tmpDir  = BlobDir + "/.tmp"
+	// keyPath keeps the key authenticating the reference files.
+	keyPath = BlobDir + "/key"
+
+	refPrefix = "sfs-blob sha256:"
+)
+
+var (
+	// refSize is the size of every reference file, which is the prefix, the digest, the size, the MAC and a newline.
+	refSize = int64(len(refPrefix) + sha256.Size*2 + 1 + 20 + 1 + sha256.Size*2 + 1)
+	// legacyRefSize is the size of the reference files written before they were authenticated, without the MAC.
+	legacyRefSize = int64(len(refPrefix) + sha256.Size*2 + 1 + 20 + 1)
+)
+
+// ref is the content of a reference file, pointing to the blob of the content of the file.
+type ref struct {
+	sum  string
+	size int64
+}
+
+// parseRef parses the content of a reference file, and returns its MAC, which is empty for a legacy one.
+func parseRef(b []byte) (ref, string, bool) {
+	s, ok := strings.CutPrefix(string(b), refPrefix)
+	if !ok || (int64(len(b)) != refSize && int64(len(b)) != legacyRefSize) || !strings.HasSuffix(s, "\n") {
+		return ref{}, "", false
+	}
+	fields := strings.Split(strings.TrimSuffix(s, "\n"), " ")
+	if len(fields) < 2 || len(fields) > 3 || len(fields[0]) != sha256.Size*2 {
+		return ref{}, "", false
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return ref{}, "", false
+	}
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || n < 0 {
+		return ref{}, "", false
+	}
+	var mac string
+	if len(fields) == 3 {
+		mac = fields[2]
+	}
+	return ref{sum: fields[0], size: n}, mac, true
+}
+
+// mac authenticates the reference, so a file which only looks like a reference file, such as one uploaded by a user,
+// is never taken for one.
+func (f *Fs) mac(r ref) string {
+	h := hmac.New(sha256.New, f.key)
+	fmt.Fprintf(h, "%s %d", r.sum, r.size)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// marshalRef returns the content of the reference file of the reference.
+func (f *Fs) marshalRef(r ref) []byte {
+	return []byte(fmt.Sprintf("%s%s %020d %s\n", refPrefix, r.sum, r.size, f.mac(r)))
+}
+
+// loadKey reads the key of the reference files, or creates it. It reports whether the key is created, in which case
+// the existing reference files are legacy ones without a MAC.
+func loadKey(base afero.Fs) ([]byte, bool, error) {
+	b, err := afero.ReadFile(base, keyPath)
+	if err == nil {
+		key := make([]byte, hex.DecodedLen(len(b)))
+		if _, err := hex.Decode(key, b); err != nil || len(key) != sha256.Size {
+			return nil, false, fmt.Errorf("invalid key of reference files '%s'", keyPath)
+		}
+		return key, false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, false, err
+	}
+
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	if err := base.MkdirAll(BlobDir, 0755); err != nil {
+		return nil, false, err
+	}
+	if err := afero.WriteFile(base, keyPath, []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// isBlobPath reports whether the path is in the blob directory.
+func isBlobPath(name string) bool {
+	p := internalpath.Clean(name)
+	return p == BlobDir || strings.HasPrefix(p, BlobDir+"/")
+}
+
+// isHidden reports whether the path is internal, such as in ".tus".
+// New files there are written as they are, because they are usually temporary.
+func isHidden(name string) bool {
+	return internalpath.Is(name)
+}
+
+func blobPath(sum string) string {
+	return path.Join(BlobDir, sum[:2], sum)
+}
+
+type blob struct {
+	size int64
+	refs int64
+}
+
+// Fs keeps the content of the files of the underlying afero.Fs in the blob directory,
+// and the files at their paths are references to the blobs.
+// A blob is removed once the last file referencing it is removed or overwritten.
+type Fs struct {
+	afero.Fs
+	logger zerolog.Logger
+	key    []byte
+
+	mu    sync.Mutex
+	blobs map[string]*blob
+}
+
+// New returns the Fs on the files of base. The references of the existing files are counted,
+// and the blobs no longer referenced are removed. The existing files which are not references are kept as they are.
+// On the first start with the authenticated references, the legacy ones are authenticated.
+func New(base afero.Fs) (*Fs, error) {
+	key, created, err := loadKey(base)
+	if err != nil {
+		return nil, err
+	}
+	f := &Fs{
+		Fs:     base,
+		logger: log.With().Str("logger", "dedupFs").Logger(),
+		key:    key,
+		blobs:  make(map[string]*blob),
+	}
+
+	if err := afero.Walk(base, ".", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if isBlobPath(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if created {
+			if r, ok := f.readLegacyRef(p, info); ok {
+				if err := f.writeRef(p, r, info.Mode().Perm()); err != nil {
+					return err
+				}
+				f.acquire(r)
+				return nil
+			}
+		}
+		if r, ok := f.readRef(p, info); ok {
+			f.acquire(r)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Remove the incomplete writes and the blobs of the files removed while the server was down.
+	if err := base.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := afero.Walk(base, BlobDir, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || p == keyPath {
+			return nil
+		}
+		if _, ok := f.blobs[info.Name()]; !ok {
+			return base.Remove(p)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for sum := range f.blobs {
+		if _, err := base.Stat(blobPath(sum)); err != nil {
+			f.logger.Warn().Err(err).Str("sum", sum).Msg("blob of referenced files is missing")
+		}
+	}
+
+	return f, nil
+}
+
+// RegisterMetrics reports the stored and the saved bytes of the blobs.
+func (f *Fs) RegisterMetrics(meter metric.Meter) error {
+	stored, err := meter.Int64ObservableGauge("dedup.stored", metric.WithUnit("By"), metric.WithDescription("Bytes of the blobs stored once for the identical files."))
+	if err != nil {
+		return err
+	}
+	saved, err := meter.Int64ObservableGauge("dedup.saved", metric.WithUnit("By"), metric.WithDescription("Bytes saved by storing the identical files once."))
+	if err != nil {
+		return err
+	}
+	blobs, err := meter.Int64ObservableGauge("dedup.blobs", metric.WithDescription("Number of the blobs."))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		u := f.Usage()
+		o.ObserveInt64(stored, u.Stored)
+		o.ObserveInt64(saved, u.Logical-u.Stored)
+		o.ObserveInt64(blobs, u.Blobs)
+		return nil
+	}, stored, saved, blobs)
+	return err
+}
+
+type Usage struct {
+	// Blobs is the number of the blobs.
+	Blobs int64
+	// Stored is the bytes of the blobs.
+	Stored int64
+	// Logical is the bytes of the files referencing the blobs.
+	Logical int64
+}
+
+// Usage returns the usage of the blobs.
+func (f *Fs) Usage() Usage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var u Usage
+	for _, b := range f.blobs {
+		u.Blobs++
+		u.Stored += b.size
+		u.Logical += b.size * b.refs
+	}
+	return u
+}
+
+// readFileOfSize returns the content of the file, if it is a regular file of the size.
+func (f *Fs) readFileOfSize(name string, info fs.FileInfo, size int64) ([]byte, bool) {
+	if info.IsDir() || info.Size() != size {
+		return nil, false
+	}
+	af, err := f.Fs.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer af.Close()
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(af, b); err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// readRef returns the reference of the file, if it is a reference file written by the Fs. A file with the content of
+// a reference file but without its MAC, such as one uploaded by a user, is an ordinary file.
+func (f *Fs) readRef(name string, info fs.FileInfo) (ref, bool) {
+	b, ok := f.readFileOfSize(name, info, refSize)
+	if !ok {
+		return ref{}, false
+	}
+	r, mac, ok := parseRef(b)
+	if !ok || !hmac.Equal([]byte(mac), []byte(f.mac(r))) {
+		return ref{}, false
+	}
+	return r, true
+}
+
+// readLegacyRef returns the reference of the file, if it is a reference file written before they were authenticated.
+func (f *Fs) readLegacyRef(name string, info fs.FileInfo) (ref, bool) {
+	b, ok := f.readFileOfSize(name, info, legacyRefSize)
+	if !ok {
+		return ref{}, false
+	}
+	r, mac, ok := parseRef(b)
+	return r, ok && mac == ""
+}
+
+// statRef returns the info of the file and its reference, if it is a reference file.
+func (f *Fs) statRef(name string) (fs.FileInfo, ref, bool, error) {
+	info, err := f.Fs.Stat(name)
+	if err != nil {
+		return nil, ref{}, false, err
+	}
+	r, ok := f.readRef(name, info)
+	return info, r, ok, nil
+}
+
+// acquire adds a reference to the blob. The caller must hold the lock, or own f exclusively.
+func (f *Fs) acquire(r ref) {
+	b, ok := f.blobs[r.sum]
+	if !ok {
+		b = &blob{size: r.size}
+		f.blobs[r.sum] = b
+	}
+	b.refs++
+}
+
+// release removes a reference to the blob, and removes the blob if it is the last one.
+// The caller must hold the lock.
+func (f *Fs) release(r ref) {
+	b, ok := f.blobs[r.sum]
+	if !ok {
+		return
+	}
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	delete(f.blobs, r.sum)
+	if err := f.Fs.Remove(blobPath(r.sum)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		f.logger.Warn().Err(err).Str("sum", r.sum).Msg("failed to remove blob")
+	}
+}
+
+// createTemp creates a file in the temporary directory of the blobs, and returns it with its path.
+func (f *Fs) createTemp() (afero.File, string, error) {
+	if err := f.Fs.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, "", err
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	name := path.Join(tmpDir, hex.EncodeToString(b))
+	af, err := f.Fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, "", err
+	}
+	return af, name, nil
+}
+
+// store moves the temporary file with the content to its blob, and makes the file at the path a reference to it.
+// The blob replaced at the path is released.
+func (f *Fs) store(name string, tmp string, r ref, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.blobs[r.sum]; ok {
+		if err := f.Fs.Remove(tmp); err != nil {
+			return err
+		}
+	} else {
+		if err := f.Fs.MkdirAll(path.Dir(blobPath(r.sum)), 0755); err != nil {
+			return err
+		}
+		if err := f.Fs.Rename(tmp, blobPath(r.sum)); err != nil {
+			return err
+		}
+	}
+	return f.putRef(name, r, perm)
+}
+
+// putRef makes the file at the path a reference to the blob, and releases the blob it replaces.
+// The caller must hold the lock.
+func (f *Fs) putRef(name string, r ref, perm os.FileMode) error {
+	var old ref
+	var replaced bool
+	if info, err := f.Fs.Stat(name); err == nil {
+		old, replaced = f.readRef(name, info)
+	}
+
+	f.acquire(r)
+	if err := f.writeRef(name, r, perm); err != nil {
+		f.release(r)
+		return err
+	}
+	if replaced {
+		f.release(old)
+	}
+	return nil
+}
+
+// writeRef writes the reference file at the path through a temporary file, so a reader or a crash never sees it
+// partially written, which would fail the MAC check.
+func (f *Fs) writeRef(name string, r ref, perm os.FileMode) error {
+	tf, err := tempfile.Create(f.Fs, name, perm)
+	if err != nil {
+		return err
+	}
+	defer tf.Close()
+
+	if _, err := tf.Write(f.marshalRef(r)); err != nil {
+		return err
+	}
+	return tf.Commit()
+}
+
+// ingest stores the content of the regular file at the old path as a blob,
+// and makes the file at the new path a reference to it.
+func (f *Fs) ingest(oldName string, newName string, info fs.FileInfo) error {
+	af, err := f.Fs.Open(oldName)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, af)
+	af.Close()
+	if err != nil {
+		return err
+	}
+
+	return f.store(newName, oldName, ref{sum: hex.EncodeToString(h.Sum(nil)), size: size}, info.Mode().Perm())
+}
+
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	if isBlobPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.Mkdir(name, perm)
+}
+
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	if isBlobPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.MkdirAll(name, perm)
+}
+
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if isBlobPath(name) {
+		return nil, notExist("open", name)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return f.openWrite(name, flag, perm)
+	}
+
+	info, r, ok, err := f.statRef(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		af, err := f.Fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return &dir{File: af, fs: f, name: name}, nil
+		}
+		return af, nil
+	}
+
+	af, err := f.Fs.Open(blobPath(r.sum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob of %s: %w", name, err)
+	}
+	return &readFile{File: af, name: name, info: &fileInfo{FileInfo: info, size: r.size}}, nil
+}
+
+// openWrite opens a temporary file with the content of the file, which is stored as a blob on close.
+func (f *Fs) openWrite(name string, flag int, perm os.FileMode) (afero.File, error) {
+	info, r, ok, err := f.statRef(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if (info != nil && info.IsDir()) || (isHidden(name) && !ok) {
+		return f.Fs.OpenFile(name, flag, perm)
+	}
+
+	if info == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, notExist("open", name)
+		}
+		// Create the file as the underlying file system does, so it is visible while writing.
+		af, err := f.Fs.OpenFile(name, flag|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return nil, err
+		}
+		af.Close()
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+
+	tmp, tmpName, err := f.createTemp()
+	if err != nil {
+		return nil, err
+	}
+
+	wf := &writeFile{
+		File:       tmp,
+		fs:         f,
+		name:       name,
+		tmp:        tmpName,
+		perm:       perm,
+		hash:       sha256.New(),
+		sequential: true,
+		append:     flag&os.O_APPEND != 0,
+	}
+	if info != nil && perm == 0 {
+		wf.perm = info.Mode().Perm()
+	}
+
+	// Copy the content to modify it, unless it is truncated.
+	if info != nil && flag&os.O_TRUNC == 0 {
+		src := name
+		if ok {
+			src = blobPath(r.sum)
+		}
+		if err := wf.copyFrom(src); err != nil {
+			tmp.Close()
+			f.Fs.Remove(tmpName)
+			return nil, err
+		}
+	}
+	return wf, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	if isBlobPath(name) {
+		return notExist("remove", name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, r, ok, err := f.statRef(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Fs.Remove(name); err != nil {
+		return err
+	}
+	if ok {
+		f.release(r)
+	}
+	return nil
+}
+
+// refsUnder returns the references of the files at or under the path.
+func (f *Fs) refsUnder(name string) ([]ref, error) {
+	var refs []ref
+	if err := afero.Walk(f.Fs, name, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if r, ok := f.readRef(p, info); ok {
+			refs = append(refs, r)
+		}
+		return nil
+	}); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (f *Fs) RemoveAll(name string) error {
+	if isBlobPath(name) {
+		return notExist("remove", name)
+	}
+	if internalpath.Clean(name) == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	refs, err := f.refsUnder(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Fs.RemoveAll(name); err != nil {
+		return err
+	}
+	for _, r := range refs {
+		f.release(r)
+	}
+	return nil
+}
+
+func (f *Fs) Rename(oldName string, newName string) error {
+	if isBlobPath(oldName) {
+		return notExist("rename", oldName)
+	}
+	if isBlobPath(newName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+
+	info, _, ok, err := f.statRef(oldName)
+	if err != nil {
+		return err
+	}
+	// A file written as it is in an internal directory, such as a completed tus upload, is stored as a blob.
+	if !ok && !info.IsDir() && isHidden(oldName) && !isHidden(newName) {
+		return f.ingest(oldName, newName, info)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, replaced, isRef, err := f.statRef(newName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := f.Fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	if isRef {
+		f.release(replaced)
+	}
+	return nil
+}
+
+// Copy copies the file at the old path to the new path, replacing the file there. A reference file is copied as
+// another reference to its blob, so the content is neither read nor stored again. An ordinary file is copied as it is.
+func (f *Fs) Copy(oldName string, newName string) error {
+	if isBlobPath(oldName) {
+		return notExist("copy", oldName)
+	}
+	if isBlobPath(newName) {
+		return &fs.PathError{Op: "copy", Path: newName, Err: fs.ErrPermission}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, r, ok, err := f.statRef(oldName)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return f.putRef(newName, r, info.Mode().Perm())
+	}
+
+	_, replaced, isRef, err := f.statRef(newName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := tempfile.Copy(f.Fs, oldName, newName, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if isRef {
+		f.release(replaced)
+	}
+	return nil
+}
+
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	if isBlobPath(name) {
+		return nil, notExist("stat", name)
+	}
+	info, r, ok, err := f.statRef(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &fileInfo{FileInfo: info, size: r.size}, nil
+	}
+	return info, nil
+}
+
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	if isBlobPath(name) {
+		return notExist("chmod", name)
+	}
+	return f.Fs.Chmod(name, mode)
+}
+
+func (f *Fs) Chown(name string, uid int, gid int) error {
+	if isBlobPath(name) {
+		return notExist("chown", name)
+	}
+	return f.Fs.Chown(name, uid, gid)
+}
+
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if isBlobPath(name) {
+		return notExist("chtimes", name)
+	}
+	return f.Fs.Chtimes(name, atime, mtime)
+}
+
+func (f *Fs) Name() string {
+	return "dedup(" + f.Fs.Name() + ")"
+}
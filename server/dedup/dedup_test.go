@@ -0,0 +1,204 @@
+package dedup
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+)
+
+func blobCount(base afero.Fs) int {
+	n := 0
+	afero.Walk(base, BlobDir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && p != keyPath {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func TestFs(t *testing.T) {
+	Convey("Given a deduplicating file system", t, func() {
+		base := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		dfs, err := New(base)
+		So(err, ShouldBeNil)
+
+		So(afero.WriteFile(dfs, "a.txt", []byte("hello"), 0644), ShouldBeNil)
+		So(dfs.MkdirAll("dir", 0755), ShouldBeNil)
+		So(afero.WriteFile(dfs, "dir/b.txt", []byte("hello"), 0644), ShouldBeNil)
+
+		Convey("Identical files should share one blob", func() {
+			So(blobCount(base), ShouldEqual, 1)
+			So(dfs.Usage(), ShouldResemble, Usage{Blobs: 1, Stored: 5, Logical: 10})
+
+			b, err := afero.ReadFile(dfs, "dir/b.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+
+			info, err := dfs.Stat("a.txt")
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, 5)
+			So(info.Name(), ShouldEqual, "a.txt")
+		})
+
+		Convey("The blob directory should be hidden", func() {
+			names, err := afero.ReadDir(dfs, "/")
+			So(err, ShouldBeNil)
+			So(len(names), ShouldEqual, 2)
+			for _, info := range names {
+				So(info.Name(), ShouldNotEqual, BlobDir)
+				if !info.IsDir() {
+					So(info.Size(), ShouldEqual, 5)
+				}
+			}
+
+			_, err = dfs.Stat(BlobDir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("The blob should be kept until its last reference is removed", func() {
+			So(dfs.Remove("a.txt"), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 1)
+			So(dfs.RemoveAll("dir"), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 0)
+		})
+
+		Convey("Overwriting a file should release its blob", func() {
+			So(afero.WriteFile(dfs, "a.txt", []byte("world"), 0644), ShouldBeNil)
+			So(afero.WriteFile(dfs, "dir/b.txt", []byte("world"), 0644), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 1)
+
+			// The reference files are replaced through temporary files, which are gone once they are written.
+			entries, err := afero.ReadDir(base, "dir")
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			b, err := afero.ReadFile(dfs, "dir/b.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "world")
+		})
+
+		Convey("Appending to a file should copy its content", func() {
+			f, err := dfs.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte(" world"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			b, err := afero.ReadFile(dfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello world")
+			b, err = afero.ReadFile(dfs, "dir/b.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+			So(blobCount(base), ShouldEqual, 2)
+		})
+
+		Convey("Writing at an offset should hash the whole content", func() {
+			f, err := dfs.OpenFile("a.txt", os.O_RDWR, 0)
+			So(err, ShouldBeNil)
+			_, err = f.WriteAt([]byte("J"), 0)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			So(afero.WriteFile(dfs, "c.txt", []byte("Jello"), 0644), ShouldBeNil)
+			So(dfs.Usage(), ShouldResemble, Usage{Blobs: 2, Stored: 10, Logical: 15})
+		})
+
+		Convey("Renaming a file should keep its blob", func() {
+			So(dfs.Rename("a.txt", "dir/b.txt"), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 1)
+			So(dfs.Usage().Logical, ShouldEqual, 5)
+		})
+
+		Convey("Copying a file should reference its blob", func() {
+			So(afero.WriteFile(dfs, "c.txt", []byte("world"), 0644), ShouldBeNil)
+			So(dfs.Copy("a.txt", "c.txt"), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 1)
+			So(dfs.Usage(), ShouldResemble, Usage{Blobs: 1, Stored: 5, Logical: 15})
+
+			b, err := afero.ReadFile(dfs, "c.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+		})
+
+		Convey("A file moved out of a hidden directory should be stored as a blob", func() {
+			So(base.MkdirAll(".tus", 0755), ShouldBeNil)
+			So(afero.WriteFile(dfs, ".tus/upload", []byte("hello"), 0644), ShouldBeNil)
+			So(blobCount(base), ShouldEqual, 1)
+
+			So(dfs.Rename(".tus/upload", "c.txt"), ShouldBeNil)
+			So(dfs.Usage(), ShouldResemble, Usage{Blobs: 1, Stored: 5, Logical: 15})
+			_, err := base.Stat(".tus/upload")
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("A file with the content of a reference file should be an ordinary file", func() {
+			info, err := base.Stat("a.txt")
+			So(err, ShouldBeNil)
+			genuine, err := afero.ReadFile(base, "a.txt")
+			So(err, ShouldBeNil)
+			So(info.Size(), ShouldEqual, refSize)
+			// The reference file with a MAC not made with the key.
+			forged := bytes.Clone(genuine)
+			forged[refSize-2] ^= 1
+			// The reference file without its MAC, as it was written before they were authenticated.
+			legacy := append(genuine[:legacyRefSize-1:legacyRefSize-1], '\n')
+
+			for name, content := range map[string][]byte{"forged.txt": forged, "legacy.txt": legacy} {
+				So(afero.WriteFile(dfs, name, content, 0644), ShouldBeNil)
+				So(base.MkdirAll(".tus", 0755), ShouldBeNil)
+				So(afero.WriteFile(dfs, ".tus/"+name, content, 0644), ShouldBeNil)
+				So(dfs.Rename(".tus/"+name, "dir/"+name), ShouldBeNil)
+
+				for _, p := range []string{name, "dir/" + name} {
+					b, err := afero.ReadFile(dfs, p)
+					So(err, ShouldBeNil)
+					So(b, ShouldResemble, content)
+				}
+			}
+
+			So(dfs.Remove("forged.txt"), ShouldBeNil)
+			So(dfs.RemoveAll("dir"), ShouldBeNil)
+			b, err := afero.ReadFile(dfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+
+			Convey("Also after a restart", func() {
+				restored, err := New(base)
+				So(err, ShouldBeNil)
+				So(restored.Usage(), ShouldResemble, dfs.Usage())
+				b, err := afero.ReadFile(restored, "legacy.txt")
+				So(err, ShouldBeNil)
+				So(b, ShouldResemble, legacy)
+			})
+		})
+
+		Convey("The legacy references should be authenticated on the first start", func() {
+			forged, err := afero.ReadFile(base, "a.txt")
+			So(err, ShouldBeNil)
+			legacy := append(forged[:legacyRefSize-1:legacyRefSize-1], '\n')
+			So(afero.WriteFile(base, "a.txt", legacy, 0644), ShouldBeNil)
+			So(base.Remove(keyPath), ShouldBeNil)
+
+			restored, err := New(base)
+			So(err, ShouldBeNil)
+			So(restored.Usage(), ShouldResemble, Usage{Blobs: 1, Stored: 5, Logical: 5})
+			b, err := afero.ReadFile(restored, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+		})
+
+		Convey("The references should be counted again on start", func() {
+			So(base.MkdirAll(BlobDir+"/00", 0755), ShouldBeNil)
+			So(afero.WriteFile(base, BlobDir+"/00/orphan", []byte("x"), 0644), ShouldBeNil)
+
+			restored, err := New(base)
+			So(err, ShouldBeNil)
+			So(restored.Usage(), ShouldResemble, dfs.Usage())
+			So(blobCount(base), ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,234 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+)
+
+// fileInfo is the info of a reference file with the size of its content.
+type fileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i *fileInfo) Size() int64 {
+	return i.size
+}
+
+// readFile is the blob opened for reading a file.
+type readFile struct {
+	afero.File
+	name string
+	info fs.FileInfo
+}
+
+func (f *readFile) Name() string {
+	return f.name
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// dir resolves the sizes of the reference files, and hides the blob directory at the root.
+type dir struct {
+	afero.File
+	fs   *Fs
+	name string
+}
+
+func (d *dir) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		infos, err := d.File.Readdir(count)
+		resolved := infos[:0]
+		for _, info := range infos {
+			p := path.Join(d.name, info.Name())
+			if isBlobPath(p) {
+				continue
+			}
+			if r, ok := d.fs.readRef(p, info); ok {
+				info = &fileInfo{FileInfo: info, size: r.size}
+			}
+			resolved = append(resolved, info)
+		}
+		// Read on if only the blob directory is read, since no entries means the end of the directory.
+		if len(resolved) == 0 && len(infos) > 0 && count > 0 && err == nil {
+			continue
+		}
+		return resolved, err
+	}
+}
+
+func (d *dir) Readdirnames(n int) ([]string, error) {
+	for {
+		names, err := d.File.Readdirnames(n)
+		visible := names[:0]
+		for _, name := range names {
+			if !isBlobPath(path.Join(d.name, name)) {
+				visible = append(visible, name)
+			}
+		}
+		if len(visible) == 0 && len(names) > 0 && n > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
+
+// writeFile is a temporary file with the content of a file, which is stored as a blob on close.
+// The content is hashed while it is written sequentially, or read again on close otherwise.
+type writeFile struct {
+	afero.File
+	fs     *Fs
+	name   string
+	tmp    string
+	perm   os.FileMode
+	append bool
+
+	hash hash.Hash
+	// hashed is the size of the content, while it is written sequentially.
+	hashed     int64
+	sequential bool
+	pos        int64
+	closed     bool
+}
+
+// copyFrom copies the content of the file at the path to the temporary file.
+func (f *writeFile) copyFrom(name string) error {
+	src, err := f.fs.Fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	n, err := io.Copy(io.MultiWriter(f.File, f.hash), src)
+	if err != nil {
+		return err
+	}
+	f.hashed = n
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return nil
+}
+
+// wrote updates the hash with the bytes written at the offset.
+func (f *writeFile) wrote(p []byte, off int64) {
+	if f.sequential && off == f.hashed {
+		f.hash.Write(p)
+		f.hashed += int64(len(p))
+	} else {
+		f.sequential = false
+	}
+}
+
+func (f *writeFile) Name() string {
+	return f.name
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	if f.append {
+		end, err := f.File.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		f.pos = end
+	}
+	n, err := f.File.Write(p)
+	f.wrote(p[:n], f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *writeFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	f.wrote(p[:n], off)
+	return n, err
+}
+
+func (f *writeFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *writeFile) Truncate(size int64) error {
+	if size != f.hashed {
+		f.sequential = false
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *writeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &namedFileInfo{FileInfo: info, name: path.Base(f.name)}, nil
+}
+
+// Close stores the content as a blob, and makes the file a reference to it.
+func (f *writeFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+
+	if !f.sequential {
+		f.hash.Reset()
+		if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+			f.discard()
+			return err
+		}
+		n, err := io.Copy(f.hash, f.File)
+		if err != nil {
+			f.discard()
+			return err
+		}
+		f.hashed = n
+	}
+	if err := f.File.Close(); err != nil {
+		f.fs.Fs.Remove(f.tmp)
+		return err
+	}
+
+	if err := f.fs.store(f.name, f.tmp, ref{sum: hex.EncodeToString(f.hash.Sum(nil)), size: f.hashed}, f.perm); err != nil {
+		f.fs.Fs.Remove(f.tmp)
+		return err
+	}
+	return nil
+}
+
+// discard closes and removes the temporary file.
+func (f *writeFile) discard() {
+	f.File.Close()
+	f.fs.Fs.Remove(f.tmp)
+}
+
+// namedFileInfo is the info of the temporary file with the name of the file.
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *namedFileInfo) Name() string {
+	return i.name
+}
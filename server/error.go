@@ -3,15 +3,52 @@ package server
 import "errors"
 
 var (
-	ErrFileNotFound          = errors.New("file not found")
-	ErrFilePathInvalid       = errors.New("file path is invalid")
-	ErrFileAlreadyExists     = errors.New("file already exists")
-	ErrFileSizeLimitExceeded = errors.New("file size limit exceeded")
+	ErrFileNotFound              = errors.New("file not found")
+	ErrFilePathInvalid           = errors.New("file path is invalid")
+	ErrFileAlreadyExists         = errors.New("file already exists")
+	ErrFileSizeLimitExceeded     = errors.New("file size limit exceeded")
+	ErrFileIsDirectory           = errors.New("file path is a directory, set recursive=true to delete it")
+	ErrFileDigestInvalid         = errors.New("invalid content digest")
+	ErrFileDigestMismatch        = errors.New("content digest mismatch")
+	ErrFileContentLengthMismatch = errors.New("content is shorter than its content length")
 
-	ErrAuthTokenRequired = errors.New("authorization token is required")
-	ErrAuthTokenInvalid  = errors.New("invalid authorization token")
+	ErrAuthTokenRequired    = errors.New("authorization token is required")
+	ErrAuthTokenInvalid     = errors.New("invalid authorization token")
+	ErrAuthPermissionDenied = errors.New("permission denied")
+
+	ErrPresignInvalid          = errors.New("invalid signed url")
+	ErrPresignExpired          = errors.New("signed url expired")
+	ErrPresignKeyNotConfigured = errors.New("no signing key configured")
+	ErrPresignMethodInvalid    = errors.New("method must be one of GET, HEAD, PUT, POST or DELETE")
+	ErrPresignExpireInvalid    = errors.New("expire must be between 1s and 168h")
+	ErrPresignMaxLengthInvalid = errors.New("max content length must not be negative")
 
 	ErrInvalidExpireTime = errors.New("invalid expiration time")
+
+	ErrQuotaDisabled = errors.New("no quota configured")
+
+	ErrVersioningDisabled = errors.New("file versioning is disabled")
+	ErrVersionInvalid     = errors.New("version must be a positive integer")
+
+	ErrTrashDisabled = errors.New("trash is disabled")
+
+	ErrEventIDInvalid = errors.New("last event ID must be a non-negative integer")
+
+	ErrListDepthInvalid  = errors.New("depth must be between 1 and 16")
+	ErrListGlobInvalid   = errors.New("invalid glob pattern")
+	ErrListSortInvalid   = errors.New("sort must be one of name, path, size, mtime or type, optionally prefixed with '-'")
+	ErrListLimitInvalid  = errors.New("limit must be between 1 and 10000")
+	ErrListCursorInvalid = errors.New("invalid cursor")
+
+	ErrArchiveFormatInvalid = errors.New("archive must be one of zip or tar.gz")
+
+	ErrTusVersionUnsupported  = errors.New("unsupported tus version")
+	ErrTusUploadLengthInvalid = errors.New("invalid upload length")
+	ErrTusMetadataInvalid     = errors.New("invalid upload metadata")
+	ErrTusContentTypeInvalid  = errors.New("content type must be application/offset+octet-stream")
+	ErrTusOffsetMismatch      = errors.New("upload offset mismatch")
+	ErrTusUploadNotFound      = errors.New("upload not found")
+	ErrTusUploadExpired       = errors.New("upload expired")
 )
 
 type ErrorRes struct {
@@ -0,0 +1,242 @@
+// Package events publishes the changes of the files to the subscribers as they happen, and keeps the latest of them
+// in a bounded ring buffer, so a subscriber can resume after reconnecting.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+)
+
+const (
+	TypeCreate = "create"
+	TypeModify = "modify"
+	TypeDelete = "delete"
+	TypeExpire = "expire"
+
+	// subscriptionBuffer is the number of the events a subscriber may fall behind before it is dropped.
+	subscriptionBuffer = 256
+	// quietPeriod is how long the changes seen on disk are ignored after a change of the path is published,
+	// so a change through the Fs, or a burst of writes on disk, is published once.
+	quietPeriod = 2 * time.Second
+)
+
+// Event is a change of a file.
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// isHidden reports whether the path is the root or an internal path, such as the incomplete uploads in ".tus",
+// whose changes are not published.
+func isHidden(p string) bool {
+	return p == "" || internalpath.Is(p)
+}
+
+// Subscription receives the events published after it is created.
+type Subscription struct {
+	// Backlog is the buffered events after the last event ID of the subscription.
+	Backlog []Event
+	// C is closed when the subscription is cancelled, or falls too far behind.
+	C <-chan Event
+
+	c chan Event
+	b *Broker
+}
+
+// Cancel stops the subscription.
+func (s *Subscription) Cancel() {
+	s.b.mu.Lock()
+	defer s.b.mu.Unlock()
+	if _, ok := s.b.subs[s]; ok {
+		delete(s.b.subs, s)
+		close(s.c)
+	}
+}
+
+// Broker publishes the events to the subscribers. A nil Broker publishes nothing.
+type Broker struct {
+	mu     sync.Mutex
+	ring   []Event
+	head   int
+	lastID uint64
+	subs   map[*Subscription]struct{}
+
+	// busy counts the changes in progress through the Fs of each path, and recent is the last change published of
+	// each path, so the same changes seen on disk are ignored.
+	busy     map[string]int
+	recent   map[string]change
+	expiring map[string]int
+}
+
+type change struct {
+	deleted bool
+	at      time.Time
+}
+
+func isDeletion(typ string) bool {
+	return typ == TypeDelete || typ == TypeExpire
+}
+
+// NewBroker returns the Broker keeping the latest size events.
+func NewBroker(size int) *Broker {
+	return &Broker{
+		ring: make([]Event, 0, max(size, 1)),
+		// The IDs continue to increase across restarts, so a subscriber resuming with an ID of the previous run
+		// receives the buffered events of this run.
+		lastID:   uint64(time.Now().UnixMicro()),
+		subs:     make(map[*Subscription]struct{}),
+		busy:     make(map[string]int),
+		recent:   make(map[string]change),
+		expiring: make(map[string]int),
+	}
+}
+
+// Publish records the change of the path, and sends it to the subscribers.
+func (b *Broker) Publish(typ string, name string, size int64) {
+	if b == nil {
+		return
+	}
+	p := internalpath.Clean(name)
+	if isHidden(p) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publish(typ, p, size)
+}
+
+func (b *Broker) publish(typ string, p string, size int64) {
+	now := time.Now()
+	if typ == TypeDelete && b.expiring[p] > 0 {
+		typ = TypeExpire
+	}
+
+	b.lastID++
+	e := Event{ID: b.lastID, Type: typ, Path: p, Size: size, Time: now.UTC()}
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, e)
+	} else {
+		b.ring[b.head] = e
+		b.head = (b.head + 1) % len(b.ring)
+	}
+
+	b.recent[p] = change{deleted: isDeletion(typ), at: now}
+	if len(b.recent) > cap(b.ring) {
+		for k, c := range b.recent {
+			if now.Sub(c.at) >= quietPeriod {
+				delete(b.recent, k)
+			}
+		}
+	}
+
+	for s := range b.subs {
+		select {
+		case s.c <- e:
+		default:
+			// The subscriber resumes from the buffer after reconnecting.
+			delete(b.subs, s)
+			close(s.c)
+		}
+	}
+}
+
+// Subscribe returns the subscription of the events after the last event ID, or of the new events if lastID is 0.
+// The events before the oldest buffered one are lost.
+func (b *Broker) Subscribe(lastID uint64) *Subscription {
+	c := make(chan Event, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, b: b}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lastID > 0 {
+		for i := range b.ring {
+			if e := b.ring[(b.head+i)%len(b.ring)]; e.ID > lastID {
+				s.Backlog = append(s.Backlog, e)
+			}
+		}
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// LastID returns the ID of the last published event.
+func (b *Broker) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastID
+}
+
+// Expiring runs fn, which deletes the expired file at the path, so its deletion is published as an expiration.
+func (b *Broker) Expiring(name string, fn func() error) error {
+	if b == nil {
+		return fn()
+	}
+	p := internalpath.Clean(name)
+
+	b.mu.Lock()
+	b.expiring[p]++
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		if b.expiring[p]--; b.expiring[p] <= 0 {
+			delete(b.expiring, p)
+		}
+		b.mu.Unlock()
+	}()
+
+	return fn()
+}
+
+// begin marks the changes of the paths through the Fs in progress.
+func (b *Broker) begin(paths ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range paths {
+		b.busy[internalpath.Clean(p)]++
+	}
+}
+
+// end marks the changes of the paths through the Fs done, after they are published.
+func (b *Broker) end(paths ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, p := range paths {
+		p = internalpath.Clean(p)
+		if b.busy[p]--; b.busy[p] <= 0 {
+			delete(b.busy, p)
+		}
+	}
+}
+
+// quiet ignores the deletions of the directories removed or renamed through the Fs seen on disk within the quiet
+// period, as the changes of the directories themselves are not published.
+func (b *Broker) quiet(dirs ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, p := range dirs {
+		b.recent[internalpath.Clean(p)] = change{deleted: true, at: now}
+	}
+}
+
+// publishUnlessQuiet publishes the change seen on disk, unless the path is being changed through the Fs, or the
+// same kind of change of it is published within the quiet period.
+func (b *Broker) publishUnlessQuiet(typ string, name string, size int64) {
+	p := internalpath.Clean(name)
+	if isHidden(p) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c, ok := b.recent[p]; b.busy[p] > 0 || (ok && c.deleted == isDeletion(typ) && time.Since(c.at) < quietPeriod) {
+		return
+	}
+	b.publish(typ, p, size)
+}
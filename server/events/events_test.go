@@ -0,0 +1,208 @@
+package events
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+)
+
+func TestBroker(t *testing.T) {
+	Convey("Given a broker keeping 3 events", t, func() {
+		b := NewBroker(3)
+
+		Convey("A subscriber should receive the published events", func() {
+			sub := b.Subscribe(0)
+			defer sub.Cancel()
+			So(sub.Backlog, ShouldBeEmpty)
+
+			b.Publish(TypeCreate, "/a.txt", 1)
+			e := <-sub.C
+			So(e.Type, ShouldEqual, TypeCreate)
+			So(e.Path, ShouldEqual, "a.txt")
+			So(e.Size, ShouldEqual, 1)
+			So(e.ID, ShouldEqual, b.LastID())
+		})
+
+		Convey("A subscriber should resume after the last event ID from the buffer", func() {
+			for _, p := range []string{"a", "b", "c", "d"} {
+				b.Publish(TypeCreate, p, 0)
+			}
+			last := b.LastID()
+
+			sub := b.Subscribe(last - 2)
+			defer sub.Cancel()
+			So(len(sub.Backlog), ShouldEqual, 2)
+			So(sub.Backlog[0].Path, ShouldEqual, "c")
+			So(sub.Backlog[1].Path, ShouldEqual, "d")
+
+			// The oldest event is dropped from the buffer.
+			sub = b.Subscribe(1)
+			defer sub.Cancel()
+			So(len(sub.Backlog), ShouldEqual, 3)
+			So(sub.Backlog[0].Path, ShouldEqual, "b")
+		})
+
+		Convey("The changes of the hidden directories should not be published", func() {
+			b.Publish(TypeCreate, ".tus/x", 0)
+			So(b.Subscribe(1).Backlog, ShouldBeEmpty)
+		})
+
+		Convey("A deletion of an expiring file should be published as an expiration", func() {
+			sub := b.Subscribe(0)
+			defer sub.Cancel()
+
+			So(b.Expiring("a.txt", func() error {
+				b.Publish(TypeDelete, "a.txt", 1)
+				return nil
+			}), ShouldBeNil)
+			b.Publish(TypeDelete, "a.txt", 1)
+
+			So((<-sub.C).Type, ShouldEqual, TypeExpire)
+			So((<-sub.C).Type, ShouldEqual, TypeDelete)
+		})
+
+		Convey("A subscriber falling too far behind should be dropped", func() {
+			sub := b.Subscribe(0)
+			for i := 0; i <= subscriptionBuffer; i++ {
+				b.Publish(TypeModify, "a.txt", 0)
+			}
+
+			n := 0
+			for range sub.C {
+				n++
+			}
+			So(n, ShouldEqual, subscriptionBuffer)
+			sub.Cancel()
+		})
+	})
+}
+
+func TestFs(t *testing.T) {
+	Convey("Given a file system publishing its changes", t, func() {
+		b := NewBroker(16)
+		fs := New(afero.NewMemMapFs(), b)
+		sub := b.Subscribe(0)
+		defer sub.Cancel()
+
+		next := func() Event {
+			select {
+			case e := <-sub.C:
+				return e
+			default:
+				return Event{}
+			}
+		}
+
+		So(afero.WriteFile(fs, "dir/a.txt", []byte("a"), 0644), ShouldBeNil)
+		e := next()
+		So(e.Type, ShouldEqual, TypeCreate)
+		So(e.Path, ShouldEqual, "dir/a.txt")
+		So(e.Size, ShouldEqual, 1)
+
+		Convey("Writing an existing file should publish a modification", func() {
+			So(afero.WriteFile(fs, "dir/a.txt", []byte("aa"), 0644), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeModify)
+			So(e.Size, ShouldEqual, 2)
+		})
+
+		Convey("Opening a file for writing without writing should publish nothing", func() {
+			f, err := fs.OpenFile("dir/a.txt", os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+			So(next().Type, ShouldBeEmpty)
+		})
+
+		Convey("Renaming a directory should publish the changes of each file", func() {
+			So(fs.Rename("dir", "moved"), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeDelete)
+			So(e.Path, ShouldEqual, "dir/a.txt")
+			e = next()
+			So(e.Type, ShouldEqual, TypeCreate)
+			So(e.Path, ShouldEqual, "moved/a.txt")
+		})
+
+		Convey("Removing a directory should publish the deletion of each file", func() {
+			So(fs.RemoveAll("dir"), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeDelete)
+			So(e.Path, ShouldEqual, "dir/a.txt")
+			So(e.Size, ShouldEqual, 1)
+			So(next().Type, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	Convey("Given a watcher of a directory", t, func() {
+		root := t.TempDir()
+		b := NewBroker(16)
+		base := afero.NewBasePathFs(afero.NewOsFs(), root)
+		fs := New(base, b)
+
+		w, err := NewWatcher(base, root, b, zerolog.Nop())
+		So(err, ShouldBeNil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go w.Run(ctx)
+
+		sub := b.Subscribe(0)
+		defer sub.Cancel()
+		next := func() Event {
+			select {
+			case e := <-sub.C:
+				return e
+			case <-time.After(time.Second):
+				return Event{}
+			}
+		}
+
+		Convey("The files changed on disk should be published", func() {
+			So(os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeCreate)
+			So(e.Path, ShouldEqual, "a.txt")
+
+			So(os.Remove(filepath.Join(root, "a.txt")), ShouldBeNil)
+			e = next()
+			So(e.Type, ShouldEqual, TypeDelete)
+			So(e.Path, ShouldEqual, "a.txt")
+		})
+
+		Convey("The files in the new directories should be published", func() {
+			So(os.Mkdir(filepath.Join(root, "dir"), 0755), ShouldBeNil)
+			time.Sleep(100 * time.Millisecond)
+			So(os.WriteFile(filepath.Join(root, "dir", "b.txt"), []byte("b"), 0644), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeCreate)
+			So(e.Path, ShouldEqual, "dir/b.txt")
+		})
+
+		Convey("The files changed through the Fs should be published once", func() {
+			So(afero.WriteFile(fs, "c.txt", []byte("c"), 0644), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeCreate)
+			So(e.Path, ShouldEqual, "c.txt")
+			So(next().Type, ShouldBeEmpty)
+		})
+
+		Convey("The directories removed through the Fs should not be published", func() {
+			So(fs.MkdirAll("dir", 0755), ShouldBeNil)
+			time.Sleep(100 * time.Millisecond)
+			So(afero.WriteFile(fs, "dir/d.txt", []byte("d"), 0644), ShouldBeNil)
+			So(next().Path, ShouldEqual, "dir/d.txt")
+			So(fs.RemoveAll("dir"), ShouldBeNil)
+			e := next()
+			So(e.Type, ShouldEqual, TypeDelete)
+			So(e.Path, ShouldEqual, "dir/d.txt")
+			So(next().Type, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,224 @@
+package events
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/quota"
+)
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// Fs publishes the changes of the files through the underlying afero.Fs to the Broker. The changes of the directories
+// themselves are not published, but removing or renaming a directory publishes the changes of each of its files.
+type Fs struct {
+	afero.Fs
+	broker *Broker
+}
+
+func New(base afero.Fs, b *Broker) *Fs {
+	return &Fs{Fs: base, broker: b}
+}
+
+// WithOwner returns the view of the Fs writing the files as the owner, if the underlying afero.Fs records the owners.
+func (f *Fs) WithOwner(owner string) afero.Fs {
+	if o, ok := f.Fs.(quota.Owned); ok {
+		return &Fs{Fs: o.WithOwner(owner), broker: f.broker}
+	}
+	return f
+}
+
+// files returns the files at or under the path with their sizes, and the directories.
+func (f *Fs) files(name string) (map[string]int64, []string, error) {
+	files := make(map[string]int64)
+	var dirs []string
+	if err := afero.Walk(f.Fs, name, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, p)
+		} else {
+			files[p] = info.Size()
+		}
+		return nil
+	}); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	return files, dirs, nil
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// OpenFile publishes the creation or the modification of the file opened for writing once it is closed,
+// if it is created, truncated or written.
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&writeFlags == 0 || isHidden(internalpath.Clean(name)) {
+		return f.Fs.OpenFile(name, flag, perm)
+	}
+
+	_, err := f.Fs.Stat(name)
+	existed := err == nil
+
+	f.broker.begin(name)
+	af, err := f.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		f.broker.end(name)
+		return nil, err
+	}
+	if info, err := af.Stat(); err == nil && info.IsDir() {
+		f.broker.end(name)
+		return af, nil
+	}
+	return &file{File: af, fs: f, name: name, existed: existed, dirty: !existed || flag&os.O_TRUNC != 0}, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	if isHidden(internalpath.Clean(name)) {
+		return f.Fs.Remove(name)
+	}
+
+	info, err := f.Fs.Stat(name)
+	if err != nil {
+		return f.Fs.Remove(name)
+	}
+
+	f.broker.begin(name)
+	defer f.broker.end(name)
+	if err := f.Fs.Remove(name); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		f.broker.Publish(TypeDelete, name, info.Size())
+	}
+	return nil
+}
+
+// RemoveAll publishes the deletion of each file under the path.
+func (f *Fs) RemoveAll(name string) error {
+	if isHidden(internalpath.Clean(name)) {
+		return f.Fs.RemoveAll(name)
+	}
+
+	files, dirs, err := f.files(name)
+	if err != nil {
+		return err
+	}
+	paths := dirs
+	for p := range files {
+		paths = append(paths, p)
+	}
+
+	f.broker.begin(paths...)
+	defer f.broker.end(paths...)
+	if err := f.Fs.RemoveAll(name); err != nil {
+		return err
+	}
+	for p, size := range files {
+		f.broker.Publish(TypeDelete, p, size)
+	}
+	f.broker.quiet(dirs...)
+	return nil
+}
+
+// Rename publishes the deletion of each file at the old path, and the creation or the modification of it at the new path.
+func (f *Fs) Rename(oldName string, newName string) error {
+	files, dirs, err := f.files(oldName)
+	if err != nil {
+		return err
+	}
+	_, err = f.Fs.Stat(newName)
+	existed := err == nil
+
+	paths := append(make([]string, 0, len(dirs)+2*len(files)), dirs...)
+	moved := make(map[string]string, len(files))
+	for p := range files {
+		rel := internalpath.Clean(p)[len(internalpath.Clean(oldName)):]
+		moved[p] = path.Join(internalpath.Clean(newName), rel)
+		paths = append(paths, p, moved[p])
+	}
+
+	f.broker.begin(paths...)
+	defer f.broker.end(paths...)
+	if err := f.Fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	for p, size := range files {
+		f.broker.Publish(TypeDelete, p, size)
+		typ := TypeCreate
+		if existed {
+			typ = TypeModify
+		}
+		f.broker.Publish(typ, moved[p], size)
+	}
+	f.broker.quiet(dirs...)
+	return nil
+}
+
+func (f *Fs) Name() string {
+	return "events(" + f.Fs.Name() + ")"
+}
+
+// file publishes the change of the file once it is closed.
+type file struct {
+	afero.File
+	fs      *Fs
+	name    string
+	existed bool
+	dirty   bool
+	closed  bool
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.dirty = true
+	return f.File.Write(p)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.dirty = true
+	return f.File.WriteAt(p, off)
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	f.dirty = true
+	return f.File.WriteString(s)
+}
+
+func (f *file) Truncate(size int64) error {
+	f.dirty = true
+	return f.File.Truncate(size)
+}
+
+func (f *file) Close() error {
+	if f.closed {
+		return f.File.Close()
+	}
+	f.closed = true
+	defer f.fs.broker.end(f.name)
+
+	if err := f.File.Close(); err != nil {
+		return err
+	}
+	if !f.dirty {
+		return nil
+	}
+
+	// The file may be gone, e.g. when an incomplete upload is removed, or renamed while open.
+	info, err := f.fs.Fs.Stat(f.name)
+	if err != nil {
+		return nil
+	}
+	typ := TypeCreate
+	if f.existed {
+		typ = TypeModify
+	}
+	f.fs.broker.Publish(typ, f.name, info.Size())
+	return nil
+}
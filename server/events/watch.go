@@ -0,0 +1,120 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+)
+
+// Watcher publishes the changes of the files made directly on disk under the root, which are not seen by the Fs.
+// The files are looked up in the afero.Fs of the root, so their sizes are of their contents rather than of the
+// encrypted or deduplicated files on disk.
+type Watcher struct {
+	logger  zerolog.Logger
+	fs      afero.Fs
+	root    string
+	broker  *Broker
+	watcher *fsnotify.Watcher
+}
+
+func NewWatcher(fs afero.Fs, root string, b *Broker, logger zerolog.Logger) (*Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := &Watcher{logger: logger, fs: fs, root: root, broker: b, watcher: w}
+	if err := watcher.addTree(root); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// rel returns the path of the file relative to the root.
+func (w *Watcher) rel(name string) string {
+	rel, err := filepath.Rel(w.root, name)
+	if err != nil {
+		return ""
+	}
+	return internalpath.Clean(rel)
+}
+
+// addTree watches the directory and its subdirectories, except the hidden top-level directories.
+func (w *Watcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory may be removed while walking.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if p != w.root && isHidden(w.rel(p)) {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(p)
+	})
+}
+
+func (w *Watcher) handle(e fsnotify.Event) {
+	p := w.rel(e.Name)
+	if isHidden(p) {
+		return
+	}
+
+	switch {
+	case e.Has(fsnotify.Create):
+		info, err := w.fs.Stat(p)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			if err := w.addTree(e.Name); err != nil {
+				w.logger.Warn().Err(err).Str("path", p).Msg("failed to watch directory")
+			}
+			return
+		}
+		w.broker.publishUnlessQuiet(TypeCreate, p, info.Size())
+	case e.Has(fsnotify.Write):
+		info, err := w.fs.Stat(p)
+		if err != nil || info.IsDir() {
+			return
+		}
+		w.broker.publishUnlessQuiet(TypeModify, p, info.Size())
+	case e.Has(fsnotify.Remove), e.Has(fsnotify.Rename):
+		// The removed directories are not told from the files, and the watches of them are removed by fsnotify.
+		w.broker.publishUnlessQuiet(TypeDelete, p, 0)
+	}
+}
+
+// Run publishes the changes until the context is done.
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(e)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn().Err(err).Msg("file watcher error")
+		}
+	}
+}
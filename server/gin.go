@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"strings"
@@ -90,11 +91,15 @@ func NewGinLogger(notLogged ...string) gin.HandlerFunc {
 	}
 }
 
-func NewGinEngine(lc fx.Lifecycle, tp trace.TracerProvider) *gin.Engine {
+func NewGinEngine(lc fx.Lifecycle, tp trace.TracerProvider, tlsConfig *tls.Config) (*gin.Engine, error) {
 	gin.SetMode(viper.GetString(config.KeyGinMode))
 
 	e := gin.New()
 	e.ContextWithFallback = true
+	// The forwarded headers are only honoured from the trusted proxies, which are none by default.
+	if err := e.SetTrustedProxies(viper.GetStringSlice(config.KeyHTTPTrustedProxies)); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
 
 	e.Use(otelgin.Middleware(config.AppName, otelgin.WithTracerProvider(tp)), NewGinLogger(), gin.Recovery())
 
@@ -110,23 +115,60 @@ func NewGinEngine(lc fx.Lifecycle, tp trace.TracerProvider) *gin.Engine {
 	m.UseWithoutExposingEndpoint(e)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", viper.GetString(config.KeyHTTPHost), viper.GetInt(config.KeyHTTPPort)),
-		Handler: e,
+		Addr:         fmt.Sprintf("%s:%d", viper.GetString(config.KeyHTTPHost), viper.GetInt(config.KeyHTTPPort)),
+		Handler:      e,
+		ReadTimeout:  viper.GetDuration(config.KeyHTTPReadTimeout),
+		WriteTimeout: viper.GetDuration(config.KeyHTTPWriteTimeout),
+		IdleTimeout:  viper.GetDuration(config.KeyHTTPIdleTimeout),
+	}
+
+	srv.TLSConfig = tlsConfig
+
+	// The redirect server only serves plain HTTP clients when HTTPS is enabled.
+	var redirectSrv *http.Server
+	if tlsConfig != nil && viper.GetInt(config.KeyHTTPRedirectPort) > 0 {
+		redirectSrv = &http.Server{
+			Addr:              fmt.Sprintf("%s:%d", viper.GetString(config.KeyHTTPHost), viper.GetInt(config.KeyHTTPRedirectPort)),
+			Handler:           NewRedirectHandler(viper.GetInt(config.KeyHTTPPort)),
+			ReadHeaderTimeout: viper.GetDuration(config.KeyHTTPReadTimeout),
+			IdleTimeout:       viper.GetDuration(config.KeyHTTPIdleTimeout),
+		}
 	}
 
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				if err := listenAndServe(srv); err != nil && err != http.ErrServerClosed {
 					panic(err)
 				}
 			}()
+			if redirectSrv != nil {
+				go func() {
+					if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+						panic(err)
+					}
+				}()
+			}
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
+			if redirectSrv != nil {
+				if err := redirectSrv.Shutdown(ctx); err != nil {
+					return err
+				}
+			}
 			return srv.Shutdown(ctx)
 		},
 	})
 
-	return e
+	return e, nil
+}
+
+// listenAndServe serves HTTPS if the server has the TLS configuration, or plain HTTP otherwise.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// The certificate is provided by the TLS configuration.
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
 }
@@ -0,0 +1,266 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+)
+
+const (
+	ArchiveFormatZip   = "zip"
+	ArchiveFormatTarGz = "tar.gz"
+)
+
+// archiveFormat returns the archive format requested by the archive query parameter or the Accept header.
+func archiveFormat(c *gin.Context) (string, error) {
+	if v, ok := c.GetQuery("archive"); ok {
+		switch v {
+		case ArchiveFormatZip, ArchiveFormatTarGz:
+			return v, nil
+		case "tgz":
+			return ArchiveFormatTarGz, nil
+		default:
+			return "", server.ErrArchiveFormatInvalid
+		}
+	}
+
+	for _, accept := range strings.Split(c.GetHeader("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/zip":
+			return ArchiveFormatZip, nil
+		case "application/gzip", "application/x-gzip", "application/x-gtar", "application/x-tar+gzip":
+			return ArchiveFormatTarGz, nil
+		}
+	}
+
+	return "", nil
+}
+
+type archiveFilter struct {
+	include string
+	exclude []string
+}
+
+func parseArchiveFilter(c *gin.Context) (*archiveFilter, error) {
+	f := &archiveFilter{include: c.Query("glob"), exclude: c.QueryArray("exclude")}
+	for _, p := range append([]string{f.include}, f.exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, server.ErrListGlobInvalid
+		}
+	}
+	return f, nil
+}
+
+// match reports whether the file should be in the archive. The patterns are matched against the name and the relative path.
+func (f *archiveFilter) match(rel string) bool {
+	name := path.Base(rel)
+	for _, p := range f.exclude {
+		if m, _ := path.Match(p, name); m {
+			return false
+		}
+		if m, _ := path.Match(p, rel); m {
+			return false
+		}
+	}
+	if f.include == "" {
+		return true
+	}
+	m1, _ := path.Match(f.include, name)
+	m2, _ := path.Match(f.include, rel)
+	return m1 || m2
+}
+
+// contextReader stops reading once the context is done, e.g. the client disconnects or the write timeout is reached.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type archiveWriter interface {
+	addDir(rel string, fi fs.FileInfo) error
+	addFile(rel string, fi fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	w *zip.Writer
+}
+
+func (a *zipArchiveWriter) addDir(rel string, fi fs.FileInfo) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel + "/"
+	_, err = a.w.CreateHeader(hdr)
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(rel string, fi fs.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	hdr.Method = zip.Deflate
+	w, err := a.w.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.w.Close()
+}
+
+type tarGzArchiveWriter struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarGzArchiveWriter) addDir(rel string, fi fs.FileInfo) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel + "/"
+	return a.tw.WriteHeader(hdr)
+}
+
+func (a *tarGzArchiveWriter) addFile(rel string, fi fs.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// The size in the header is fixed, so the file must not be copied beyond it even if it grows meanwhile.
+	_, err = io.CopyN(a.tw, r, hdr.Size)
+	return err
+}
+
+func (a *tarGzArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
+
+// writeArchive streams the files under dir into w in the format without temporary files.
+func writeArchive(ctx context.Context, w io.Writer, fsys afero.Fs, dir string, format string, filter *archiveFilter) error {
+	var a archiveWriter
+	switch format {
+	case ArchiveFormatZip:
+		a = &zipArchiveWriter{w: zip.NewWriter(w)}
+	case ArchiveFormatTarGz:
+		gw := gzip.NewWriter(w)
+		a = &tarGzArchiveWriter{gw: gw, tw: tar.NewWriter(gw)}
+	default:
+		return server.ErrArchiveFormatInvalid
+	}
+
+	if err := walkDir(fsys, dir, math.MaxInt, func(rel string, fi fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			// Only the directories of the matched files are added when filtering.
+			if filter.include == "" && len(filter.exclude) == 0 {
+				return a.addDir(rel, fi)
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !filter.match(rel) {
+			return nil
+		}
+
+		f, err := fsys.Open(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// The file was removed while archiving.
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+
+		return a.addFile(rel, fi, &contextReader{ctx: ctx, r: f})
+	}); err != nil {
+		return err
+	}
+
+	return a.Close()
+}
+
+// serveArchive responds the directory at dir as an archive in the format.
+func serveArchive(c *gin.Context, fsys afero.Fs, dir string, format string) error {
+	filter, err := parseArchiveFilter(c)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return nil
+	}
+
+	// The archive is streamed while it is built, so the response must finish within the transfer write timeout
+	// and stop as soon as the client disconnects.
+	ctx := c.Request.Context()
+	if writeTimeout := viper.GetDuration(config.KeyHTTPTransferWriteTimeout); writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, writeTimeout)
+		defer cancel()
+	}
+
+	name := path.Base(filepath.ToSlash(filepath.Clean(dir)))
+	if name == "." || name == "/" {
+		name = "files"
+	}
+
+	contentType := "application/zip"
+	if format == ArchiveFormatTarGz {
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	c.Status(http.StatusOK)
+
+	if c.Request.Method == http.MethodHead {
+		return nil
+	}
+
+	return writeArchive(ctx, c.Writer, fsys, dir, format, filter)
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+)
+
+func TestFileHandler_Archive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	memFs := afero.NewMemMapFs()
+	_ = afero.WriteFile(memFs, "releases/v1.2/app.bin", []byte("binary"), 0644)
+	_ = afero.WriteFile(memFs, "releases/v1.2/notes.txt", []byte("notes"), 0644)
+	_ = afero.WriteFile(memFs, "releases/v1.2/docs/readme.txt", []byte("readme"), 0644)
+
+	h := &FileHandler{logger: zerolog.Nop(), fs: memFs, metadata: newTestMetadataStore(t)}
+	e := gin.New()
+	e.GET("/files/*path", h.ServeContent)
+
+	get := func(target string, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("Downloading a directory as zip should contain its files", t, func() {
+		w := get("/files/releases/v1.2?archive=zip", "")
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Disposition"), ShouldEqual, `attachment; filename=v1.2.zip`)
+
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		So(err, ShouldBeNil)
+
+		files := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			So(err, ShouldBeNil)
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			files[f.Name] = string(b)
+		}
+		So(files, ShouldResemble, map[string]string{
+			"app.bin":         "binary",
+			"docs/":           "",
+			"docs/readme.txt": "readme",
+			"notes.txt":       "notes",
+		})
+	})
+
+	Convey("Downloading a directory as tar.gz with filters should contain the matched files", t, func() {
+		w := get("/files/releases/v1.2?glob=*.txt&exclude=docs/*", "application/gzip")
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Type"), ShouldEqual, "application/gzip")
+
+		gr, err := gzip.NewReader(w.Body)
+		So(err, ShouldBeNil)
+		tr := tar.NewReader(gr)
+
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			So(err, ShouldBeNil)
+			names = append(names, hdr.Name)
+		}
+		So(names, ShouldResemble, []string{"notes.txt"})
+	})
+
+	Convey("An unknown archive format should be rejected", t, func() {
+		w := get("/files/releases?archive=rar", "")
+
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Archiving should stop when the context is done", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := writeArchive(ctx, io.Discard, memFs, "releases", ArchiveFormatZip, &archiveFilter{})
+
+		So(err, ShouldEqual, context.Canceled)
+	})
+}
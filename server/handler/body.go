@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+)
+
+// checksumAlgorithm is the algorithm of the checksum always computed for the uploads, which makes the ETag of a file.
+const checksumAlgorithm = "sha-256"
+
+// digestAlgorithms are the algorithms of the checksums computed for the uploads on request, and of the Digest
+// (RFC 3230) and Repr-Digest (RFC 9530) headers verified in the uploads. The others are ignored.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// wantedDigests returns the known algorithms of the Want-Repr-Digest header (RFC 9530) with a nonzero preference.
+func wantedDigests(header http.Header) []string {
+	var algs []string
+	for _, s := range header.Values("Want-Repr-Digest") {
+		for _, member := range strings.Split(s, ",") {
+			alg, weight, _ := strings.Cut(strings.TrimSpace(member), "=")
+			if _, ok := digestAlgorithms[alg]; ok && strings.TrimSpace(weight) != "0" {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	return algs
+}
+
+// setDigestHeaders sets the strong ETag of the content by its SHA-256 checksum, and the Repr-Digest header (RFC 9530)
+// with the checksums in the Want-Repr-Digest header of the request, or with all of them if it is absent. It does
+// nothing without the SHA-256 checksum.
+func setDigestHeaders(c *gin.Context, checksums map[string]string) {
+	if checksums[checksumAlgorithm] == "" {
+		return
+	}
+	c.Header("ETag", `"`+checksums[checksumAlgorithm]+`"`)
+
+	algs := wantedDigests(c.Request.Header)
+	if c.GetHeader("Want-Repr-Digest") == "" {
+		algs = slices.Collect(maps.Keys(checksums))
+	}
+	slices.Sort(algs)
+
+	var members []string
+	for _, alg := range slices.Compact(algs) {
+		sum, err := hex.DecodeString(checksums[alg])
+		if err != nil || len(sum) == 0 {
+			continue
+		}
+		members = append(members, alg+"=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	}
+	if len(members) > 0 {
+		c.Header("Repr-Digest", strings.Join(members, ", "))
+	}
+}
+
+// digester hashes the content read through it with the algorithms of the checksums, and compares the digests with
+// the expected ones.
+type digester struct {
+	hashes   map[string]hash.Hash
+	expected map[string][]byte
+}
+
+func newDigester(algs ...string) *digester {
+	d := &digester{hashes: make(map[string]hash.Hash), expected: make(map[string][]byte)}
+	for _, alg := range algs {
+		d.hashes[alg] = digestAlgorithms[alg]()
+	}
+	return d
+}
+
+// expect adds the expected digests in the Content-MD5, Digest and Repr-Digest headers.
+func (d *digester) expect(header http.Header) error {
+	expect := func(alg string, sum []byte) error {
+		if want, ok := d.expected[alg]; ok && !bytes.Equal(want, sum) {
+			return server.ErrFileDigestMismatch
+		}
+		d.expected[alg] = sum
+		if _, ok := d.hashes[alg]; !ok {
+			d.hashes[alg] = digestAlgorithms[alg]()
+		}
+		return nil
+	}
+
+	if s := header.Get("Content-MD5"); s != "" {
+		sum, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(sum) != md5.Size {
+			return server.ErrFileDigestInvalid
+		}
+		if err := expect("md5", sum); err != nil {
+			return err
+		}
+	}
+
+	// Digest: sha-256=<base64>, md5=<base64>
+	for _, s := range header.Values("Digest") {
+		for _, member := range strings.Split(s, ",") {
+			alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			alg = strings.ToLower(alg)
+			if _, known := digestAlgorithms[alg]; !ok || !known {
+				continue
+			}
+			sum, err := base64.StdEncoding.DecodeString(value)
+			if err != nil || len(sum) != digestAlgorithms[alg]().Size() {
+				return server.ErrFileDigestInvalid
+			}
+			if err := expect(alg, sum); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Repr-Digest: sha-256=:<base64>:, sha-512=:<base64>:
+	for _, s := range header.Values("Repr-Digest") {
+		for _, member := range strings.Split(s, ",") {
+			member, _, _ = strings.Cut(member, ";")
+			alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+			if _, known := digestAlgorithms[alg]; !ok || !known {
+				continue
+			}
+			if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+				return server.ErrFileDigestInvalid
+			}
+			sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+			if err != nil || len(sum) != digestAlgorithms[alg]().Size() {
+				return server.ErrFileDigestInvalid
+			}
+			if err := expect(alg, sum); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reader returns the reader of src hashing the content read.
+func (d *digester) Reader(src io.Reader) io.Reader {
+	writers := make([]io.Writer, 0, len(d.hashes))
+	for _, h := range d.hashes {
+		writers = append(writers, h)
+	}
+	return io.TeeReader(src, io.MultiWriter(writers...))
+}
+
+// Verify returns server.ErrFileDigestMismatch if any digest of the content read differs from the expected one.
+func (d *digester) Verify() error {
+	for alg, want := range d.expected {
+		if !bytes.Equal(d.hashes[alg].Sum(nil), want) {
+			return server.ErrFileDigestMismatch
+		}
+	}
+	return nil
+}
+
+// Checksums returns the hex digests of the content read by their algorithms.
+func (d *digester) Checksums() map[string]string {
+	checksums := make(map[string]string, len(d.hashes))
+	for alg, h := range d.hashes {
+		checksums[alg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return checksums
+}
+
+// uploadBody is the content of an upload, either the file field of a multipart form, or the raw request body.
+type uploadBody struct {
+	io.Reader
+	closer      io.Closer
+	filename    string
+	contentType string
+	digester    *digester
+}
+
+func (b *uploadBody) Close() error {
+	return b.closer.Close()
+}
+
+// openUploadBody returns the content of the upload, limited to the max upload size. The content is hashed with SHA-256
+// and the algorithms in the Want-Repr-Digest header while it is read. A raw request body is streamed without
+// buffering, and its digests are verified by verify after it is read. If the request is invalid, it is aborted and
+// false is returned.
+func openUploadBody(c *gin.Context) (*uploadBody, bool) {
+	maxSize := viper.GetInt64(config.KeyHTTPMaxUploadSize)
+	d := newDigester(append(wantedDigests(c.Request.Header), checksumAlgorithm)...)
+
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: err.Error(),
+			})
+			return nil, false
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: err.Error(),
+			})
+			return nil, false
+		}
+
+		src := http.MaxBytesReader(c.Writer, f, maxSize)
+		return &uploadBody{
+			Reader:      d.Reader(src),
+			closer:      src,
+			filename:    fh.Filename,
+			contentType: fh.Header.Get("Content-Type"),
+			digester:    d,
+		}, true
+	}
+
+	// The declared length is rejected before any of the content is written.
+	if c.Request.ContentLength > maxSize {
+		c.Error(server.ErrFileSizeLimitExceeded)
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, server.ErrorRes{
+			Error: server.ErrFileSizeLimitExceeded.Error(),
+		})
+		return nil, false
+	}
+
+	if err := d.expect(c.Request.Header); err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return nil, false
+	}
+
+	var filename string
+	if _, params, err := mime.ParseMediaType(c.GetHeader("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+	contentType := c.GetHeader("Content-Type")
+	// Clients such as curl --data-binary send the form type by default, which does not describe the content.
+	if c.ContentType() == gin.MIMEPOSTForm {
+		contentType = ""
+	}
+
+	src := http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+	return &uploadBody{
+		Reader:      d.Reader(src),
+		closer:      src,
+		filename:    filename,
+		contentType: contentType,
+		digester:    d,
+	}, true
+}
+
+// checksums returns the hex checksums of the content after it is read.
+func (b *uploadBody) checksums() map[string]string {
+	return b.digester.Checksums()
+}
+
+// verify checks the digests of the raw request body after it is read. If they differ, the request is aborted and
+// false is returned.
+func (b *uploadBody) verify(c *gin.Context) bool {
+	if err := b.digester.Verify(); err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// abortWithUploadError aborts the request with the status of the error of reading the content of an upload,
+// and returns false if the error is not of the content.
+func abortWithUploadError(c *gin.Context, err error) bool {
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesError):
+		c.Error(server.ErrFileSizeLimitExceeded)
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, server.ErrorRes{
+			Error: server.ErrFileSizeLimitExceeded.Error(),
+		})
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		// The body ended before its Content-Length.
+		c.Error(server.ErrFileContentLengthMismatch)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: server.ErrFileContentLengthMismatch.Error(),
+		})
+	default:
+		return false
+	}
+	return true
+}
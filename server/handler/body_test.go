@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+)
+
+func TestRawBodyUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPMaxUploadSize, 16)
+	viper.Set(config.KeyFileWebUploadPath, "./files")
+	defer viper.Reset()
+
+	memFs := afero.NewMemMapFs()
+	metadata := newTestMetadataStore(t)
+	scheduler := &fakeScheduler{expires: make(map[string]time.Duration)}
+
+	fh := &FileHandler{logger: zerolog.Nop(), fs: memFs, metadata: metadata}
+	uh := &UploadHandler{logger: zerolog.Nop(), fs: memFs, scheduler: scheduler, metadata: metadata}
+	e := gin.New()
+	e.GET("/files/*path", fh.ServeContent)
+	e.PUT("/files/*path", fh.UploadContent)
+	e.POST("/upload", uh.UploadContent)
+
+	const content = "hello world"
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+
+	put := func(target string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(content))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	errorOf := func(w *httptest.ResponseRecorder) string {
+		var res server.ErrorRes
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+		return res.Error
+	}
+
+	Convey("Given a raw request body", t, func() {
+		Reset(func() {
+			memFs.RemoveAll("a.txt")
+		})
+
+		Convey("It should be written as the content of the file", func() {
+			w := put("/files/a.txt", nil)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+
+			b, err := afero.ReadFile(memFs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, content)
+		})
+
+		Convey("It should be verified with the matching digests", func() {
+			w := put("/files/a.txt", map[string]string{
+				"Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:]),
+				"Digest":      "SHA-256=" + base64.StdEncoding.EncodeToString(sha256Sum[:]) + ",unixsum=30637",
+				"Repr-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(sha256Sum[:]) + ":",
+			})
+			So(w.Code, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("It should be rejected and removed with a mismatched digest", func() {
+			other := sha256.Sum256([]byte("other"))
+			w := put("/files/a.txt", map[string]string{
+				"Repr-Digest": "sha-256=:" + base64.StdEncoding.EncodeToString(other[:]) + ":",
+			})
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(errorOf(w), ShouldEqual, server.ErrFileDigestMismatch.Error())
+
+			exists, _ := afero.Exists(memFs, "a.txt")
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("It should leave the existing file untouched if rejected", func() {
+			So(afero.WriteFile(memFs, "a.txt", []byte("old"), 0644), ShouldBeNil)
+
+			w := put("/files/a.txt", map[string]string{
+				"Content-MD5": base64.StdEncoding.EncodeToString(make([]byte, md5.Size)),
+			})
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+
+			b, err := afero.ReadFile(memFs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "old")
+
+			entries, _ := afero.ReadDir(memFs, "/")
+			So(entries, ShouldHaveLength, 1)
+		})
+
+		Convey("It should be rejected with an invalid digest", func() {
+			w := put("/files/a.txt", map[string]string{"Content-MD5": "invalid"})
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+			So(errorOf(w), ShouldEqual, server.ErrFileDigestInvalid.Error())
+		})
+
+		Convey("It should be rejected before writing if the content length exceeds the limit", func() {
+			r := httptest.NewRequest(http.MethodPut, "/files/a.txt", strings.NewReader(strings.Repeat("a", 17)))
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+
+			exists, _ := afero.Exists(memFs, "a.txt")
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("It should be named by the Content-Disposition on /upload", func() {
+			r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(content))
+			r.Header.Set("Content-Type", "text/plain")
+			r.Header.Set("Content-Disposition", `attachment; filename="hello.txt"`)
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusCreated)
+
+			var res struct{ Path string }
+			So(json.Unmarshal(w.Body.Bytes(), &res), ShouldBeNil)
+			So(res.Path, ShouldEndWith, ".txt")
+
+			m, err := metadata.Get(path.Base(res.Path))
+			So(err, ShouldBeNil)
+			So(m.OriginalName, ShouldEqual, "hello.txt")
+			So(m.ContentType, ShouldEqual, "text/plain")
+			So(m.Size, ShouldEqual, len(content))
+
+			get := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/"+path.Base(res.Path), nil))
+				return w
+			}
+			w = get()
+			So(w.Header().Get("Content-Disposition"), ShouldEqual, `inline; filename=hello.txt`)
+
+			Convey("The name should not be served once the file is changed otherwise", func() {
+				So(afero.WriteFile(memFs, path.Base(res.Path), []byte("<html></html>"), 0644), ShouldBeNil)
+
+				w := get()
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Header().Get("Content-Disposition"), ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+func TestUploadChecksums(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPMaxUploadSize, 1024)
+	defer viper.Reset()
+
+	memFs := afero.NewMemMapFs()
+	metadata := newTestMetadataStore(t)
+
+	fh := &FileHandler{logger: zerolog.Nop(), fs: memFs, metadata: metadata}
+	e := gin.New()
+	e.GET("/files/*path", fh.ServeContent)
+	e.HEAD("/files/*path", fh.ServeContent)
+	e.PUT("/files/*path", fh.UploadContent)
+
+	const content = "hello world"
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+
+	serve := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/files/a.txt", strings.NewReader(content))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("Given a file uploaded with the MD5 checksum wanted", t, func() {
+		Reset(func() {
+			memFs.Remove("a.txt")
+		})
+
+		w := serve(http.MethodPut, map[string]string{"Want-Repr-Digest": "md5=3, sha-512=0"})
+		So(w.Code, ShouldEqual, http.StatusCreated)
+
+		Convey("The response should contain the checksums", func() {
+			var res struct{ Checksums map[string]string }
+			So(json.Unmarshal(w.Body.Bytes(), &res), ShouldBeNil)
+			So(res.Checksums, ShouldResemble, map[string]string{
+				"md5":     hex.EncodeToString(md5Sum[:]),
+				"sha-256": hex.EncodeToString(sha256Sum[:]),
+			})
+
+			m, err := metadata.Get("a.txt")
+			So(err, ShouldBeNil)
+			So(m.Checksums, ShouldResemble, res.Checksums)
+			So(m.OriginalName, ShouldBeEmpty)
+		})
+
+		Convey("The download should have the strong ETag and the Repr-Digest header", func() {
+			w := serve(http.MethodHead, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("ETag"), ShouldEqual, `"`+hex.EncodeToString(sha256Sum[:])+`"`)
+			So(w.Header().Get("Repr-Digest"), ShouldEqual,
+				"md5=:"+base64.StdEncoding.EncodeToString(md5Sum[:])+":, sha-256=:"+base64.StdEncoding.EncodeToString(sha256Sum[:])+":")
+			So(w.Header().Get("Content-Disposition"), ShouldBeEmpty)
+		})
+
+		Convey("The Repr-Digest header should only contain the wanted checksums", func() {
+			w := serve(http.MethodGet, map[string]string{"Want-Repr-Digest": "sha-256=1, md5=0"})
+			So(w.Header().Get("Repr-Digest"), ShouldEqual, "sha-256=:"+base64.StdEncoding.EncodeToString(sha256Sum[:])+":")
+		})
+
+		Convey("The download should not be modified with the matching ETag", func() {
+			w := serve(http.MethodGet, map[string]string{"If-None-Match": `"` + hex.EncodeToString(sha256Sum[:]) + `"`})
+			So(w.Code, ShouldEqual, http.StatusNotModified)
+		})
+
+		Convey("The checksums should not be sent once the file is changed", func() {
+			So(afero.WriteFile(memFs, "a.txt", []byte("changed"), 0644), ShouldBeNil)
+
+			w := serve(http.MethodGet, nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("ETag"), ShouldBeEmpty)
+			So(w.Header().Get("Repr-Digest"), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/events"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+// eventsKeepAlive is the interval of the comments sent to keep the idle stream open.
+const eventsKeepAlive = 15 * time.Second
+
+type EventsHandler struct {
+	logger zerolog.Logger
+	broker *events.Broker
+}
+
+// Stream streams the changes of the files as Server-Sent Events, resuming after the Last-Event-ID header or
+// the lastEventId query parameter.
+func (h *EventsHandler) Stream(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.Error(server.ErrEventIDInvalid)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: server.ErrEventIDInvalid.Error(),
+			})
+			return
+		}
+		lastID = id
+	}
+	// The prefix is a directory or a file, like the path of a policy rule, so "test" does not match "testing".
+	prefix := strings.Trim(path.Clean("/"+c.Query("prefix")), "/")
+	policy := middleware.PolicyFromContext(c)
+
+	visible := func(e events.Event) bool {
+		if prefix != "" && e.Path != prefix && !strings.HasPrefix(e.Path, prefix+"/") {
+			return false
+		}
+		// A policy token only sees the changes of the files it can read.
+		return policy == nil || policy.Allows(e.Path, middleware.OperationRead)
+	}
+
+	sub := h.broker.Subscribe(lastID)
+	defer sub.Cancel()
+
+	// The stream is open until the client goes away, so the deadlines of the server only apply to each write.
+	rc := http.NewResponseController(c.Writer)
+	rc.SetReadDeadline(time.Time{})
+	writeTimeout := viper.GetDuration(config.KeyHTTPWriteTimeout)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	write := func(s string) bool {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if _, err := c.Writer.WriteString(s); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+	send := func(e events.Event) bool {
+		if !visible(e) {
+			return true
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			panic(err)
+		}
+		return write(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b))
+	}
+
+	// The retry field tells the client to reconnect soon, e.g. after the subscription falls too far behind.
+	if !write("retry: 1000\n\n") {
+		return
+	}
+	for _, e := range sub.Backlog {
+		if !send(e) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case e, ok := <-sub.C:
+			if !ok {
+				h.logger.Debug().Ctx(c).Msg("event subscriber fell behind")
+				return
+			}
+			if !send(e) {
+				return
+			}
+		case <-ticker.C:
+			if !write(": keep-alive\n\n") {
+				return
+			}
+		}
+	}
+}
+
+func RegisterEventsHandler(e *gin.Engine, b *events.Broker, t *store.TokenStore) {
+	h := EventsHandler{
+		logger: log.With().Str("logger", "eventsHandler").Logger(),
+		broker: b,
+	}
+
+	e.GET("/events", middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t)), h.Stream)
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/wei840222/simple-file-server/server/events"
+)
+
+func TestEventsHandler_Stream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	b := events.NewBroker(16)
+	lastID := b.LastID()
+	b.Publish(events.TypeCreate, "test", 1)
+	b.Publish(events.TypeCreate, "test/a.txt", 1)
+	b.Publish(events.TypeCreate, "testing/b.txt", 1)
+	b.Publish(events.TypeCreate, "other/c.txt", 1)
+
+	h := &EventsHandler{logger: zerolog.Nop(), broker: b}
+	e := gin.New()
+	e.GET("/events", h.Stream)
+
+	stream := func(prefix string) string {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		w := httptest.NewRecorder()
+		target := "/events?lastEventId=" + strconv.FormatUint(lastID, 10) + "&prefix=" + prefix
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+		return w.Body.String()
+	}
+
+	Convey("When the events are streamed under a prefix", t, func() {
+		body := stream("test")
+
+		Convey("Then only the changes of the path and the files under it are sent", func() {
+			So(body, ShouldContainSubstring, `"path":"test"`)
+			So(body, ShouldContainSubstring, `"path":"test/a.txt"`)
+			So(body, ShouldNotContainSubstring, `"path":"testing/b.txt"`)
+			So(body, ShouldNotContainSubstring, `"path":"other/c.txt"`)
+		})
+	})
+
+	Convey("When the events are streamed without a prefix", t, func() {
+		body := stream("")
+
+		Convey("Then every change is sent", func() {
+			So(body, ShouldContainSubstring, `"path":"testing/b.txt"`)
+			So(body, ShouldContainSubstring, `"path":"other/c.txt"`)
+		})
+	})
+}
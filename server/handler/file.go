@@ -3,10 +3,12 @@ package handler
 import (
 	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
@@ -15,20 +17,29 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/job"
 	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/internalpath"
 	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 type FileHandler struct {
-	logger zerolog.Logger
-	fs     afero.Fs
+	logger    zerolog.Logger
+	fs        afero.Fs
+	scheduler job.Scheduler
+	metadata  *store.MetadataStore
+	webhooks  *webhook.Notifier
 }
 
 func (h *FileHandler) ServeContent(c *gin.Context) {
 	path := strings.TrimPrefix(c.Param("path"), "/")
 	h.logger.Debug().Ctx(c).Str("path", path).Msg("checking if file exists")
 
-	if path == "" {
+	if internalpath.Is(path) {
 		c.Error(server.ErrFileNotFound)
 		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
 			Error: server.ErrFileNotFound.Error(),
@@ -36,6 +47,16 @@ func (h *FileHandler) ServeContent(c *gin.Context) {
 		return
 	}
 
+	if path == "" {
+		h.serveDirectory(c, path)
+		return
+	}
+
+	// Whether the file exists is only disclosed to the tokens that may read or list it.
+	if p := middleware.PolicyFromContext(c); p != nil && !p.Allows(path, middleware.OperationList) && !middleware.Authorize(c, path, middleware.OperationRead) {
+		return
+	}
+
 	f, err := h.fs.Open(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -56,21 +77,81 @@ func (h *FileHandler) ServeContent(c *gin.Context) {
 
 	if fi.IsDir() {
 		h.logger.Debug().Ctx(c).Str("path", path).Msg("path is a directory")
-		c.Error(server.ErrFileNotFound)
-		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
-			Error: server.ErrFileNotFound.Error(),
-		})
+		h.serveDirectory(c, path)
+		return
+	}
+
+	if !middleware.Authorize(c, path, middleware.OperationRead) {
+		return
+	}
+
+	m, err := h.metadata.Get(path)
+	if err != nil && !errors.Is(err, store.ErrMetadataNotFound) {
+		panic(err)
+	}
+
+	if c.Request.URL.Query().Has("meta") {
+		if m == nil {
+			c.Error(store.ErrMetadataNotFound)
+			c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+				Error: store.ErrMetadataNotFound.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, m)
 		return
 	}
 
 	name := fi.Name()
+	// The metadata of a file changed since its upload, e.g. via WebDAV, no longer describes it.
+	if m.IsCurrent(fi) {
+		// Restore the original filename and content type of the upload.
+		if m.OriginalName != "" {
+			name = m.OriginalName
+			c.Header("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": m.OriginalName}))
+		}
+		if m.ContentType != "" {
+			c.Header("Content-Type", m.ContentType)
+		}
+	}
+	setDigestHeaders(c, m.ChecksumsOf(fi))
 	modtime := fi.ModTime()
 	http.ServeContent(c.Writer, c.Request, name, modtime, f)
 }
 
+// serveDirectory responds the directory as an archive if requested, or lists it otherwise.
+func (h *FileHandler) serveDirectory(c *gin.Context, path string) {
+	format, err := archiveFormat(c)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if format == "" {
+		if !middleware.Authorize(c, path, middleware.OperationList) {
+			return
+		}
+		h.ListContent(c, path)
+		return
+	}
+
+	// An archive contains the files as well as their names.
+	if !middleware.Authorize(c, path, middleware.OperationList, middleware.OperationRead) {
+		return
+	}
+
+	if err := serveArchive(c, h.fs, path, format); err != nil {
+		h.logger.Warn().Ctx(c).Err(err).Str("path", path).Str("format", format).Msg("failed to stream archive")
+		c.Error(err)
+	}
+}
+
 func (h *FileHandler) UploadContent(c *gin.Context) {
 	path := strings.TrimPrefix(c.Param("path"), "/")
-	if path == "" {
+	if path == "" || internalpath.Is(path) {
 		c.Error(server.ErrFilePathInvalid)
 		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
 			Error: server.ErrFilePathInvalid.Error(),
@@ -78,6 +159,10 @@ func (h *FileHandler) UploadContent(c *gin.Context) {
 		return
 	}
 
+	if !middleware.Authorize(c, path, middleware.OperationWrite) {
+		return
+	}
+
 	// Check if the file already exists.
 	exists, err := afero.Exists(h.fs, path)
 	if err != nil {
@@ -94,26 +179,10 @@ func (h *FileHandler) UploadContent(c *gin.Context) {
 		return
 	}
 
-	fh, err := c.FormFile("file")
-	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
-			Error: err.Error(),
-		})
+	src, ok := openUploadBody(c)
+	if !ok {
 		return
 	}
-
-	f, err := fh.Open()
-	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
-			Error: err.Error(),
-		})
-		return
-	}
-	defer f.Close()
-
-	src := http.MaxBytesReader(c.Writer, f, viper.GetInt64(config.KeyHTTPMaxUploadSize))
 	defer src.Close()
 
 	// Ensure the directories exist.
@@ -122,8 +191,13 @@ func (h *FileHandler) UploadContent(c *gin.Context) {
 		panic(err)
 	}
 
-	dstFile, err := h.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	// The content is written to a temporary file, which replaces the file only once it is complete.
+	dstFile, err := tempfile.Create(ownedFs(c, h.fs), path, 0666)
 	if err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
 		panic(err)
 	}
 	defer dstFile.Close()
@@ -131,41 +205,232 @@ func (h *FileHandler) UploadContent(c *gin.Context) {
 	// Copy the content from the source to the destination file.
 	written, err := io.Copy(dstFile, src)
 	if err != nil {
-		var maxBytesError *http.MaxBytesError
-		if errors.As(err, &maxBytesError) {
-			c.Error(server.ErrFileSizeLimitExceeded)
-			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, server.ErrorRes{
-				Error: server.ErrFileSizeLimitExceeded.Error(),
-			})
+		// The incomplete temporary file is removed when closed, giving back the quota taken by it.
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
+		if abortWithUploadError(c, err) {
+			return
+		}
+		panic(err)
+	}
+	if !src.verify(c) {
+		return
+	}
+	if err := dstFile.Commit(); err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
 			return
 		}
 		panic(err)
 	}
 	h.logger.Debug().Ctx(c).Str("path", path).Int64("bytes", written).Msg("uploaded file")
 
+	fi, err := h.fs.Stat(path)
+	if err != nil {
+		panic(err)
+	}
+
+	// The metadata of a previous upload no longer describes the content. The file keeps its name and has no content
+	// type, so only its checksums are recorded.
+	checksums := src.checksums()
+	if err := h.metadata.Put(&store.Metadata{
+		Path:      path,
+		Uploader:  middleware.TokenOwner(c),
+		Size:      written,
+		CreatedAt: time.Now(),
+		Checksums: checksums,
+		ModTime:   fi.ModTime(),
+	}); err != nil {
+		panic(err)
+	}
+
+	event := webhook.Event{
+		Type:   webhook.EventFileUploaded,
+		Path:   path,
+		Size:   written,
+		SHA256: checksums[checksumAlgorithm],
+	}
+	if exists {
+		event.Type = webhook.EventFileOverwritten
+	}
+	h.webhooks.Notify(webhookContext(c), event)
+
 	if !exists {
 		c.JSON(http.StatusCreated, gin.H{
-			"message": "file created successfully",
+			"message":   "file created successfully",
+			"checksums": checksums,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "file overwritten successfully",
+		"checksums": checksums,
+	})
+}
+
+func (h *FileHandler) DeleteContent(c *gin.Context) {
+	// The path is cleaned, so "." or "a/.." is the root, which is never deleted.
+	path := internalpath.Clean(c.Param("path"))
+	if path == "" || internalpath.Is(path) {
+		c.Error(server.ErrFilePathInvalid)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: server.ErrFilePathInvalid.Error(),
 		})
 		return
 	}
 
+	if !middleware.Authorize(c, path, middleware.OperationDelete) {
+		return
+	}
+
+	fi, err := h.fs.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.Error(server.ErrFileNotFound)
+			c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+				Error: server.ErrFileNotFound.Error(),
+			})
+			return
+		}
+		panic(err)
+	}
+
+	// Collect the files to cancel their pending expiration and notify the webhooks after deletion.
+	files := []string{path}
+	sizes := []int64{fi.Size()}
+	if fi.IsDir() {
+		if c.Query("recursive") != "true" {
+			c.Error(server.ErrFileIsDirectory)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: server.ErrFileIsDirectory.Error(),
+			})
+			return
+		}
+
+		files, sizes = files[:0], sizes[:0]
+		if err := afero.Walk(h.fs, path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// The temporary files of the writes in progress are not files of the users.
+			if !info.IsDir() && !internalpath.Is(p) {
+				files = append(files, p)
+				sizes = append(sizes, info.Size())
+			}
+			return nil
+		}); err != nil {
+			panic(err)
+		}
+
+		if err := h.fs.RemoveAll(path); err != nil {
+			panic(err)
+		}
+	} else {
+		if err := h.fs.Remove(path); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := h.metadata.Delete(files...); err != nil {
+		h.logger.Warn().Ctx(c).Err(err).Str("path", path).Msg("failed to delete file metadata")
+	}
+	ctx := webhookContext(c)
+	for i, f := range files {
+		if err := h.scheduler.CancelFileExpire(c, f); err != nil {
+			h.logger.Warn().Ctx(c).Err(err).Str("path", f).Msg("failed to cancel file expiration")
+		}
+		h.webhooks.Notify(ctx, webhook.Event{
+			Type: webhook.EventFileDeleted,
+			Path: filepath.ToSlash(f),
+			Size: sizes[i],
+		})
+	}
+	h.logger.Debug().Ctx(c).Str("path", path).Int("files", len(files)).Msg("deleted file")
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "file overwritten successfully",
+		"message": "file deleted successfully",
+	})
+}
+
+// ownedFs returns the view of fs writing the files as the owner of the request, which is the fingerprint of its token,
+// or of the token which signed its URL.
+func ownedFs(c *gin.Context, fs afero.Fs) afero.Fs {
+	return quota.WithOwner(fs, middleware.TokenOwner(c))
+}
+
+func abortWithQuotaExceeded(c *gin.Context) {
+	c.Error(quota.ErrExceeded)
+	c.AbortWithStatusJSON(http.StatusInsufficientStorage, server.ErrorRes{
+		Error: quota.ErrExceeded.Error(),
 	})
 }
 
-func RegisterFileHandler(e *gin.Engine, fs afero.Fs) {
+// writeContent writes the content of src to the file at path as the owner of the request, and deletes the metadata of
+// a previous upload. The content is written to a temporary file, which replaces the file only once it is complete, so
+// the file is left untouched if the write fails. It aborts the request and returns false if a quota is exceeded.
+func writeContent(c *gin.Context, fs afero.Fs, m *store.MetadataStore, path string, src io.Reader) (int64, bool) {
+	if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		panic(err)
+	}
+
+	dst, err := tempfile.Create(ownedFs(c, fs), path, 0666)
+	if err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return 0, false
+		}
+		panic(err)
+	}
+	defer dst.Close()
+
+	written, err := io.Copy(dst, src)
+	if err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return written, false
+		}
+		panic(err)
+	}
+	if err := dst.Commit(); err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return written, false
+		}
+		panic(err)
+	}
+
+	if err := m.Delete(path); err != nil {
+		panic(err)
+	}
+	return written, true
+}
+
+// transferTimeout returns the middleware that applies the transfer timeouts to the routes uploading or downloading files.
+func transferTimeout() gin.HandlerFunc {
+	return middleware.NewTransferTimeout(viper.GetDuration(config.KeyHTTPTransferReadTimeout), viper.GetDuration(config.KeyHTTPTransferWriteTimeout))
+}
+
+func RegisterFileHandler(e *gin.Engine, fs afero.Fs, s job.Scheduler, m *store.MetadataStore, t *store.TokenStore, n *webhook.Notifier) {
 	h := FileHandler{
-		logger: log.With().Str("logger", "fileHandler").Logger(),
-		fs:     fs,
+		logger:    log.With().Str("logger", "fileHandler").Logger(),
+		fs:        fs,
+		scheduler: s,
+		metadata:  m,
+		webhooks:  n,
 	}
 
-	files := e.Group("/files")
+	readOnlyAuth := middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t))
+	readWriteAuth := middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t))
+
+	files := e.Group("/files", transferTimeout())
 	{
-		files.HEAD("/*path", middleware.NewTokenAuth(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens)), h.ServeContent)
-		files.GET("/*path", middleware.NewTokenAuth(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens)), h.ServeContent)
-		files.POST("/*path", middleware.NewTokenAuth(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)), h.UploadContent)
-		files.PUT("/*path", middleware.NewTokenAuth(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)), h.UploadContent)
+		files.HEAD("/*path", readOnlyAuth, h.ServeContent)
+		files.GET("/*path", readOnlyAuth, h.ServeContent)
+		files.POST("/*path", readWriteAuth, h.UploadContent)
+		files.PUT("/*path", readWriteAuth, h.UploadContent)
+		files.DELETE("/*path", readWriteAuth, h.DeleteContent)
 	}
 }
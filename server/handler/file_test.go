@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestFileHandler_DeleteContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given the files", t, func() {
+		memFs := afero.NewMemMapFs()
+		So(afero.WriteFile(memFs, "a.txt", []byte("a"), 0644), ShouldBeNil)
+		So(afero.WriteFile(memFs, "dir/b.txt", []byte("b"), 0644), ShouldBeNil)
+		So(afero.WriteFile(memFs, ".tus/partial", []byte("partial"), 0644), ShouldBeNil)
+
+		scheduler := &fakeScheduler{expires: make(map[string]time.Duration)}
+		h := &FileHandler{logger: zerolog.Nop(), fs: memFs, scheduler: scheduler, metadata: newTestMetadataStore(t), webhooks: webhook.NewNotifier(scheduler)}
+		e := gin.New()
+		e.DELETE("/files/*path", h.DeleteContent)
+
+		del := func(target string) int {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, target, nil))
+			return w.Code
+		}
+		exists := func(p string) bool {
+			ok, err := afero.Exists(memFs, p)
+			So(err, ShouldBeNil)
+			return ok
+		}
+
+		Convey("Deleting a file should remove it", func() {
+			So(del("/files/a.txt"), ShouldEqual, http.StatusOK)
+			So(exists("a.txt"), ShouldBeFalse)
+		})
+
+		Convey("Deleting a missing file should be not found", func() {
+			So(del("/files/missing.txt"), ShouldEqual, http.StatusNotFound)
+		})
+
+		Convey("Deleting a directory should require recursive", func() {
+			So(del("/files/dir"), ShouldEqual, http.StatusBadRequest)
+			So(exists("dir/b.txt"), ShouldBeTrue)
+
+			So(del("/files/dir?recursive=true"), ShouldEqual, http.StatusOK)
+			So(exists("dir"), ShouldBeFalse)
+		})
+
+		Convey("Deleting the root should be rejected", func() {
+			for _, target := range []string{"/files/", "/files/.?recursive=true", "/files/dir/..?recursive=true", "/files/dir/../.?recursive=true"} {
+				So(del(target), ShouldEqual, http.StatusBadRequest)
+			}
+			So(exists("a.txt"), ShouldBeTrue)
+			So(exists("dir/b.txt"), ShouldBeTrue)
+		})
+
+		Convey("Deleting an internal directory should be rejected", func() {
+			So(del("/files/.tus?recursive=true"), ShouldEqual, http.StatusBadRequest)
+			So(del("/files/dir/../.tus/partial"), ShouldEqual, http.StatusBadRequest)
+			So(exists(".tus/partial"), ShouldBeTrue)
+		})
+	})
+}
+
+func TestWriteContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	Convey("Given a file", t, func() {
+		memFs := afero.NewMemMapFs()
+		So(afero.WriteFile(memFs, "dir/a.txt", []byte("current"), 0644), ShouldBeNil)
+		qfs, err := quota.New(memFs, nil, quota.Options{Directory: quota.Limits{MaxBytes: 16}})
+		So(err, ShouldBeNil)
+		metadata := newTestMetadataStore(t)
+
+		write := func(src io.Reader) int {
+			e := gin.New()
+			e.Use(gin.RecoveryWithWriter(io.Discard))
+			e.PUT("/", func(c *gin.Context) {
+				if _, ok := writeContent(c, qfs, metadata, "dir/a.txt", src); ok {
+					c.Status(http.StatusOK)
+				}
+			})
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", nil))
+			return w.Code
+		}
+		content := func() string {
+			b, err := afero.ReadFile(memFs, "dir/a.txt")
+			So(err, ShouldBeNil)
+			return string(b)
+		}
+		temps := func() []string {
+			var names []string
+			So(afero.Walk(memFs, "", func(p string, info fs.FileInfo, err error) error {
+				if err == nil && !info.IsDir() && p != "dir/a.txt" {
+					names = append(names, p)
+				}
+				return err
+			}), ShouldBeNil)
+			return names
+		}
+
+		Convey("Writing the content should replace the file", func() {
+			So(metadata.Put(&store.Metadata{Path: "dir/a.txt", OriginalName: "old.txt"}), ShouldBeNil)
+
+			So(write(strings.NewReader("restored")), ShouldEqual, http.StatusOK)
+			So(content(), ShouldEqual, "restored")
+			_, err := metadata.Get("dir/a.txt")
+			So(err, ShouldEqual, store.ErrMetadataNotFound)
+		})
+
+		Convey("A failed write should leave the file untouched", func() {
+			So(write(io.MultiReader(strings.NewReader("part"), iotest.ErrReader(errors.New("read failed")))), ShouldEqual, http.StatusInternalServerError)
+			So(content(), ShouldEqual, "current")
+			So(temps(), ShouldBeEmpty)
+		})
+
+		Convey("Exceeding the quota should leave the file untouched", func() {
+			So(write(strings.NewReader(strings.Repeat("x", 32))), ShouldEqual, http.StatusInsufficientStorage)
+			So(content(), ShouldEqual, "current")
+			So(temps(), ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+)
+
+const (
+	listDefaultLimit = 1000
+	listMaxLimit     = 10000
+	listMaxDepth     = 16
+
+	EntryTypeFile      = "file"
+	EntryTypeDirectory = "directory"
+)
+
+type Entry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	MIME    string    `json:"mime,omitempty"`
+}
+
+type ListRes struct {
+	Path       string  `json:"path"`
+	Entries    []Entry `json:"entries"`
+	NextCursor string  `json:"nextCursor,omitempty"`
+}
+
+type listOptions struct {
+	depth  int
+	glob   string
+	sortBy string
+	desc   bool
+	limit  int
+	cursor *Entry
+}
+
+func parseListOptions(c *gin.Context) (*listOptions, error) {
+	o := &listOptions{depth: 1, limit: listDefaultLimit, sortBy: "name"}
+
+	if v := c.Query("depth"); v != "" {
+		depth, err := strconv.Atoi(v)
+		if err != nil || depth < 1 || depth > listMaxDepth {
+			return nil, server.ErrListDepthInvalid
+		}
+		o.depth = depth
+	}
+	if c.Query("recursive") == "true" {
+		o.depth = listMaxDepth
+	}
+
+	if v := c.Query("glob"); v != "" {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, server.ErrListGlobInvalid
+		}
+		o.glob = v
+	}
+
+	if v := c.Query("sort"); v != "" {
+		o.sortBy, o.desc = strings.CutPrefix(v, "-")
+		if !slices.Contains([]string{"name", "path", "size", "mtime", "type"}, o.sortBy) {
+			return nil, server.ErrListSortInvalid
+		}
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > listMaxLimit {
+			return nil, server.ErrListLimitInvalid
+		}
+		o.limit = limit
+	}
+
+	if v := c.Query("cursor"); v != "" {
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return nil, server.ErrListCursorInvalid
+		}
+		var cursor Entry
+		if err := json.Unmarshal(b, &cursor); err != nil {
+			return nil, server.ErrListCursorInvalid
+		}
+		o.cursor = &cursor
+	}
+
+	return o, nil
+}
+
+// compare orders the entries by the sort key, using the path as the tie breaker so that the order is total.
+func (o *listOptions) compare(a, b *Entry) int {
+	var r int
+	switch o.sortBy {
+	case "size":
+		r = cmp.Compare(a.Size, b.Size)
+	case "mtime":
+		r = a.ModTime.Compare(b.ModTime)
+	case "type":
+		r = cmp.Compare(a.Type, b.Type)
+	case "name":
+		r = cmp.Compare(a.Name, b.Name)
+	}
+	if r == 0 {
+		r = cmp.Compare(a.Path, b.Path)
+	}
+	if o.desc {
+		return -r
+	}
+	return r
+}
+
+func encodeCursor(e *Entry) string {
+	b, _ := json.Marshal(e)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// walkDir calls fn for the entries under dir up to the depth, skipping the internal directories.
+// The path of an entry is relative to dir and uses forward slashes.
+func walkDir(fsys afero.Fs, dir string, depth int, fn func(rel string, fi fs.FileInfo) error) error {
+	root := filepath.Clean(dir)
+	return afero.Walk(fsys, root, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if internalpath.Is(filepath.Join(dir, rel)) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel = filepath.ToSlash(rel)
+		if err := fn(rel, fi); err != nil {
+			return err
+		}
+		if fi.IsDir() && strings.Count(rel, "/")+1 >= depth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func newEntry(rel string, fi fs.FileInfo) Entry {
+	e := Entry{
+		Name:    fi.Name(),
+		Path:    rel,
+		Type:    EntryTypeFile,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC(),
+	}
+	if fi.IsDir() {
+		e.Type = EntryTypeDirectory
+		e.Size = 0
+	} else {
+		e.MIME = mime.TypeByExtension(filepath.Ext(fi.Name()))
+	}
+	return e
+}
+
+// ListContent responds the entries of the directory at path as JSON.
+func (h *FileHandler) ListContent(c *gin.Context, dir string) {
+	o, err := parseListOptions(c)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	var entries []Entry
+	if err := walkDir(h.fs, dir, o.depth, func(rel string, fi fs.FileInfo) error {
+		if o.glob != "" {
+			if matched, _ := path.Match(o.glob, fi.Name()); !matched {
+				return nil
+			}
+		}
+		entries = append(entries, newEntry(rel, fi))
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return o.compare(&a, &b)
+	})
+
+	// The cursor is the last entry of the previous page, so the pagination is stable while entries are added or removed.
+	if o.cursor != nil {
+		i, _ := slices.BinarySearchFunc(entries, o.cursor, func(e Entry, cursor *Entry) int {
+			if o.compare(&e, cursor) <= 0 {
+				return -1
+			}
+			return 1
+		})
+		entries = entries[i:]
+	}
+
+	res := ListRes{
+		Path:    filepath.ToSlash(dir),
+		Entries: entries,
+	}
+	if len(entries) > o.limit {
+		res.Entries = entries[:o.limit]
+		res.NextCursor = encodeCursor(&res.Entries[o.limit-1])
+	}
+	if res.Entries == nil {
+		res.Entries = []Entry{}
+	}
+
+	c.JSON(http.StatusOK, res)
+}
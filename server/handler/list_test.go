@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+)
+
+func TestFileHandler_ListContent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	memFs := afero.NewMemMapFs()
+	_ = afero.WriteFile(memFs, "releases/a.txt", []byte("a"), 0644)
+	_ = afero.WriteFile(memFs, "releases/bb.zip", []byte("bb"), 0644)
+	_ = afero.WriteFile(memFs, "releases/v1/ccc.txt", []byte("ccc"), 0644)
+	_ = afero.WriteFile(memFs, ".tus/partial", []byte("partial"), 0644)
+
+	h := &FileHandler{logger: zerolog.Nop(), fs: memFs, metadata: newTestMetadataStore(t)}
+	e := gin.New()
+	e.GET("/files/*path", h.ServeContent)
+
+	list := func(target string) (int, ListRes) {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var res ListRes
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+
+	names := func(res ListRes) []string {
+		var names []string
+		for _, e := range res.Entries {
+			names = append(names, e.Path)
+		}
+		return names
+	}
+
+	Convey("Listing a directory should return its entries", t, func() {
+		code, res := list("/files/releases")
+
+		So(code, ShouldEqual, http.StatusOK)
+		So(names(res), ShouldResemble, []string{"a.txt", "bb.zip", "v1"})
+		So(res.Entries[0].MIME, ShouldStartWith, "text/plain")
+		So(res.Entries[2].Type, ShouldEqual, EntryTypeDirectory)
+	})
+
+	Convey("Listing the root should hide the internal directories", t, func() {
+		code, res := list("/files/")
+
+		So(code, ShouldEqual, http.StatusOK)
+		So(names(res), ShouldResemble, []string{"releases"})
+	})
+
+	Convey("Listing recursively with a glob should match the names in subdirectories", t, func() {
+		_, res := list("/files/releases?depth=2&glob=*.txt&sort=-size")
+
+		So(names(res), ShouldResemble, []string{"v1/ccc.txt", "a.txt"})
+	})
+
+	Convey("Listing with a limit should paginate with the cursor", t, func() {
+		_, res := list("/files/releases?limit=2")
+		So(names(res), ShouldResemble, []string{"a.txt", "bb.zip"})
+		So(res.NextCursor, ShouldNotBeEmpty)
+
+		_, res = list("/files/releases?limit=2&cursor=" + res.NextCursor)
+		So(names(res), ShouldResemble, []string{"v1"})
+		So(res.NextCursor, ShouldBeEmpty)
+	})
+
+	Convey("Listing with an invalid sort key should be rejected", t, func() {
+		code, _ := list("/files/releases?sort=owner")
+
+		So(code, ShouldEqual, http.StatusBadRequest)
+	})
+
+	Convey("Internal paths should not be served", t, func() {
+		code, _ := list("/files/.tus/partial")
+
+		So(code, ShouldEqual, http.StatusNotFound)
+	})
+}
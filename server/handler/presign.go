@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type PresignReq struct {
+	Method           string `json:"method" binding:"required"`
+	Path             string `json:"path" binding:"required"`
+	Expire           string `json:"expire"`
+	MaxContentLength int64  `json:"maxContentLength"`
+}
+
+type PresignRes struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// presignOperations maps the methods of signed URLs to the operations of policies.
+var presignOperations = map[string]string{
+	http.MethodGet:    middleware.OperationRead,
+	http.MethodHead:   middleware.OperationRead,
+	http.MethodPut:    middleware.OperationWrite,
+	http.MethodPost:   middleware.OperationWrite,
+	http.MethodDelete: middleware.OperationDelete,
+}
+
+// presignFilePath returns the path of the file behind the URL path of a signed URL, without its query parameters.
+// A signed URL of /upload writes a new file at the root.
+func presignFilePath(urlPath string) (string, bool) {
+	urlPath, _, _ = strings.Cut(urlPath, "?")
+	urlPath = "/" + strings.TrimLeft(urlPath, "/")
+	for _, prefix := range []string{"/files", "/webdav"} {
+		if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return strings.TrimPrefix(urlPath, prefix), true
+		}
+	}
+	if urlPath == "/upload" {
+		return "", true
+	}
+	return "", false
+}
+
+type PresignHandler struct {
+	logger zerolog.Logger
+}
+
+func (h *PresignHandler) Presign(c *gin.Context) {
+	// A signed URL must not be able to mint other signed URLs.
+	if c.Query(middleware.QueryPresignSignature) != "" {
+		c.Error(server.ErrAuthTokenRequired)
+		c.AbortWithStatusJSON(http.StatusForbidden, server.ErrorRes{
+			Error: server.ErrAuthTokenRequired.Error(),
+		})
+		return
+	}
+
+	var req PresignReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if req.Expire == "" {
+		req.Expire = "1h"
+	}
+	expire, err := time.ParseDuration(req.Expire)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	// A token of a policy can only sign the operations it is allowed to perform.
+	if middleware.PolicyFromContext(c) != nil {
+		filePath, ok := presignFilePath(req.Path)
+		if !ok {
+			err := fmt.Errorf("%w: %s", server.ErrAuthPermissionDenied, req.Path)
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusForbidden, server.ErrorRes{
+				Error: err.Error(),
+			})
+			return
+		}
+		if op, ok := presignOperations[strings.ToUpper(req.Method)]; ok && !middleware.Authorize(c, filePath, op) {
+			return
+		}
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	// The scheme of the client is only taken from the proxies trusted to set it.
+	if proto := middleware.ForwardedProto(c); proto != "" {
+		scheme = proto
+	}
+
+	u, expiresAt, err := middleware.PresignURL(fmt.Sprintf("%s://%s", scheme, c.Request.Host), req.Method, req.Path, expire, req.MaxContentLength, middleware.TokenOwner(c))
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	h.logger.Debug().Ctx(c).Str("method", req.Method).Str("path", req.Path).Time("expiresAt", expiresAt).Msg("presigned url")
+
+	c.JSON(http.StatusOK, PresignRes{
+		URL:       u,
+		ExpiresAt: expiresAt,
+	})
+}
+
+func RegisterPresignHandler(e *gin.Engine, t *store.TokenStore) {
+	h := PresignHandler{
+		logger: log.With().Str("logger", "presignHandler").Logger(),
+	}
+
+	e.POST("/presign", middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t)), h.Presign)
+}
@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type QuotaUsage struct {
+	quota.Usage
+	Limits quota.Limits `json:"limits"`
+}
+
+type DirQuotaUsage struct {
+	QuotaUsage
+	Directory string `json:"directory"`
+}
+
+type QuotaUsageRes struct {
+	Token       *QuotaUsage     `json:"token,omitempty"`
+	Directories []DirQuotaUsage `json:"directories"`
+}
+
+type QuotaHandler struct {
+	logger zerolog.Logger
+	fs     afero.Fs
+}
+
+// GetUsage responds the usage of the token and the top-level directories, with their quotas.
+func (h *QuotaHandler) GetUsage(c *gin.Context) {
+	qfs, ok := h.fs.(*quota.Fs)
+	if !ok {
+		c.Error(server.ErrQuotaDisabled)
+		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+			Error: server.ErrQuotaDisabled.Error(),
+		})
+		return
+	}
+
+	limits := qfs.Limits()
+	res := QuotaUsageRes{
+		Directories: make([]DirQuotaUsage, 0),
+	}
+
+	if owner := middleware.TokenOwner(c); owner != "" {
+		res.Token = &QuotaUsage{
+			Usage:  qfs.OwnerUsage(owner),
+			Limits: limits.Owner,
+		}
+	}
+
+	policy := middleware.PolicyFromContext(c)
+	for dir, usage := range qfs.AllDirUsage() {
+		if internalpath.Is(dir) {
+			continue
+		}
+		// A policy token only sees the directories it can list.
+		if policy != nil && !policy.Allows(dir, middleware.OperationList) {
+			continue
+		}
+		res.Directories = append(res.Directories, DirQuotaUsage{
+			QuotaUsage: QuotaUsage{
+				Usage:  usage,
+				Limits: limits.Directory,
+			},
+			Directory: dir,
+		})
+	}
+	sort.Slice(res.Directories, func(i, j int) bool {
+		return res.Directories[i].Directory < res.Directories[j].Directory
+	})
+
+	h.logger.Debug().Ctx(c).Int("directories", len(res.Directories)).Msg("usage listed")
+
+	c.JSON(http.StatusOK, res)
+}
+
+func RegisterQuotaHandler(e *gin.Engine, _ metric.MeterProvider, fs afero.Fs, t *store.TokenStore) error {
+	h := QuotaHandler{
+		logger: log.With().Str("logger", "quotaHandler").Logger(),
+		fs:     fs,
+	}
+
+	e.GET("/usage", middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t)), h.GetUsage)
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/trash"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type TrashListRes struct {
+	Entries []*store.TrashEntry `json:"entries"`
+}
+
+type TrashHandler struct {
+	logger   zerolog.Logger
+	fs       afero.Fs
+	trash    *trash.Fs
+	metadata *store.MetadataStore
+}
+
+// enabled aborts the request if the trash is disabled.
+func (h *TrashHandler) enabled(c *gin.Context) bool {
+	if h.trash == nil {
+		c.Error(server.ErrTrashDisabled)
+		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+			Error: server.ErrTrashDisabled.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+func abortWithTrashEntryNotFound(c *gin.Context) {
+	c.Error(store.ErrTrashEntryNotFound)
+	c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+		Error: store.ErrTrashEntryNotFound.Error(),
+	})
+}
+
+// entry returns the entry of the request, or aborts the request if it does not exist or the operation on its path is not allowed.
+func (h *TrashHandler) entry(c *gin.Context, operation string) (*store.TrashEntry, bool) {
+	if !h.enabled(c) {
+		return nil, false
+	}
+
+	e, err := h.trash.Entry(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, store.ErrTrashEntryNotFound) {
+			abortWithTrashEntryNotFound(c)
+			return nil, false
+		}
+		panic(err)
+	}
+
+	// Whether the entry exists is only disclosed to the tokens that may list its path.
+	if p := middleware.PolicyFromContext(c); p != nil && !p.Allows(e.Path, middleware.OperationList) {
+		abortWithTrashEntryNotFound(c)
+		return nil, false
+	}
+	if !middleware.Authorize(c, e.Path, operation) {
+		return nil, false
+	}
+	return e, true
+}
+
+// visibleEntries returns the entries in the trash, except the ones a policy token cannot list.
+func (h *TrashHandler) visibleEntries(c *gin.Context) []*store.TrashEntry {
+	entries, err := h.trash.List()
+	if err != nil {
+		panic(err)
+	}
+
+	policy := middleware.PolicyFromContext(c)
+	if policy == nil {
+		return entries
+	}
+	visible := entries[:0]
+	for _, e := range entries {
+		if policy.Allows(e.Path, middleware.OperationList) {
+			visible = append(visible, e)
+		}
+	}
+	return visible
+}
+
+// ListEntries lists the deleted files in the trash, the latest deleted first.
+func (h *TrashHandler) ListEntries(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	entries := h.visibleEntries(c)
+	h.logger.Debug().Ctx(c).Int("entries", len(entries)).Msg("trash listed")
+
+	c.JSON(http.StatusOK, TrashListRes{Entries: entries})
+}
+
+// ServeEntry downloads the content of the deleted file.
+func (h *TrashHandler) ServeEntry(c *gin.Context) {
+	e, ok := h.entry(c, middleware.OperationRead)
+	if !ok {
+		return
+	}
+
+	f, _, err := h.trash.OpenEntry(e.ID)
+	if err != nil {
+		if errors.Is(err, store.ErrTrashEntryNotFound) || errors.Is(err, os.ErrNotExist) {
+			abortWithTrashEntryNotFound(c)
+			return
+		}
+		panic(err)
+	}
+	defer f.Close()
+
+	http.ServeContent(c.Writer, c.Request, filepath.Base(e.Path), e.ModTime, f)
+}
+
+// RestoreEntry writes the deleted file back to its original path, and removes it from the trash.
+func (h *TrashHandler) RestoreEntry(c *gin.Context) {
+	e, ok := h.entry(c, middleware.OperationWrite)
+	if !ok {
+		return
+	}
+
+	exists, err := afero.Exists(h.fs, e.Path)
+	if err != nil {
+		panic(err)
+	}
+	if exists {
+		c.Error(server.ErrFileAlreadyExists)
+		c.AbortWithStatusJSON(http.StatusConflict, server.ErrorRes{
+			Error: server.ErrFileAlreadyExists.Error(),
+		})
+		return
+	}
+
+	src, _, err := h.trash.OpenEntry(e.ID)
+	if err != nil {
+		if errors.Is(err, store.ErrTrashEntryNotFound) || errors.Is(err, os.ErrNotExist) {
+			abortWithTrashEntryNotFound(c)
+			return
+		}
+		panic(err)
+	}
+	defer src.Close()
+
+	written, ok := writeContent(c, h.fs, h.metadata, e.Path, src)
+	if !ok {
+		return
+	}
+	src.Close()
+	if err := h.trash.Purge(e.ID); err != nil && !errors.Is(err, store.ErrTrashEntryNotFound) {
+		panic(err)
+	}
+	h.logger.Debug().Ctx(c).Str("id", e.ID).Str("path", e.Path).Int64("bytes", written).Msg("trash entry restored")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file restored successfully",
+		"path":    e.Path,
+	})
+}
+
+// PurgeEntry removes the deleted file from the trash permanently.
+func (h *TrashHandler) PurgeEntry(c *gin.Context) {
+	e, ok := h.entry(c, middleware.OperationDelete)
+	if !ok {
+		return
+	}
+
+	if err := h.trash.Purge(e.ID); err != nil {
+		if errors.Is(err, store.ErrTrashEntryNotFound) {
+			abortWithTrashEntryNotFound(c)
+			return
+		}
+		panic(err)
+	}
+	h.logger.Debug().Ctx(c).Str("id", e.ID).Str("path", e.Path).Msg("trash entry purged")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file purged successfully",
+	})
+}
+
+// EmptyTrash removes the deleted files from the trash permanently. A policy token only removes the files it may delete.
+func (h *TrashHandler) EmptyTrash(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	policy := middleware.PolicyFromContext(c)
+	purged := 0
+	for _, e := range h.visibleEntries(c) {
+		if policy != nil && !policy.Allows(e.Path, middleware.OperationDelete) {
+			continue
+		}
+		if err := h.trash.Purge(e.ID); err != nil && !errors.Is(err, store.ErrTrashEntryNotFound) {
+			panic(err)
+		}
+		purged++
+	}
+	h.logger.Debug().Ctx(c).Int("entries", purged).Msg("trash emptied")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "trash emptied successfully",
+		"purged":  purged,
+	})
+}
+
+func RegisterTrashHandler(e *gin.Engine, fs afero.Fs, tfs *trash.Fs, m *store.MetadataStore, t *store.TokenStore) {
+	h := TrashHandler{
+		logger:   log.With().Str("logger", "trashHandler").Logger(),
+		fs:       fs,
+		trash:    tfs,
+		metadata: m,
+	}
+
+	readOnlyAuth := middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t))
+	readWriteAuth := middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t))
+
+	e.GET("/trash", readOnlyAuth, h.ListEntries)
+	e.DELETE("/trash", readWriteAuth, h.EmptyTrash)
+
+	entries := e.Group("/trash", transferTimeout())
+	{
+		entries.HEAD("/:id", readOnlyAuth, h.ServeEntry)
+		entries.GET("/:id", readOnlyAuth, h.ServeEntry)
+		entries.POST("/:id", readWriteAuth, h.RestoreEntry)
+		entries.DELETE("/:id", readWriteAuth, h.PurgeEntry)
+	}
+}
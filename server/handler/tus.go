@@ -0,0 +1,593 @@
+package handler
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/job"
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,expiration,termination"
+	tusContentType = "application/offset+octet-stream"
+
+	// TusDir is the directory in the file root to keep the incomplete tus uploads.
+	TusDir = internalpath.Tus
+)
+
+// parseTusMetadata parses the Upload-Metadata header, which is a comma separated list of
+// keys and base64 encoded values separated by a space.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, server.ErrTusMetadataInvalid
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, server.ErrTusMetadataInvalid
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+type tusUpload struct {
+	ID          string            `json:"id"`
+	Length      int64             `json:"length"`
+	Metadata    map[string]string `json:"metadata"`
+	RawMetadata string            `json:"rawMetadata"`
+	Path        string            `json:"path"`
+	Expire      time.Duration     `json:"expire"`
+	Uploader    string            `json:"uploader"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Completed   bool              `json:"completed"`
+}
+
+func tusDataPath(id string) string {
+	return filepath.Join(TusDir, id)
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(TusDir, id+".info")
+}
+
+type TusHandler struct {
+	logger    zerolog.Logger
+	fs        afero.Fs
+	scheduler job.Scheduler
+	metadata  *store.MetadataStore
+	webhooks  *webhook.Notifier
+
+	locksMu sync.Mutex
+	locks   map[string]*tusLock
+}
+
+// tusLock serializes the requests of an upload. It is removed once no request holds or waits for it, so the locks of
+// the completed, expired and terminated uploads are not kept.
+type tusLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func (h *TusHandler) lock(id string) func() {
+	h.locksMu.Lock()
+	if h.locks == nil {
+		h.locks = make(map[string]*tusLock)
+	}
+	l, ok := h.locks[id]
+	if !ok {
+		l = &tusLock{}
+		h.locks[id] = l
+	}
+	l.refs++
+	h.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+
+		h.locksMu.Lock()
+		defer h.locksMu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(h.locks, id)
+		}
+	}
+}
+
+func (h *TusHandler) loadUpload(id string) (*tusUpload, error) {
+	b, err := afero.ReadFile(h.fs, tusInfoPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, server.ErrTusUploadNotFound
+		}
+		return nil, err
+	}
+
+	var u tusUpload
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (h *TusHandler) saveUpload(u *tusUpload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(h.fs, tusInfoPath(u.ID), b, 0666)
+}
+
+// abortWithUploadError responds the error of loading an upload.
+func (h *TusHandler) abortWithUploadError(c *gin.Context, err error) {
+	if errors.Is(err, server.ErrTusUploadNotFound) {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+	panic(err)
+}
+
+// offset returns the number of bytes received of the upload.
+func (h *TusHandler) offset(u *tusUpload) (int64, error) {
+	if u.Completed {
+		return u.Length, nil
+	}
+	fi, err := h.fs.Stat(tusDataPath(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Resumable checks the protocol version of the request and sets the Tus-Resumable header.
+func (h *TusHandler) Resumable(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.Error(server.ErrTusVersionUnsupported)
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, server.ErrorRes{
+			Error: server.ErrTusVersionUnsupported.Error(),
+		})
+		return
+	}
+
+	c.Next()
+}
+
+func (h *TusHandler) Options(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(viper.GetInt64(config.KeyHTTPMaxUploadSize), 10))
+	c.Status(http.StatusNoContent)
+}
+
+func (h *TusHandler) CreateUpload(c *gin.Context) {
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.Error(server.ErrTusUploadLengthInvalid)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: server.ErrTusUploadLengthInvalid.Error(),
+		})
+		return
+	}
+
+	if length > viper.GetInt64(config.KeyHTTPMaxUploadSize) {
+		c.Error(server.ErrFileSizeLimitExceeded)
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, server.ErrorRes{
+			Error: server.ErrFileSizeLimitExceeded.Error(),
+		})
+		return
+	}
+
+	rawMetadata := c.GetHeader("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	// Like /files/:path, an upload with a chosen path does not expire by default.
+	// Otherwise, the file gets a generated ID and expires like /upload.
+	var path, authPath string
+	var expire time.Duration
+	if chosenPath, ok := metadata["path"]; ok {
+		path = internalpath.Clean(chosenPath)
+		authPath = path
+		if path == "" || internalpath.Is(path) {
+			c.Error(server.ErrFilePathInvalid)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: server.ErrFilePathInvalid.Error(),
+			})
+			return
+		}
+
+		exists, err := afero.Exists(h.fs, path)
+		if err != nil {
+			panic(err)
+		}
+		if exists {
+			c.Error(server.ErrFileAlreadyExists)
+			c.AbortWithStatusJSON(http.StatusConflict, server.ErrorRes{
+				Error: server.ErrFileAlreadyExists.Error(),
+			})
+			return
+		}
+	} else {
+		fileID, err := generateRandomID(8)
+		if err != nil {
+			panic(err)
+		}
+		path = fileID + filepath.Ext(metadata["filename"])
+		metadata["expire"] = cmp.Or(metadata["expire"], "168h")
+		// Like /upload, the random name is authorized as a write to the root directory where it is created.
+		authPath = "/"
+	}
+
+	if !middleware.Authorize(c, authPath, middleware.OperationWrite) {
+		return
+	}
+
+	if e, ok := metadata["expire"]; ok {
+		if expire, err = parseExpire(e); err != nil {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: err.Error(),
+			})
+			return
+		}
+	}
+
+	id, err := generateRandomID(32)
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now()
+	u := &tusUpload{
+		ID:          id,
+		Length:      length,
+		Metadata:    metadata,
+		RawMetadata: rawMetadata,
+		Path:        path,
+		Expire:      expire,
+		Uploader:    middleware.TokenOwner(c),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(viper.GetDuration(config.KeyTusExpiration)),
+	}
+
+	if err := h.fs.MkdirAll(TusDir, 0755); err != nil {
+		panic(err)
+	}
+	// The incomplete upload already counts against the quota of the uploader.
+	f, err := ownedFs(c, h.fs).OpenFile(tusDataPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
+		panic(err)
+	}
+	f.Close()
+	if err := h.saveUpload(u); err != nil {
+		panic(err)
+	}
+
+	// Incomplete uploads are removed after expiration.
+	for _, p := range []string{tusDataPath(id), tusInfoPath(id)} {
+		if err := h.scheduler.ScheduleFileExpire(c, p, viper.GetDuration(config.KeyTusExpiration)); err != nil {
+			panic(err)
+		}
+	}
+
+	h.logger.Debug().Ctx(c).Str("id", id).Str("path", path).Int64("length", length).Msg("created upload")
+
+	// An empty upload is complete on creation.
+	if length == 0 {
+		if err := h.complete(c, u); err != nil {
+			panic(err)
+		}
+		c.Header("X-File-Path", responsePath(c, u.Path))
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+id)
+	c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+func (h *TusHandler) HeadUpload(c *gin.Context) {
+	id := c.Param("id")
+
+	unlock := h.lock(id)
+	defer unlock()
+
+	u, err := h.loadUpload(id)
+	if err != nil {
+		h.abortWithUploadError(c, err)
+		return
+	}
+	if !middleware.Authorize(c, u.Path, middleware.OperationWrite) {
+		return
+	}
+
+	offset, err := h.offset(u)
+	if err != nil {
+		panic(err)
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+	if u.RawMetadata != "" {
+		c.Header("Upload-Metadata", u.RawMetadata)
+	}
+	if u.Completed {
+		c.Header("X-File-Path", responsePath(c, u.Path))
+	} else {
+		c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	c.Status(http.StatusOK)
+}
+
+func (h *TusHandler) PatchUpload(c *gin.Context) {
+	id := c.Param("id")
+
+	if c.ContentType() != tusContentType {
+		c.Error(server.ErrTusContentTypeInvalid)
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, server.ErrorRes{
+			Error: server.ErrTusContentTypeInvalid.Error(),
+		})
+		return
+	}
+
+	unlock := h.lock(id)
+	defer unlock()
+
+	u, err := h.loadUpload(id)
+	if err != nil {
+		h.abortWithUploadError(c, err)
+		return
+	}
+	if !middleware.Authorize(c, u.Path, middleware.OperationWrite) {
+		return
+	}
+
+	if !u.Completed && time.Now().After(u.ExpiresAt) {
+		c.Error(server.ErrTusUploadExpired)
+		c.AbortWithStatusJSON(http.StatusGone, server.ErrorRes{
+			Error: server.ErrTusUploadExpired.Error(),
+		})
+		return
+	}
+
+	offset, err := h.offset(u)
+	if err != nil {
+		panic(err)
+	}
+
+	if requestOffset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64); err != nil || requestOffset != offset {
+		c.Error(server.ErrTusOffsetMismatch)
+		c.AbortWithStatusJSON(http.StatusConflict, server.ErrorRes{
+			Error: server.ErrTusOffsetMismatch.Error(),
+		})
+		return
+	}
+
+	if !u.Completed {
+		f, err := h.fs.OpenFile(tusDataPath(id), os.O_WRONLY, 0666)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			panic(err)
+		}
+
+		// Keep what was received even if the client disconnects, so the upload can be resumed from there.
+		written, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, u.Length-offset))
+		if err := f.Close(); err != nil {
+			panic(err)
+		}
+		offset += written
+
+		if errors.Is(copyErr, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
+		if copyErr != nil {
+			h.logger.Warn().Ctx(c).Err(copyErr).Str("id", id).Int64("offset", offset).Msg("upload interrupted")
+			c.Error(copyErr)
+			c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+				Error: copyErr.Error(),
+			})
+			return
+		}
+
+		if offset == u.Length {
+			if err := h.complete(c, u); err != nil {
+				if errors.Is(err, quota.ErrExceeded) {
+					abortWithQuotaExceeded(c)
+					return
+				}
+				if errors.Is(err, server.ErrFileAlreadyExists) {
+					c.Error(err)
+					c.AbortWithStatusJSON(http.StatusConflict, server.ErrorRes{
+						Error: err.Error(),
+					})
+					return
+				}
+				panic(err)
+			}
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	if u.Completed {
+		c.Header("X-File-Path", responsePath(c, u.Path))
+	} else {
+		c.Header("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// renameNoReplace renames the file unless a file exists at the new path. afero has no atomic rename without
+// replacing, so the existence is checked right before the rename.
+func renameNoReplace(fs afero.Fs, oldName string, newName string) error {
+	if _, err := fs.Stat(newName); err == nil {
+		return server.ErrFileAlreadyExists
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fs.Rename(oldName, newName)
+}
+
+// complete moves the finished upload to its path, and records its metadata and expiration like /upload does.
+func (h *TusHandler) complete(c *gin.Context, u *tusUpload) error {
+	if err := h.fs.MkdirAll(filepath.Dir(u.Path), 0755); err != nil {
+		return err
+	}
+	// The file may be created at the path since the upload is created.
+	if err := renameNoReplace(ownedFs(c, h.fs), tusDataPath(u.ID), u.Path); err != nil {
+		return err
+	}
+	if err := h.scheduler.CancelFileExpire(c, tusDataPath(u.ID)); err != nil {
+		return err
+	}
+
+	originalName := filepath.Base(u.Path)
+	if filename := u.Metadata["filename"]; filename != "" {
+		originalName = filepath.Base(filename)
+	}
+
+	fi, err := h.fs.Stat(u.Path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	m := &store.Metadata{
+		Path:         u.Path,
+		OriginalName: originalName,
+		ContentType:  u.Metadata["filetype"],
+		Uploader:     u.Uploader,
+		Size:         u.Length,
+		CreatedAt:    now,
+		ModTime:      fi.ModTime(),
+	}
+	if u.Expire > 0 {
+		m.ExpiredAt = now.Add(u.Expire)
+		if err := h.scheduler.ScheduleFileExpire(c, u.Path, u.Expire+5*time.Minute); err != nil {
+			return err
+		}
+	}
+	if err := h.metadata.Put(m); err != nil {
+		return err
+	}
+
+	digest, err := hashFile(h.webhooks, h.fs, u.Path)
+	if err != nil {
+		return err
+	}
+	h.webhooks.Notify(webhookContext(c), webhook.Event{
+		Type:   webhook.EventFileUploaded,
+		Path:   u.Path,
+		Size:   u.Length,
+		SHA256: digest,
+	})
+
+	// The info is kept until its expiration, so clients can still look up the file path with HEAD.
+	u.Completed = true
+	if err := h.saveUpload(u); err != nil {
+		return err
+	}
+
+	h.logger.Debug().Ctx(c).Str("id", u.ID).Str("path", u.Path).Int64("bytes", u.Length).Msg("uploaded file")
+	return nil
+}
+
+func (h *TusHandler) DeleteUpload(c *gin.Context) {
+	id := c.Param("id")
+
+	unlock := h.lock(id)
+	defer unlock()
+
+	u, err := h.loadUpload(id)
+	if err != nil {
+		h.abortWithUploadError(c, err)
+		return
+	}
+	if !middleware.Authorize(c, u.Path, middleware.OperationWrite) {
+		return
+	}
+
+	for _, p := range []string{tusDataPath(id), tusInfoPath(id)} {
+		if err := h.fs.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+		if err := h.scheduler.CancelFileExpire(c, p); err != nil {
+			h.logger.Warn().Ctx(c).Err(err).Str("path", p).Msg("failed to cancel file expiration")
+		}
+	}
+
+	h.logger.Debug().Ctx(c).Str("id", id).Msg("terminated upload")
+
+	c.Status(http.StatusNoContent)
+}
+
+func RegisterTusHandler(e *gin.Engine, fs afero.Fs, s job.Scheduler, m *store.MetadataStore, t *store.TokenStore, n *webhook.Notifier) {
+	h := &TusHandler{
+		logger:    log.With().Str("logger", "tusHandler").Logger(),
+		fs:        fs,
+		scheduler: s,
+		metadata:  m,
+		webhooks:  n,
+	}
+
+	readWriteAuth := middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t))
+
+	tus := e.Group("/tus", transferTimeout(), h.Resumable)
+	{
+		tus.OPTIONS("/*id", h.Options)
+		tus.POST("/", readWriteAuth, h.CreateUpload)
+		tus.HEAD("/:id", readWriteAuth, h.HeadUpload)
+		tus.PATCH("/:id", readWriteAuth, h.PatchUpload)
+		tus.DELETE("/:id", readWriteAuth, h.DeleteUpload)
+	}
+}
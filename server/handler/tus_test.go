@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type fakeScheduler struct {
+	expires  map[string]time.Duration
+	webhooks []*webhook.Event
+}
+
+func (s *fakeScheduler) ScheduleFileExpire(_ context.Context, path string, delay time.Duration) error {
+	s.expires[path] = delay
+	return nil
+}
+
+func (s *fakeScheduler) CancelFileExpire(_ context.Context, path string) error {
+	delete(s.expires, path)
+	return nil
+}
+
+func (s *fakeScheduler) ScheduleWebhook(_ context.Context, _ string, e *webhook.Event) error {
+	s.webhooks = append(s.webhooks, e)
+	return nil
+}
+
+func (s *fakeScheduler) ScheduleReplication(context.Context, string) error {
+	return nil
+}
+
+func newTestMetadataStore(t *testing.T) *store.MetadataStore {
+	db, err := store.OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := store.NewMetadataStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTusHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPMaxUploadSize, 1024)
+	viper.Set(config.KeyTusExpiration, time.Hour)
+	viper.Set(config.KeyFileWebUploadPath, "./files")
+	viper.Set(config.KeyWebhookURLs, []string{"http://receiver.example.com"})
+	defer viper.Reset()
+
+	memFs := afero.NewMemMapFs()
+	scheduler := &fakeScheduler{expires: make(map[string]time.Duration)}
+	metadata := newTestMetadataStore(t)
+
+	h := &TusHandler{logger: zerolog.Nop(), fs: memFs, scheduler: scheduler, metadata: metadata, webhooks: webhook.NewNotifier(scheduler)}
+	e := gin.New()
+	tus := e.Group("/tus", h.Resumable)
+	tus.POST("/", h.CreateUpload)
+	tus.HEAD("/:id", h.HeadUpload)
+	tus.PATCH("/:id", h.PatchUpload)
+	tus.DELETE("/:id", h.DeleteUpload)
+
+	do := func(method, target string, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("Given an upload created with a chosen path", t, func() {
+		w := do(http.MethodPost, "/tus/", "", map[string]string{
+			"Upload-Length":   "11",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("hello.txt")) + ",path " + base64.StdEncoding.EncodeToString([]byte("dir/hello.txt")),
+		})
+		So(w.Code, ShouldEqual, http.StatusCreated)
+		location := w.Header().Get("Location")
+		So(location, ShouldStartWith, "/tus/")
+
+		Reset(func() {
+			memFs.RemoveAll("dir")
+		})
+
+		Convey("A patch with a wrong offset should conflict", func() {
+			w := do(http.MethodPatch, location, "world", map[string]string{
+				"Content-Type":  tusContentType,
+				"Upload-Offset": "6",
+			})
+			So(w.Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Patches should resume from the offset and complete the upload", func() {
+			w := do(http.MethodPatch, location, "hello ", map[string]string{
+				"Content-Type":  tusContentType,
+				"Upload-Offset": "0",
+			})
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Header().Get("Upload-Offset"), ShouldEqual, "6")
+
+			w = do(http.MethodHead, location, "", nil)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Upload-Offset"), ShouldEqual, "6")
+			So(w.Header().Get("Upload-Length"), ShouldEqual, "11")
+
+			w = do(http.MethodPatch, location, "world", map[string]string{
+				"Content-Type":  tusContentType,
+				"Upload-Offset": "6",
+			})
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Header().Get("Upload-Offset"), ShouldEqual, "11")
+			So(w.Header().Get("X-File-Path"), ShouldEqual, "files/dir/hello.txt")
+
+			b, err := afero.ReadFile(memFs, "dir/hello.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello world")
+
+			m, err := metadata.Get("dir/hello.txt")
+			So(err, ShouldBeNil)
+			So(m.OriginalName, ShouldEqual, "hello.txt")
+			So(scheduler.expires, ShouldNotContainKey, "dir/hello.txt")
+
+			So(len(scheduler.webhooks), ShouldEqual, 1)
+			So(scheduler.webhooks[0].Type, ShouldEqual, webhook.EventFileUploaded)
+			So(scheduler.webhooks[0].Path, ShouldEqual, "dir/hello.txt")
+			So(scheduler.webhooks[0].Size, ShouldEqual, 11)
+			So(scheduler.webhooks[0].SHA256, ShouldEqual, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9")
+		})
+
+		Convey("A file created at the path meanwhile should not be replaced", func() {
+			So(afero.WriteFile(memFs, "dir/hello.txt", []byte("other"), 0644), ShouldBeNil)
+
+			w := do(http.MethodPatch, location, "hello world", map[string]string{
+				"Content-Type":  tusContentType,
+				"Upload-Offset": "0",
+			})
+			So(w.Code, ShouldEqual, http.StatusConflict)
+
+			b, err := afero.ReadFile(memFs, "dir/hello.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "other")
+		})
+
+		Convey("The lock of the upload should not be kept after the requests", func() {
+			do(http.MethodHead, location, "", nil)
+			So(h.locks, ShouldBeEmpty)
+		})
+
+		Convey("A terminated upload should be gone", func() {
+			w := do(http.MethodDelete, location, "", nil)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+
+			w = do(http.MethodHead, location, "", nil)
+			So(w.Code, ShouldEqual, http.StatusNotFound)
+		})
+	})
+
+	Convey("Given an upload without a chosen path", t, func() {
+		w := do(http.MethodPost, "/tus/", "", map[string]string{
+			"Upload-Length":   "2",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt")),
+		})
+		So(w.Code, ShouldEqual, http.StatusCreated)
+
+		w = do(http.MethodPatch, w.Header().Get("Location"), "ok", map[string]string{
+			"Content-Type":  tusContentType,
+			"Upload-Offset": "0",
+		})
+		So(w.Code, ShouldEqual, http.StatusNoContent)
+
+		Convey("The file should get a generated ID and expire like /upload", func() {
+			path := strings.TrimPrefix(w.Header().Get("X-File-Path"), "files/")
+			So(path, ShouldEndWith, ".txt")
+			So(len(path), ShouldEqual, 12)
+			So(scheduler.expires[path], ShouldEqual, 168*time.Hour+5*time.Minute)
+		})
+	})
+
+	Convey("A request without Tus-Resumable should be rejected", t, func() {
+		r := httptest.NewRequest(http.MethodPost, "/tus/", nil)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		So(w.Code, ShouldEqual, http.StatusPreconditionFailed)
+	})
+
+	Convey("An upload to an internal path should be rejected", t, func() {
+		for _, p := range []string{".tus/x.info", "dir/../.versions/a", "."} {
+			w := do(http.MethodPost, "/tus/", "", map[string]string{
+				"Upload-Length":   "2",
+				"Upload-Metadata": "path " + base64.StdEncoding.EncodeToString([]byte(p)),
+			})
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		}
+	})
+
+	Convey("An upload exceeding the size limit should be rejected", t, func() {
+		w := do(http.MethodPost, "/tus/", "", map[string]string{"Upload-Length": "2048"})
+		So(w.Code, ShouldEqual, http.StatusRequestEntityTooLarge)
+	})
+}
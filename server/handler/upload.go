@@ -17,12 +17,15 @@ import (
 	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/otel/metric"
-	"go.temporal.io/sdk/client"
 
 	"github.com/wei840222/simple-file-server/config"
 	"github.com/wei840222/simple-file-server/job"
 	"github.com/wei840222/simple-file-server/server"
 	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 func generateRandomID(length int) (string, error) {
@@ -40,22 +43,39 @@ func generateRandomID(length int) (string, error) {
 	return string(result), nil
 }
 
-type Upload struct {
-	ID            string    `gorm:"column:id; type:VARCHAR(8); primaryKey"`
-	FileExtension string    `gorm:"column:file_extension; type:VARCHAR(8); not null"`
-	CreatedAt     time.Time `gorm:"column:created_at; not null"`
-	ExpiredAt     time.Time `gorm:"column:expired_at; not null"`
+// parseExpire parses and validates the expiration time of an upload.
+func parseExpire(s string) (time.Duration, error) {
+	expire, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if expire < 1*time.Minute || expire > 30*24*time.Hour {
+		return 0, server.ErrInvalidExpireTime
+	}
+
+	return expire, nil
+}
+
+// responsePath returns the path to access the uploaded file in the API.
+func responsePath(c *gin.Context, path string) string {
+	if pathOverwrite := c.GetHeader("X-Path-Overwrite"); pathOverwrite != "" {
+		return server.JoinURL(pathOverwrite, path)
+	}
+	return server.JoinURL(viper.GetString(config.KeyFileWebUploadPath), path)
 }
 
 type UploadHandler struct {
-	logger         zerolog.Logger
-	fs             afero.Fs
-	temporalClient client.Client
+	logger    zerolog.Logger
+	fs        afero.Fs
+	scheduler job.Scheduler
+	metadata  *store.MetadataStore
+	webhooks  *webhook.Notifier
 }
 
 func (h *UploadHandler) UploadContent(c *gin.Context) {
 	// Extract the expiration time from the query parameters, defaulting to 168 hours (7 days).
-	expire, err := time.ParseDuration(c.DefaultQuery("expire", "168h"))
+	expire, err := parseExpire(c.DefaultQuery("expire", "168h"))
 	if err != nil {
 		c.Error(err)
 		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
@@ -64,12 +84,9 @@ func (h *UploadHandler) UploadContent(c *gin.Context) {
 		return
 	}
 
-	// Validate the expiration time.
-	if expire < 1*time.Minute || expire > 30*24*time.Hour {
-		c.Error(server.ErrInvalidExpireTime)
-		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
-			Error: server.ErrInvalidExpireTime.Error(),
-		})
+	// The random name is not known to the client, so the upload is authorized as a write to the root directory,
+	// where the file is created, before its body is read.
+	if !middleware.Authorize(c, "/", middleware.OperationWrite) {
 		return
 	}
 
@@ -79,16 +96,13 @@ func (h *UploadHandler) UploadContent(c *gin.Context) {
 		panic(err)
 	}
 
-	fh, err := c.FormFile("file")
-	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
-			Error: err.Error(),
-		})
+	src, ok := openUploadBody(c)
+	if !ok {
 		return
 	}
+	defer src.Close()
 
-	fileExtension := filepath.Ext(fh.Filename)
+	fileExtension := filepath.Ext(src.filename)
 	path := id + fileExtension
 
 	// Check if the error indicates that the file does not exist
@@ -99,69 +113,100 @@ func (h *UploadHandler) UploadContent(c *gin.Context) {
 		panic(fmt.Errorf("error checking file '%s': %w", path, err))
 	}
 
-	f, err := fh.Open()
+	// The content is written to a temporary file, which replaces the file only once it is complete.
+	dstFile, err := tempfile.Create(ownedFs(c, h.fs), path, 0666)
 	if err != nil {
-		c.Error(err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
-			Error: err.Error(),
-		})
-		return
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
+		panic(err)
 	}
-	defer f.Close()
-
-	src := http.MaxBytesReader(c.Writer, f, viper.GetInt64(config.KeyHTTPMaxUploadSize))
-	defer src.Close()
+	defer dstFile.Close()
 
-	workflowOptions := client.StartWorkflowOptions{
-		TaskQueue:  viper.GetString(config.KeyTemporalTaskQueue),
-		StartDelay: expire + 5*time.Minute,
+	// Copy the content from the source to the destination file.
+	written, err := io.Copy(dstFile, src)
+	if err != nil {
+		// The incomplete temporary file is removed when closed, giving back the quota taken by it.
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
+		if abortWithUploadError(c, err) {
+			return
+		}
+		panic(err)
 	}
-	if _, err := h.temporalClient.ExecuteWorkflow(c, workflowOptions, job.FileExpireWorkflow, path); err != nil {
+	if !src.verify(c) {
+		return
+	}
+	if err := dstFile.Commit(); err != nil {
+		if errors.Is(err, quota.ErrExceeded) {
+			abortWithQuotaExceeded(c)
+			return
+		}
 		panic(err)
 	}
 
-	dstFile, err := h.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
+	if err := h.scheduler.ScheduleFileExpire(c, path, expire+5*time.Minute); err != nil {
 		panic(err)
 	}
-	defer dstFile.Close()
 
-	// Copy the content from the source to the destination file.
-	written, err := io.Copy(dstFile, src)
+	fi, err := h.fs.Stat(path)
 	if err != nil {
-		var maxBytesError *http.MaxBytesError
-		if errors.As(err, &maxBytesError) {
-			c.Error(server.ErrFileSizeLimitExceeded)
-			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, server.ErrorRes{
-				Error: server.ErrFileSizeLimitExceeded.Error(),
-			})
-			return
-		}
 		panic(err)
 	}
 
-	if pathOverwrite := c.GetHeader("X-Path-Overwrite"); pathOverwrite != "" {
-		path = server.JoinURL(pathOverwrite, path)
-	} else {
-		path = server.JoinURL(viper.GetString(config.KeyFileWebUploadPath), path)
+	// A raw request body without a filename is named by its path.
+	originalName := path
+	if src.filename != "" {
+		originalName = filepath.Base(src.filename)
 	}
 
+	now := time.Now()
+	checksums := src.checksums()
+	if err := h.metadata.Put(&store.Metadata{
+		Path:         path,
+		OriginalName: originalName,
+		ContentType:  src.contentType,
+		Uploader:     middleware.TokenOwner(c),
+		Size:         written,
+		CreatedAt:    now,
+		ExpiredAt:    now.Add(expire),
+		Checksums:    checksums,
+		ModTime:      fi.ModTime(),
+	}); err != nil {
+		panic(err)
+	}
+
+	h.webhooks.Notify(webhookContext(c), webhook.Event{
+		Type:   webhook.EventFileUploaded,
+		Path:   path,
+		Size:   written,
+		SHA256: checksums[checksumAlgorithm],
+	})
+
+	path = responsePath(c, path)
+
 	h.logger.Debug().Ctx(c).Str("path", path).Int64("bytes", written).Msg("uploaded file")
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "file created successfully",
-		"path":    path,
+		"message":   "file created successfully",
+		"path":      path,
+		"checksums": checksums,
 	})
 }
 
-func RegisterUploadHandler(e *gin.Engine, _ metric.MeterProvider, fs afero.Fs, c client.Client) error {
+func RegisterUploadHandler(e *gin.Engine, _ metric.MeterProvider, fs afero.Fs, s job.Scheduler, m *store.MetadataStore, t *store.TokenStore, n *webhook.Notifier) error {
 	h := UploadHandler{
-		logger:         log.With().Str("logger", "uploadHandler").Logger(),
-		fs:             fs,
-		temporalClient: c,
+		logger:    log.With().Str("logger", "uploadHandler").Logger(),
+		fs:        fs,
+		scheduler: s,
+		metadata:  m,
+		webhooks:  n,
 	}
 
-	e.POST("/upload", middleware.NewTokenAuth(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)), h.UploadContent)
+	e.POST("/upload", transferTimeout(), middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t)), h.UploadContent)
 
 	return nil
 }
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestUploadHandler_Policy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPMaxUploadSize, 1024)
+	viper.Set(config.KeyFileWebUploadPath, "./files")
+	viper.Set(config.KeyHTTPPolicies, []map[string]any{
+		{"name": "root", "token": "root-token", "rules": []map[string]any{{"path": "/", "operations": []string{"write"}}}},
+		{"name": "team-a", "token": "a-token", "rules": []map[string]any{
+			{"path": "/team-a", "operations": []string{"write"}},
+			{"path": "/*.txt", "operations": []string{"write"}},
+		}},
+	})
+	defer viper.Reset()
+
+	memFs := afero.NewMemMapFs()
+	scheduler := &fakeScheduler{expires: make(map[string]time.Duration)}
+	h := &UploadHandler{logger: zerolog.Nop(), fs: memFs, scheduler: scheduler, metadata: newTestMetadataStore(t), webhooks: webhook.NewNotifier(scheduler)}
+	e := gin.New()
+	e.POST("/upload", middleware.NewTokenAuth(store.ScopeWrite), h.UploadContent)
+
+	upload := func(token string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		_, _ = fw.Write([]byte("hello"))
+		_ = mw.Close()
+
+		r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("Given the policies of the upload tokens", t, func() {
+		Convey("A token with a write rule on the root should upload", func() {
+			So(upload("root-token").Code, ShouldEqual, http.StatusCreated)
+		})
+
+		Convey("A token without a write rule on the root should be forbidden, even if a rule matches the random name", func() {
+			before, _ := afero.ReadDir(memFs, "/")
+			So(upload("a-token").Code, ShouldEqual, http.StatusForbidden)
+
+			after, _ := afero.ReadDir(memFs, "/")
+			So(after, ShouldHaveLength, len(before))
+		})
+	})
+}
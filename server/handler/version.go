@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/versioning"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+type VersionListRes struct {
+	Path     string           `json:"path"`
+	Versions []*store.Version `json:"versions"`
+}
+
+type VersionHandler struct {
+	logger     zerolog.Logger
+	fs         afero.Fs
+	versioning *versioning.Fs
+	metadata   *store.MetadataStore
+}
+
+// versionPath returns the path of the request, or aborts the request if versioning is disabled or the path is invalid.
+func (h *VersionHandler) versionPath(c *gin.Context, operation string) (string, bool) {
+	if h.versioning == nil {
+		c.Error(server.ErrVersioningDisabled)
+		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+			Error: server.ErrVersioningDisabled.Error(),
+		})
+		return "", false
+	}
+
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	if path == "" {
+		c.Error(server.ErrFilePathInvalid)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: server.ErrFilePathInvalid.Error(),
+		})
+		return "", false
+	}
+	if internalpath.Is(path) {
+		c.Error(server.ErrFileNotFound)
+		c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+			Error: server.ErrFileNotFound.Error(),
+		})
+		return "", false
+	}
+
+	if !middleware.Authorize(c, path, operation) {
+		return "", false
+	}
+	return path, true
+}
+
+// versionNumber returns the version of the query, or aborts the request if it is invalid.
+func versionNumber(c *gin.Context) (int64, bool) {
+	n, err := strconv.ParseInt(c.Query("version"), 10, 64)
+	if err != nil || n <= 0 {
+		c.Error(server.ErrVersionInvalid)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: server.ErrVersionInvalid.Error(),
+		})
+		return 0, false
+	}
+	return n, true
+}
+
+// openVersion opens the content of the version, or aborts the request if it does not exist.
+func (h *VersionHandler) openVersion(c *gin.Context, path string, n int64) (afero.File, *store.Version, bool) {
+	f, v, err := h.versioning.OpenVersion(path, n)
+	if err != nil {
+		if errors.Is(err, store.ErrVersionNotFound) || errors.Is(err, os.ErrNotExist) {
+			c.Error(store.ErrVersionNotFound)
+			c.AbortWithStatusJSON(http.StatusNotFound, server.ErrorRes{
+				Error: store.ErrVersionNotFound.Error(),
+			})
+			return nil, nil, false
+		}
+		panic(err)
+	}
+	return f, v, true
+}
+
+// GetVersions lists the versions of the file, or downloads one of them with the version query.
+func (h *VersionHandler) GetVersions(c *gin.Context) {
+	path, ok := h.versionPath(c, middleware.OperationRead)
+	if !ok {
+		return
+	}
+
+	if !c.Request.URL.Query().Has("version") {
+		versions, err := h.versioning.History(path)
+		if err != nil {
+			panic(err)
+		}
+		h.logger.Debug().Ctx(c).Str("path", path).Int("versions", len(versions)).Msg("versions listed")
+		c.JSON(http.StatusOK, VersionListRes{Path: path, Versions: versions})
+		return
+	}
+
+	n, ok := versionNumber(c)
+	if !ok {
+		return
+	}
+	f, v, ok := h.openVersion(c, path, n)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), v.ModTime, f)
+}
+
+// RestoreVersion writes the content of the version to the file. The current content is kept as a new version.
+func (h *VersionHandler) RestoreVersion(c *gin.Context) {
+	path, ok := h.versionPath(c, middleware.OperationWrite)
+	if !ok {
+		return
+	}
+	n, ok := versionNumber(c)
+	if !ok {
+		return
+	}
+	src, _, ok := h.openVersion(c, path, n)
+	if !ok {
+		return
+	}
+	defer src.Close()
+
+	written, ok := writeContent(c, h.fs, h.metadata, path, src)
+	if !ok {
+		return
+	}
+	h.logger.Debug().Ctx(c).Str("path", path).Int64("version", n).Int64("bytes", written).Msg("version restored")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "file restored successfully",
+		"path":    path,
+	})
+}
+
+func RegisterVersionHandler(e *gin.Engine, fs afero.Fs, v *versioning.Fs, m *store.MetadataStore, t *store.TokenStore) {
+	h := VersionHandler{
+		logger:     log.With().Str("logger", "versionHandler").Logger(),
+		fs:         fs,
+		versioning: v,
+		metadata:   m,
+	}
+
+	versions := e.Group("/versions", transferTimeout())
+	{
+		versions.HEAD("/*path", middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t)), h.GetVersions)
+		versions.GET("/*path", middleware.NewTokenAuth(store.ScopeRead, middleware.WithTokenStore(t)), h.GetVersions)
+		versions.POST("/*path", middleware.NewTokenAuth(store.ScopeWrite, middleware.WithTokenStore(t)), h.RestoreVersion)
+	}
+}
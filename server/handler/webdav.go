@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strings"
@@ -15,7 +16,12 @@ import (
 	"github.com/spf13/afero"
 	"golang.org/x/net/webdav"
 
+	"github.com/wei840222/simple-file-server/config"
 	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/server/webhook"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 const (
@@ -60,6 +66,7 @@ func (x SortFileInfo) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
 type WebdavHandler struct {
 	logger zerolog.Logger
 	fs     webdav.Handler
+	afs    afero.Fs
 }
 
 func (h *WebdavHandler) generateWeb(FSInfo []fs.FileInfo, path string, writer io.Writer) {
@@ -102,6 +109,27 @@ func (h *WebdavHandler) handleDirList(fs webdav.FileSystem, c *gin.Context) bool
 	if fi, err := f.Stat(); err != nil || fi == nil || !fi.IsDir() {
 		return false
 	}
+
+	format, err := archiveFormat(c)
+	if err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, server.ErrorRes{
+			Error: err.Error(),
+		})
+		return true
+	}
+	if format != "" {
+		// An archive contains the files as well as their names, like FileHandler.serveDirectory.
+		if !middleware.Authorize(c, filePath, middleware.OperationRead) {
+			return true
+		}
+		if err := serveArchive(c, h.afs, strings.TrimPrefix(filePath, "/"), format); err != nil {
+			h.logger.Warn().Ctx(c).Err(err).Str("path", filePath).Str("format", format).Msg("failed to stream archive")
+			c.Error(err)
+		}
+		return true
+	}
+
 	dirs, err := f.Readdir(-1)
 	if err != nil {
 		c.Writer.WriteHeader(http.StatusInternalServerError)
@@ -112,29 +140,146 @@ func (h *WebdavHandler) handleDirList(fs webdav.FileSystem, c *gin.Context) bool
 	return true
 }
 
+// authorize checks the operations of the request against the policy of the token.
+// COPY and MOVE also write the destination, and MOVE deletes the source.
+func (h *WebdavHandler) authorize(c *gin.Context) bool {
+	filePath := c.Param("webdav")
+
+	var ops []string
+	switch c.Request.Method {
+	case http.MethodOptions:
+		return true
+	case http.MethodGet, http.MethodHead:
+		ops = []string{middleware.OperationRead}
+		if fi, err := h.afs.Stat(filePath); err == nil && fi.IsDir() {
+			ops = []string{middleware.OperationList}
+		}
+	case "PROPFIND":
+		ops = []string{middleware.OperationList}
+	case http.MethodDelete:
+		ops = []string{middleware.OperationDelete}
+	case "COPY":
+		ops = []string{middleware.OperationRead}
+	case "MOVE":
+		ops = []string{middleware.OperationDelete}
+	default:
+		ops = []string{middleware.OperationWrite}
+	}
+	if !middleware.Authorize(c, filePath, ops...) {
+		return false
+	}
+
+	if c.Request.Method == "COPY" || c.Request.Method == "MOVE" {
+		// The handler rejects a missing or foreign destination by itself.
+		if dst, ok := h.destination(c); ok {
+			return middleware.Authorize(c, dst, middleware.OperationWrite)
+		}
+	}
+	return true
+}
+
+// destination returns the path of the Destination header of COPY and MOVE.
+func (h *WebdavHandler) destination(c *gin.Context) (string, bool) {
+	u, err := url.Parse(c.GetHeader("Destination"))
+	if err != nil || !strings.HasPrefix(u.Path, h.fs.Prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(u.Path, h.fs.Prefix), true
+}
+
+// writtenPath returns the path written by PUT or COPY, or false for the other methods.
+func (h *WebdavHandler) writtenPath(c *gin.Context) (string, bool) {
+	switch c.Request.Method {
+	case http.MethodPut:
+		return c.Param("webdav"), true
+	case "COPY":
+		return h.destination(c)
+	default:
+		return "", false
+	}
+}
+
+// quotaResponseWriter responds 507 Insufficient Storage if a quota is exceeded,
+// instead of the status the WebDAV handler maps the error to.
+type quotaResponseWriter struct {
+	gin.ResponseWriter
+	req      *quota.Request
+	replaced bool
+}
+
+func (w *quotaResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && w.req.Exceeded() {
+		w.replaced = true
+		code = http.StatusInsufficientStorage
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *quotaResponseWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		// Discard the status text of the replaced status.
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
 func (h *WebdavHandler) HandlerRequest(c *gin.Context) {
 	h.logger.Debug().Ctx(c).Msg("WebDAV request received")
+	if !h.authorize(c) {
+		return
+	}
 	if c.Request.Method == http.MethodGet && h.handleDirList(h.fs.FileSystem, c) {
 		return
 	}
-	h.fs.ServeHTTP(c.Writer, c.Request)
+
+	dst, isWrite := h.writtenPath(c)
+	if isWrite {
+		if _, err := h.afs.Stat(dst); err == nil {
+			isWrite = false
+		}
+	}
+
+	// The files are written as the owner of the token through the file system adapter, which also names the token
+	// in the webhook events.
+	ctx, req := quota.NewContext(webhookContext(c), middleware.TokenOwner(c))
+	// A file written from an incomplete request body is discarded.
+	ctx, c.Request.Body = server.NewRequestBodyContext(ctx, c.Request.Body)
+	w := &quotaResponseWriter{ResponseWriter: c.Writer, req: req}
+	h.fs.ServeHTTP(w, c.Request.WithContext(ctx))
+	if w.replaced {
+		c.Error(quota.ErrExceeded)
+		// Remove the new file or directory left incomplete.
+		if isWrite {
+			if err := h.afs.RemoveAll(dst); err != nil {
+				h.logger.Warn().Ctx(c).Err(err).Str("path", dst).Msg("failed to remove incomplete file")
+			}
+		}
+	}
 }
 
-func RegisterWebdavHandler(e *gin.Engine, fs afero.Fs) {
+func RegisterWebdavHandler(e *gin.Engine, fs afero.Fs, t *store.TokenStore, n *webhook.Notifier) {
 	h := WebdavHandler{
 		logger: log.With().Str("logger", "webdavHandler").Logger(),
 		fs: webdav.Handler{
 			Prefix:     "/webdav",
-			FileSystem: server.AferoFSWebdavAdapter(fs),
+			FileSystem: server.AferoFSWebdavAdapter(fs, n),
 			LockSystem: webdav.NewMemLS(),
 		},
+		afs: fs,
 	}
 
-	webdav := e.Group("/webdav")
+	// WebDAV clients such as Finder, Windows Explorer and davfs2 cannot send bearer tokens,
+	// so the token is also accepted as the password of HTTP Basic auth.
+	webdav := e.Group("/webdav", transferTimeout())
 	{
-		webdav.Any("/*webdav", h.HandlerRequest)
-		for _, method := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
-			webdav.Handle(method, "/*webdav", h.HandlerRequest)
+		readOnlyAuth := middleware.NewTokenAuth(store.ScopeRead, middleware.WithBasicAuthChallenge(config.AppName), middleware.WithTokenStore(t))
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND"} {
+			webdav.Handle(method, "/*webdav", readOnlyAuth, h.HandlerRequest)
+		}
+
+		readWriteAuth := middleware.NewTokenAuth(store.ScopeWrite, middleware.WithBasicAuthChallenge(config.AppName), middleware.WithTokenStore(t))
+		for _, method := range []string{http.MethodPut, http.MethodDelete, "MKCOL", "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK"} {
+			webdav.Handle(method, "/*webdav", readWriteAuth, h.HandlerRequest)
 		}
 	}
 }
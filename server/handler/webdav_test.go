@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"golang.org/x/net/webdav"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestWebdavHandler_Archive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPPolicies, []map[string]any{
+		{"name": "lister", "token": "list-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"list"}}}},
+		{"name": "reader", "token": "read-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"list", "read"}}}},
+	})
+	defer viper.Reset()
+
+	memFs := afero.NewMemMapFs()
+	_ = afero.WriteFile(memFs, "/team-a/secret.txt", []byte("secret"), 0644)
+
+	h := &WebdavHandler{
+		logger: zerolog.Nop(),
+		fs: webdav.Handler{
+			Prefix:     "/webdav",
+			FileSystem: server.AferoFSWebdavAdapter(memFs, nil),
+			LockSystem: webdav.NewMemLS(),
+		},
+		afs: memFs,
+	}
+	e := gin.New()
+	e.GET("/webdav/*webdav", middleware.NewTokenAuth(store.ScopeRead), h.HandlerRequest)
+
+	get := func(target string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("A token which may only list a directory should list it", t, func() {
+		w := get("/webdav/team-a/", "list-token")
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Body.String(), ShouldContainSubstring, "secret.txt")
+	})
+
+	Convey("A token which may only list a directory should not archive it", t, func() {
+		w := get("/webdav/team-a/?archive=zip", "list-token")
+
+		So(w.Code, ShouldEqual, http.StatusForbidden)
+		So(w.Body.String(), ShouldNotContainSubstring, "secret")
+	})
+
+	Convey("A token which may also read a directory should archive it", t, func() {
+		w := get("/webdav/team-a/?archive=zip", "read-token")
+
+		So(w.Code, ShouldEqual, http.StatusOK)
+		So(w.Header().Get("Content-Disposition"), ShouldEqual, `attachment; filename=team-a.zip`)
+	})
+}
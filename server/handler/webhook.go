@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/middleware"
+	"github.com/wei840222/simple-file-server/server/webhook"
+)
+
+// webhookContext returns the context of the request carrying its token, so the webhook events name who made the change.
+func webhookContext(c *gin.Context) context.Context {
+	return webhook.NewContext(c.Request.Context(), webhook.Actor{
+		Token:      middleware.TokenOwner(c),
+		TokenLabel: middleware.TokenLabel(c),
+	})
+}
+
+// hashFile returns the hex digest of the content of the file, or "" when the webhooks are disabled.
+func hashFile(n *webhook.Notifier, fs afero.Fs, path string) (string, error) {
+	if !n.Enabled() {
+		return "", nil
+	}
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,53 @@
+// Package internalpath tells the directories at the root and the temporary files used by the server itself from the
+// files of the users. The layers of the file system and the handlers share it, so they agree on which paths are internal.
+package internalpath
+
+import (
+	"encoding/hex"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// Blobs keeps the content of the deduplicated files.
+	Blobs = ".blobs"
+	// Tus keeps the incomplete tus uploads.
+	Tus = ".tus"
+	// Temp kept the files being written by the previous versions, which write them next to their paths instead.
+	Temp = ".tmp"
+	// TempPrefix is the prefix of the names of the temporary files, which is followed by 32 hex digits.
+	TempPrefix = Temp + "-"
+	// Quarantine keeps the corrupted files found by the integrity scrub.
+	Quarantine = ".quarantine"
+	// Versions keeps the previous contents of the files.
+	Versions = ".versions"
+	// Trash keeps the deleted files.
+	Trash = ".trash"
+)
+
+// dirs are all internal directories. Any other directory, including the ones of the users starting with a dot, holds
+// the files of the users.
+var dirs = []string{Blobs, Tus, Temp, Quarantine, Versions, Trash}
+
+// Clean returns the path relative to the root in slash form, or "" for the root.
+func Clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// Is reports whether the path is an internal directory or in one, or a temporary file.
+func Is(name string) bool {
+	top, _, _ := strings.Cut(Clean(name), "/")
+	return slices.Contains(dirs, top) || IsTemp(name)
+}
+
+// IsTemp reports whether the path is a temporary file, which is in any directory.
+func IsTemp(name string) bool {
+	suffix, ok := strings.CutPrefix(path.Base(Clean(name)), TempPrefix)
+	if !ok || len(suffix) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(suffix)
+	return err == nil
+}
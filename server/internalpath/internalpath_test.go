@@ -0,0 +1,36 @@
+package internalpath
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIs(t *testing.T) {
+	Convey("Given the paths", t, func() {
+		Convey("The internal directories and the paths in them should be internal", func() {
+			for _, p := range []string{".tus", "/.tmp/x", ".versions/a/b", "a/../.trash", "./.blobs", ".quarantine/"} {
+				So(Is(p), ShouldBeTrue)
+			}
+		})
+
+		Convey("The temporary files in any directory should be internal", func() {
+			for _, p := range []string{".tmp-0123456789abcdef0123456789abcdef", "/a/b/.tmp-0123456789abcdef0123456789abcdef"} {
+				So(IsTemp(p), ShouldBeTrue)
+				So(Is(p), ShouldBeTrue)
+			}
+		})
+
+		Convey("The other paths should not be internal", func() {
+			for _, p := range []string{"", ".", "/", "a", ".hidden/a", "a/.tus", ".tusk", "..", "../a", "a/.tmp-notes", ".tmp-0123456789abcdef0123456789abcdeg", "a/.tmp-0123456789abcdef0123456789abcdef/b"} {
+				So(Is(p), ShouldBeFalse)
+			}
+		})
+
+		Convey("Clean should return the path relative to the root", func() {
+			So(Clean("/a/b/../c"), ShouldEqual, "a/c")
+			So(Clean("."), ShouldEqual, "")
+			So(Clean("../a"), ShouldEqual, "a")
+		})
+	})
+}
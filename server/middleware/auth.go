@@ -1,30 +1,184 @@
 package middleware
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
 
+	"github.com/wei840222/simple-file-server/config"
 	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/store"
 )
 
-func NewTokenAuth(allowedTokens []string) gin.HandlerFunc {
+const tokenLabelContextKey = "tokenLabel"
+
+type tokenAuthOptions struct {
+	basicRealm string
+	tokens     *store.TokenStore
+}
+
+type TokenAuthOption func(*tokenAuthOptions)
+
+// WithBasicAuthChallenge makes the middleware answer unauthenticated requests with
+// a "WWW-Authenticate: Basic" challenge, so clients that only speak HTTP Basic auth
+// (e.g. WebDAV clients) prompt for credentials.
+func WithBasicAuthChallenge(realm string) TokenAuthOption {
+	return func(o *tokenAuthOptions) {
+		o.basicRealm = realm
+	}
+}
+
+// WithTokenStore also allows the tokens of the store granted the scope of the route.
+func WithTokenStore(tokens *store.TokenStore) TokenAuthOption {
+	return func(o *tokenAuthOptions) {
+		o.tokens = tokens
+	}
+}
+
+// allowed returns the tokens and the client certificate subjects of the configuration granted the scope.
+// They are read on every request, so they follow the configuration.
+func allowed(scope string) ([]string, []string) {
+	tokens := viper.GetStringSlice(config.KeyHTTPReadWriteTokens)
+	subjects := viper.GetStringSlice(config.KeyHTTPTLSReadWriteSubjects)
+	if scope == store.ScopeRead {
+		// Read-write tokens and subjects are also allowed to read.
+		tokens = append(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens), tokens...)
+		subjects = append(viper.GetStringSlice(config.KeyHTTPTLSReadOnlySubjects), subjects...)
+	}
+	return tokens, subjects
+}
+
+// IsAuthEnabled reports whether authentication is enabled explicitly or implicitly by configuring any token.
+func IsAuthEnabled() bool {
+	return viper.GetBool(config.KeyHTTPEnableAuth) ||
+		len(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens)) > 0 || len(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)) > 0 ||
+		len(viper.GetStringSlice(config.KeyHTTPTLSReadOnlySubjects)) > 0 || len(viper.GetStringSlice(config.KeyHTTPTLSReadWriteSubjects)) > 0 ||
+		len(cast.ToSlice(viper.Get(config.KeyHTTPPolicies))) > 0
+}
+
+// ClientCertSubjects returns the subjects of the verified client certificate of the request,
+// which are the common name, the distinguished name and the SANs.
+func ClientCertSubjects(c *gin.Context) []string {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	cert := c.Request.TLS.VerifiedChains[0][0]
+
+	subjects := []string{cert.Subject.String()}
+	if cert.Subject.CommonName != "" {
+		subjects = append(subjects, cert.Subject.CommonName)
+	}
+	subjects = append(subjects, cert.DNSNames...)
+	subjects = append(subjects, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		subjects = append(subjects, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	return subjects
+}
+
+// ExtractToken returns the token of the request.
+// It accepts "Bearer <token>" and HTTP Basic auth with the token as the password.
+func ExtractToken(c *gin.Context) string {
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		return password
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// TokenOwner returns the fingerprint of the token the request acts for, which owns the files it writes. A request with
+// a signed URL acts for the token which signed it.
+func TokenOwner(c *gin.Context) string {
+	if owner, ok := c.Get(presignOwnerContextKey); ok {
+		return owner.(string)
+	}
+	return TokenFingerprint(ExtractToken(c))
+}
+
+// TokenFingerprint returns a short non-reversible identifier of the token, which is safe to store and log.
+func TokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	b := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(b[:8])
+}
+
+// TokenLabel returns the label of the token of the request, which is the label of a managed token or
+// the name of a policy, or "" for the other tokens.
+func TokenLabel(c *gin.Context) string {
+	if p := PolicyFromContext(c); p != nil {
+		return p.Name
+	}
+	return c.GetString(tokenLabelContextKey)
+}
+
+// NewTokenAuth allows the requests with a token or a client certificate granted the scope, or the token of a policy.
+// The operations of a policy token are authorized by the handler with Authorize, once the path is known.
+func NewTokenAuth(scope string, opts ...TokenAuthOption) gin.HandlerFunc {
+	var o tokenAuthOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// The policies are validated on startup.
+	policies, _ := LoadPolicies()
+
+	abort := func(c *gin.Context, status int, err error) {
+		if o.basicRealm != "" {
+			c.Header("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", o.basicRealm))
+			status = http.StatusUnauthorized
+		}
+		c.Error(err)
+		c.AbortWithStatusJSON(status, server.ErrorRes{
+			Error: err.Error(),
+		})
+	}
+
 	return func(c *gin.Context) {
-		if len(allowedTokens) == 0 {
-			// If no tokens are configured, skip authentication.
+		if !IsAuthEnabled() && (o.tokens == nil || o.tokens.Len() == 0) {
+			// If authentication is disabled, skip authentication.
+			c.Next()
+			return
+		}
+
+		// A signed URL authorizes the request by itself.
+		if isPresigned(c) {
+			if err := verifyPresigned(c); err != nil {
+				abortWithPresignError(c, err)
+				return
+			}
 			c.Next()
 			return
 		}
 
+		allowedTokens, allowedSubjects := allowed(scope)
+
+		// A verified client certificate of an allowed subject authorizes the request without a token.
+		if len(allowedSubjects) > 0 {
+			for _, subject := range ClientCertSubjects(c) {
+				if slices.Contains(allowedSubjects, subject) {
+					c.Next()
+					return
+				}
+			}
+		}
+
 		// Extract the token from the Authorization header.
-		// The header should be in the format "Bearer <token>"
-		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		// The header should be in the format "Bearer <token>" or "Basic <base64(user:token)>".
+		token := ExtractToken(c)
 		if token == "" {
-			c.Error(server.ErrAuthTokenRequired)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, server.ErrorRes{
-				Error: server.ErrAuthTokenRequired.Error(),
-			})
+			abort(c, http.StatusUnauthorized, server.ErrAuthTokenRequired)
 			return
 		}
 
@@ -36,10 +190,33 @@ func NewTokenAuth(allowedTokens []string) gin.HandlerFunc {
 			}
 		}
 
+		for i := range policies {
+			if token == policies[i].Token {
+				c.Set(policyContextKey, &policies[i])
+				c.Next()
+				return
+			}
+		}
+
+		if o.tokens != nil {
+			t, err := o.tokens.Verify(token)
+			switch {
+			case err == nil && t.HasScope(scope):
+				c.Set(tokenLabelContextKey, t.Label)
+				c.Next()
+				return
+			case err == nil:
+				abort(c, http.StatusForbidden, fmt.Errorf("%w: %s scope is required", server.ErrAuthPermissionDenied, scope))
+				return
+			case errors.Is(err, store.ErrTokenExpired):
+				abort(c, http.StatusUnauthorized, err)
+				return
+			case !errors.Is(err, store.ErrTokenInvalid):
+				panic(err)
+			}
+		}
+
 		// If the token is not in the list, return an error.
-		c.Error(server.ErrAuthTokenInvalid)
-		c.AbortWithStatusJSON(http.StatusForbidden, server.ErrorRes{
-			Error: server.ErrAuthTokenInvalid.Error(),
-		})
+		abort(c, http.StatusForbidden, server.ErrAuthTokenInvalid)
 	}
 }
@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestNewTokenAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPReadOnlyTokens, []string{"ro-token"})
+	viper.Set(config.KeyHTTPReadWriteTokens, []string{"rw-token"})
+	viper.Set(config.KeyHTTPTLSReadWriteSubjects, []string{"writer.example.com"})
+	defer viper.Reset()
+
+	newEngine := func(opts ...TokenAuthOption) *gin.Engine {
+		e := gin.New()
+		e.PUT("/", NewTokenAuth(store.ScopeWrite, opts...), func(c *gin.Context) {
+			c.Header("X-Token-Label", TokenLabel(c))
+			c.Status(http.StatusNoContent)
+		})
+		return e
+	}
+
+	Convey("Given a token auth middleware", t, func() {
+		e := newEngine()
+
+		Convey("A request without token should be unauthorized", func() {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", nil))
+
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Header().Get("WWW-Authenticate"), ShouldBeEmpty)
+		})
+
+		Convey("A request with an unknown bearer token should be forbidden", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Header.Set("Authorization", "Bearer unknown-token")
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A request with a valid bearer token should pass", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Header.Set("Authorization", "Bearer rw-token")
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("A request with the token as basic auth password should pass", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.SetBasicAuth("anyone", "rw-token")
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+		})
+	})
+
+	Convey("Given a token auth middleware with basic auth challenge", t, func() {
+		e := newEngine(WithBasicAuthChallenge(config.AppName))
+
+		Convey("A request with a wrong password should be challenged", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.SetBasicAuth("anyone", "ro-token")
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+			So(w.Header().Get("WWW-Authenticate"), ShouldEqual, `Basic realm="simple-file-server"`)
+		})
+	})
+
+	Convey("Given a token auth middleware of the read scope", t, func() {
+		e := gin.New()
+		e.GET("/", NewTokenAuth(store.ScopeRead), func(c *gin.Context) {
+			c.Status(http.StatusNoContent)
+		})
+
+		Convey("Both read-only and read-write tokens should pass", func() {
+			for _, token := range []string{"ro-token", "rw-token"} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("Authorization", "Bearer "+token)
+				e.ServeHTTP(w, r)
+
+				So(w.Code, ShouldEqual, http.StatusNoContent)
+			}
+		})
+	})
+
+	Convey("Given a token auth middleware of the write scope", t, func() {
+		e := newEngine()
+
+		Convey("A read-only token should be forbidden", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Header.Set("Authorization", "Bearer ro-token")
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Given a token auth middleware with a token store", t, func() {
+		db, err := store.OpenDB(filepath.Join(t.TempDir(), "tokens.db"))
+		So(err, ShouldBeNil)
+		Reset(func() { db.Close() })
+		tokens, err := store.NewTokenStoreWithDB(db)
+		So(err, ShouldBeNil)
+
+		e := newEngine(WithTokenStore(tokens))
+		put := func(token string) int {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			e.ServeHTTP(w, r)
+			return w.Code
+		}
+
+		Convey("A stored token of the write scope should pass", func() {
+			_, token, err := tokens.Create("ci", []string{store.ScopeWrite}, 0)
+			So(err, ShouldBeNil)
+
+			So(put(token), ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("The label of a stored token should be known to the handler", func() {
+			_, token, err := tokens.Create("ci", []string{store.ScopeWrite}, 0)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			e.ServeHTTP(w, r)
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+			So(w.Header().Get("X-Token-Label"), ShouldEqual, "ci")
+		})
+
+		Convey("A stored token of the read scope should be forbidden", func() {
+			_, token, err := tokens.Create("reader", []string{store.ScopeRead}, 0)
+			So(err, ShouldBeNil)
+
+			So(put(token), ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A revoked token should be forbidden", func() {
+			record, token, err := tokens.Create("ci", []string{store.ScopeWrite}, 0)
+			So(err, ShouldBeNil)
+			So(put(token), ShouldEqual, http.StatusNoContent)
+
+			So(tokens.Revoke(record.ID), ShouldBeNil)
+			So(put(token), ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("The static tokens should still pass", func() {
+			So(put("rw-token"), ShouldEqual, http.StatusNoContent)
+		})
+	})
+
+	Convey("Given a token auth middleware with client certificate subjects", t, func() {
+		e := newEngine()
+
+		withCert := func(r *http.Request, cert *x509.Certificate) {
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+
+		Convey("A request with a verified certificate of an allowed SAN should pass", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			withCert(r, &x509.Certificate{Subject: pkix.Name{CommonName: "writer"}, DNSNames: []string{"writer.example.com"}})
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("A request with a verified certificate of another subject should require a token", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			withCert(r, &x509.Certificate{Subject: pkix.Name{CommonName: "reader"}})
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("A request with an unverified certificate should require a token", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/", nil)
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{DNSNames: []string{"writer.example.com"}}},
+			}
+			e.ServeHTTP(w, r)
+
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+)
+
+const (
+	OperationRead   = "read"
+	OperationWrite  = "write"
+	OperationDelete = "delete"
+	OperationList   = "list"
+
+	policyContextKey = "policy"
+)
+
+var allOperations = []string{OperationRead, OperationWrite, OperationDelete, OperationList}
+
+// Policy grants a named token the operations on the paths of its rules.
+type Policy struct {
+	Name  string       `mapstructure:"name" json:"name"`
+	Token string       `mapstructure:"token" json:"-"`
+	Rules []PolicyRule `mapstructure:"rules" json:"rules"`
+}
+
+// PolicyRule allows the operations on the path and everything under it. The path can be a glob pattern,
+// which is matched against the requested path and each of its parent directories.
+type PolicyRule struct {
+	Path       string   `mapstructure:"path" json:"path"`
+	Operations []string `mapstructure:"operations" json:"operations"`
+}
+
+// LoadPolicies returns the policies of the configuration, or an error if any of them is invalid.
+func LoadPolicies() ([]Policy, error) {
+	var policies []Policy
+	if err := viper.UnmarshalKey(config.KeyHTTPPolicies, &policies); err != nil {
+		return nil, err
+	}
+
+	for i, p := range policies {
+		if p.Name == "" || p.Token == "" {
+			return nil, fmt.Errorf("policy #%d: name and token are required", i)
+		}
+		for j, r := range p.Rules {
+			if _, err := path.Match(cleanPolicyPath(r.Path), ""); err != nil {
+				return nil, fmt.Errorf("policy %s: rule #%d: %w", p.Name, j, err)
+			}
+			for _, op := range r.Operations {
+				if !slices.Contains(allOperations, op) {
+					return nil, fmt.Errorf("policy %s: rule #%d: unknown operation %q", p.Name, j, op)
+				}
+			}
+		}
+	}
+
+	return policies, nil
+}
+
+func cleanPolicyPath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// Allows reports whether the policy allows the operation on the path.
+func (p *Policy) Allows(filePath string, op string) bool {
+	filePath = cleanPolicyPath(filePath)
+	for _, r := range p.Rules {
+		if !slices.Contains(r.Operations, op) {
+			continue
+		}
+		pattern := cleanPolicyPath(r.Path)
+		if pattern == "" {
+			return true
+		}
+		// The rule also covers everything under the matched directories.
+		for dir := filePath; dir != "" && dir != "."; dir = path.Dir(dir) {
+			if matched, _ := path.Match(pattern, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PolicyFromContext returns the policy of the token of the request, or nil if the token has no policy.
+func PolicyFromContext(c *gin.Context) *Policy {
+	v, ok := c.Get(policyContextKey)
+	if !ok {
+		return nil
+	}
+	return v.(*Policy)
+}
+
+// Authorize aborts the request with 403 unless the policy of the token allows the operations on the path.
+// Requests without a policy, e.g. authenticated by the read-only or read-write tokens, are already authorized by the route.
+func Authorize(c *gin.Context, filePath string, ops ...string) bool {
+	p := PolicyFromContext(c)
+	if p == nil {
+		return true
+	}
+
+	for _, op := range ops {
+		if !p.Allows(filePath, op) {
+			err := fmt.Errorf("%w: %s %s", server.ErrAuthPermissionDenied, op, filePath)
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusForbidden, server.ErrorRes{
+				Error: err.Error(),
+			})
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	Convey("Given a policy with a prefix rule and a glob rule", t, func() {
+		p := &Policy{
+			Name: "team-a",
+			Rules: []PolicyRule{
+				{Path: "/team-a/", Operations: []string{OperationRead, OperationWrite, OperationList}},
+				{Path: "shared/*.pdf", Operations: []string{OperationRead}},
+			},
+		}
+
+		Convey("The operations should be allowed on the prefix and everything under it", func() {
+			So(p.Allows("team-a", OperationList), ShouldBeTrue)
+			So(p.Allows("/team-a/docs/a.txt", OperationWrite), ShouldBeTrue)
+			So(p.Allows("team-a/docs/a.txt", OperationDelete), ShouldBeFalse)
+		})
+
+		Convey("The prefix should not match the siblings with the same beginning", func() {
+			So(p.Allows("team-ab/a.txt", OperationRead), ShouldBeFalse)
+		})
+
+		Convey("The glob should match the files in the directory only", func() {
+			So(p.Allows("shared/a.pdf", OperationRead), ShouldBeTrue)
+			So(p.Allows("shared/a.txt", OperationRead), ShouldBeFalse)
+			So(p.Allows("shared/a.pdf", OperationWrite), ShouldBeFalse)
+		})
+
+		Convey("Nothing should be allowed at the root", func() {
+			So(p.Allows("", OperationList), ShouldBeFalse)
+		})
+
+		Convey("The path should not escape the root", func() {
+			So(p.Allows("../team-a/a.txt", OperationRead), ShouldBeTrue)
+			So(p.Allows("team-a/../team-b/a.txt", OperationRead), ShouldBeFalse)
+		})
+	})
+}
+
+func TestLoadPolicies(t *testing.T) {
+	defer viper.Reset()
+
+	Convey("Given valid policies", t, func() {
+		viper.Reset()
+		viper.Set(config.KeyHTTPPolicies, []map[string]any{
+			{"name": "team-a", "token": "a-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"read"}}}},
+		})
+
+		Convey("They should be loaded", func() {
+			policies, err := LoadPolicies()
+			So(err, ShouldBeNil)
+			So(policies, ShouldHaveLength, 1)
+			So(policies[0].Rules[0].Path, ShouldEqual, "/team-a")
+		})
+	})
+
+	Convey("Given a policy with an unknown operation", t, func() {
+		viper.Reset()
+		viper.Set(config.KeyHTTPPolicies, []map[string]any{
+			{"name": "team-a", "token": "a-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"rename"}}}},
+		})
+
+		Convey("It should fail", func() {
+			_, err := LoadPolicies()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a policy without token", t, func() {
+		viper.Reset()
+		viper.Set(config.KeyHTTPPolicies, []map[string]any{{"name": "team-a"}})
+
+		Convey("It should fail", func() {
+			_, err := LoadPolicies()
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPReadWriteTokens, []string{"rw-token"})
+	viper.Set(config.KeyHTTPPolicies, []map[string]any{
+		{"name": "team-a", "token": "a-token", "rules": []map[string]any{{"path": "/team-a", "operations": []string{"write"}}}},
+	})
+	defer viper.Reset()
+
+	e := gin.New()
+	e.PUT("/*path", NewTokenAuth(store.ScopeWrite), func(c *gin.Context) {
+		if !Authorize(c, c.Param("path"), OperationWrite) {
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	put := func(path string, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPut, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		e.ServeHTTP(w, r)
+		return w
+	}
+
+	Convey("Given a route authorizing the writes", t, func() {
+		Convey("The token of a policy should write in its subtree", func() {
+			So(put("/team-a/a.txt", "a-token").Code, ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("The token of a policy should be forbidden outside its subtree", func() {
+			w := put("/team-b/a.txt", "a-token")
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+			So(strings.Contains(w.Body.String(), "permission denied"), ShouldBeTrue)
+		})
+
+		Convey("The tokens without policy should not be restricted", func() {
+			So(put("/team-b/a.txt", "rw-token").Code, ShouldEqual, http.StatusNoContent)
+		})
+	})
+}
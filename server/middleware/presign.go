@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+)
+
+const (
+	QueryPresignKey       = "presign_key"
+	QueryPresignExpires   = "presign_expires"
+	QueryPresignMaxLength = "presign_max_length"
+	QueryPresignOwner     = "presign_owner"
+	QueryPresignSignature = "presign_signature"
+
+	queryPresignPrefix = "presign_"
+
+	presignOwnerContextKey = "presignOwner"
+)
+
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// SigningKeys returns the configured signing keys. Each key is in the format "<id>:<secret>".
+// The first key signs new URLs, and all of them verify, so keys can be rotated by prepending a new one.
+func SigningKeys() []SigningKey {
+	var keys []SigningKey
+	for _, k := range viper.GetStringSlice(config.KeyHTTPSigningKeys) {
+		id, secret, ok := strings.Cut(k, ":")
+		if !ok {
+			// Without an explicit ID, the key is identified by its fingerprint.
+			id, secret = TokenFingerprint(k)[:8], k
+		}
+		if id == "" || secret == "" {
+			continue
+		}
+		keys = append(keys, SigningKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys
+}
+
+type PresignOptions struct {
+	Method    string
+	Path      string
+	ExpiresAt time.Time
+	// MaxContentLength limits the request body of the signed URL. Zero means no limit.
+	MaxContentLength int64
+	// Owner is the fingerprint of the token which signed the URL, which the files written by the URL are charged to.
+	Owner string
+	// Query is the other query parameters of the URL, such as "recursive", which are signed as well, so none can be
+	// added to or changed in a signed URL.
+	Query url.Values
+}
+
+// otherQuery returns the query parameters other than the ones of the signature, or nil if there are none.
+func otherQuery(q url.Values) url.Values {
+	var other url.Values
+	for k, v := range q {
+		if strings.HasPrefix(k, queryPresignPrefix) {
+			continue
+		}
+		if other == nil {
+			other = url.Values{}
+		}
+		other[k] = v
+	}
+	return other
+}
+
+func (o PresignOptions) sign(key SigningKey) string {
+	fields := []string{
+		strings.ToUpper(o.Method),
+		o.Path,
+		strconv.FormatInt(o.ExpiresAt.Unix(), 10),
+		strconv.FormatInt(o.MaxContentLength, 10),
+	}
+	// The URLs without an owner or other query parameters are signed as before, so they stay valid.
+	if o.Owner != "" || len(o.Query) > 0 {
+		fields = append(fields, o.Owner)
+	}
+	if len(o.Query) > 0 {
+		fields = append(fields, o.Query.Encode())
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Presign returns the query parameters that authorize the request of the method to the path until the expiration,
+// including the other query parameters of the options.
+func Presign(key SigningKey, o PresignOptions) url.Values {
+	q := url.Values{}
+	for k, v := range o.Query {
+		q[k] = v
+	}
+	q.Set(QueryPresignKey, key.ID)
+	q.Set(QueryPresignExpires, strconv.FormatInt(o.ExpiresAt.Unix(), 10))
+	if o.MaxContentLength > 0 {
+		q.Set(QueryPresignMaxLength, strconv.FormatInt(o.MaxContentLength, 10))
+	}
+	if o.Owner != "" {
+		q.Set(QueryPresignOwner, o.Owner)
+	}
+	q.Set(QueryPresignSignature, o.sign(key))
+	return q
+}
+
+// PresignURL validates the options and returns the URL signed with the first signing key. The files written by the URL
+// are charged to the owner, which is the fingerprint of the token signing it, or "" for none. The query parameters of
+// the path, such as "?recursive=true", are signed with it.
+func PresignURL(baseURL string, method string, path string, expire time.Duration, maxContentLength int64, owner string) (string, time.Time, error) {
+	keys := SigningKeys()
+	if len(keys) == 0 {
+		return "", time.Time{}, server.ErrPresignKeyNotConfigured
+	}
+
+	method = strings.ToUpper(method)
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		return "", time.Time{}, server.ErrPresignMethodInvalid
+	}
+
+	if expire < time.Second || expire > 7*24*time.Hour {
+		return "", time.Time{}, server.ErrPresignExpireInvalid
+	}
+
+	if maxContentLength < 0 {
+		return "", time.Time{}, server.ErrPresignMaxLengthInvalid
+	}
+
+	u, err := url.Parse(strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(path, "/"))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	o := PresignOptions{
+		Method:           method,
+		Path:             u.Path,
+		ExpiresAt:        time.Now().Add(expire).Truncate(time.Second),
+		MaxContentLength: maxContentLength,
+		Owner:            owner,
+		Query:            otherQuery(u.Query()),
+	}
+	u.RawQuery = Presign(keys[0], o).Encode()
+
+	return u.String(), o.ExpiresAt, nil
+}
+
+func isPresigned(c *gin.Context) bool {
+	return c.Query(QueryPresignSignature) != ""
+}
+
+// verifyPresigned verifies the signed URL of the request, including all of its query parameters, and limits the request
+// body to the signed maximum content length.
+func verifyPresigned(c *gin.Context) error {
+	expires, err := strconv.ParseInt(c.Query(QueryPresignExpires), 10, 64)
+	if err != nil {
+		return server.ErrPresignInvalid
+	}
+
+	var maxContentLength int64
+	if v := c.Query(QueryPresignMaxLength); v != "" {
+		if maxContentLength, err = strconv.ParseInt(v, 10, 64); err != nil || maxContentLength <= 0 {
+			return server.ErrPresignInvalid
+		}
+	}
+
+	signature, err := hex.DecodeString(c.Query(QueryPresignSignature))
+	if err != nil {
+		return server.ErrPresignInvalid
+	}
+
+	// The fields are signed joined by newlines, so an owner with a newline could pass the other fields as its own.
+	owner := c.Query(QueryPresignOwner)
+	if strings.Contains(owner, "\n") {
+		return server.ErrPresignInvalid
+	}
+	query := otherQuery(c.Request.URL.Query())
+
+	methods := []string{c.Request.Method}
+	if c.Request.Method == http.MethodHead {
+		// A URL signed for GET can also be used for HEAD.
+		methods = append(methods, http.MethodGet)
+	}
+
+	keyID := c.Query(QueryPresignKey)
+	for _, key := range SigningKeys() {
+		if key.ID != keyID {
+			continue
+		}
+		for _, method := range methods {
+			o := PresignOptions{
+				Method:           method,
+				Path:             c.Request.URL.Path,
+				ExpiresAt:        time.Unix(expires, 0),
+				MaxContentLength: maxContentLength,
+				Owner:            owner,
+				Query:            query,
+			}
+			expected, _ := hex.DecodeString(o.sign(key))
+			if !hmac.Equal(signature, expected) {
+				continue
+			}
+
+			if time.Now().After(o.ExpiresAt) {
+				return server.ErrPresignExpired
+			}
+			if maxContentLength > 0 {
+				if c.Request.ContentLength > maxContentLength {
+					return server.ErrFileSizeLimitExceeded
+				}
+				c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxContentLength)
+			}
+			c.Set(presignOwnerContextKey, o.Owner)
+			return nil
+		}
+	}
+
+	return server.ErrPresignInvalid
+}
+
+func abortWithPresignError(c *gin.Context, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, server.ErrFileSizeLimitExceeded) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	c.Error(err)
+	c.AbortWithStatusJSON(status, server.ErrorRes{
+		Error: err.Error(),
+	})
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestPresign(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPReadWriteTokens, []string{"rw-token"})
+	viper.Set(config.KeyHTTPSigningKeys, []string{"new:new-secret", "old:old-secret"})
+	defer viper.Reset()
+
+	e := gin.New()
+	handler := func(c *gin.Context) { c.Status(http.StatusNoContent) }
+	e.GET("/files/*path", NewTokenAuth(store.ScopeWrite), handler)
+	e.DELETE("/files/*path", NewTokenAuth(store.ScopeWrite), func(c *gin.Context) { c.String(http.StatusOK, c.Query("recursive")) })
+	e.POST("/files/*path", NewTokenAuth(store.ScopeWrite), func(c *gin.Context) { c.String(http.StatusOK, TokenOwner(c)) })
+	e.PUT("/files/*path", NewTokenAuth(store.ScopeWrite), func(c *gin.Context) {
+		if _, err := c.GetRawData(); err != nil {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	do := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w.Code
+	}
+
+	Convey("Given a URL signed for GET", t, func() {
+		u, _, err := PresignURL("http://localhost:8080", http.MethodGet, "/files/a.txt", time.Minute, 0, "")
+		So(err, ShouldBeNil)
+		parsed, _ := url.Parse(u)
+		target := parsed.RequestURI()
+
+		Convey("GET on the path should pass", func() {
+			So(do(http.MethodGet, target, ""), ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("Another path should be forbidden", func() {
+			So(do(http.MethodGet, strings.Replace(target, "a.txt", "b.txt", 1), ""), ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("Another method should be forbidden", func() {
+			So(do(http.MethodPut, target, ""), ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Given a URL signed with an old key", t, func() {
+		key := SigningKey{ID: "old", Secret: []byte("old-secret")}
+		q := Presign(key, PresignOptions{Method: http.MethodGet, Path: "/files/a.txt", ExpiresAt: time.Now().Add(time.Minute)})
+
+		Convey("It should still pass after rotation", func() {
+			So(do(http.MethodGet, "/files/a.txt?"+q.Encode(), ""), ShouldEqual, http.StatusNoContent)
+		})
+	})
+
+	Convey("Given an expired URL", t, func() {
+		key := SigningKeys()[0]
+		q := Presign(key, PresignOptions{Method: http.MethodGet, Path: "/files/a.txt", ExpiresAt: time.Now().Add(-time.Minute)})
+
+		Convey("It should be forbidden", func() {
+			So(do(http.MethodGet, "/files/a.txt?"+q.Encode(), ""), ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Given a URL signed by a token", t, func() {
+		owner := TokenFingerprint("rw-token")
+		u, _, err := PresignURL("", http.MethodPost, "/files/up.txt", time.Minute, 0, owner)
+		So(err, ShouldBeNil)
+
+		Convey("The request should act for the token", func() {
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, u, nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, owner)
+		})
+
+		Convey("Another owner should be forbidden", func() {
+			So(do(http.MethodPost, strings.Replace(u, owner, TokenFingerprint("other"), 1), ""), ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Given a URL signed for PUT with a max content length", t, func() {
+		u, _, err := PresignURL("", http.MethodPut, "/files/up.txt", time.Minute, 4, "")
+		So(err, ShouldBeNil)
+
+		Convey("A small body should pass", func() {
+			So(do(http.MethodPut, u, "abc"), ShouldEqual, http.StatusNoContent)
+		})
+
+		Convey("A large body should be rejected", func() {
+			So(do(http.MethodPut, u, "abcdef"), ShouldEqual, http.StatusRequestEntityTooLarge)
+		})
+	})
+
+	Convey("Given a URL signed for DELETE", t, func() {
+		u, _, err := PresignURL("", http.MethodDelete, "/files/dir", time.Minute, 0, "")
+		So(err, ShouldBeNil)
+
+		Convey("Adding a query parameter should be forbidden", func() {
+			So(do(http.MethodDelete, u+"&recursive=true", ""), ShouldEqual, http.StatusForbidden)
+			So(do(http.MethodDelete, "/files/dir?recursive=true&"+strings.SplitN(u, "?", 2)[1], ""), ShouldEqual, http.StatusForbidden)
+		})
+
+		Convey("A query parameter of the signed path should be signed", func() {
+			u, _, err := PresignURL("", http.MethodDelete, "/files/dir?recursive=true", time.Minute, 0, "")
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			e.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, u, nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldEqual, "true")
+
+			So(do(http.MethodDelete, strings.Replace(u, "recursive=true", "recursive=false", 1), ""), ShouldEqual, http.StatusForbidden)
+			So(do(http.MethodDelete, strings.Replace(u, "&recursive=true", "", 1), ""), ShouldEqual, http.StatusForbidden)
+		})
+	})
+
+	Convey("Given a URL signed by a token with an owner carrying a newline", t, func() {
+		key := SigningKeys()[0]
+		q := Presign(key, PresignOptions{Method: http.MethodGet, Path: "/files/a.txt", ExpiresAt: time.Now().Add(time.Minute), Owner: "a\nb"})
+
+		Convey("It should be forbidden", func() {
+			So(do(http.MethodGet, "/files/a.txt?"+q.Encode(), ""), ShouldEqual, http.StatusForbidden)
+		})
+	})
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+// TrustedProxies returns the address ranges of the configured trusted proxies. An address without a prefix length is
+// a single address. The invalid ones are skipped, as the server refuses to start with them.
+func TrustedProxies() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range viper.GetStringSlice(config.KeyHTTPTrustedProxies) {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+// IsFromTrustedProxy reports whether the request is from a trusted proxy, so its forwarded headers are honoured.
+func IsFromTrustedProxy(c *gin.Context) bool {
+	a, err := netip.ParseAddr(c.RemoteIP())
+	if err != nil {
+		return false
+	}
+	a = a.Unmap()
+	for _, p := range TrustedProxies() {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedProto returns the scheme in X-Forwarded-Proto of the request from a trusted proxy, which is "http" or
+// "https", or "" otherwise.
+func ForwardedProto(c *gin.Context) string {
+	if !IsFromTrustedProxy(c) {
+		return ""
+	}
+	switch proto := strings.ToLower(c.GetHeader("X-Forwarded-Proto")); proto {
+	case "http", "https":
+		return proto
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+func TestForwardedProto(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPTrustedProxies, []string{"10.0.0.0/8", "192.168.1.1", "invalid"})
+	defer viper.Reset()
+
+	e := gin.New()
+	e.GET("/", func(c *gin.Context) { c.String(http.StatusOK, ForwardedProto(c)) })
+
+	proto := func(remoteAddr string, header string) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-Forwarded-Proto", header)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	Convey("Given the requests with X-Forwarded-Proto", t, func() {
+		Convey("The header of a trusted proxy should be honoured", func() {
+			So(proto("10.1.2.3:1234", "https"), ShouldEqual, "https")
+			So(proto("192.168.1.1:1234", "HTTP"), ShouldEqual, "http")
+			So(proto("[::ffff:10.1.2.3]:1234", "https"), ShouldEqual, "https")
+		})
+
+		Convey("The header of another client should be ignored", func() {
+			So(proto("192.168.1.2:1234", "https"), ShouldEqual, "")
+			So(proto("203.0.113.1:1234", "https"), ShouldEqual, "")
+		})
+
+		Convey("Another scheme should be ignored", func() {
+			So(proto("10.1.2.3:1234", "javascript"), ShouldEqual, "")
+			So(proto("10.1.2.3:1234", ""), ShouldEqual, "")
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+// deadline extends a deadline of the connection by the idle duration, but not beyond the end.
+type deadline struct {
+	set  func(time.Time) error
+	idle time.Duration
+	end  time.Time
+	last time.Time
+}
+
+func (d *deadline) extend(now time.Time) error {
+	// Setting the deadline on every read or write is unnecessary, and a fixed one is only set once.
+	if !d.last.IsZero() && (d.idle <= 0 || now.Sub(d.last) < d.idle/10) {
+		return nil
+	}
+	d.last = now
+
+	t := d.end
+	if d.idle > 0 {
+		if next := now.Add(d.idle); t.IsZero() || next.Before(t) {
+			t = next
+		}
+	}
+	return d.set(t)
+}
+
+type progressReader struct {
+	io.ReadCloser
+	deadline *deadline
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.deadline.extend(time.Now())
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	gin.ResponseWriter
+	deadline *deadline
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if n > 0 {
+		w.deadline.extend(time.Now())
+	}
+	return n, err
+}
+
+func (w *progressWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	if n > 0 {
+		w.deadline.extend(time.Now())
+	}
+	return n, err
+}
+
+func (w *progressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewTransferTimeout overrides the read and write timeouts of the server for the routes transferring files.
+// While the request body is being read or the response is being written, the deadline is extended by the
+// read or write timeout of the server, so a transfer only fails when it stalls, or takes longer than
+// readTimeout or writeTimeout in total. Zero means no limit in total.
+func NewTransferTimeout(readTimeout time.Duration, writeTimeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		now := time.Now()
+		rc := http.NewResponseController(c.Writer)
+
+		read := &deadline{set: rc.SetReadDeadline, idle: viper.GetDuration(config.KeyHTTPReadTimeout)}
+		if readTimeout > 0 {
+			read.end = now.Add(readTimeout)
+		}
+		write := &deadline{set: rc.SetWriteDeadline, idle: viper.GetDuration(config.KeyHTTPWriteTimeout)}
+		if writeTimeout > 0 {
+			write.end = now.Add(writeTimeout)
+		}
+
+		// The deadlines are not supported by the writer, e.g. in tests.
+		if err := read.extend(now); err != nil {
+			c.Next()
+			return
+		}
+		if err := write.extend(now); err != nil {
+			c.Next()
+			return
+		}
+
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = &progressReader{ReadCloser: c.Request.Body, deadline: read}
+		}
+		c.Writer = &progressWriter{ResponseWriter: c.Writer, deadline: write}
+
+		c.Next()
+	}
+}
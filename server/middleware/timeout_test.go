@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+func TestTransferTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	viper.Set(config.KeyHTTPReadTimeout, 300*time.Millisecond)
+	defer viper.Reset()
+
+	handler := func(c *gin.Context) {
+		b, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatus(http.StatusRequestTimeout)
+			return
+		}
+		c.String(http.StatusOK, "%d", len(b))
+	}
+
+	e := gin.New()
+	e.PUT("/plain", handler)
+	e.PUT("/transfer", NewTransferTimeout(0, 0), handler)
+	e.PUT("/limited", NewTransferTimeout(500*time.Millisecond, 0), handler)
+
+	srv := httptest.NewUnstartedServer(e)
+	srv.Config.ReadTimeout = viper.GetDuration(config.KeyHTTPReadTimeout)
+	srv.Start()
+	defer srv.Close()
+
+	// upload sends the chunks of the body with the interval, and reports whether the upload succeeded.
+	upload := func(path string, chunks int, interval time.Duration) bool {
+		pr, pw := io.Pipe()
+		go func() {
+			for range chunks {
+				time.Sleep(interval)
+				if _, err := pw.Write([]byte("x")); err != nil {
+					return
+				}
+			}
+			pw.Close()
+		}()
+
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+path, pr)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}
+
+	Convey("Given an upload slower than the read timeout in total", t, func() {
+		Convey("It should fail without the transfer timeout", func() {
+			So(upload("/plain", 8, 100*time.Millisecond), ShouldBeFalse)
+		})
+
+		Convey("It should succeed with the transfer timeout while making progress", func() {
+			So(upload("/transfer", 8, 100*time.Millisecond), ShouldBeTrue)
+		})
+
+		Convey("It should fail beyond the total transfer timeout", func() {
+			So(upload("/limited", 8, 100*time.Millisecond), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given an upload stalling longer than the read timeout", t, func() {
+		Convey("It should fail with the transfer timeout", func() {
+			So(upload("/transfer", 2, 500*time.Millisecond), ShouldBeFalse)
+		})
+	})
+}
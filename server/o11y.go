@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -23,6 +24,7 @@ import (
 	"go.uber.org/fx"
 
 	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
 )
 
 func NewTracerProvider(lc fx.Lifecycle) (trace.TracerProvider, error) {
@@ -81,12 +83,15 @@ func NewMeterProvider(lc fx.Lifecycle) (metric.MeterProvider, error) {
 	return provider, nil
 }
 
-func RunO11yHTTPServer(lc fx.Lifecycle) {
+func RunO11yHTTPServer(lc fx.Lifecycle, tlsConfig *tls.Config, tokens *store.TokenStore, scrub *store.ScrubStore) {
 	mux := http.NewServeMux()
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", viper.GetString(config.KeyO11yHost), viper.GetInt(config.KeyO11yPort)),
 		Handler: mux,
 	}
+	if viper.GetBool(config.KeyO11yEnableTLS) {
+		srv.TLSConfig = tlsConfig
+	}
 
 	var isShuttingDown bool
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
@@ -100,11 +105,12 @@ func RunO11yHTTPServer(lc fx.Lifecycle) {
 	})
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	registerAdminHandler(mux, tokens, scrub)
 
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				if err := listenAndServe(srv); err != nil && err != http.ErrServerClosed {
 					panic(err)
 				}
 			}()
@@ -0,0 +1,90 @@
+package quota
+
+import (
+	"github.com/spf13/afero"
+)
+
+// file counts the bytes written beyond the end of the file against the quotas before writing them.
+type file struct {
+	afero.File
+	fs   *Fs
+	name string
+	size int64
+	pos  int64
+}
+
+// reserve adds the growth of the file by writing n bytes at the offset.
+func (f *file) reserve(off int64, n int) (int64, error) {
+	growth := max(off+int64(n)-f.size, 0)
+	if growth == 0 {
+		return 0, nil
+	}
+	if err := f.fs.t.grow(f.name, growth); err != nil {
+		return 0, f.fs.exceeded(err)
+	}
+	return growth, nil
+}
+
+// settle gives back the reserved growth which is not written, and updates the size.
+func (f *file) settle(off int64, written int, reserved int64) {
+	end := off + int64(written)
+	if growth := max(end-f.size, 0); growth < reserved {
+		f.fs.t.grow(f.name, growth-reserved)
+	}
+	f.size = max(f.size, end)
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	reserved, err := f.reserve(f.pos, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	f.settle(f.pos, n, reserved)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	reserved, err := f.reserve(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.WriteAt(p, off)
+	f.settle(off, n, reserved)
+	return n, err
+}
+
+func (f *file) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
+}
+
+func (f *file) Truncate(size int64) error {
+	reserved, err := f.reserve(size, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		f.fs.t.grow(f.name, -reserved)
+		return err
+	}
+	if size < f.size {
+		f.fs.t.grow(f.name, size-f.size)
+	}
+	f.size = size
+	return nil
+}
@@ -0,0 +1,490 @@
+// Package quota limits the bytes and the number of files per owner and per top-level directory of an afero.Fs.
+package quota
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+var ErrExceeded = errors.New("storage quota exceeded")
+
+// Limits is the maximum usage. Zero means unlimited.
+type Limits struct {
+	MaxBytes int64 `json:"maxBytes,omitempty"`
+	MaxFiles int64 `json:"maxFiles,omitempty"`
+}
+
+func (l Limits) exceeded(u *Usage, bytes int64, files int64) bool {
+	return (l.MaxBytes > 0 && bytes > 0 && u.Bytes+bytes > l.MaxBytes) || (l.MaxFiles > 0 && files > 0 && u.Files+files > l.MaxFiles)
+}
+
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+type Options struct {
+	// Owner limits the files written by each owner. The files without owner are not limited.
+	Owner Limits
+	// Directory limits each top-level directory. The files at the root count as the directory "".
+	// Hidden directories such as ".tus" are not limited.
+	Directory Limits
+}
+
+// Request is the state of the quotas in the context of a request.
+type Request struct {
+	Owner    string
+	exceeded atomic.Bool
+}
+
+// Exceeded reports whether any operation of the request exceeded a quota.
+func (r *Request) Exceeded() bool {
+	return r.exceeded.Load()
+}
+
+type requestContextKey struct{}
+
+// NewContext returns a context with the request writing the files as the owner.
+func NewContext(ctx context.Context, owner string) (context.Context, *Request) {
+	r := &Request{Owner: owner}
+	return context.WithValue(ctx, requestContextKey{}, r), r
+}
+
+// FromContext returns the request of the context, or nil if there is none.
+func FromContext(ctx context.Context) *Request {
+	r, _ := ctx.Value(requestContextKey{}).(*Request)
+	return r
+}
+
+// TopDir returns the top-level directory of the directory at the path, or "" for the root.
+func TopDir(dir string) string {
+	top, _, _ := strings.Cut(internalpath.Clean(dir), "/")
+	return top
+}
+
+// topDir returns the top-level directory of the file at the path, or "" for the files at the root. The temporary files
+// count as in the internal directory of them wherever they are, so a file counts against its directory only once it is
+// committed, replacing the previous one.
+func topDir(name string) string {
+	if internalpath.IsTemp(name) {
+		return internalpath.Temp
+	}
+	return TopDir(path.Dir(internalpath.Clean(name)))
+}
+
+type entry struct {
+	owner string
+	size  int64
+}
+
+// tracker keeps the usage of all files, which is shared by the views of the owners.
+type tracker struct {
+	opts   Options
+	owners *store.OwnerStore
+
+	mu      sync.Mutex
+	files   map[string]*entry
+	byOwner map[string]*Usage
+	byDir   map[string]*Usage
+}
+
+func (t *tracker) usage(m map[string]*Usage, key string) *Usage {
+	u, ok := m[key]
+	if !ok {
+		u = &Usage{}
+		m[key] = u
+	}
+	return u
+}
+
+// check returns ErrExceeded if adding the bytes and the files to the path of the owner exceeds any quota.
+func (t *tracker) check(name string, owner string, bytes int64, files int64) error {
+	if owner != "" && t.opts.Owner.exceeded(t.usage(t.byOwner, owner), bytes, files) {
+		return ErrExceeded
+	}
+	if dir := topDir(name); !internalpath.Is(dir) && t.opts.Directory.exceeded(t.usage(t.byDir, dir), bytes, files) {
+		return ErrExceeded
+	}
+	return nil
+}
+
+func (t *tracker) add(name string, owner string, bytes int64, files int64) {
+	if owner != "" {
+		u := t.usage(t.byOwner, owner)
+		u.Bytes, u.Files = u.Bytes+bytes, u.Files+files
+	}
+	u := t.usage(t.byDir, topDir(name))
+	u.Bytes, u.Files = u.Bytes+bytes, u.Files+files
+}
+
+// persist records the owners of the paths.
+func (t *tracker) persist(owners map[string]string) error {
+	if t.owners == nil || len(owners) == 0 {
+		return nil
+	}
+	return t.owners.Put(owners)
+}
+
+// open tracks the file opened for writing by the owner and returns its size, and whether it is new.
+// A new or truncated file belongs to the owner.
+func (t *tracker) open(name string, owner string, size int64, truncate bool) (int64, bool, error) {
+	t.mu.Lock()
+	e, ok := t.files[name]
+	if !ok {
+		if truncate {
+			size = 0
+		}
+		if err := t.check(name, owner, size, 1); err != nil {
+			t.mu.Unlock()
+			return 0, false, err
+		}
+		e = &entry{owner: owner, size: size}
+		t.files[name] = e
+		t.add(name, owner, size, 1)
+	} else if truncate {
+		t.add(name, e.owner, -e.size, -1)
+		if err := t.check(name, owner, 0, 1); err != nil {
+			t.add(name, e.owner, e.size, 1)
+			t.mu.Unlock()
+			return 0, false, err
+		}
+		e.owner, e.size = owner, 0
+		t.add(name, owner, 0, 1)
+	}
+	size, owner = e.size, e.owner
+	t.mu.Unlock()
+
+	return size, !ok, t.persist(map[string]string{name: owner})
+}
+
+// grow adds the bytes to the file, or returns ErrExceeded if it exceeds any quota.
+func (t *tracker) grow(name string, bytes int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.files[name]
+	if !ok {
+		// The file is removed while it is open.
+		return nil
+	}
+	if err := t.check(name, e.owner, bytes, 0); err != nil {
+		return err
+	}
+	e.size += bytes
+	t.add(name, e.owner, bytes, 0)
+	return nil
+}
+
+// under returns the paths of the tracked files at or under the path.
+func (t *tracker) under(name string) []string {
+	var paths []string
+	for p := range t.files {
+		if name == "" || p == name || strings.HasPrefix(p, name+"/") {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// remove stops tracking the files at or under the path.
+func (t *tracker) remove(name string) error {
+	t.mu.Lock()
+	owners := make(map[string]string)
+	for _, p := range t.under(name) {
+		e := t.files[p]
+		t.add(p, e.owner, -e.size, -1)
+		delete(t.files, p)
+		owners[p] = ""
+	}
+	t.mu.Unlock()
+
+	return t.persist(owners)
+}
+
+// checkRename returns ErrExceeded if moving the files at or under the old path to the new path
+// exceeds the quota of another top-level directory. The quotas of the owners are unchanged.
+func (t *tracker) checkRename(oldName string, newName string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	moved := make(map[string]*Usage)
+	// An existing file at the new path is replaced.
+	if e, ok := t.files[newName]; ok {
+		u := t.usage(moved, topDir(newName))
+		u.Bytes, u.Files = u.Bytes-e.size, u.Files-1
+	}
+	for _, p := range t.under(oldName) {
+		dir := topDir(newName + strings.TrimPrefix(p, oldName))
+		if dir == topDir(p) || internalpath.Is(dir) {
+			continue
+		}
+		u := t.usage(moved, dir)
+		u.Bytes, u.Files = u.Bytes+t.files[p].size, u.Files+1
+	}
+	for dir, u := range moved {
+		if t.opts.Directory.exceeded(t.usage(t.byDir, dir), u.Bytes, u.Files) {
+			return ErrExceeded
+		}
+	}
+	return nil
+}
+
+// rename moves the files at or under the old path to the new path.
+func (t *tracker) rename(oldName string, newName string) error {
+	t.mu.Lock()
+	owners := make(map[string]string)
+	paths := t.under(oldName)
+
+	// An existing file at the new path is replaced.
+	if e, ok := t.files[newName]; ok {
+		t.add(newName, e.owner, -e.size, -1)
+		delete(t.files, newName)
+		owners[newName] = ""
+	}
+
+	for _, p := range paths {
+		e := t.files[p]
+		np := newName + strings.TrimPrefix(p, oldName)
+		t.add(p, e.owner, -e.size, -1)
+		t.add(np, e.owner, e.size, 1)
+		delete(t.files, p)
+		t.files[np] = e
+		owners[p], owners[np] = "", e.owner
+	}
+	t.mu.Unlock()
+
+	return t.persist(owners)
+}
+
+// Fs tracks the usage of the files of the underlying afero.Fs, and limits the writes of its owner.
+type Fs struct {
+	afero.Fs
+	t   *tracker
+	req *Request
+}
+
+// New returns the Fs tracking the existing files of fs, with the owners recorded in the store.
+func New(base afero.Fs, owners *store.OwnerStore, opts Options) (*Fs, error) {
+	t := &tracker{
+		opts:    opts,
+		owners:  owners,
+		files:   make(map[string]*entry),
+		byOwner: make(map[string]*Usage),
+		byDir:   make(map[string]*Usage),
+	}
+
+	recorded := make(map[string]string)
+	if owners != nil {
+		var err error
+		if recorded, err = owners.All(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := afero.Walk(base, ".", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		name := internalpath.Clean(p)
+		t.files[name] = &entry{owner: recorded[name], size: info.Size()}
+		t.add(name, recorded[name], info.Size(), 1)
+		delete(recorded, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Forget the owners of the files removed while the server was down.
+	for p := range recorded {
+		recorded[p] = ""
+	}
+	if err := t.persist(recorded); err != nil {
+		return nil, err
+	}
+
+	return &Fs{Fs: base, t: t, req: &Request{}}, nil
+}
+
+// Owned is implemented by the file systems under an Fs which record the owners of the files as well.
+type Owned interface {
+	WithOwner(owner string) afero.Fs
+}
+
+// withOwner returns the view of fs writing the files as the owner, if fs is Owned.
+func withOwner(fs afero.Fs, owner string) afero.Fs {
+	if o, ok := fs.(Owned); ok {
+		return o.WithOwner(owner)
+	}
+	return fs
+}
+
+// WithRequest returns the view of the Fs writing the files as the owner of the request,
+// which is marked if any quota is exceeded.
+func (f *Fs) WithRequest(r *Request) *Fs {
+	return &Fs{Fs: withOwner(f.Fs, r.Owner), t: f.t, req: r}
+}
+
+// WithContext returns the view of fs for the request of the context, if fs is an Fs or Owned.
+func WithContext(ctx context.Context, fs afero.Fs) afero.Fs {
+	r := FromContext(ctx)
+	if r == nil {
+		return fs
+	}
+	if f, ok := fs.(*Fs); ok {
+		return f.WithRequest(r)
+	}
+	return withOwner(fs, r.Owner)
+}
+
+// WithOwner returns the view of fs writing the files as the owner, if fs is an Fs or Owned.
+func WithOwner(fs afero.Fs, owner string) afero.Fs {
+	if f, ok := fs.(*Fs); ok {
+		return f.WithRequest(&Request{Owner: owner})
+	}
+	return withOwner(fs, owner)
+}
+
+func (f *Fs) exceeded(err error) error {
+	if errors.Is(err, ErrExceeded) {
+		f.req.exceeded.Store(true)
+	}
+	return err
+}
+
+// Limits returns the quotas of the owners and the directories.
+func (f *Fs) Limits() Options {
+	return f.t.opts
+}
+
+// OwnerUsage returns the usage of the owner.
+func (f *Fs) OwnerUsage(owner string) Usage {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	if u, ok := f.t.byOwner[owner]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// DirUsage returns the usage of the top-level directory.
+func (f *Fs) DirUsage(dir string) Usage {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	if u, ok := f.t.byDir[dir]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// AllDirUsage returns the usage of the top-level directories with any file, keyed by their names.
+func (f *Fs) AllDirUsage() map[string]Usage {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+	m := make(map[string]Usage, len(f.t.byDir))
+	for dir, u := range f.t.byDir {
+		if u.Files > 0 {
+			m[dir] = *u
+		}
+	}
+	return m
+}
+
+// Available returns the bytes the owner can still write to the top-level directory, or -1 if it is unlimited.
+func (f *Fs) Available(dir string) int64 {
+	f.t.mu.Lock()
+	defer f.t.mu.Unlock()
+
+	available := int64(-1)
+	if l := f.t.opts.Owner.MaxBytes; l > 0 && f.req.Owner != "" {
+		available = max(l-f.t.usage(f.t.byOwner, f.req.Owner).Bytes, 0)
+	}
+	if !internalpath.Is(dir) && f.t.opts.Directory.MaxBytes > 0 {
+		a := max(f.t.opts.Directory.MaxBytes-f.t.usage(f.t.byDir, dir).Bytes, 0)
+		if available < 0 || a < available {
+			available = a
+		}
+	}
+	return available
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		return f.Fs.OpenFile(name, flag, perm)
+	}
+
+	// The file may exist without being tracked, e.g. created by another process.
+	var size int64
+	if fi, err := f.Fs.Stat(name); err == nil {
+		if fi.IsDir() {
+			return f.Fs.OpenFile(name, flag, perm)
+		}
+		size = fi.Size()
+	}
+
+	p := internalpath.Clean(name)
+	size, created, err := f.t.open(p, f.req.Owner, size, flag&os.O_TRUNC != 0)
+	if err != nil {
+		return nil, f.exceeded(err)
+	}
+
+	af, err := f.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		if created {
+			f.t.remove(p)
+		}
+		return nil, err
+	}
+
+	qf := &file{File: af, fs: f, name: p, size: size}
+	if flag&os.O_APPEND != 0 {
+		qf.pos = size
+	}
+	return qf, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	if err := f.Fs.Remove(name); err != nil {
+		return err
+	}
+	return f.t.remove(internalpath.Clean(name))
+}
+
+func (f *Fs) RemoveAll(name string) error {
+	if err := f.Fs.RemoveAll(name); err != nil {
+		return err
+	}
+	return f.t.remove(internalpath.Clean(name))
+}
+
+func (f *Fs) Rename(oldName string, newName string) error {
+	oldPath, newPath := internalpath.Clean(oldName), internalpath.Clean(newName)
+	if err := f.t.checkRename(oldPath, newPath); err != nil {
+		return f.exceeded(err)
+	}
+	if err := f.Fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	return f.t.rename(oldPath, newPath)
+}
+
+func (f *Fs) Name() string {
+	return "quota(" + f.Fs.Name() + ")"
+}
@@ -0,0 +1,142 @@
+package quota
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func writeFile(fs afero.Fs, name string, n int) error {
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(make([]byte, n))
+	return err
+}
+
+func TestFs(t *testing.T) {
+	db, err := store.OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	owners, err := store.NewOwnerStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a file system with quotas", t, func() {
+		base := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		So(base.MkdirAll("a", 0755), ShouldBeNil)
+		So(base.MkdirAll("b", 0755), ShouldBeNil)
+		So(base.MkdirAll(".tus", 0755), ShouldBeNil)
+
+		qfs, err := New(base, owners, Options{
+			Owner:     Limits{MaxBytes: 10},
+			Directory: Limits{MaxBytes: 8, MaxFiles: 2},
+		})
+		So(err, ShouldBeNil)
+		alice := WithOwner(qfs, "alice")
+
+		Convey("Writes within the quotas should be counted", func() {
+			So(writeFile(alice, "a/1", 5), ShouldBeNil)
+			So(qfs.OwnerUsage("alice"), ShouldResemble, Usage{Bytes: 5, Files: 1})
+			So(qfs.DirUsage("a"), ShouldResemble, Usage{Bytes: 5, Files: 1})
+			So(alice.(*Fs).Available("a"), ShouldEqual, 3)
+			So(alice.(*Fs).Available("b"), ShouldEqual, 5)
+		})
+
+		Convey("A write beyond the directory quota should fail", func() {
+			So(writeFile(alice, "a/1", 5), ShouldBeNil)
+			So(errors.Is(writeFile(alice, "a/2", 4), ErrExceeded), ShouldBeTrue)
+			So(qfs.DirUsage("a").Bytes, ShouldEqual, 5)
+		})
+
+		Convey("A write beyond the token quota should fail and mark the request", func() {
+			_, req := NewContext(t.Context(), "alice")
+			fs := qfs.WithRequest(req)
+			So(writeFile(fs, "a/1", 6), ShouldBeNil)
+			So(errors.Is(writeFile(fs, "b/1", 6), ErrExceeded), ShouldBeTrue)
+			So(req.Exceeded(), ShouldBeTrue)
+		})
+
+		Convey("Overwriting a file should count the new size only", func() {
+			So(writeFile(alice, "a/1", 6), ShouldBeNil)
+			So(writeFile(alice, "a/1", 7), ShouldBeNil)
+			So(qfs.OwnerUsage("alice"), ShouldResemble, Usage{Bytes: 7, Files: 1})
+		})
+
+		Convey("Creating more files than the directory quota should fail", func() {
+			So(writeFile(qfs, "b/1", 1), ShouldBeNil)
+			So(writeFile(qfs, "b/2", 1), ShouldBeNil)
+			So(errors.Is(writeFile(qfs, "b/3", 1), ErrExceeded), ShouldBeTrue)
+		})
+
+		Convey("The internal directories should not be limited by the directory quota", func() {
+			So(writeFile(qfs, ".tus/1", 20), ShouldBeNil)
+		})
+
+		Convey("Other directories starting with a dot should be limited by the directory quota", func() {
+			So(base.MkdirAll(".hidden", 0755), ShouldBeNil)
+			So(errors.Is(writeFile(qfs, ".hidden/1", 20), ErrExceeded), ShouldBeTrue)
+			So(qfs.Available(".hidden"), ShouldEqual, 8)
+		})
+
+		Convey("Removing a file should give back its usage", func() {
+			So(writeFile(alice, "a/1", 5), ShouldBeNil)
+			So(alice.Remove("a/1"), ShouldBeNil)
+			So(qfs.OwnerUsage("alice"), ShouldResemble, Usage{})
+			So(qfs.DirUsage("a"), ShouldResemble, Usage{})
+		})
+
+		Convey("Renaming a directory should move its usage", func() {
+			So(writeFile(alice, "a/1", 3), ShouldBeNil)
+			So(writeFile(alice, "a/2", 3), ShouldBeNil)
+			So(alice.Rename("a", "c"), ShouldBeNil)
+			So(qfs.DirUsage("a"), ShouldResemble, Usage{})
+			So(qfs.DirUsage("c"), ShouldResemble, Usage{Bytes: 6, Files: 2})
+
+			Convey("Unless it exceeds the quota of the destination", func() {
+				So(writeFile(qfs, "b/1", 6), ShouldBeNil)
+				So(errors.Is(alice.Rename("c/1", "b/2"), ErrExceeded), ShouldBeTrue)
+				So(qfs.DirUsage("c"), ShouldResemble, Usage{Bytes: 6, Files: 2})
+				So(qfs.DirUsage("b"), ShouldResemble, Usage{Bytes: 6, Files: 1})
+			})
+		})
+
+		Convey("Replacing a file by renaming should count the new size only", func() {
+			So(writeFile(qfs, "b/1", 6), ShouldBeNil)
+			So(writeFile(qfs, ".tus/1", 7), ShouldBeNil)
+			So(qfs.Rename(".tus/1", "b/1"), ShouldBeNil)
+			So(qfs.DirUsage("b"), ShouldResemble, Usage{Bytes: 7, Files: 1})
+		})
+
+		Convey("Replacing a file through a temporary file next to it should count the new file only", func() {
+			So(writeFile(qfs, "b/1", 1), ShouldBeNil)
+			So(writeFile(qfs, "b/2", 1), ShouldBeNil)
+
+			tmp := "b/" + internalpath.TempPrefix + "0123456789abcdef0123456789abcdef"
+			So(writeFile(qfs, tmp, 7), ShouldBeNil)
+			So(qfs.DirUsage("b"), ShouldResemble, Usage{Bytes: 2, Files: 2})
+			So(qfs.Rename(tmp, "b/1"), ShouldBeNil)
+			So(qfs.DirUsage("b"), ShouldResemble, Usage{Bytes: 8, Files: 2})
+		})
+
+		Convey("The usage of the owners should be restored", func() {
+			So(writeFile(alice, "a/1", 5), ShouldBeNil)
+			restored, err := New(base, owners, qfs.Limits())
+			So(err, ShouldBeNil)
+			So(restored.OwnerUsage("alice"), ShouldResemble, Usage{Bytes: 5, Files: 1})
+		})
+	})
+}
@@ -0,0 +1,294 @@
+// Package replication mirrors the files to a secondary storage for disaster recovery. The changes of the files are
+// queued by their paths, and replicating a path makes the secondary the same as the primary at that path, so the
+// replication of a change is idempotent, and covers all the changes of the path before it.
+package replication
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/wei840222/simple-file-server/server/events"
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+)
+
+// Scheduler schedules the replication of the paths.
+type Scheduler interface {
+	// ScheduleReplication replicates the path to the secondary storage, retrying with backoff until it succeeds.
+	ScheduleReplication(ctx context.Context, path string) error
+}
+
+// pending is a change of a path queued but not replicated yet.
+type pending struct {
+	since time.Time
+	seq   uint64
+}
+
+// Replicator mirrors the files of the primary Fs to the secondary Fs, and tracks the changes pending replication.
+type Replicator struct {
+	logger    zerolog.Logger
+	primary   afero.Fs
+	secondary afero.Fs
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[string]pending
+	// drift is the number of the paths found out of sync by the last reconciliation.
+	drift int64
+}
+
+// New returns the Replicator of the files of primary to secondary.
+func New(primary, secondary afero.Fs) *Replicator {
+	return &Replicator{
+		logger:    log.With().Str("logger", "replicator").Logger(),
+		primary:   primary,
+		secondary: secondary,
+		pending:   make(map[string]pending),
+	}
+}
+
+// Primary returns the Fs of the files replicated.
+func (r *Replicator) Primary() afero.Fs {
+	return r.primary
+}
+
+// Secondary returns the Fs of the replicas.
+func (r *Replicator) Secondary() afero.Fs {
+	return r.secondary
+}
+
+// Queue records the change of the path as pending, and schedules its replication.
+func (r *Replicator) Queue(ctx context.Context, s Scheduler, name string) error {
+	p := internalpath.Clean(name)
+
+	r.mu.Lock()
+	r.seq++
+	if c, ok := r.pending[p]; ok {
+		c.seq = r.seq
+		r.pending[p] = c
+	} else {
+		r.pending[p] = pending{since: time.Now(), seq: r.seq}
+	}
+	r.mu.Unlock()
+
+	return s.ScheduleReplication(ctx, p)
+}
+
+// done clears the pending change of the path, unless the path is changed again after the replication started.
+func (r *Replicator) done(p string, seq uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c, ok := r.pending[p]; ok && c.seq <= seq {
+		delete(r.pending, p)
+	}
+}
+
+// Pending reports whether a change of the path is queued but not replicated yet.
+func (r *Replicator) Pending(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.pending[internalpath.Clean(name)]
+	return ok
+}
+
+// Lag returns how long the oldest change pending replication has waited, and the number of the paths pending.
+// The changes queued before the start of the server are not tracked.
+func (r *Replicator) Lag() (time.Duration, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var oldest time.Time
+	for _, c := range r.pending {
+		if oldest.IsZero() || c.since.Before(oldest) {
+			oldest = c.since
+		}
+	}
+	if oldest.IsZero() {
+		return 0, 0
+	}
+	return time.Since(oldest), len(r.pending)
+}
+
+// Reconciled records the number of the paths found out of sync by a reconciliation.
+func (r *Replicator) Reconciled(drift int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.drift = drift
+}
+
+// InSync reports whether the file at the path on the secondary is the same as on the primary, by its size and
+// modification time. The secondary may keep the modification time in seconds, and an object storage keeps the time
+// of the upload instead, which is after the modification on the primary. It is only a heuristic for the
+// reconciliation, as it misses a change keeping the size within the same second.
+func (r *Replicator) InSync(name string) (bool, error) {
+	fi, err := r.primary.Stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			_, err := r.secondary.Stat(name)
+			if errors.Is(err, fs.ErrNotExist) {
+				return true, nil
+			}
+			return false, err
+		}
+		return false, err
+	}
+	return r.inSync(name, fi)
+}
+
+func (r *Replicator) inSync(name string, fi fs.FileInfo) (bool, error) {
+	si, err := r.secondary.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if fi.IsDir() || si.IsDir() {
+		return fi.IsDir() == si.IsDir(), nil
+	}
+	return si.Size() == fi.Size() && !si.ModTime().Before(fi.ModTime().Truncate(time.Second)), nil
+}
+
+// Replicate copies the file at the path from the primary to the secondary, or removes it from the secondary if it no
+// longer exists. The file is always copied, and to a temporary file first, so the replica is never partially written.
+func (r *Replicator) Replicate(ctx context.Context, name string) error {
+	p := internalpath.Clean(name)
+	r.mu.Lock()
+	seq := r.seq
+	r.mu.Unlock()
+
+	if err := r.replicate(p); err != nil {
+		return err
+	}
+	r.done(p, seq)
+	return nil
+}
+
+func (r *Replicator) replicate(p string) error {
+	fi, err := r.primary.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := r.secondary.RemoveAll(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		r.logger.Debug().Str("path", p).Msg("replica removed")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return r.secondary.MkdirAll(p, 0755)
+	}
+	// The file is copied even if it looks in sync, since a file overwritten with the same size within the same second
+	// has the same size and modification time. The size and the time only find the drift on the reconciliation.
+	// A directory replaced by a file on the primary is replaced on the secondary.
+	if si, err := r.secondary.Stat(p); err == nil && si.IsDir() {
+		if err := r.secondary.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+
+	src, err := r.primary.Open(p)
+	if err != nil {
+		// The file removed since is replicated by the replication of its removal.
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+
+	if err := r.secondary.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	dst, err := tempfile.Create(r.secondary, p, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	if err := dst.Commit(); err != nil {
+		return err
+	}
+	// The backends without modification times, such as an object storage, keep the time of the upload.
+	if err := r.secondary.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+
+	r.logger.Debug().Str("path", p).Int64("size", n).Msg("file replicated")
+	return nil
+}
+
+// Run queues the replication of the changes published by the broker until the context is done. A subscription
+// falling too far behind resumes from the buffered events, and the changes lost meanwhile are left to the
+// reconciliation.
+func (r *Replicator) Run(ctx context.Context, b *events.Broker, s Scheduler) {
+	var lastID uint64
+	for {
+		sub := b.Subscribe(lastID)
+		queue := func(e events.Event) {
+			lastID = e.ID
+			if err := r.Queue(ctx, s, e.Path); err != nil {
+				r.logger.Warn().Ctx(ctx).Err(err).Str("path", e.Path).Msg("failed to queue replication")
+			}
+		}
+		for _, e := range sub.Backlog {
+			queue(e)
+		}
+
+	receive:
+		for {
+			select {
+			case <-ctx.Done():
+				sub.Cancel()
+				return
+			case e, ok := <-sub.C:
+				if !ok {
+					r.logger.Warn().Ctx(ctx).Uint64("lastID", lastID).Msg("replication fell behind the file events, resubscribing")
+					break receive
+				}
+				queue(e)
+			}
+		}
+	}
+}
+
+// RegisterMetrics observes the lag and the number of the changes pending replication, and the drift found by the
+// last reconciliation.
+func (r *Replicator) RegisterMetrics(meter metric.Meter) error {
+	lag, err := meter.Float64ObservableGauge("replication.lag", metric.WithUnit("s"), metric.WithDescription("Seconds the oldest change of the files has waited to be replicated to the secondary storage."))
+	if err != nil {
+		return err
+	}
+	pendingPaths, err := meter.Int64ObservableGauge("replication.pending", metric.WithDescription("Number of the paths pending replication to the secondary storage."))
+	if err != nil {
+		return err
+	}
+	drift, err := meter.Int64ObservableGauge("replication.drift", metric.WithDescription("Number of the paths found out of sync with the secondary storage by the last reconciliation."))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		d, n := r.Lag()
+		o.ObserveFloat64(lag, d.Seconds())
+		o.ObserveInt64(pendingPaths, int64(n))
+		r.mu.Lock()
+		o.ObserveInt64(drift, r.drift)
+		r.mu.Unlock()
+		return nil
+	}, lag, pendingPaths, drift)
+	return err
+}
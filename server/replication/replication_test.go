@@ -0,0 +1,141 @@
+package replication
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/events"
+)
+
+type fakeScheduler struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (s *fakeScheduler) ScheduleReplication(_ context.Context, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, path)
+	return nil
+}
+
+func (s *fakeScheduler) scheduled() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.paths...)
+}
+
+func TestReplicator(t *testing.T) {
+	Convey("Given the primary and the secondary file systems", t, func() {
+		primary, secondary := afero.NewMemMapFs(), afero.NewMemMapFs()
+		r := New(primary, secondary)
+		s := &fakeScheduler{}
+		ctx := context.Background()
+
+		So(afero.WriteFile(primary, "dir/a.txt", []byte("a"), 0644), ShouldBeNil)
+
+		Convey("Replicating a file should copy it with its modification time", func() {
+			So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+
+			b, err := afero.ReadFile(secondary, "dir/a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "a")
+			ok, err := r.InSync("dir/a.txt")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+
+			Convey("Replicating an overwritten file should replace the replica", func() {
+				So(afero.WriteFile(primary, "dir/a.txt", []byte("aa"), 0644), ShouldBeNil)
+				ok, err := r.InSync("dir/a.txt")
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeFalse)
+
+				So(r.Replicate(ctx, "/dir/a.txt"), ShouldBeNil)
+				b, err := afero.ReadFile(secondary, "dir/a.txt")
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "aa")
+			})
+
+			Convey("Replicating a file overwritten with the same size and modification time should replace the replica", func() {
+				fi, err := primary.Stat("dir/a.txt")
+				So(err, ShouldBeNil)
+				So(afero.WriteFile(primary, "dir/a.txt", []byte("b"), 0644), ShouldBeNil)
+				So(primary.Chtimes("dir/a.txt", fi.ModTime(), fi.ModTime()), ShouldBeNil)
+				ok, err := r.InSync("dir/a.txt")
+				So(err, ShouldBeNil)
+				So(ok, ShouldBeTrue)
+
+				So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+				b, err := afero.ReadFile(secondary, "dir/a.txt")
+				So(err, ShouldBeNil)
+				So(string(b), ShouldEqual, "b")
+			})
+
+			Convey("Replicating a deleted file should remove the replica", func() {
+				So(primary.Remove("dir/a.txt"), ShouldBeNil)
+				So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+
+				exists, err := afero.Exists(secondary, "dir/a.txt")
+				So(err, ShouldBeNil)
+				So(exists, ShouldBeFalse)
+
+				Convey("Replicating it again should do nothing", func() {
+					So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+				})
+			})
+		})
+
+		Convey("A stale replica of the same size should be replaced", func() {
+			So(afero.WriteFile(secondary, "dir/a.txt", []byte("x"), 0644), ShouldBeNil)
+			old := time.Now().Add(-time.Hour)
+			So(secondary.Chtimes("dir/a.txt", old, old), ShouldBeNil)
+
+			So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+			b, err := afero.ReadFile(secondary, "dir/a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "a")
+		})
+
+		Convey("The lag should be tracked until the queued changes are replicated", func() {
+			So(r.Queue(ctx, s, "dir/a.txt"), ShouldBeNil)
+			So(r.Queue(ctx, s, "dir/b.txt"), ShouldBeNil)
+			So(s.scheduled(), ShouldResemble, []string{"dir/a.txt", "dir/b.txt"})
+
+			lag, n := r.Lag()
+			So(n, ShouldEqual, 2)
+			So(lag, ShouldBeGreaterThan, 0)
+
+			So(r.Replicate(ctx, "dir/a.txt"), ShouldBeNil)
+			So(r.Replicate(ctx, "dir/b.txt"), ShouldBeNil)
+			lag, n = r.Lag()
+			So(n, ShouldEqual, 0)
+			So(lag, ShouldEqual, 0)
+		})
+
+		Convey("The changes published by the broker should be queued", func() {
+			b := events.NewBroker(16)
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go r.Run(ctx, b, s)
+
+			efs := events.New(primary, b)
+			// The subscription is created once Run starts.
+			So(func() bool {
+				for i := 0; i < 100; i++ {
+					So(afero.WriteFile(efs, "b.txt", []byte("b"), 0644), ShouldBeNil)
+					if len(s.scheduled()) > 0 {
+						return true
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				return false
+			}(), ShouldBeTrue)
+			So(s.scheduled()[0], ShouldEqual, "b.txt")
+		})
+	})
+}
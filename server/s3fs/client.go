@@ -0,0 +1,167 @@
+package s3fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// partSize is the size of the parts of a streaming upload. The client buffers one part at a time,
+// and an object can have at most 10000 parts, so the maximum size of a streamed object is about 156GiB.
+const partSize = 16 << 20
+
+const maxCopySize = 5 << 30
+
+// ObjectInfo describes an object, or a common prefix if the key ends with a slash.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Client is the subset of the S3 API the file system needs, so it can be backed by a fake in tests.
+// The methods return an error wrapping fs.ErrNotExist if the object does not exist.
+type Client interface {
+	StatObject(ctx context.Context, key string) (ObjectInfo, error)
+	// GetObject returns the content of the object from the offset to the end.
+	GetObject(ctx context.Context, key string, offset int64) (io.ReadCloser, error)
+	// PutObject uploads the object from r. If size is -1, the object is streamed in multiple parts.
+	PutObject(ctx context.Context, key string, r io.Reader, size int64) error
+	CopyObject(ctx context.Context, src string, dst string) error
+	RemoveObject(ctx context.Context, key string) error
+	// ListObjects lists the objects under the prefix. If it is not recursive,
+	// the objects in the sub directories are grouped into common prefixes.
+	ListObjects(ctx context.Context, prefix string, recursive bool) iter.Seq2[ObjectInfo, error]
+}
+
+type MinioOptions struct {
+	Endpoint        string
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+}
+
+type minioClient struct {
+	c      *minio.Client
+	bucket string
+}
+
+// NewMinioClient returns a client of an S3 compatible object storage. Without the static credentials,
+// they are loaded from the environment variables or the IAM role of the instance.
+func NewMinioClient(ctx context.Context, o MinioOptions) (Client, error) {
+	creds := credentials.NewStaticV4(o.AccessKeyID, o.SecretAccessKey, "")
+	if o.AccessKeyID == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+
+	c, err := minio.New(o.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: o.UseSSL,
+		Region: o.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := c.BucketExists(ctx, o.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %q does not exist", o.Bucket)
+	}
+
+	return &minioClient{c: c, bucket: o.Bucket}, nil
+}
+
+func toError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case minio.NoSuchKey, minio.NoSuchBucket:
+		return fmt.Errorf("%w: %w", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+func (m *minioClient) StatObject(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := m.c.StatObject(ctx, m.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, toError(err)
+	}
+	return ObjectInfo{Key: info.Key, Size: info.Size, LastModified: info.LastModified}, nil
+}
+
+func (m *minioClient) GetObject(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	// The object is requested lazily by the first read, from the offset.
+	obj, err := m.c.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, toError(err)
+	}
+	if _, err := obj.Seek(offset, io.SeekStart); err != nil {
+		obj.Close()
+		return nil, toError(err)
+	}
+	return obj, nil
+}
+
+func (m *minioClient) PutObject(ctx context.Context, key string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{PartSize: partSize}
+	if size == 0 {
+		// An empty body with the streaming signature is sent without Content-Length, which is rejected by S3.
+		opts.DisableContentSha256 = true
+	}
+	_, err := m.c.PutObject(ctx, m.bucket, key, r, size, opts)
+	return toError(err)
+}
+
+func (m *minioClient) CopyObject(ctx context.Context, src string, dst string) error {
+	info, err := m.c.StatObject(ctx, m.bucket, src, minio.StatObjectOptions{})
+	if err != nil {
+		return toError(err)
+	}
+
+	dstOpts := minio.CopyDestOptions{Bucket: m.bucket, Object: dst}
+	srcOpts := minio.CopySrcOptions{Bucket: m.bucket, Object: src}
+	// A single copy is limited to 5GiB, so a larger object is copied in parts.
+	if info.Size > maxCopySize {
+		_, err = m.c.ComposeObject(ctx, dstOpts, srcOpts)
+	} else {
+		_, err = m.c.CopyObject(ctx, dstOpts, srcOpts)
+	}
+	return toError(err)
+}
+
+func (m *minioClient) RemoveObject(ctx context.Context, key string) error {
+	return toError(m.c.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (m *minioClient) ListObjects(ctx context.Context, prefix string, recursive bool) iter.Seq2[ObjectInfo, error] {
+	return func(yield func(ObjectInfo, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		for obj := range m.c.ListObjectsIter(ctx, m.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: recursive}) {
+			if obj.Err != nil {
+				yield(ObjectInfo{}, toError(obj.Err))
+				return
+			}
+			if !yield(ObjectInfo{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}, nil) {
+				return
+			}
+		}
+	}
+}
+
+var _ Client = (*minioClient)(nil)
@@ -0,0 +1,415 @@
+package s3fs
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errSeekUnsupported = errors.New("seek is not supported by a streaming write")
+
+// baseFile implements the operations of afero.File that are not supported by the file type.
+type baseFile struct {
+	name string
+}
+
+func (f *baseFile) Name() string {
+	return f.name
+}
+
+func (f *baseFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) ReadAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) Seek(int64, int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) WriteAt([]byte, int64) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) WriteString(string) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) Truncate(int64) error {
+	return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *baseFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *baseFile) Readdirnames(int) ([]string, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *baseFile) Sync() error {
+	return nil
+}
+
+// readFile reads an object with ranged requests, so seeking does not download the skipped content.
+type readFile struct {
+	baseFile
+	fs   *Fs
+	key  string
+	info *fileInfo
+
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+	closed     bool
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.offset >= f.info.size {
+		return 0, io.EOF
+	}
+
+	// Reopen the object at the offset after seeking.
+	if f.body != nil && f.bodyOffset != f.offset {
+		f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		body, err := f.fs.client.GetObject(context.Background(), f.key, f.offset)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.body, f.bodyOffset = body, f.offset
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	f.bodyOffset += int64(n)
+	return n, err
+}
+
+func (f *readFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	body, err := f.fs.client.GetObject(context.Background(), f.key, off)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	defer body.Close()
+
+	n, err := io.ReadFull(body, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *readFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *readFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+// dirFile lists a directory by the objects and the common prefixes under it.
+type dirFile struct {
+	baseFile
+	fs     *Fs
+	prefix string
+	info   *fileInfo
+
+	entries []os.FileInfo
+	pos     int
+}
+
+func (f *dirFile) load() error {
+	if f.entries != nil {
+		return nil
+	}
+	entries := []os.FileInfo{}
+	seen := map[string]bool{}
+	for obj, err := range f.fs.client.ListObjects(context.Background(), f.prefix, false) {
+		if err != nil {
+			return &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		// Skip the marker of the directory itself.
+		if obj.Key == f.prefix || seen[obj.Key] {
+			continue
+		}
+		// Some storages list the marker of a sub directory besides its common prefix.
+		seen[obj.Key] = true
+		name, isDir := strings.CutSuffix(strings.TrimPrefix(obj.Key, f.prefix), "/")
+		entries = append(entries, &fileInfo{name: path.Base(name), size: obj.Size, modTime: obj.LastModified, dir: isDir})
+	}
+	f.entries = entries
+	return nil
+}
+
+func (f *dirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	rest := f.entries[f.pos:]
+	if count <= 0 {
+		f.pos = len(f.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	rest = rest[:min(count, len(rest))]
+	f.pos += len(rest)
+	return rest, nil
+}
+
+func (f *dirFile) Readdirnames(n int) ([]string, error) {
+	fis, err := f.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+// Seek only supports rewinding the directory listing.
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.entries, f.pos = nil, 0
+	return 0, nil
+}
+
+func (f *dirFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+// streamFile uploads the written content while writing, so it can only be written sequentially.
+type streamFile struct {
+	baseFile
+	pw      *io.PipeWriter
+	done    chan error
+	written int64
+	closed  bool
+}
+
+func newStreamFile(fsys *Fs, name string, key string) *streamFile {
+	pr, pw := io.Pipe()
+	f := &streamFile{baseFile: baseFile{name: name}, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := fsys.client.PutObject(context.Background(), key, pr, -1)
+		// Fail the pending and later writes if the upload is aborted.
+		pr.CloseWithError(cmp.Or(err, io.ErrClosedPipe))
+		f.done <- err
+	}()
+	return f
+}
+
+func (f *streamFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	n, err := f.pw.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		return n, &fs.PathError{Op: "write", Path: f.name, Err: err}
+	}
+	return n, nil
+}
+
+func (f *streamFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// WriteAt only supports writing at the end of the written content.
+func (f *streamFile) WriteAt(p []byte, off int64) (int, error) {
+	if off != f.written {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: errSeekUnsupported}
+	}
+	return f.Write(p)
+}
+
+// Seek only supports seeking to the end of the written content.
+func (f *streamFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent, io.SeekEnd:
+		offset += f.written
+	}
+	if offset != f.written {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errSeekUnsupported}
+	}
+	return offset, nil
+}
+
+// Truncate only supports the current size.
+func (f *streamFile) Truncate(size int64) error {
+	if size != f.written {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: errSeekUnsupported}
+	}
+	return nil
+}
+
+// Stat reports the content written so far.
+func (f *streamFile) Stat() (os.FileInfo, error) {
+	return &fileInfo{name: path.Base(clean(f.name)), size: f.written, modTime: time.Now()}, nil
+}
+
+// Close completes the upload and returns its error.
+func (f *streamFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	f.pw.Close()
+	if err := <-f.done; err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// spoolFile modifies a copy of the object in a temporary file, and uploads it when closed if modified.
+type spoolFile struct {
+	*os.File
+	fs       *Fs
+	name     string
+	key      string
+	modified bool
+}
+
+func newSpoolFile(fsys *Fs, name string, key string, appending bool) (*spoolFile, error) {
+	tmp, err := os.CreateTemp("", "s3fs-*")
+	if err != nil {
+		return nil, err
+	}
+	f := &spoolFile{File: tmp, fs: fsys, name: name, key: key}
+
+	if err := f.download(appending); err != nil {
+		f.discard()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *spoolFile) download(appending bool) error {
+	body, err := f.fs.client.GetObject(context.Background(), f.key, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(f.File, body); err != nil {
+		return err
+	}
+	if !appending {
+		_, err = f.File.Seek(0, io.SeekStart)
+	}
+	return err
+}
+
+func (f *spoolFile) discard() {
+	f.File.Close()
+	os.Remove(f.File.Name())
+}
+
+func (f *spoolFile) Name() string {
+	return f.name
+}
+
+func (f *spoolFile) Write(p []byte) (int, error) {
+	f.modified = true
+	return f.File.Write(p)
+}
+
+func (f *spoolFile) WriteAt(p []byte, off int64) (int, error) {
+	f.modified = true
+	return f.File.WriteAt(p, off)
+}
+
+func (f *spoolFile) WriteString(s string) (int, error) {
+	f.modified = true
+	return f.File.WriteString(s)
+}
+
+func (f *spoolFile) Truncate(size int64) error {
+	f.modified = true
+	return f.File.Truncate(size)
+}
+
+func (f *spoolFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(clean(f.name)), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// Close uploads the file if modified and removes the temporary file.
+func (f *spoolFile) Close() error {
+	defer f.discard()
+	if !f.modified {
+		return nil
+	}
+
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := f.fs.client.PutObject(context.Background(), f.key, f.File, fi.Size()); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
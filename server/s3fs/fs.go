@@ -0,0 +1,378 @@
+// Package s3fs implements afero.Fs on an S3 compatible object storage.
+//
+// Directories are emulated by the common prefixes of the object keys. An empty directory is
+// kept by a marker object whose key is the directory path with a trailing slash.
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+type Fs struct {
+	client Client
+	prefix string
+}
+
+// New returns a file system that stores the files under the key prefix of the client.
+func New(client Client, prefix string) *Fs {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &Fs{client: client, prefix: prefix}
+}
+
+var _ afero.Fs = (*Fs)(nil)
+
+// clean returns the slash separated path relative to the root, which is empty for the root itself.
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func (f *Fs) key(rel string) string {
+	return f.prefix + rel
+}
+
+// dirKey returns the prefix of the objects in the directory, which is also the key of its marker object.
+func (f *Fs) dirKey(rel string) string {
+	if rel == "" {
+		return f.prefix
+	}
+	return f.prefix + rel + "/"
+}
+
+func (f *Fs) stat(rel string) (*fileInfo, error) {
+	if rel == "" {
+		return &fileInfo{name: "/", dir: true}, nil
+	}
+
+	ctx := context.Background()
+	obj, err := f.client.StatObject(ctx, f.key(rel))
+	if err == nil {
+		return &fileInfo{name: path.Base(rel), size: obj.Size, modTime: obj.LastModified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// A directory exists if there is any object under it, including its marker.
+	dirKey := f.dirKey(rel)
+	for obj, err := range f.client.ListObjects(ctx, dirKey, false) {
+		if err != nil {
+			return nil, err
+		}
+		fi := &fileInfo{name: path.Base(rel), dir: true}
+		if obj.Key == dirKey {
+			fi.modTime = obj.LastModified
+		}
+		return fi, nil
+	}
+
+	return nil, fs.ErrNotExist
+}
+
+// checkParent returns an error if the parent directory of the path does not exist.
+func (f *Fs) checkParent(rel string) error {
+	parent := path.Dir(rel)
+	if parent == "." {
+		return nil
+	}
+	fi, err := f.stat(parent)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) Mkdir(name string, _ os.FileMode) error {
+	rel := clean(name)
+	if _, err := f.stat(rel); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if err := f.checkParent(rel); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if err := f.client.PutObject(context.Background(), f.dirKey(rel), bytes.NewReader(nil), 0); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	rel := clean(name)
+	fi, err := f.stat(rel)
+	if err == nil {
+		if !fi.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	if parent := path.Dir(rel); parent != "." {
+		if err := f.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+
+	if err := f.client.PutObject(context.Background(), f.dirKey(rel), bytes.NewReader(nil), 0); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the file for reading with ranged requests, or for writing. A truncated or new file is
+// streamed to the storage while written. Otherwise, the file is spooled in a temporary file to be modified
+// in place, and uploaded when closed.
+func (f *Fs) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	rel := clean(name)
+	fi, err := f.stat(rel)
+	exists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		if !exists {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if fi.IsDir() {
+			return &dirFile{baseFile: baseFile{name: name}, fs: f, prefix: f.dirKey(rel), info: fi}, nil
+		}
+		return &readFile{baseFile: baseFile{name: name}, fs: f, key: f.key(rel), info: fi}, nil
+	}
+
+	if exists {
+		if fi.IsDir() {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	} else {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if err := f.checkParent(rel); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	if !exists || flag&os.O_TRUNC != 0 {
+		return newStreamFile(f, name, f.key(rel)), nil
+	}
+
+	file, err := newSpoolFile(f, name, f.key(rel), flag&os.O_APPEND != 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return file, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	rel := clean(name)
+	fi, err := f.stat(rel)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+
+	ctx := context.Background()
+	if !fi.IsDir() {
+		if err := f.client.RemoveObject(ctx, f.key(rel)); err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		return nil
+	}
+
+	if rel == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	dirKey := f.dirKey(rel)
+	for obj, err := range f.client.ListObjects(ctx, dirKey, false) {
+		if err != nil {
+			return &fs.PathError{Op: "remove", Path: name, Err: err}
+		}
+		if obj.Key != dirKey {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if err := f.client.RemoveObject(ctx, dirKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// listKeys returns the keys of all objects under the prefix. They are collected before being modified,
+// because the listing is paginated.
+func (f *Fs) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	for obj, err := range f.client.ListObjects(context.Background(), prefix, true) {
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (f *Fs) RemoveAll(name string) error {
+	rel := clean(name)
+	ctx := context.Background()
+
+	keys, err := f.listKeys(f.dirKey(rel))
+	if err != nil {
+		return &fs.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	if rel != "" {
+		keys = append(keys, f.key(rel))
+	}
+
+	for _, key := range keys {
+		if err := f.client.RemoveObject(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: "removeall", Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// Rename copies the objects to the new path and removes the old ones, so renaming a directory is not atomic.
+func (f *Fs) Rename(oldname, newname string) error {
+	oldRel, newRel := clean(oldname), clean(newname)
+	fi, err := f.stat(oldRel)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if oldRel == newRel {
+		return nil
+	}
+	if err := f.checkParent(newRel); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	if dst, err := f.stat(newRel); err == nil && dst.IsDir() != fi.IsDir() {
+		err := syscall.EISDIR
+		if !dst.IsDir() {
+			err = syscall.ENOTDIR
+		}
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	ctx := context.Background()
+	if !fi.IsDir() {
+		if err := f.client.CopyObject(ctx, f.key(oldRel), f.key(newRel)); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		if err := f.client.RemoveObject(ctx, f.key(oldRel)); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+		return nil
+	}
+
+	oldDirKey, newDirKey := f.dirKey(oldRel), f.dirKey(newRel)
+	if oldRel == "" || strings.HasPrefix(newDirKey, oldDirKey) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EINVAL}
+	}
+
+	keys, err := f.listKeys(oldDirKey)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	for _, key := range keys {
+		if err := f.client.CopyObject(ctx, key, newDirKey+strings.TrimPrefix(key, oldDirKey)); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	for _, key := range keys {
+		if err := f.client.RemoveObject(ctx, key); err != nil {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+		}
+	}
+	return nil
+}
+
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	fi, err := f.stat(clean(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+func (f *Fs) Name() string {
+	return "S3Fs"
+}
+
+// Chmod is a no-op, because objects have no permissions.
+func (f *Fs) Chmod(string, os.FileMode) error {
+	return nil
+}
+
+// Chown is a no-op, because objects have no owners.
+func (f *Fs) Chown(string, int, int) error {
+	return nil
+}
+
+// Chtimes is a no-op, because the modification time of an object is set by the storage.
+func (f *Fs) Chtimes(string, time.Time, time.Time) error {
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() any {
+	return nil
+}
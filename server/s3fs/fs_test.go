@@ -0,0 +1,286 @@
+package s3fs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+	"golang.org/x/net/webdav"
+
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/server/s3fs"
+)
+
+// memClient is an in-process fake of the object storage.
+type memClient struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemClient() *memClient {
+	return &memClient{objects: map[string][]byte{}}
+}
+
+func (m *memClient) StatObject(_ context.Context, key string) (s3fs.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return s3fs.ObjectInfo{}, fs.ErrNotExist
+	}
+	return s3fs.ObjectInfo{Key: key, Size: int64(len(data))}, nil
+}
+
+func (m *memClient) GetObject(_ context.Context, key string, offset int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:])), nil
+}
+
+func (m *memClient) PutObject(_ context.Context, key string, r io.Reader, _ int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memClient) CopyObject(_ context.Context, src string, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[src]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	m.objects[dst] = data
+	return nil
+}
+
+func (m *memClient) RemoveObject(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memClient) ListObjects(_ context.Context, prefix string, recursive bool) iter.Seq2[s3fs.ObjectInfo, error] {
+	m.mu.Lock()
+	var objs []s3fs.ObjectInfo
+	for key, data := range m.objects {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, "/"); !recursive && i >= 0 {
+			objs = append(objs, s3fs.ObjectInfo{Key: prefix + rest[:i+1]})
+			continue
+		}
+		objs = append(objs, s3fs.ObjectInfo{Key: key, Size: int64(len(data))})
+	}
+	m.mu.Unlock()
+
+	slices.SortFunc(objs, func(a, b s3fs.ObjectInfo) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	objs = slices.CompactFunc(objs, func(a, b s3fs.ObjectInfo) bool {
+		return a.Key == b.Key
+	})
+
+	return func(yield func(s3fs.ObjectInfo, error) bool) {
+		for _, obj := range objs {
+			if !yield(obj, nil) {
+				return
+			}
+		}
+	}
+}
+
+// newTestClient returns a client of the MinIO at S3FS_TEST_ENDPOINT if set, or an in-process fake otherwise.
+func newTestClient(t *testing.T) s3fs.Client {
+	endpoint := os.Getenv("S3FS_TEST_ENDPOINT")
+	if endpoint == "" {
+		return newMemClient()
+	}
+
+	c, err := s3fs.NewMinioClient(context.Background(), s3fs.MinioOptions{
+		Endpoint:        endpoint,
+		Bucket:          os.Getenv("S3FS_TEST_BUCKET"),
+		AccessKeyID:     os.Getenv("S3FS_TEST_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3FS_TEST_SECRET_ACCESS_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFs(t *testing.T) {
+	client := newTestClient(t)
+	prefix := "s3fs-test-" + time.Now().Format("20060102150405")
+
+	Convey("Given an S3 file system", t, func() {
+		fsys := s3fs.New(client, prefix)
+		So(afero.WriteFile(fsys, "a.txt", []byte("hello world"), 0644), ShouldBeNil)
+		So(fsys.MkdirAll("dir/sub", 0755), ShouldBeNil)
+		So(afero.WriteFile(fsys, "dir/b.txt", []byte("b"), 0644), ShouldBeNil)
+
+		Reset(func() {
+			fsys.RemoveAll("")
+		})
+
+		Convey("Stat should emulate the directories", func() {
+			fi, err := fsys.Stat("dir")
+			So(err, ShouldBeNil)
+			So(fi.IsDir(), ShouldBeTrue)
+
+			fi, err = fsys.Stat("dir/sub")
+			So(err, ShouldBeNil)
+			So(fi.IsDir(), ShouldBeTrue)
+
+			fi, err = fsys.Stat("/a.txt")
+			So(err, ShouldBeNil)
+			So(fi.IsDir(), ShouldBeFalse)
+			So(fi.Size(), ShouldEqual, 11)
+
+			_, err = fsys.Stat("missing")
+			So(errors.Is(err, fs.ErrNotExist), ShouldBeTrue)
+		})
+
+		Convey("Readdir should list the files and the directories", func() {
+			fis, err := afero.ReadDir(fsys, "dir")
+			So(err, ShouldBeNil)
+			So(fis, ShouldHaveLength, 2)
+			So(fis[0].Name(), ShouldEqual, "b.txt")
+			So(fis[1].Name(), ShouldEqual, "sub")
+			So(fis[1].IsDir(), ShouldBeTrue)
+
+			fis, err = afero.ReadDir(fsys, "")
+			So(err, ShouldBeNil)
+			So(fis, ShouldHaveLength, 2)
+		})
+
+		Convey("Read should support seeking and ranged reads", func() {
+			f, err := fsys.Open("a.txt")
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			_, err = f.Seek(6, io.SeekStart)
+			So(err, ShouldBeNil)
+			b, err := io.ReadAll(f)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "world")
+
+			p := make([]byte, 4)
+			n, err := f.ReadAt(p, 1)
+			So(err, ShouldBeNil)
+			So(string(p[:n]), ShouldEqual, "ello")
+		})
+
+		Convey("http.ServeContent should respond ranges", func() {
+			f, err := fsys.Open("a.txt")
+			So(err, ShouldBeNil)
+			defer f.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/a.txt", nil)
+			req.Header.Set("Range", "bytes=0-4")
+			w := httptest.NewRecorder()
+			http.ServeContent(w, req, "a.txt", time.Time{}, f)
+
+			So(w.Code, ShouldEqual, http.StatusPartialContent)
+			So(w.Body.String(), ShouldEqual, "hello")
+		})
+
+		Convey("OpenFile should fail if the parent directory does not exist", func() {
+			_, err := fsys.OpenFile("missing/c.txt", os.O_WRONLY|os.O_CREATE, 0644)
+			So(errors.Is(err, fs.ErrNotExist), ShouldBeTrue)
+		})
+
+		Convey("OpenFile without truncation should write in place", func() {
+			f, err := fsys.OpenFile("a.txt", os.O_WRONLY, 0644)
+			So(err, ShouldBeNil)
+			_, err = f.Seek(6, io.SeekStart)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("there"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			b, err := afero.ReadFile(fsys, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello there")
+		})
+
+		Convey("Remove should not remove a directory that is not empty", func() {
+			So(fsys.Remove("dir"), ShouldNotBeNil)
+			So(fsys.Remove("dir/sub"), ShouldBeNil)
+
+			_, err := fsys.Stat("dir/sub")
+			So(errors.Is(err, fs.ErrNotExist), ShouldBeTrue)
+		})
+
+		Convey("Rename should move a directory with its content", func() {
+			So(fsys.Rename("dir", "moved"), ShouldBeNil)
+
+			b, err := afero.ReadFile(fsys, "moved/b.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "b")
+			exists, err := afero.DirExists(fsys, "moved/sub")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeTrue)
+			exists, err = afero.Exists(fsys, "dir")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+		})
+
+		Convey("WebDAV PROPFIND should list the directory", func() {
+			h := &webdav.Handler{
+				FileSystem: server.AferoFSWebdavAdapter(fsys, nil),
+				LockSystem: webdav.NewMemLS(),
+			}
+
+			req := httptest.NewRequest("PROPFIND", "/dir/", nil)
+			req.Header.Set("Depth", "1")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, http.StatusMultiStatus)
+			So(w.Body.String(), ShouldContainSubstring, "<D:href>/dir/b.txt</D:href>")
+			So(w.Body.String(), ShouldContainSubstring, "<D:href>/dir/sub/</D:href>")
+		})
+
+		Convey("WebDAV PUT should stream the file", func() {
+			h := &webdav.Handler{
+				FileSystem: server.AferoFSWebdavAdapter(fsys, nil),
+				LockSystem: webdav.NewMemLS(),
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/dir/c.txt", strings.NewReader("content"))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			So(w.Code, ShouldEqual, http.StatusCreated)
+			b, err := afero.ReadFile(fsys, "dir/c.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "content")
+		})
+	})
+}
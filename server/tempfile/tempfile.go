@@ -0,0 +1,154 @@
+// Package tempfile writes the files to temporary files first, and renames them to their paths once they are complete,
+// so the readers never see a partially written file.
+//
+// A temporary file is created next to its file, so the rename never crosses the directories, which may be on other
+// mounts under the root. The temporary files are internal, so they are not visible through the handlers.
+package tempfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+)
+
+// legacyDir is the hidden directory at the root, which kept the files being written by the previous versions.
+const legacyDir = internalpath.Temp
+
+// File is the temporary file of a file being written. It replaces the file when committed, and is removed when closed
+// without being committed.
+type File struct {
+	afero.File
+	fs     afero.Fs
+	tmp    string
+	name   string
+	closed bool
+}
+
+// Create returns the temporary file of the file at the path, in the directory of the file, which must exist.
+func Create(fsys afero.Fs, name string, perm os.FileMode) (*File, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	tmp := path.Join(path.Dir(filepath.ToSlash(name)), internalpath.TempPrefix+hex.EncodeToString(b))
+
+	af, err := fsys.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: af, fs: fsys, tmp: tmp, name: name}, nil
+}
+
+// Commit flushes the content to the storage, and renames the temporary file to the path of the file, replacing the
+// existing one. The temporary file is removed if it fails.
+func (f *File) Commit() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		f.fs.Remove(f.tmp)
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		f.fs.Remove(f.tmp)
+		return err
+	}
+	if err := f.fs.Rename(f.tmp, f.name); err != nil {
+		f.fs.Remove(f.tmp)
+		return err
+	}
+	return nil
+}
+
+// Close removes the temporary file if it is not committed, leaving the file untouched. It does nothing after Commit.
+func (f *File) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+
+	err := f.File.Close()
+	return errors.Join(err, f.fs.Remove(f.tmp))
+}
+
+// Copy copies the content of the file at src to the file at dst, which is replaced only once the copy is complete.
+func Copy(fsys afero.Fs, src string, dst string, perm os.FileMode) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := Create(fsys, dst, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// Clean removes the temporary files last modified before maxAge ago, which are left by the interrupted writes, and
+// returns the number of the removed files. A maxAge of 0 removes all of them.
+func Clean(fsys afero.Fs, maxAge time.Duration) (int, error) {
+	expired := func(info fs.FileInfo) bool {
+		return maxAge <= 0 || time.Since(info.ModTime()) >= maxAge
+	}
+
+	var names []string
+	if err := afero.Walk(fsys, ".", func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			// The file is removed while walking, such as a temporary file committed meanwhile.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		p = internalpath.Clean(p)
+		switch {
+		case p == legacyDir:
+			entries, err := afero.ReadDir(fsys, p)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				if expired(e) {
+					names = append(names, path.Join(p, e.Name()))
+				}
+			}
+			return filepath.SkipDir
+		case internalpath.IsTemp(p):
+			if !info.IsDir() && expired(info) {
+				names = append(names, p)
+			}
+		case info.IsDir() && internalpath.Is(p):
+			return filepath.SkipDir
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, name := range names {
+		if err := fsys.RemoveAll(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,134 @@
+package tempfile
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+)
+
+func TestFile(t *testing.T) {
+	Convey("Given an existing file", t, func() {
+		fs := afero.NewMemMapFs()
+		So(afero.WriteFile(fs, "dir/a.txt", []byte("old"), 0644), ShouldBeNil)
+
+		f, err := Create(fs, "dir/a.txt", 0644)
+		So(err, ShouldBeNil)
+		_, err = f.WriteString("new")
+		So(err, ShouldBeNil)
+
+		Convey("The file should be kept while the new content is written next to it", func() {
+			b, _ := afero.ReadFile(fs, "dir/a.txt")
+			So(string(b), ShouldEqual, "old")
+
+			entries, _ := afero.ReadDir(fs, "dir")
+			So(entries, ShouldHaveLength, 2)
+			for _, e := range entries {
+				if e.Name() != "a.txt" {
+					So(internalpath.IsTemp("dir/"+e.Name()), ShouldBeTrue)
+				}
+			}
+		})
+
+		Convey("Committing should replace the file", func() {
+			So(f.Commit(), ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			b, _ := afero.ReadFile(fs, "dir/a.txt")
+			So(string(b), ShouldEqual, "new")
+
+			entries, _ := afero.ReadDir(fs, "dir")
+			So(entries, ShouldHaveLength, 1)
+		})
+
+		Convey("Closing without committing should leave the file untouched", func() {
+			So(f.Close(), ShouldBeNil)
+
+			b, _ := afero.ReadFile(fs, "dir/a.txt")
+			So(string(b), ShouldEqual, "old")
+
+			entries, _ := afero.ReadDir(fs, "dir")
+			So(entries, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestCopy(t *testing.T) {
+	Convey("Given the files", t, func() {
+		fs := afero.NewMemMapFs()
+		So(afero.WriteFile(fs, "a.txt", []byte("new"), 0644), ShouldBeNil)
+		So(afero.WriteFile(fs, "dir/b.txt", []byte("old"), 0644), ShouldBeNil)
+
+		Convey("Copying should replace the file", func() {
+			So(Copy(fs, "a.txt", "dir/b.txt", 0600), ShouldBeNil)
+
+			b, _ := afero.ReadFile(fs, "dir/b.txt")
+			So(string(b), ShouldEqual, "new")
+			b, _ = afero.ReadFile(fs, "a.txt")
+			So(string(b), ShouldEqual, "new")
+
+			entries, _ := afero.ReadDir(fs, "dir")
+			So(entries, ShouldHaveLength, 1)
+		})
+
+		Convey("Copying a missing file should leave the file untouched", func() {
+			So(Copy(fs, "missing.txt", "dir/b.txt", 0600), ShouldNotBeNil)
+
+			b, _ := afero.ReadFile(fs, "dir/b.txt")
+			So(string(b), ShouldEqual, "old")
+
+			entries, _ := afero.ReadDir(fs, "dir")
+			So(entries, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestClean(t *testing.T) {
+	Convey("Given the temporary files left by interrupted writes", t, func() {
+		const (
+			oldTemp = "dir/" + internalpath.TempPrefix + "00000000000000000000000000000000"
+			newTemp = internalpath.TempPrefix + "11111111111111111111111111111111"
+		)
+		fs := afero.NewMemMapFs()
+		So(afero.WriteFile(fs, oldTemp, nil, 0644), ShouldBeNil)
+		So(fs.Chtimes(oldTemp, time.Now(), time.Now().Add(-2*time.Hour)), ShouldBeNil)
+		So(afero.WriteFile(fs, newTemp, nil, 0644), ShouldBeNil)
+		So(afero.WriteFile(fs, legacyDir+"/old", nil, 0644), ShouldBeNil)
+		So(fs.Chtimes(legacyDir+"/old", time.Now(), time.Now().Add(-2*time.Hour)), ShouldBeNil)
+		So(afero.WriteFile(fs, "dir/a.txt", nil, 0644), ShouldBeNil)
+		So(afero.WriteFile(fs, "dir/.tmp-notes", nil, 0644), ShouldBeNil)
+
+		exists := func(name string) bool {
+			ok, _ := afero.Exists(fs, name)
+			return ok
+		}
+
+		Convey("Only the files older than the max age should be removed", func() {
+			n, err := Clean(fs, time.Hour)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			So(exists(oldTemp), ShouldBeFalse)
+			So(exists(legacyDir+"/old"), ShouldBeFalse)
+			So(exists(newTemp), ShouldBeTrue)
+		})
+
+		Convey("All temporary files should be removed without a max age", func() {
+			n, err := Clean(fs, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+
+			So(exists("dir/a.txt"), ShouldBeTrue)
+			So(exists("dir/.tmp-notes"), ShouldBeTrue)
+		})
+	})
+
+	Convey("Cleaning without any temporary file should do nothing", t, func() {
+		n, err := Clean(afero.NewMemMapFs(), 0)
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader loads the certificate again when the files are modified, e.g. renewed by cert-manager.
+type certReloader struct {
+	logger   zerolog.Logger
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		logger:   log.With().Str("logger", "tls").Logger(),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the certificate if any of the files is modified since the last load.
+func (r *certReloader) reload(now time.Time) error {
+	r.checked = now
+
+	var modTime time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert, r.modTime = &cert, modTime
+	r.logger.Info().Str("certFile", r.certFile).Time("modTime", modTime).Msg("loaded TLS certificate")
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Checking the files on every handshake is unnecessary.
+	if now := time.Now(); now.Sub(r.checked) >= time.Second {
+		if err := r.reload(now); err != nil {
+			// Keep serving the previous certificate, because the files may be in the middle of an update.
+			r.logger.Warn().Err(err).Str("certFile", r.certFile).Msg("failed to reload TLS certificate")
+		}
+	}
+	return r.cert, nil
+}
+
+// NewTLSConfig returns the TLS configuration of the servers, or nil if TLS is not configured.
+// Client certificates are verified against the CA bundle if configured, but are not required,
+// so clients can still authenticate with tokens.
+func NewTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := viper.GetString(config.KeyHTTPTLSCertFile), viper.GetString(config.KeyHTTPTLSKeyFile)
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both %s and %s are required", config.KeyHTTPTLSCertFile, config.KeyHTTPTLSKeyFile)
+	}
+
+	minVersion, ok := tlsVersions[viper.GetString(config.KeyHTTPTLSMinVersion)]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version: %s", viper.GetString(config.KeyHTTPTLSMinVersion))
+	}
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if caFile := viper.GetString(config.KeyHTTPTLSClientCAFile); caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return c, nil
+}
+
+// NewRedirectHandler redirects the requests to the same URL on HTTPS at the port.
+func NewRedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		// 308 keeps the method and the body of uploads, unlike 301.
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+// writeCert writes a self-signed certificate of the common name and its key to the files.
+func writeCert(t *testing.T, certFile string, keyFile string, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "old.example.com")
+	defer viper.Reset()
+
+	Convey("Given no certificate", t, func() {
+		viper.Reset()
+
+		Convey("TLS should be disabled", func() {
+			c, err := NewTLSConfig()
+			So(err, ShouldBeNil)
+			So(c, ShouldBeNil)
+		})
+	})
+
+	Convey("Given a certificate without the key", t, func() {
+		viper.Reset()
+		viper.Set(config.KeyHTTPTLSCertFile, certFile)
+
+		Convey("It should fail", func() {
+			_, err := NewTLSConfig()
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a certificate and a client CA bundle", t, func() {
+		viper.Reset()
+		viper.Set(config.KeyHTTPTLSCertFile, certFile)
+		viper.Set(config.KeyHTTPTLSKeyFile, keyFile)
+		viper.Set(config.KeyHTTPTLSMinVersion, "1.3")
+		viper.Set(config.KeyHTTPTLSClientCAFile, certFile)
+
+		c, err := NewTLSConfig()
+		So(err, ShouldBeNil)
+
+		Convey("The client certificate should be verified if given", func() {
+			So(c.MinVersion, ShouldEqual, tls.VersionTLS13)
+			So(c.ClientAuth, ShouldEqual, tls.VerifyClientCertIfGiven)
+			So(c.ClientCAs, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCert(t, certFile, keyFile, "old.example.com")
+
+	commonName := func(r *certReloader) string {
+		cert, err := r.GetCertificate(nil)
+		So(err, ShouldBeNil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		So(err, ShouldBeNil)
+		return leaf.Subject.CommonName
+	}
+
+	Convey("Given a certificate reloader", t, func() {
+		r, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+		So(commonName(r), ShouldEqual, "old.example.com")
+
+		Convey("It should serve the new certificate after the files are replaced", func() {
+			writeCert(t, certFile, keyFile, "new.example.com")
+			future := time.Now().Add(time.Minute)
+			So(os.Chtimes(certFile, future, future), ShouldBeNil)
+			r.checked = time.Time{}
+
+			So(commonName(r), ShouldEqual, "new.example.com")
+		})
+
+		Convey("It should keep the previous certificate if the files are broken", func() {
+			So(os.WriteFile(certFile, []byte("broken"), 0644), ShouldBeNil)
+			future := time.Now().Add(2 * time.Minute)
+			So(os.Chtimes(certFile, future, future), ShouldBeNil)
+			r.checked = time.Time{}
+
+			So(commonName(r), ShouldEqual, "old.example.com")
+		})
+
+		Reset(func() {
+			writeCert(t, certFile, keyFile, "old.example.com")
+		})
+	})
+}
+
+func TestRedirectHandler(t *testing.T) {
+	Convey("Given a redirect handler to port 8443", t, func() {
+		h := NewRedirectHandler(8443)
+
+		Convey("It should redirect to the same URL on HTTPS", func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "http://example.com:8080/files/a.txt?x=1", nil))
+
+			So(w.Code, ShouldEqual, http.StatusPermanentRedirect)
+			So(w.Header().Get("Location"), ShouldEqual, "https://example.com:8443/files/a.txt?x=1")
+		})
+	})
+
+	Convey("Given a redirect handler to port 443", t, func() {
+		h := NewRedirectHandler(443)
+
+		Convey("It should omit the port", func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+			So(w.Header().Get("Location"), ShouldEqual, "https://example.com/")
+		})
+	})
+}
@@ -0,0 +1,308 @@
+// Package trash moves the deleted files to a hidden trash directory, where they can be restored until they are purged.
+package trash
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/quota"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+// Dir is the hidden directory at the root keeping the contents of the deleted files, which is not visible through the Fs.
+const Dir = internalpath.Trash
+
+// isTrashPath reports whether the path is in the trash directory.
+func isTrashPath(name string) bool {
+	p := internalpath.Clean(name)
+	return p == Dir || strings.HasPrefix(p, Dir+"/")
+}
+
+// isTrashed reports whether the file is moved to the trash when it is removed. The internal files, such as the
+// incomplete uploads in ".tus", are removed at once.
+func isTrashed(name string) bool {
+	return internalpath.Clean(name) != "" && !internalpath.Is(name)
+}
+
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Fs moves the files removed from the underlying afero.Fs to the trash directory, and records their original paths.
+type Fs struct {
+	afero.Fs
+	entries *store.TrashStore
+}
+
+func New(base afero.Fs, entries *store.TrashStore) *Fs {
+	return &Fs{Fs: base, entries: entries}
+}
+
+// WithOwner returns the view of the Fs writing the files as the owner, if the underlying afero.Fs records the owners.
+func (f *Fs) WithOwner(owner string) afero.Fs {
+	if o, ok := f.Fs.(quota.Owned); ok {
+		return &Fs{Fs: o.WithOwner(owner), entries: f.entries}
+	}
+	return f
+}
+
+func entryPath(id string) string {
+	return path.Join(Dir, id)
+}
+
+// trash moves the file to the trash directory, and records it as an entry.
+func (f *Fs) trash(name string, info fs.FileInfo, deletedAt time.Time) error {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	e := &store.TrashEntry{
+		ID:        hex.EncodeToString(b),
+		Path:      internalpath.Clean(name),
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		DeletedAt: deletedAt,
+	}
+	if err := f.Fs.MkdirAll(Dir, 0755); err != nil {
+		return err
+	}
+	if err := f.entries.Put(e); err != nil {
+		return err
+	}
+	if err := f.Fs.Rename(name, entryPath(e.ID)); err != nil {
+		f.entries.Delete(e.ID)
+		return err
+	}
+	return nil
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	if isTrashPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.Mkdir(name, perm)
+}
+
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	if isTrashPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.MkdirAll(name, perm)
+}
+
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if isTrashPath(name) {
+		return nil, notExist("open", name)
+	}
+	af, err := f.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if internalpath.Clean(name) == "" {
+		return &rootDir{File: af}, nil
+	}
+	return af, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	if isTrashPath(name) {
+		return notExist("remove", name)
+	}
+	if !isTrashed(name) {
+		return f.Fs.Remove(name)
+	}
+
+	info, err := f.Fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return f.Fs.Remove(name)
+	}
+	return f.trash(name, info, time.Now())
+}
+
+// RemoveAll moves each file under the path to the trash as an entry, and removes the directories.
+func (f *Fs) RemoveAll(name string) error {
+	if isTrashPath(name) {
+		return notExist("remove", name)
+	}
+	if internalpath.Clean(name) == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if !isTrashed(name) {
+		return f.Fs.RemoveAll(name)
+	}
+
+	files := make(map[string]fs.FileInfo)
+	if err := afero.Walk(f.Fs, name, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[p] = info
+		}
+		return nil
+	}); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	now := time.Now()
+	for p, info := range files {
+		if err := f.trash(p, info, now); err != nil {
+			return err
+		}
+	}
+	return f.Fs.RemoveAll(name)
+}
+
+func (f *Fs) Rename(oldName string, newName string) error {
+	if isTrashPath(oldName) {
+		return notExist("rename", oldName)
+	}
+	if isTrashPath(newName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+	return f.Fs.Rename(oldName, newName)
+}
+
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	if isTrashPath(name) {
+		return nil, notExist("stat", name)
+	}
+	return f.Fs.Stat(name)
+}
+
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	if isTrashPath(name) {
+		return notExist("chmod", name)
+	}
+	return f.Fs.Chmod(name, mode)
+}
+
+func (f *Fs) Chown(name string, uid int, gid int) error {
+	if isTrashPath(name) {
+		return notExist("chown", name)
+	}
+	return f.Fs.Chown(name, uid, gid)
+}
+
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if isTrashPath(name) {
+		return notExist("chtimes", name)
+	}
+	return f.Fs.Chtimes(name, atime, mtime)
+}
+
+func (f *Fs) Name() string {
+	return "trash(" + f.Fs.Name() + ")"
+}
+
+// List returns the entries in the trash, the latest deleted first.
+func (f *Fs) List() ([]*store.TrashEntry, error) {
+	return f.entries.List()
+}
+
+func (f *Fs) Entry(id string) (*store.TrashEntry, error) {
+	return f.entries.Get(id)
+}
+
+// OpenEntry opens the content of the entry.
+func (f *Fs) OpenEntry(id string) (afero.File, *store.TrashEntry, error) {
+	e, err := f.entries.Get(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	af, err := f.Fs.Open(entryPath(e.ID))
+	if err != nil {
+		return nil, nil, err
+	}
+	return af, e, nil
+}
+
+// Purge removes the entry from the trash permanently.
+func (f *Fs) Purge(id string) error {
+	e, err := f.entries.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := f.Fs.Remove(entryPath(e.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return f.entries.Delete(e.ID)
+}
+
+// PurgeOlderThan removes the entries deleted longer than the age ago, and returns the number of the removed entries.
+func (f *Fs) PurgeOlderThan(age time.Duration) (int, error) {
+	entries, err := f.entries.List()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	deadline := time.Now().Add(-age)
+	for _, e := range entries {
+		if !e.DeletedAt.Before(deadline) {
+			continue
+		}
+		if err := f.Purge(e.ID); err != nil && !errors.Is(err, store.ErrTrashEntryNotFound) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// rootDir hides the trash directory from the root.
+type rootDir struct {
+	afero.File
+}
+
+func (d *rootDir) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		infos, err := d.File.Readdir(count)
+		visible := infos[:0]
+		for _, info := range infos {
+			if info.Name() != Dir {
+				visible = append(visible, info)
+			}
+		}
+		// Read on if only the trash directory is read, since no entries means the end of the directory.
+		if len(visible) == 0 && len(infos) > 0 && count > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
+
+func (d *rootDir) Readdirnames(n int) ([]string, error) {
+	for {
+		names, err := d.File.Readdirnames(n)
+		visible := names[:0]
+		for _, name := range names {
+			if name != Dir {
+				visible = append(visible, name)
+			}
+		}
+		if len(visible) == 0 && len(names) > 0 && n > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
@@ -0,0 +1,120 @@
+package trash
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func TestFs(t *testing.T) {
+	Convey("Given a file system with the trash", t, func() {
+		db, err := store.OpenDB(filepath.Join(t.TempDir(), "trash.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		entries, err := store.NewTrashStoreWithDB(db)
+		So(err, ShouldBeNil)
+
+		base := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		tfs := New(base, entries)
+
+		So(tfs.MkdirAll("dir/sub", 0755), ShouldBeNil)
+		So(afero.WriteFile(tfs, "a.txt", []byte("a"), 0644), ShouldBeNil)
+		So(afero.WriteFile(tfs, "dir/b.txt", []byte("bb"), 0644), ShouldBeNil)
+		So(afero.WriteFile(tfs, "dir/sub/c.txt", []byte("ccc"), 0644), ShouldBeNil)
+
+		Convey("Removing a file should move it to the trash", func() {
+			So(tfs.Remove("a.txt"), ShouldBeNil)
+
+			exists, err := afero.Exists(tfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+
+			list, err := tfs.List()
+			So(err, ShouldBeNil)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Path, ShouldEqual, "a.txt")
+			So(list[0].Size, ShouldEqual, 1)
+
+			f, e, err := tfs.OpenEntry(list[0].ID)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			So(e.Path, ShouldEqual, "a.txt")
+			b, err := afero.ReadAll(f)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "a")
+		})
+
+		Convey("Removing a directory should move each of its files to the trash", func() {
+			So(tfs.RemoveAll("dir"), ShouldBeNil)
+
+			exists, err := afero.Exists(tfs, "dir")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+
+			list, err := tfs.List()
+			So(err, ShouldBeNil)
+			So(len(list), ShouldEqual, 2)
+			paths := []string{list[0].Path, list[1].Path}
+			So(paths, ShouldContain, "dir/b.txt")
+			So(paths, ShouldContain, "dir/sub/c.txt")
+		})
+
+		Convey("The files in hidden directories should be removed at once", func() {
+			So(tfs.MkdirAll(".tus", 0755), ShouldBeNil)
+			So(afero.WriteFile(tfs, ".tus/x", []byte("x"), 0644), ShouldBeNil)
+			So(tfs.Remove(".tus/x"), ShouldBeNil)
+
+			list, err := tfs.List()
+			So(err, ShouldBeNil)
+			So(list, ShouldBeEmpty)
+		})
+
+		Convey("The trash directory should be hidden", func() {
+			So(tfs.Remove("a.txt"), ShouldBeNil)
+
+			infos, err := afero.ReadDir(tfs, "/")
+			So(err, ShouldBeNil)
+			So(len(infos), ShouldEqual, 1)
+			So(infos[0].Name(), ShouldEqual, "dir")
+
+			_, err = tfs.Stat(Dir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(tfs.RemoveAll(Dir), ShouldNotBeNil)
+			So(tfs.Rename("dir/b.txt", Dir+"/b.txt"), ShouldNotBeNil)
+		})
+
+		Convey("Purge should remove the entry permanently", func() {
+			So(tfs.Remove("a.txt"), ShouldBeNil)
+			list, err := tfs.List()
+			So(err, ShouldBeNil)
+
+			So(tfs.Purge(list[0].ID), ShouldBeNil)
+			So(tfs.Purge(list[0].ID), ShouldEqual, store.ErrTrashEntryNotFound)
+
+			infos, err := afero.ReadDir(base, Dir)
+			So(err, ShouldBeNil)
+			So(infos, ShouldBeEmpty)
+		})
+
+		Convey("PurgeOlderThan should remove the entries older than the age", func() {
+			So(tfs.Remove("a.txt"), ShouldBeNil)
+			time.Sleep(20 * time.Millisecond)
+			So(tfs.Remove("dir/b.txt"), ShouldBeNil)
+
+			n, err := tfs.PurgeOlderThan(10 * time.Millisecond)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			list, err := tfs.List()
+			So(err, ShouldBeNil)
+			So(len(list), ShouldEqual, 1)
+			So(list[0].Path, ShouldEqual, "dir/b.txt")
+		})
+	})
+}
@@ -0,0 +1,423 @@
+// Package versioning keeps the previous contents of the files as numbered versions when they are overwritten or deleted.
+package versioning
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/internalpath"
+	"github.com/wei840222/simple-file-server/server/tempfile"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+// Dir is the hidden directory at the root keeping the contents of the versions, which is not visible through the Fs.
+const Dir = internalpath.Versions
+
+// isVersionPath reports whether the path is in the directory of the versions.
+func isVersionPath(name string) bool {
+	p := internalpath.Clean(name)
+	return p == Dir || strings.HasPrefix(p, Dir+"/")
+}
+
+// isVersioned reports whether the previous contents of the file are kept. The internal files, such as the incomplete
+// uploads in ".tus", are not versioned.
+func isVersioned(name string) bool {
+	return internalpath.Clean(name) != "" && !internalpath.Is(name)
+}
+
+func notExist(op string, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Fs copies the files of the underlying afero.Fs to the directory of the versions before they are overwritten, moves
+// them there before they are removed, and records the uploaders of the files written by its owner.
+type Fs struct {
+	afero.Fs
+	logger   zerolog.Logger
+	versions *store.VersionStore
+	owner    string
+	// mu serializes the changes of the files with their versions, and is shared by the views of the owners.
+	mu *sync.Mutex
+}
+
+func New(base afero.Fs, versions *store.VersionStore) *Fs {
+	return &Fs{
+		Fs:       base,
+		logger:   log.With().Str("logger", "versioningFs").Logger(),
+		versions: versions,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// WithOwner returns the view of the Fs recording the owner as the uploader of the files it writes.
+func (f *Fs) WithOwner(owner string) afero.Fs {
+	return &Fs{Fs: f.Fs, logger: f.logger, versions: f.versions, owner: owner, mu: f.mu}
+}
+
+// copier is implemented by the file systems copying a file without copying its content, such as the deduplicating
+// one, which references the same blob.
+type copier interface {
+	Copy(oldName string, newName string) error
+}
+
+// newVersion returns the version of the file, at a new path in the directory of the versions.
+func newVersion(name string, info fs.FileInfo) *store.Version {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	return &store.Version{
+		Path:       internalpath.Clean(name),
+		Size:       info.Size(),
+		Name:       path.Join(Dir, id[:2], id),
+		ModTime:    info.ModTime(),
+		ArchivedAt: time.Now(),
+	}
+}
+
+// archive moves the file being removed to the directory of the versions, and records it as the latest version.
+// The caller must hold the lock.
+func (f *Fs) archive(name string, info fs.FileInfo) (*store.Version, error) {
+	v := newVersion(name, info)
+	if err := f.Fs.MkdirAll(path.Dir(v.Name), 0755); err != nil {
+		return nil, err
+	}
+	if err := f.versions.Add(v); err != nil {
+		return nil, err
+	}
+	if err := f.Fs.Rename(name, v.Name); err != nil {
+		f.versions.Delete(v.Path, v.Number)
+		return nil, err
+	}
+	return v, nil
+}
+
+// snapshot copies the file being replaced or modified to the directory of the versions, and records it as the latest
+// version. The file stays at its path meanwhile, so the readers never miss it. The caller must hold the lock.
+func (f *Fs) snapshot(name string, info fs.FileInfo) (*store.Version, error) {
+	v := newVersion(name, info)
+	if err := f.Fs.MkdirAll(path.Dir(v.Name), 0755); err != nil {
+		return nil, err
+	}
+	if c, ok := f.Fs.(copier); ok {
+		if err := c.Copy(name, v.Name); err != nil {
+			return nil, err
+		}
+	} else if err := tempfile.Copy(f.Fs, name, v.Name, info.Mode().Perm()); err != nil {
+		return nil, err
+	}
+	if err := f.versions.Add(v); err != nil {
+		f.Fs.Remove(v.Name)
+		return nil, err
+	}
+	return v, nil
+}
+
+// discard removes the version, when the change it was kept for fails.
+func (f *Fs) discard(v *store.Version) {
+	if err := f.versions.Delete(v.Path, v.Number); err != nil {
+		f.logger.Warn().Err(err).Str("path", v.Path).Int64("version", v.Number).Msg("failed to remove the version of a failed change")
+		return
+	}
+	if err := f.Fs.Remove(v.Name); err != nil {
+		f.logger.Warn().Err(err).Str("path", v.Path).Int64("version", v.Number).Msg("failed to remove the version of a failed change")
+	}
+}
+
+func (f *Fs) setUploader(name string) {
+	if err := f.versions.SetUploader(internalpath.Clean(name), f.owner); err != nil {
+		f.logger.Warn().Err(err).Str("path", name).Msg("failed to record the uploader")
+	}
+}
+
+func (f *Fs) Create(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (f *Fs) Mkdir(name string, perm os.FileMode) error {
+	if isVersionPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.Mkdir(name, perm)
+}
+
+func (f *Fs) MkdirAll(name string, perm os.FileMode) error {
+	if isVersionPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+	}
+	return f.Fs.MkdirAll(name, perm)
+}
+
+func (f *Fs) Open(name string) (afero.File, error) {
+	return f.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (f *Fs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if isVersionPath(name) {
+		return nil, notExist("open", name)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 || !isVersioned(name) {
+		af, err := f.Fs.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if internalpath.Clean(name) == "" {
+			return &rootDir{File: af}, nil
+		}
+		return af, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.Fs.Stat(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if info == nil || info.IsDir() || flag&os.O_EXCL != 0 {
+		af, err := f.Fs.OpenFile(name, flag, perm)
+		if err == nil && info == nil {
+			f.setUploader(name)
+		}
+		return af, err
+	}
+
+	v, err := f.snapshot(name, info)
+	if err != nil {
+		return nil, err
+	}
+	af, err := f.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		f.discard(v)
+		return nil, err
+	}
+	f.setUploader(name)
+	return af, nil
+}
+
+func (f *Fs) Remove(name string) error {
+	if isVersionPath(name) {
+		return notExist("remove", name)
+	}
+	if !isVersioned(name) {
+		return f.Fs.Remove(name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := f.Fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return f.Fs.Remove(name)
+	}
+	_, err = f.archive(name, info)
+	return err
+}
+
+func (f *Fs) RemoveAll(name string) error {
+	if isVersionPath(name) {
+		return notExist("remove", name)
+	}
+	if internalpath.Clean(name) == "" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	if !isVersioned(name) {
+		return f.Fs.RemoveAll(name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	files := make(map[string]fs.FileInfo)
+	if err := afero.Walk(f.Fs, name, func(p string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[p] = info
+		}
+		return nil
+	}); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for p, info := range files {
+		if _, err := f.archive(p, info); err != nil {
+			return err
+		}
+	}
+	return f.Fs.RemoveAll(name)
+}
+
+func (f *Fs) Rename(oldName string, newName string) error {
+	if isVersionPath(oldName) {
+		return notExist("rename", oldName)
+	}
+	if isVersionPath(newName) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrPermission}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The file replaced at the new path is kept as a version, and stays there until it is replaced.
+	var replaced *store.Version
+	if isVersioned(newName) && internalpath.Clean(oldName) != internalpath.Clean(newName) {
+		if info, err := f.Fs.Stat(newName); err == nil && !info.IsDir() {
+			if replaced, err = f.snapshot(newName, info); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := f.Fs.Rename(oldName, newName); err != nil {
+		if replaced != nil {
+			f.discard(replaced)
+		}
+		return err
+	}
+
+	if err := f.versions.MoveUploaders(internalpath.Clean(oldName), internalpath.Clean(newName)); err != nil {
+		f.logger.Warn().Err(err).Str("oldPath", oldName).Str("newPath", newName).Msg("failed to move the uploaders")
+	}
+	if f.owner != "" && !isVersioned(oldName) && isVersioned(newName) {
+		// A file completed in a hidden directory, such as a tus upload, is uploaded by the owner.
+		f.setUploader(newName)
+	}
+	return nil
+}
+
+func (f *Fs) Stat(name string) (os.FileInfo, error) {
+	if isVersionPath(name) {
+		return nil, notExist("stat", name)
+	}
+	return f.Fs.Stat(name)
+}
+
+func (f *Fs) Chmod(name string, mode os.FileMode) error {
+	if isVersionPath(name) {
+		return notExist("chmod", name)
+	}
+	return f.Fs.Chmod(name, mode)
+}
+
+func (f *Fs) Chown(name string, uid int, gid int) error {
+	if isVersionPath(name) {
+		return notExist("chown", name)
+	}
+	return f.Fs.Chown(name, uid, gid)
+}
+
+func (f *Fs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if isVersionPath(name) {
+		return notExist("chtimes", name)
+	}
+	return f.Fs.Chtimes(name, atime, mtime)
+}
+
+func (f *Fs) Name() string {
+	return "versioning(" + f.Fs.Name() + ")"
+}
+
+// History returns the versions of the file, the latest first.
+func (f *Fs) History(name string) ([]*store.Version, error) {
+	return f.versions.List(internalpath.Clean(name))
+}
+
+// OpenVersion opens the content of the version of the file.
+func (f *Fs) OpenVersion(name string, number int64) (afero.File, *store.Version, error) {
+	v, err := f.versions.Get(internalpath.Clean(name), number)
+	if err != nil {
+		return nil, nil, err
+	}
+	af, err := f.Fs.Open(v.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return af, v, nil
+}
+
+// Retention is the rule of the versions to keep. Zero values keep the versions without limit.
+type Retention struct {
+	// KeepLast is the number of the latest versions to keep for each file.
+	KeepLast int
+	// KeepFor is the duration to keep a version after it is archived.
+	KeepFor time.Duration
+}
+
+// Prune removes the versions beyond the retention, and returns the number of the removed versions.
+func (f *Fs) Prune(r Retention) (int, error) {
+	var expired []*store.Version
+	deadline := time.Now().Add(-r.KeepFor)
+	if err := f.versions.All(func(_ string, versions []*store.Version) error {
+		for i, v := range versions {
+			if (r.KeepLast > 0 && i >= r.KeepLast) || (r.KeepFor > 0 && v.ArchivedAt.Before(deadline)) {
+				expired = append(expired, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for i, v := range expired {
+		if err := f.Fs.Remove(v.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return i, err
+		}
+		if err := f.versions.Delete(v.Path, v.Number); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// rootDir hides the directory of the versions from the root.
+type rootDir struct {
+	afero.File
+}
+
+func (d *rootDir) Readdir(count int) ([]os.FileInfo, error) {
+	for {
+		infos, err := d.File.Readdir(count)
+		visible := infos[:0]
+		for _, info := range infos {
+			if info.Name() != Dir {
+				visible = append(visible, info)
+			}
+		}
+		// Read on if only the directory of the versions is read, since no entries means the end of the directory.
+		if len(visible) == 0 && len(infos) > 0 && count > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
+
+func (d *rootDir) Readdirnames(n int) ([]string, error) {
+	for {
+		names, err := d.File.Readdirnames(n)
+		visible := names[:0]
+		for _, name := range names {
+			if name != Dir {
+				visible = append(visible, name)
+			}
+		}
+		if len(visible) == 0 && len(names) > 0 && n > 0 && err == nil {
+			continue
+		}
+		return visible, err
+	}
+}
@@ -0,0 +1,186 @@
+package versioning
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/afero"
+
+	"github.com/wei840222/simple-file-server/server/dedup"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+func readVersion(vfs *Fs, name string, number int64) string {
+	f, _, err := vfs.OpenVersion(name, number)
+	So(err, ShouldBeNil)
+	defer f.Close()
+	b, err := afero.ReadAll(f)
+	So(err, ShouldBeNil)
+	return string(b)
+}
+
+func TestFs(t *testing.T) {
+	Convey("Given a versioning file system", t, func() {
+		db, err := store.OpenDB(filepath.Join(t.TempDir(), "versions.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		versions, err := store.NewVersionStoreWithDB(db)
+		So(err, ShouldBeNil)
+
+		base := afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+		vfs := New(base, versions)
+		alice := vfs.WithOwner("alice")
+
+		So(afero.WriteFile(alice, "a.txt", []byte("v1"), 0644), ShouldBeNil)
+
+		Convey("Overwriting a file should keep the previous content as a version", func() {
+			So(afero.WriteFile(vfs.WithOwner("bob"), "a.txt", []byte("v2"), 0644), ShouldBeNil)
+			So(afero.WriteFile(alice, "a.txt", []byte("v3"), 0644), ShouldBeNil)
+
+			history, err := vfs.History("a.txt")
+			So(err, ShouldBeNil)
+			So(len(history), ShouldEqual, 2)
+			So(history[0].Number, ShouldEqual, 2)
+			So(history[0].Uploader, ShouldEqual, "bob")
+			So(history[1].Number, ShouldEqual, 1)
+			So(history[1].Uploader, ShouldEqual, "alice")
+			So(history[1].Size, ShouldEqual, 2)
+
+			So(readVersion(vfs, "a.txt", 1), ShouldEqual, "v1")
+			So(readVersion(vfs, "a.txt", 2), ShouldEqual, "v2")
+			b, err := afero.ReadFile(vfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "v3")
+		})
+
+		Convey("Appending to a file should keep its content", func() {
+			f, err := alice.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0)
+			So(err, ShouldBeNil)
+			_, err = f.Write([]byte("+"))
+			So(err, ShouldBeNil)
+			So(f.Close(), ShouldBeNil)
+
+			b, err := afero.ReadFile(vfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "v1+")
+			So(readVersion(vfs, "a.txt", 1), ShouldEqual, "v1")
+		})
+
+		Convey("Removing a file should keep it as a version", func() {
+			So(afero.WriteFile(alice, "dir/b.txt", []byte("b"), 0644), ShouldNotBeNil)
+			So(vfs.MkdirAll("dir", 0755), ShouldBeNil)
+			So(afero.WriteFile(alice, "dir/b.txt", []byte("b"), 0644), ShouldBeNil)
+
+			So(vfs.Remove("a.txt"), ShouldBeNil)
+			So(vfs.RemoveAll("dir"), ShouldBeNil)
+
+			exists, err := afero.Exists(vfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(exists, ShouldBeFalse)
+			So(readVersion(vfs, "a.txt", 1), ShouldEqual, "v1")
+			So(readVersion(vfs, "dir/b.txt", 1), ShouldEqual, "b")
+		})
+
+		Convey("Renaming over a file should keep the replaced file as a version", func() {
+			So(afero.WriteFile(alice, "c.txt", []byte("c"), 0644), ShouldBeNil)
+			So(vfs.Rename("c.txt", "a.txt"), ShouldBeNil)
+
+			So(readVersion(vfs, "a.txt", 1), ShouldEqual, "v1")
+			_, _, err := vfs.OpenVersion("c.txt", 1)
+			So(err, ShouldEqual, store.ErrVersionNotFound)
+		})
+
+		Convey("A failed rename over a file should keep the file without a version", func() {
+			So(vfs.Rename("missing.txt", "a.txt"), ShouldNotBeNil)
+
+			b, err := afero.ReadFile(vfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "v1")
+			history, err := vfs.History("a.txt")
+			So(err, ShouldBeNil)
+			So(history, ShouldBeEmpty)
+		})
+
+		Convey("The files in hidden directories should not be versioned", func() {
+			So(vfs.MkdirAll(".tus", 0755), ShouldBeNil)
+			So(afero.WriteFile(vfs, ".tus/x", []byte("x"), 0644), ShouldBeNil)
+			So(vfs.Remove(".tus/x"), ShouldBeNil)
+
+			history, err := vfs.History(".tus/x")
+			So(err, ShouldBeNil)
+			So(history, ShouldBeEmpty)
+		})
+
+		Convey("The directory of the versions should be hidden", func() {
+			So(vfs.Remove("a.txt"), ShouldBeNil)
+
+			infos, err := afero.ReadDir(vfs, "/")
+			So(err, ShouldBeNil)
+			So(infos, ShouldBeEmpty)
+
+			_, err = vfs.Stat(Dir)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(vfs.RemoveAll(Dir), ShouldNotBeNil)
+			So(vfs.Rename("a.txt", Dir+"/a.txt"), ShouldNotBeNil)
+		})
+
+		Convey("Prune should remove the versions beyond the retention", func() {
+			for _, s := range []string{"v2", "v3", "v4"} {
+				So(afero.WriteFile(alice, "a.txt", []byte(s), 0644), ShouldBeNil)
+			}
+
+			n, err := vfs.Prune(Retention{KeepLast: 2})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+
+			history, err := vfs.History("a.txt")
+			So(err, ShouldBeNil)
+			So(len(history), ShouldEqual, 2)
+			So(history[1].Number, ShouldEqual, 2)
+			_, _, err = vfs.OpenVersion("a.txt", 1)
+			So(err, ShouldEqual, store.ErrVersionNotFound)
+
+			time.Sleep(10 * time.Millisecond)
+			n, err = vfs.Prune(Retention{KeepFor: time.Millisecond})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			content, err := afero.ReadDir(base, Dir)
+			So(err, ShouldBeNil)
+			for _, info := range content {
+				sub, err := afero.ReadDir(base, filepath.Join(Dir, info.Name()))
+				So(err, ShouldBeNil)
+				So(sub, ShouldBeEmpty)
+			}
+		})
+	})
+}
+
+func TestFs_Dedup(t *testing.T) {
+	Convey("Given a versioning file system on a deduplicating one", t, func() {
+		db, err := store.OpenDB(filepath.Join(t.TempDir(), "versions.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		versions, err := store.NewVersionStoreWithDB(db)
+		So(err, ShouldBeNil)
+
+		dfs, err := dedup.New(afero.NewBasePathFs(afero.NewOsFs(), t.TempDir()))
+		So(err, ShouldBeNil)
+		vfs := New(dfs, versions)
+
+		So(afero.WriteFile(vfs, "a.txt", []byte("v1"), 0644), ShouldBeNil)
+
+		Convey("The versions of the overwritten files should reference their blobs", func() {
+			So(afero.WriteFile(vfs, "a.txt", []byte("v2"), 0644), ShouldBeNil)
+
+			So(dfs.Usage(), ShouldResemble, dedup.Usage{Blobs: 2, Stored: 4, Logical: 4})
+			So(readVersion(vfs, "a.txt", 1), ShouldEqual, "v1")
+			b, err := afero.ReadFile(vfs, "a.txt")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "v2")
+		})
+	})
+}
@@ -0,0 +1,176 @@
+// Package webhook notifies the receivers of the lifecycle events of the files with signed JSON requests.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+const (
+	EventFileUploaded    = "file.uploaded"
+	EventFileOverwritten = "file.overwritten"
+	EventFileDeleted     = "file.deleted"
+	EventFileExpired     = "file.expired"
+
+	HeaderID        = "X-Webhook-Id"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Event is the body of a webhook request.
+type Event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Path string    `json:"path"`
+	Size int64     `json:"size"`
+	// SHA256 is the hex digest of the content, omitted for the removed files.
+	SHA256 string `json:"sha256,omitempty"`
+	// Token is the fingerprint of the token of the change, omitted for the changes without a token.
+	Token      string `json:"token,omitempty"`
+	TokenLabel string `json:"tokenLabel,omitempty"`
+	TraceID    string `json:"traceId,omitempty"`
+}
+
+// Actor is the token making the changes of a request.
+type Actor struct {
+	Token      string
+	TokenLabel string
+}
+
+type actorContextKey struct{}
+
+// NewContext returns the context of the changes made by the actor.
+func NewContext(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, a)
+}
+
+// FromContext returns the actor of the context, if any.
+func FromContext(ctx context.Context) (Actor, bool) {
+	a, ok := ctx.Value(actorContextKey{}).(Actor)
+	return a, ok
+}
+
+// Scheduler delivers the events to the receivers in the background, retrying the failed deliveries.
+type Scheduler interface {
+	ScheduleWebhook(ctx context.Context, url string, e *Event) error
+}
+
+// Notifier sends the events to the receivers of the config.
+type Notifier struct {
+	logger    zerolog.Logger
+	scheduler Scheduler
+}
+
+func NewNotifier(s Scheduler) *Notifier {
+	return &Notifier{
+		logger:    log.With().Str("logger", "webhookNotifier").Logger(),
+		scheduler: s,
+	}
+}
+
+// Enabled reports whether any receiver is configured, so the details of the events are worth collecting.
+func (n *Notifier) Enabled() bool {
+	return n != nil && len(viper.GetStringSlice(config.KeyWebhookURLs)) > 0
+}
+
+// Notify schedules the delivery of the event to every receiver. The ID, the time, the actor and the trace ID of
+// the event are filled from the context if they are empty. A failure to schedule is logged rather than returned,
+// since the change is already made.
+func (n *Notifier) Notify(ctx context.Context, e Event) {
+	if !n.Enabled() {
+		return
+	}
+
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if a, ok := FromContext(ctx); ok && e.Token == "" {
+		e.Token, e.TokenLabel = a.Token, a.TokenLabel
+	}
+	if sc := trace.SpanContextFromContext(ctx); e.TraceID == "" && sc.HasTraceID() {
+		e.TraceID = sc.TraceID().String()
+	}
+
+	for _, url := range viper.GetStringSlice(config.KeyWebhookURLs) {
+		if err := n.scheduler.ScheduleWebhook(ctx, url, &e); err != nil {
+			n.logger.Error().Ctx(ctx).Err(err).Str("url", url).Str("id", e.ID).Str("type", e.Type).Str("path", e.Path).Msg("failed to schedule webhook")
+		}
+	}
+}
+
+// Sign returns the signature of the body sent at the timestamp, which is the hex HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// StatusError is the unsuccessful response of a receiver.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook receiver responded %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Retryable reports whether the delivery may succeed later. A client error other than a timeout or
+// a rate limit means the receiver rejects the event.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Deliver sends the event to the receiver, signed with the secret of the config if any.
+func Deliver(ctx context.Context, client *http.Client, url string, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", config.AppName)
+	req.Header.Set(HeaderID, e.ID)
+	req.Header.Set(HeaderEvent, e.Type)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now, 10))
+	if secret := viper.GetString(config.KeyWebhookSecret); secret != "" {
+		req.Header.Set(HeaderSignature, Sign(secret, now, body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return &StatusError{StatusCode: res.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+type fakeScheduler struct {
+	urls   []string
+	events []*Event
+}
+
+func (s *fakeScheduler) ScheduleWebhook(_ context.Context, url string, e *Event) error {
+	s.urls = append(s.urls, url)
+	s.events = append(s.events, e)
+	return nil
+}
+
+func TestNotifier(t *testing.T) {
+	defer viper.Reset()
+
+	Convey("Given a notifier", t, func() {
+		s := &fakeScheduler{}
+		n := NewNotifier(s)
+
+		Convey("It should be disabled without receivers", func() {
+			viper.Set(config.KeyWebhookURLs, []string{})
+			So(n.Enabled(), ShouldBeFalse)
+
+			n.Notify(context.Background(), Event{Type: EventFileUploaded, Path: "a.txt"})
+			So(s.events, ShouldBeEmpty)
+		})
+
+		Convey("A nil notifier should be disabled", func() {
+			var nilNotifier *Notifier
+			So(nilNotifier.Enabled(), ShouldBeFalse)
+			nilNotifier.Notify(context.Background(), Event{Type: EventFileUploaded, Path: "a.txt"})
+		})
+
+		Convey("It should schedule the event for each receiver with the actor of the context", func() {
+			viper.Set(config.KeyWebhookURLs, []string{"http://a.example.com", "http://b.example.com"})
+
+			ctx := NewContext(context.Background(), Actor{Token: "fingerprint", TokenLabel: "ci"})
+			n.Notify(ctx, Event{Type: EventFileUploaded, Path: "a.txt", Size: 1})
+
+			So(s.urls, ShouldResemble, []string{"http://a.example.com", "http://b.example.com"})
+			e := s.events[0]
+			So(e.ID, ShouldNotBeEmpty)
+			So(e.Time.IsZero(), ShouldBeFalse)
+			So(e.Token, ShouldEqual, "fingerprint")
+			So(e.TokenLabel, ShouldEqual, "ci")
+			So(s.events[1].ID, ShouldEqual, e.ID)
+		})
+	})
+}
+
+func TestDeliver(t *testing.T) {
+	defer viper.Reset()
+
+	Convey("Given a receiver", t, func() {
+		status := http.StatusNoContent
+		var req *http.Request
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req = r
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer srv.Close()
+
+		e := &Event{ID: "id", Type: EventFileDeleted, Path: "a.txt", Size: 1}
+
+		Convey("The event should be signed with the secret", func() {
+			viper.Set(config.KeyWebhookSecret, "secret")
+
+			So(Deliver(context.Background(), srv.Client(), srv.URL, e), ShouldBeNil)
+			So(req.Header.Get(HeaderID), ShouldEqual, "id")
+			So(req.Header.Get(HeaderEvent), ShouldEqual, EventFileDeleted)
+
+			var got Event
+			So(json.Unmarshal(body, &got), ShouldBeNil)
+			So(got.Path, ShouldEqual, "a.txt")
+
+			ts, err := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+			So(err, ShouldBeNil)
+			So(req.Header.Get(HeaderSignature), ShouldEqual, Sign("secret", ts, body))
+			So(req.Header.Get(HeaderSignature), ShouldNotEqual, Sign("other", ts, body))
+		})
+
+		Convey("The event should be unsigned without a secret", func() {
+			viper.Set(config.KeyWebhookSecret, "")
+
+			So(Deliver(context.Background(), srv.Client(), srv.URL, e), ShouldBeNil)
+			So(req.Header.Get(HeaderSignature), ShouldBeEmpty)
+		})
+
+		Convey("A server error should be retryable", func() {
+			status = http.StatusServiceUnavailable
+
+			err := Deliver(context.Background(), srv.Client(), srv.URL, e)
+			statusErr, ok := err.(*StatusError)
+			So(ok, ShouldBeTrue)
+			So(statusErr.Retryable(), ShouldBeTrue)
+		})
+
+		Convey("A client error should not be retryable", func() {
+			status = http.StatusBadRequest
+
+			err := Deliver(context.Background(), srv.Client(), srv.URL, e)
+			statusErr, ok := err.(*StatusError)
+			So(ok, ShouldBeTrue)
+			So(statusErr.Retryable(), ShouldBeFalse)
+		})
+	})
+}
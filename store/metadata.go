@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+var (
+	ErrMetadataNotFound = errors.New("metadata not found")
+
+	bucketMetadata = []byte("metadata")
+)
+
+// Metadata is the record of an uploaded file, keyed by its path in the file root.
+type Metadata struct {
+	Path         string    `json:"path"`
+	OriginalName string    `json:"originalName"`
+	ContentType  string    `json:"contentType"`
+	Uploader     string    `json:"uploader,omitempty"`
+	Size         int64     `json:"size"`
+	CreatedAt    time.Time `json:"createdAt"`
+	ExpiredAt    time.Time `json:"expiredAt,omitzero"`
+	// Checksums are the hex digests of the content keyed by their algorithms, such as "sha-256", computed when the
+	// file is written with ModTime.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	ModTime   time.Time         `json:"modTime,omitzero"`
+}
+
+// IsCurrent reports whether the file is unchanged since the metadata is recorded, which is when its size and
+// modification time are the same. The file may be changed otherwise, e.g. via WebDAV, which keeps no metadata.
+// The metadata recorded without the modification time is checked by the size only.
+func (m *Metadata) IsCurrent(fi fs.FileInfo) bool {
+	return m != nil && fi.Size() == m.Size && (m.ModTime.IsZero() || fi.ModTime().Equal(m.ModTime))
+}
+
+// ChecksumsOf returns the checksums of the file if it is unchanged since they are computed, or nil otherwise.
+func (m *Metadata) ChecksumsOf(fi fs.FileInfo) map[string]string {
+	if !m.IsCurrent(fi) || m.ModTime.IsZero() {
+		return nil
+	}
+	return m.Checksums
+}
+
+type MetadataStore struct {
+	db *bolt.DB
+}
+
+func (s *MetadataStore) Get(path string) (*Metadata, error) {
+	var m Metadata
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketMetadata).Get([]byte(path))
+		if v == nil {
+			return ErrMetadataNotFound
+		}
+		return json.Unmarshal(v, &m)
+	}); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *MetadataStore) Put(m *Metadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMetadata).Put([]byte(m.Path), b)
+	})
+}
+
+// Delete removes the records of the paths. Missing records are ignored.
+func (s *MetadataStore) Delete(paths ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range paths {
+			if err := tx.Bucket(bucketMetadata).Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// List returns at most limit records after the path in the order of their paths, from the first one if after is empty.
+func (s *MetadataStore) List(after string, limit int) ([]*Metadata, error) {
+	records := make([]*Metadata, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketMetadata).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(records) < limit; k, v = c.Next() {
+			var m Metadata
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			records = append(records, &m)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// NewMetadataStoreWithDB creates a MetadataStore on an opened database. It is mainly used for testing.
+func NewMetadataStoreWithDB(db *bolt.DB) (*MetadataStore, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketMetadata)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &MetadataStore{db: db}, nil
+}
+
+func NewMetadataStore(lc fx.Lifecycle) (*MetadataStore, error) {
+	db, err := OpenDB(viper.GetString(config.KeyFileMetadataPath), bucketMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return db.Close()
+		},
+	})
+
+	return &MetadataStore{db: db}, nil
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fileInfo struct {
+	fs.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+
+func TestMetadataStore(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, err := NewMetadataStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a metadata record", t, func() {
+		m := &Metadata{
+			Path:         "abc12345.txt",
+			OriginalName: "sample.txt",
+			ContentType:  "text/plain",
+			Size:         14,
+			CreatedAt:    time.Now().Truncate(time.Second),
+		}
+		So(s.Put(m), ShouldBeNil)
+
+		Convey("Get should return the record", func() {
+			got, err := s.Get("abc12345.txt")
+
+			So(err, ShouldBeNil)
+			So(got.OriginalName, ShouldEqual, "sample.txt")
+			So(got.CreatedAt.Equal(m.CreatedAt), ShouldBeTrue)
+		})
+
+		Convey("It should be current only for the file unchanged since", func() {
+			modTime := time.Now().Truncate(time.Second)
+			m.ModTime = modTime
+
+			So(m.IsCurrent(fileInfo{size: 14, modTime: modTime}), ShouldBeTrue)
+			So(m.IsCurrent(fileInfo{size: 15, modTime: modTime}), ShouldBeFalse)
+			So(m.IsCurrent(fileInfo{size: 14, modTime: modTime.Add(time.Second)}), ShouldBeFalse)
+
+			m.ModTime = time.Time{}
+			So(m.IsCurrent(fileInfo{size: 14, modTime: modTime.Add(time.Second)}), ShouldBeTrue)
+			So((*Metadata)(nil).IsCurrent(fileInfo{size: 14}), ShouldBeFalse)
+		})
+
+		Convey("Get should return ErrMetadataNotFound after Delete", func() {
+			So(s.Delete("abc12345.txt", "missing.txt"), ShouldBeNil)
+
+			_, err := s.Get("abc12345.txt")
+			So(err, ShouldEqual, ErrMetadataNotFound)
+		})
+	})
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketOwners = []byte("owners")
+
+// OwnerStore records the owner of each file, which is the fingerprint of the token that wrote it,
+// so the usage of a token can be restored after a restart.
+type OwnerStore struct {
+	db *bolt.DB
+}
+
+// All returns the owners keyed by the paths of the files.
+func (s *OwnerStore) All() (map[string]string, error) {
+	owners := make(map[string]string)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketOwners).ForEach(func(k, v []byte) error {
+			owners[string(k)] = string(v)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return owners, nil
+}
+
+// Put sets the owners of the paths. An empty owner removes the record.
+func (s *OwnerStore) Put(owners map[string]string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketOwners)
+		for p, owner := range owners {
+			var err error
+			if owner == "" {
+				err = b.Delete([]byte(p))
+			} else {
+				err = b.Put([]byte(p), []byte(owner))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NewOwnerStoreWithDB creates an OwnerStore on an opened database. It is mainly used for testing.
+func NewOwnerStoreWithDB(db *bolt.DB) (*OwnerStore, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketOwners)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &OwnerStore{db: db}, nil
+}
+
+// NewOwnerStore creates an OwnerStore in the database of the metadata, which records the files as well.
+func NewOwnerStore(m *MetadataStore) (*OwnerStore, error) {
+	return NewOwnerStoreWithDB(m.db)
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// ScrubIssueMismatch is a file whose content no longer matches its recorded checksum.
+	ScrubIssueMismatch = "mismatch"
+	// ScrubIssueMissing is a file with a recorded checksum which no longer exists.
+	ScrubIssueMissing = "missing"
+)
+
+var (
+	ErrScrubRunNotFound = errors.New("scrub run not found")
+
+	bucketScrubIssues = []byte("scrub_issues")
+	bucketScrubRuns   = []byte("scrub_runs")
+
+	keyScrubLastRun = []byte("last")
+)
+
+// ScrubIssue is the record of a file failing the integrity scrub.
+type ScrubIssue struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	// Quarantine is the path the corrupted file is moved to, if it is quarantined.
+	Quarantine string    `json:"quarantine,omitempty"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// ScrubRun is the progress of the latest integrity scrub, or its result once it is finished.
+type ScrubRun struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitzero"`
+	// Scanned is the number of the files walked, of which Verified match their checksums, Mismatched do not, and
+	// Skipped have no checksum or are changed since it is recorded.
+	Scanned    int64 `json:"scanned"`
+	Verified   int64 `json:"verified"`
+	Skipped    int64 `json:"skipped"`
+	Mismatched int64 `json:"mismatched"`
+	// Missing is the number of the recorded files which no longer exist.
+	Missing int64 `json:"missing"`
+}
+
+// ScrubStore records the issues found by the integrity scrub by their paths, and the latest run.
+type ScrubStore struct {
+	db *bolt.DB
+}
+
+func (s *ScrubStore) PutIssue(i *ScrubIssue) error {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketScrubIssues).Put([]byte(i.Path), b)
+	})
+}
+
+// DeleteIssues removes the issues of the paths. Missing issues are ignored.
+func (s *ScrubStore) DeleteIssues(paths ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range paths {
+			if err := tx.Bucket(bucketScrubIssues).Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListIssues returns the issues in the order of their paths.
+func (s *ScrubStore) ListIssues() ([]*ScrubIssue, error) {
+	issues := make([]*ScrubIssue, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketScrubIssues).ForEach(func(_, v []byte) error {
+			var i ScrubIssue
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			issues = append(issues, &i)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].Path < issues[j].Path
+	})
+	return issues, nil
+}
+
+// PruneIssues removes the issues detected before the time which are not quarantined, since a later run did not find
+// them again, and returns the number of the removed issues. The quarantined issues are kept until they are deleted.
+func (s *ScrubStore) PruneIssues(before time.Time) (int, error) {
+	var stale [][]byte
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketScrubIssues)
+		if err := b.ForEach(func(k, v []byte) error {
+			var i ScrubIssue
+			if err := json.Unmarshal(v, &i); err != nil {
+				return err
+			}
+			if i.Quarantine == "" && i.DetectedAt.Before(before) {
+				stale = append(stale, k)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// The keys are deleted after the iteration, which deleting under the cursor would disturb.
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(stale), nil
+}
+
+// PutRun records the progress of the latest run.
+func (s *ScrubStore) PutRun(r *ScrubRun) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketScrubRuns).Put(keyScrubLastRun, b)
+	})
+}
+
+// LastRun returns the latest run, or ErrScrubRunNotFound if the scrub has never run.
+func (s *ScrubStore) LastRun() (*ScrubRun, error) {
+	var r ScrubRun
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketScrubRuns).Get(keyScrubLastRun)
+		if v == nil {
+			return ErrScrubRunNotFound
+		}
+		return json.Unmarshal(v, &r)
+	}); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// NewScrubStoreWithDB creates a ScrubStore on an opened database. It is mainly used for testing.
+func NewScrubStoreWithDB(db *bolt.DB) (*ScrubStore, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketScrubIssues, bucketScrubRuns} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &ScrubStore{db: db}, nil
+}
+
+// NewScrubStore creates a ScrubStore in the database of the metadata.
+func NewScrubStore(m *MetadataStore) (*ScrubStore, error) {
+	return NewScrubStoreWithDB(m.db)
+}
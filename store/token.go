@@ -0,0 +1,350 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/fx"
+
+	"github.com/wei840222/simple-file-server/config"
+)
+
+const (
+	// ScopeRead allows the read-only routes.
+	ScopeRead = "read"
+	// ScopeWrite allows the read-write routes, which include the read-only routes.
+	ScopeWrite = "write"
+
+	// tokenCacheTTL bounds how long a verified token is trusted without checking the database,
+	// e.g. for the expiration. Revoking or rotating a token clears the cache immediately.
+	tokenCacheTTL = time.Minute
+	// tokenTouchInterval throttles the updates of the last used time.
+	tokenTouchInterval = time.Minute
+)
+
+var (
+	ErrTokenNotFound     = errors.New("token not found")
+	ErrTokenInvalid      = errors.New("invalid token")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrTokenScopeInvalid = errors.New("scopes must be read or write")
+
+	bucketTokens = []byte("tokens")
+)
+
+// Token is the record of a managed token. Only the salted hash of the secret is stored,
+// so the token is only known to the client it is issued to.
+type Token struct {
+	ID         string    `json:"id"`
+	Label      string    `json:"label"`
+	Scopes     []string  `json:"scopes"`
+	Salt       string    `json:"salt,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitzero"`
+	LastUsedAt time.Time `json:"lastUsedAt,omitzero"`
+}
+
+// HasScope reports whether the token is granted the scope. The write scope implies the read scope.
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope) || (scope == ScopeRead && slices.Contains(t.Scopes, ScopeWrite))
+}
+
+// Expired reports whether the token is expired at the time.
+func (t *Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
+
+type cachedToken struct {
+	token    Token
+	cachedAt time.Time
+}
+
+type TokenStore struct {
+	db    *bolt.DB
+	count atomic.Int64
+
+	mu    sync.Mutex
+	cache map[string]*cachedToken
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(salt string, secret string) string {
+	b := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(b[:])
+}
+
+// splitToken splits the token in the format "<id>.<secret>".
+func splitToken(token string) (string, string, bool) {
+	return strings.Cut(token, ".")
+}
+
+// newSecret sets a new salted secret to the record and returns the token.
+func newSecret(t *Token) (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	t.Salt, t.Hash = salt, hashSecret(salt, secret)
+	return t.ID + "." + secret, nil
+}
+
+func (s *TokenStore) put(tx *bolt.Tx, t *Token) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketTokens).Put([]byte(t.ID), b)
+}
+
+func (s *TokenStore) get(tx *bolt.Tx, id string) (*Token, error) {
+	v := tx.Bucket(bucketTokens).Get([]byte(id))
+	if v == nil {
+		return nil, ErrTokenNotFound
+	}
+	var t Token
+	if err := json.Unmarshal(v, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// forget removes the cached verifications of the token record.
+func (s *TokenStore) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.cache {
+		if v.token.ID == id {
+			delete(s.cache, k)
+		}
+	}
+}
+
+// Create issues a token of the scopes. A zero ttl means the token never expires.
+// It returns the record and the token, which cannot be recovered later.
+func (s *TokenStore) Create(label string, scopes []string, ttl time.Duration) (*Token, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", ErrTokenScopeInvalid
+	}
+	for _, scope := range scopes {
+		if scope != ScopeRead && scope != ScopeWrite {
+			return nil, "", ErrTokenScopeInvalid
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	t := &Token{
+		ID:        id,
+		Label:     label,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		t.ExpiresAt = t.CreatedAt.Add(ttl)
+	}
+	token, err := newSecret(t)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, t)
+	}); err != nil {
+		return nil, "", err
+	}
+	s.count.Add(1)
+
+	t.Salt, t.Hash = "", ""
+	return t, token, nil
+}
+
+// List returns the records of all tokens without their hashes.
+func (s *TokenStore) List() ([]*Token, error) {
+	tokens := []*Token{}
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokens).ForEach(func(_, v []byte) error {
+			var t Token
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			t.Salt, t.Hash = "", ""
+			tokens = append(tokens, &t)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Revoke deletes the token.
+func (s *TokenStore) Revoke(id string) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketTokens).Get([]byte(id)) == nil {
+			return ErrTokenNotFound
+		}
+		return tx.Bucket(bucketTokens).Delete([]byte(id))
+	}); err != nil {
+		return err
+	}
+	s.count.Add(-1)
+	s.forget(id)
+	return nil
+}
+
+// Rotate replaces the secret of the token, keeping its ID, label, scopes and expiration.
+// The previous token stops working immediately.
+func (s *TokenStore) Rotate(id string) (*Token, string, error) {
+	var t *Token
+	var token string
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if t, err = s.get(tx, id); err != nil {
+			return err
+		}
+		if token, err = newSecret(t); err != nil {
+			return err
+		}
+		return s.put(tx, t)
+	}); err != nil {
+		return nil, "", err
+	}
+	s.forget(id)
+
+	t.Salt, t.Hash = "", ""
+	return t, token, nil
+}
+
+// Len returns the number of tokens.
+func (s *TokenStore) Len() int {
+	return int(s.count.Load())
+}
+
+// Verify returns the record of the token, or an error if it is unknown or expired.
+// The verifications are cached, so the database is not read on every request.
+func (s *TokenStore) Verify(token string) (*Token, error) {
+	now := time.Now()
+	key := hashSecret("", token)
+
+	s.mu.Lock()
+	c, ok := s.cache[key]
+	s.mu.Unlock()
+
+	if !ok || now.Sub(c.cachedAt) > tokenCacheTTL {
+		id, secret, ok := splitToken(token)
+		if !ok {
+			return nil, ErrTokenInvalid
+		}
+
+		var t *Token
+		if err := s.db.View(func(tx *bolt.Tx) error {
+			var err error
+			t, err = s.get(tx, id)
+			return err
+		}); err != nil {
+			if errors.Is(err, ErrTokenNotFound) {
+				return nil, ErrTokenInvalid
+			}
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(hashSecret(t.Salt, secret)), []byte(t.Hash)) != 1 {
+			return nil, ErrTokenInvalid
+		}
+
+		c = &cachedToken{token: *t, cachedAt: now}
+		s.mu.Lock()
+		s.cache[key] = c
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	t := c.token
+	s.mu.Unlock()
+
+	if t.Expired(now) {
+		return nil, ErrTokenExpired
+	}
+
+	if now.Sub(t.LastUsedAt) >= tokenTouchInterval {
+		if err := s.touch(t.ID, now); err != nil && !errors.Is(err, ErrTokenNotFound) {
+			return nil, err
+		}
+		s.mu.Lock()
+		c.token.LastUsedAt = now
+		s.mu.Unlock()
+		t.LastUsedAt = now
+	}
+
+	return &t, nil
+}
+
+// touch updates the last used time of the token.
+func (s *TokenStore) touch(id string, now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t, err := s.get(tx, id)
+		if err != nil {
+			return err
+		}
+		t.LastUsedAt = now
+		return s.put(tx, t)
+	})
+}
+
+// NewTokenStoreWithDB creates a TokenStore on an opened database. It is mainly used for testing.
+func NewTokenStoreWithDB(db *bolt.DB) (*TokenStore, error) {
+	s := &TokenStore{
+		db:    db,
+		cache: make(map[string]*cachedToken),
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketTokens)
+		if err != nil {
+			return err
+		}
+		s.count.Store(int64(b.Stats().KeyN))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func NewTokenStore(lc fx.Lifecycle) (*TokenStore, error) {
+	db, err := OpenDB(viper.GetString(config.KeyHTTPTokenStorePath), bucketTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return db.Close()
+		},
+	})
+
+	return NewTokenStoreWithDB(db)
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenStore(t *testing.T) {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "tokens.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s, err := NewTokenStoreWithDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a created token", t, func() {
+		record, token, err := s.Create("ci", []string{ScopeWrite}, time.Hour)
+		So(err, ShouldBeNil)
+		So(token, ShouldStartWith, record.ID+".")
+
+		Convey("It should be verified with its scopes", func() {
+			got, err := s.Verify(token)
+			So(err, ShouldBeNil)
+			So(got.Label, ShouldEqual, "ci")
+			So(got.HasScope(ScopeRead), ShouldBeTrue)
+			So(got.LastUsedAt.IsZero(), ShouldBeFalse)
+		})
+
+		Convey("A wrong secret should be invalid", func() {
+			_, err := s.Verify(record.ID + "." + strings.Repeat("0", 64))
+			So(err, ShouldEqual, ErrTokenInvalid)
+		})
+
+		Convey("It should be listed without the hash", func() {
+			tokens, err := s.List()
+			So(err, ShouldBeNil)
+			So(tokens, ShouldNotBeEmpty)
+			for _, t := range tokens {
+				So(t.Salt, ShouldBeEmpty)
+				So(t.Hash, ShouldBeEmpty)
+			}
+		})
+
+		Convey("Only the new token should be valid after rotation", func() {
+			_, err := s.Verify(token)
+			So(err, ShouldBeNil)
+
+			_, newToken, err := s.Rotate(record.ID)
+			So(err, ShouldBeNil)
+
+			_, err = s.Verify(token)
+			So(err, ShouldEqual, ErrTokenInvalid)
+			got, err := s.Verify(newToken)
+			So(err, ShouldBeNil)
+			So(got.ID, ShouldEqual, record.ID)
+		})
+
+		Convey("It should be invalid after revocation, even if cached", func() {
+			_, err := s.Verify(token)
+			So(err, ShouldBeNil)
+			n := s.Len()
+
+			So(s.Revoke(record.ID), ShouldBeNil)
+			So(s.Len(), ShouldEqual, n-1)
+
+			_, err = s.Verify(token)
+			So(err, ShouldEqual, ErrTokenInvalid)
+			So(s.Revoke(record.ID), ShouldEqual, ErrTokenNotFound)
+		})
+	})
+
+	Convey("Given an expired token", t, func() {
+		_, token, err := s.Create("old", []string{ScopeRead}, time.Nanosecond)
+		So(err, ShouldBeNil)
+		time.Sleep(time.Millisecond)
+
+		Convey("It should be rejected", func() {
+			_, err := s.Verify(token)
+			So(err, ShouldEqual, ErrTokenExpired)
+		})
+	})
+
+	Convey("Given an unknown scope", t, func() {
+		_, _, err := s.Create("admin", []string{"admin"}, 0)
+
+		Convey("It should fail", func() {
+			So(err, ShouldEqual, ErrTokenScopeInvalid)
+		})
+	})
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrTrashEntryNotFound = errors.New("trash entry not found")
+
+	bucketTrash = []byte("trash")
+)
+
+// TrashEntry is the record of a deleted file kept in the trash.
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// TrashStore records the files in the trash by their IDs.
+type TrashStore struct {
+	db *bolt.DB
+}
+
+func (s *TrashStore) Put(e *TrashEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).Put([]byte(e.ID), b)
+	})
+}
+
+func (s *TrashStore) Get(id string) (*TrashEntry, error) {
+	var e TrashEntry
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketTrash).Get([]byte(id))
+		if v == nil {
+			return ErrTrashEntryNotFound
+		}
+		return json.Unmarshal(v, &e)
+	}); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// List returns the entries, the latest deleted first.
+func (s *TrashStore) List() ([]*TrashEntry, error) {
+	entries := make([]*TrashEntry, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).ForEach(func(_, v []byte) error {
+			var e TrashEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, &e)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// Delete removes the record of the entry. A missing record is ignored.
+func (s *TrashStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTrash).Delete([]byte(id))
+	})
+}
+
+// NewTrashStoreWithDB creates a TrashStore on an opened database. It is mainly used for testing.
+func NewTrashStoreWithDB(db *bolt.DB) (*TrashStore, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketTrash)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &TrashStore{db: db}, nil
+}
+
+// NewTrashStore creates a TrashStore in the database of the metadata.
+func NewTrashStore(m *MetadataStore) (*TrashStore, error) {
+	return NewTrashStoreWithDB(m.db)
+}
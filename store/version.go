@@ -0,0 +1,263 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+
+	bucketVersions     = []byte("versions")
+	bucketVersionHeads = []byte("version_heads")
+)
+
+// Version is the record of a previous content of a file, numbered from 1 per path.
+type Version struct {
+	Path     string `json:"path"`
+	Number   int64  `json:"version"`
+	Size     int64  `json:"size"`
+	Uploader string `json:"uploader,omitempty"`
+	// Name is the path of the content in the directory of the versions.
+	Name       string    `json:"-"`
+	ModTime    time.Time `json:"modTime"`
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// versionRecord is the stored Version, with the path of its content which is not exposed in the API.
+type versionRecord struct {
+	*Version
+	Name string `json:"name"`
+}
+
+func marshalVersion(v *Version) ([]byte, error) {
+	return json.Marshal(versionRecord{Version: v, Name: v.Name})
+}
+
+func unmarshalVersion(b []byte) (*Version, error) {
+	r := versionRecord{Version: &Version{}}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	r.Version.Name = r.Name
+	return r.Version, nil
+}
+
+// versionHead is the state of the current content of a path.
+type versionHead struct {
+	Uploader string `json:"uploader,omitempty"`
+	Latest   int64  `json:"latest"`
+}
+
+// VersionStore records the versions of the files, and the uploaders of their current contents.
+type VersionStore struct {
+	db *bolt.DB
+}
+
+func versionKey(path string, number int64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(path), 0), uint64(number))
+}
+
+func versionPrefix(path string) []byte {
+	return append([]byte(path), 0)
+}
+
+func getHead(b *bolt.Bucket, path string) (*versionHead, error) {
+	var h versionHead
+	if v := b.Get([]byte(path)); v != nil {
+		if err := json.Unmarshal(v, &h); err != nil {
+			return nil, err
+		}
+	}
+	return &h, nil
+}
+
+func putHead(b *bolt.Bucket, path string, h *versionHead) error {
+	// A head without anything to remember is removed.
+	if h.Uploader == "" && h.Latest == 0 {
+		return b.Delete([]byte(path))
+	}
+	v, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(path), v)
+}
+
+// Add records the version with the next number of its path, and the uploader of the current content.
+func (s *VersionStore) Add(v *Version) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		heads := tx.Bucket(bucketVersionHeads)
+		h, err := getHead(heads, v.Path)
+		if err != nil {
+			return err
+		}
+		h.Latest++
+		v.Number = h.Latest
+		v.Uploader = h.Uploader
+		h.Uploader = ""
+		if err := putHead(heads, v.Path, h); err != nil {
+			return err
+		}
+
+		b, err := marshalVersion(v)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketVersions).Put(versionKey(v.Path, v.Number), b)
+	})
+}
+
+// List returns the versions of the path, the latest first.
+func (s *VersionStore) List(path string) ([]*Version, error) {
+	versions := make([]*Version, 0)
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketVersions).Cursor()
+		prefix := versionPrefix(path)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			ver, err := unmarshalVersion(v)
+			if err != nil {
+				return err
+			}
+			versions = append([]*Version{ver}, versions...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// All calls fn with the versions of every path, the latest first.
+func (s *VersionStore) All(fn func(path string, versions []*Version) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		var path string
+		var versions []*Version
+		if err := tx.Bucket(bucketVersions).ForEach(func(_, v []byte) error {
+			ver, err := unmarshalVersion(v)
+			if err != nil {
+				return err
+			}
+			if ver.Path != path && len(versions) > 0 {
+				if err := fn(path, versions); err != nil {
+					return err
+				}
+				versions = nil
+			}
+			path = ver.Path
+			versions = append([]*Version{ver}, versions...)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(versions) > 0 {
+			return fn(path, versions)
+		}
+		return nil
+	})
+}
+
+func (s *VersionStore) Get(path string, number int64) (*Version, error) {
+	var ver *Version
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketVersions).Get(versionKey(path, number))
+		if v == nil {
+			return ErrVersionNotFound
+		}
+		var err error
+		ver, err = unmarshalVersion(v)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return ver, nil
+}
+
+// Delete removes the record of the version. A missing record is ignored.
+func (s *VersionStore) Delete(path string, number int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketVersions).Delete(versionKey(path, number))
+	})
+}
+
+// SetUploader records the uploader of the current content of the path.
+func (s *VersionStore) SetUploader(path string, uploader string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		heads := tx.Bucket(bucketVersionHeads)
+		h, err := getHead(heads, path)
+		if err != nil {
+			return err
+		}
+		h.Uploader = uploader
+		return putHead(heads, path, h)
+	})
+}
+
+// MoveUploaders moves the uploaders of the current contents at or under the old path to the new path.
+// The versions stay with their paths.
+func (s *VersionStore) MoveUploaders(oldPath string, newPath string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		heads := tx.Bucket(bucketVersionHeads)
+
+		var paths []string
+		c := heads.Cursor()
+		for k, _ := c.Seek([]byte(oldPath)); k != nil && bytes.HasPrefix(k, []byte(oldPath)); k, _ = c.Next() {
+			if p := string(k); p == oldPath || strings.HasPrefix(p, oldPath+"/") {
+				paths = append(paths, p)
+			}
+		}
+
+		moved := make(map[string]string)
+		for _, p := range paths {
+			h, err := getHead(heads, p)
+			if err != nil {
+				return err
+			}
+			if h.Uploader == "" {
+				continue
+			}
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = h.Uploader
+			h.Uploader = ""
+			if err := putHead(heads, p, h); err != nil {
+				return err
+			}
+		}
+		for p, uploader := range moved {
+			h, err := getHead(heads, p)
+			if err != nil {
+				return err
+			}
+			h.Uploader = uploader
+			if err := putHead(heads, p, h); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NewVersionStoreWithDB creates a VersionStore on an opened database. It is mainly used for testing.
+func NewVersionStoreWithDB(db *bolt.DB) (*VersionStore, error) {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketVersions, bucketVersionHeads} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &VersionStore{db: db}, nil
+}
+
+// NewVersionStore creates a VersionStore in the database of the metadata.
+func NewVersionStore(m *MetadataStore) (*VersionStore, error) {
+	return NewVersionStoreWithDB(m.db)
+}
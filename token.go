@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/server"
+	"github.com/wei840222/simple-file-server/store"
+)
+
+// adminRequest sends the request to the admin API and decodes the response into v.
+func adminRequest(cmd *cobra.Command, method string, path string, body any, v any) error {
+	adminURL, _ := cmd.Flags().GetString("admin-url")
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(cmd.Context(), method, strings.TrimRight(adminURL, "/")+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+viper.GetString(config.KeyO11yAdminToken))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var errRes server.ErrorRes
+		if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil || errRes.Error == "" {
+			return fmt.Errorf("admin api responded %s", res.Status)
+		}
+		return fmt.Errorf("admin api responded %s: %s", res.Status, errRes.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage the tokens.",
+	Long:  "Manage the tokens with the admin API on the observability server, which is enabled by --o11y-admin-token.",
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		if err := config.InitViper(); err != nil {
+			return err
+		}
+
+		config.InitCobraPFlag(cmd)
+		config.InitZerolog()
+
+		return nil
+	},
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a token and print it.",
+	Long:  "Create a token and print it. The token cannot be shown again, because only its salted hash is stored.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		label, _ := cmd.Flags().GetString("label")
+		scopes, _ := cmd.Flags().GetStringSlice("scopes")
+		expire, _ := cmd.Flags().GetDuration("expire")
+
+		req := server.CreateTokenReq{
+			Label:  label,
+			Scopes: scopes,
+		}
+		if expire > 0 {
+			req.Expire = expire.String()
+		}
+
+		var res server.TokenRes
+		if err := adminRequest(cmd, http.MethodPost, "/admin/tokens", req, &res); err != nil {
+			return err
+		}
+
+		fmt.Println(res.Value)
+		return nil
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tokens.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		var tokens []*store.Token
+		if err := adminRequest(cmd, http.MethodGet, "/admin/tokens", nil, &tokens); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tLABEL\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Label, strings.Join(t.Scopes, ","), formatTime(t.CreatedAt), formatTime(t.ExpiresAt), formatTime(t.LastUsedAt))
+		}
+		return w.Flush()
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke a token.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(cmd, http.MethodDelete, "/admin/tokens/"+args[0], nil, nil)
+	},
+}
+
+var tokenRotateCmd = &cobra.Command{
+	Use:   "rotate <id>",
+	Short: "Replace the secret of a token and print the new token.",
+	Long:  "Replace the secret of a token and print the new token. The label, the scopes and the expiration are kept, and the previous token stops working immediately.",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var res server.TokenRes
+		if err := adminRequest(cmd, http.MethodPost, "/admin/tokens/"+args[0]+"/rotate", nil, &res); err != nil {
+			return err
+		}
+
+		fmt.Println(res.Value)
+		return nil
+	},
+}
@@ -1,16 +1,33 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
-	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+
+	"github.com/wei840222/simple-file-server/config"
+	"github.com/wei840222/simple-file-server/store"
 )
 
-func generateToken() (string, error) {
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
-		return "", err
+// bootstrapTokens issues a read only and a read write token if authentication is enabled without any token,
+// so the server is usable on the first start. They are persisted in the token store and only logged once.
+func bootstrapTokens(tokens *store.TokenStore) error {
+	if !viper.GetBool(config.KeyHTTPEnableAuth) || len(viper.GetStringSlice(config.KeyHTTPReadOnlyTokens)) > 0 || len(viper.GetStringSlice(config.KeyHTTPReadWriteTokens)) > 0 || tokens.Len() > 0 {
+		return nil
+	}
+
+	logger := log.With().Str("logger", "token").Logger()
+	logger.Info().Msg("authentication is enabled but no tokens provided. generating tokens")
+
+	_, readOnlyToken, err := tokens.Create("bootstrap read only", []string{store.ScopeRead}, 0)
+	if err != nil {
+		return err
+	}
+	_, readWriteToken, err := tokens.Create("bootstrap read write", []string{store.ScopeWrite}, 0)
+	if err != nil {
+		return err
 	}
-	b := sha256.Sum256(randBytes)
-	return fmt.Sprintf("%x", b), nil
+	logger.Info().Msgf("generated read only token: %s", readOnlyToken)
+	logger.Info().Msgf("generated read write token: %s", readWriteToken)
+
+	return nil
 }